@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// BucketHistogram counts values in buckets of fixed upper bounds, like a
+// Prometheus histogram.  Unlike a sample based Histogram its counts are exact
+// and can be summed across instances, so the fraction of values below a
+// bound, such as the requests served within 25ms, follows directly.
+type BucketHistogram interface {
+	Buckets() []float64 // upper bounds, without the implicit +Inf
+	Clear()
+	Count() int64
+	Counts() []int64 // cumulative count of values less than or equal to every bound
+	Snapshot() BucketHistogram
+	Sum() int64
+	Update(int64)
+}
+
+// GetOrRegisterBucketHistogram returns an existing BucketHistogram or
+// constructs and registers a new StandardBucketHistogram with the given
+// upper bounds.
+func GetOrRegisterBucketHistogram(name string, r Registry, buckets []float64) BucketHistogram {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, func() BucketHistogram { return NewBucketHistogram(buckets) }, nil).(BucketHistogram)
+}
+
+// NewBucketHistogram constructs a new StandardBucketHistogram with the given
+// upper bounds, which are in the unit of the values, such as nanoseconds for
+// durations.  Values greater than the last bound are only counted by Count.
+// It panics unless the bounds are increasing.
+func NewBucketHistogram(buckets []float64) BucketHistogram {
+	if UseNilMetrics {
+		return NilBucketHistogram{}
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			panic(fmt.Sprintf("NewBucketHistogram: bucket %v not greater than %v", buckets[i], buckets[i-1]))
+		}
+	}
+	// +Inf is implicit
+	if n := len(buckets); n > 0 && math.IsInf(buckets[n-1], 1) {
+		buckets = buckets[:n-1]
+	}
+	return &StandardBucketHistogram{
+		buckets: append([]float64(nil), buckets...),
+		counts:  make([]int64, len(buckets)+1),
+	}
+}
+
+// NewRegisteredBucketHistogram constructs and registers a new
+// StandardBucketHistogram.
+func NewRegisteredBucketHistogram(name string, r Registry, buckets []float64) BucketHistogram {
+	c := NewBucketHistogram(buckets)
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, c)
+	return c
+}
+
+// LinearBuckets returns count upper bounds starting at start, each width
+// greater than the previous one.
+func LinearBuckets(start, width float64, count int) []float64 {
+	if count < 1 || width <= 0 {
+		panic("LinearBuckets: count and width must be positive")
+	}
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start + float64(i)*width
+	}
+	return buckets
+}
+
+// ExponentialBuckets returns count upper bounds starting at start, each
+// factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	if count < 1 || start <= 0 || factor <= 1 {
+		panic("ExponentialBuckets: count and start must be positive and factor greater than 1")
+	}
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// BucketHistogramSnapshot is a read-only copy of another BucketHistogram.
+type BucketHistogramSnapshot struct {
+	buckets []float64
+	counts  []int64 // cumulative
+	count   int64
+	sum     int64
+}
+
+// Buckets returns the upper bounds of the buckets.
+func (h *BucketHistogramSnapshot) Buckets() []float64 {
+	return append([]float64(nil), h.buckets...)
+}
+
+// Clear panics.
+func (*BucketHistogramSnapshot) Clear() {
+	panic("Clear called on a BucketHistogramSnapshot")
+}
+
+// Count returns the number of values recorded at the time the snapshot was
+// taken.
+func (h *BucketHistogramSnapshot) Count() int64 { return h.count }
+
+// Counts returns the cumulative counts of the buckets at the time the
+// snapshot was taken.
+func (h *BucketHistogramSnapshot) Counts() []int64 {
+	return append([]int64(nil), h.counts...)
+}
+
+// Snapshot returns the snapshot.
+func (h *BucketHistogramSnapshot) Snapshot() BucketHistogram { return h }
+
+// Sum returns the sum of the values recorded at the time the snapshot was
+// taken.
+func (h *BucketHistogramSnapshot) Sum() int64 { return h.sum }
+
+// Update panics.
+func (*BucketHistogramSnapshot) Update(int64) {
+	panic("Update called on a BucketHistogramSnapshot")
+}
+
+// NilBucketHistogram is a no-op BucketHistogram.
+type NilBucketHistogram struct{}
+
+// Buckets is a no-op.
+func (NilBucketHistogram) Buckets() []float64 { return nil }
+
+// Clear is a no-op.
+func (NilBucketHistogram) Clear() {}
+
+// Count is a no-op.
+func (NilBucketHistogram) Count() int64 { return 0 }
+
+// Counts is a no-op.
+func (NilBucketHistogram) Counts() []int64 { return nil }
+
+// Snapshot is a no-op.
+func (NilBucketHistogram) Snapshot() BucketHistogram { return NilBucketHistogram{} }
+
+// Sum is a no-op.
+func (NilBucketHistogram) Sum() int64 { return 0 }
+
+// Update is a no-op.
+func (NilBucketHistogram) Update(int64) {}
+
+// StandardBucketHistogram is the standard implementation of a
+// BucketHistogram and uses the sync/atomic package to manage the count of
+// every bucket.
+type StandardBucketHistogram struct {
+	buckets []float64
+	counts  []int64 // per bucket, the last one above every bound
+	sum     int64
+}
+
+// Buckets returns the upper bounds of the buckets.
+func (h *StandardBucketHistogram) Buckets() []float64 {
+	return append([]float64(nil), h.buckets...)
+}
+
+// Clear sets every count and the sum to zero.
+func (h *StandardBucketHistogram) Clear() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.sum, 0)
+}
+
+// Count returns the number of values recorded.
+func (h *StandardBucketHistogram) Count() int64 {
+	var count int64
+	for i := range h.counts {
+		count += atomic.LoadInt64(&h.counts[i])
+	}
+	return count
+}
+
+// Counts returns the cumulative count of values less than or equal to every
+// upper bound.
+func (h *StandardBucketHistogram) Counts() []int64 {
+	return h.Snapshot().Counts()
+}
+
+// Snapshot returns a read-only copy of the histogram.
+func (h *StandardBucketHistogram) Snapshot() BucketHistogram {
+	s := &BucketHistogramSnapshot{
+		buckets: h.buckets,
+		counts:  make([]int64, len(h.buckets)),
+		sum:     atomic.LoadInt64(&h.sum),
+	}
+	for i := range h.counts {
+		s.count += atomic.LoadInt64(&h.counts[i])
+		if i < len(s.counts) {
+			s.counts[i] = s.count
+		}
+	}
+	return s
+}
+
+// Sum returns the sum of the values recorded.
+func (h *StandardBucketHistogram) Sum() int64 {
+	return atomic.LoadInt64(&h.sum)
+}
+
+// Update counts v in the first bucket whose upper bound is greater than or
+// equal to it.
+func (h *StandardBucketHistogram) Update(v int64) {
+	i := sort.SearchFloat64s(h.buckets, float64(v))
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, v)
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func BenchmarkBucketHistogram(b *testing.B) {
+	h := NewBucketHistogram(ExponentialBuckets(1, 2, 20))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Update(int64(i))
+	}
+}
+
+func BenchmarkBucketHistogramParallel(b *testing.B) {
+	h := NewBucketHistogram(ExponentialBuckets(1, 2, 20))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int64
+		for pb.Next() {
+			h.Update(i)
+			i++
+		}
+	})
+}
+
+func TestLinearBuckets(t *testing.T) {
+	if b := LinearBuckets(5, 5, 4); !reflect.DeepEqual([]float64{5, 10, 15, 20}, b) {
+		t.Errorf("LinearBuckets(5, 5, 4): %v\n", b)
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	if b := ExponentialBuckets(0.5, 2, 4); !reflect.DeepEqual([]float64{0.5, 1, 2, 4}, b) {
+		t.Errorf("ExponentialBuckets(0.5, 2, 4): %v\n", b)
+	}
+}
+
+func TestBucketHistogram(t *testing.T) {
+	h := NewBucketHistogram([]float64{10, 25, 50})
+	for _, v := range []int64{1, 10, 11, 30, 100} {
+		h.Update(v)
+	}
+	if count := h.Count(); 5 != count {
+		t.Errorf("h.Count(): 5 != %v\n", count)
+	}
+	if sum := h.Sum(); 152 != sum {
+		t.Errorf("h.Sum(): 152 != %v\n", sum)
+	}
+	if counts := h.Counts(); !reflect.DeepEqual([]int64{2, 3, 4}, counts) {
+		t.Errorf("h.Counts(): [2 3 4] != %v\n", counts)
+	}
+	snapshot := h.Snapshot()
+	h.Clear()
+	if count, sum := h.Count(), h.Sum(); 0 != count || 0 != sum {
+		t.Errorf("h.Count(), h.Sum(): 0, 0 != %v, %v\n", count, sum)
+	}
+	if count := snapshot.Count(); 5 != count {
+		t.Errorf("snapshot.Count(): 5 != %v\n", count)
+	}
+}
+
+func TestBucketHistogramUnsorted(t *testing.T) {
+	defer func() {
+		if nil == recover() {
+			t.Error("NewBucketHistogram did not panic")
+		}
+	}()
+	NewBucketHistogram([]float64{10, 5})
+}
+
+func TestGetOrRegisterBucketHistogram(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredBucketHistogram("foo", r, []float64{1}).Update(47)
+	if h := GetOrRegisterBucketHistogram("foo", r, nil); 1 != h.Count() {
+		t.Fatal(h)
+	}
+}
+
+func TestBucketHistogramReporters(t *testing.T) {
+	r := NewRegistry()
+	h := NewRegisteredBucketHistogram("latency", r, []float64{0.5, 25})
+	h.Update(10)
+	h.Update(100)
+
+	b := &bytes.Buffer{}
+	WriteJSONOnce(r, b)
+	if s := b.String(); "{\"latency\":{\"count\":2,\"le-0_5\":0,\"le-25\":1,\"sum\":110}}\n" != s {
+		t.Errorf("WriteJSONOnce: %s", s)
+	}
+
+	b.Reset()
+	WriteOnce(r, b)
+	if s := b.String(); !strings.Contains(s, "buckethistogram latency\n") || !strings.Contains(s, "  le-25:               1\n") {
+		t.Errorf("WriteOnce:\n%s", s)
+	}
+
+	b.Reset()
+	if err := WritePrometheusOnce(r, b); nil != err {
+		t.Fatal(err)
+	}
+	if s := b.String(); "# TYPE latency histogram\n"+
+		"latency_bucket{le=\"0.5\"} 0\n"+
+		"latency_bucket{le=\"25\"} 1\n"+
+		"latency_bucket{le=\"+Inf\"} 2\n"+
+		"latency_sum 110\n"+
+		"latency_count 2\n" != s {
+		t.Errorf("WritePrometheusOnce:\n%s", s)
+	}
+}
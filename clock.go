@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time for time-dependent metrics.
+// Injecting a ManualClock makes period alignment, decay and writability
+// testable without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// DefaultClock is the Clock used by metrics constructed without one.  It
+// reads the system time.
+var DefaultClock Clock = systemClock{}
+
+type systemClock struct{}
+
+// Now returns time.Now().
+func (systemClock) Now() time.Time { return time.Now() }
+
+// ManualClock is a Clock which only moves when told to.
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewManualClock constructs a new ManualClock set to t.
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{now: t}
+}
+
+// Add moves the clock forward by d.
+func (c *ManualClock) Add(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Now returns the time the clock is set to.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Set sets the clock to t.
+func (c *ManualClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = t
+}
+
+// clockAdopter is implemented by the samples which read a Clock.
+type clockAdopter interface {
+	// adoptClock makes the sample read c if it reads DefaultClock and has
+	// no values yet.
+	adoptClock(c Clock)
+}
+
+// sampleWithClock makes s read c, the clock of the registry its histogram is
+// registered in, if s was constructed without a clock and is still empty,
+// and returns it.
+func sampleWithClock(s Sample, c Clock) Sample {
+	if a, ok := s.(clockAdopter); ok && DefaultClock != c {
+		a.adoptClock(c)
+	}
+	return s
+}
+
+// newSampleWithClock wraps newSample in sampleWithClock.
+func newSampleWithClock(newSample func() Sample, c Clock) func() Sample {
+	return func() Sample { return sampleWithClock(newSample(), c) }
+}
+
+// registryClock returns the Clock of r if it has one, or DefaultClock.
+func registryClock(r Registry) Clock {
+	if c, ok := r.(interface {
+		Clock() Clock
+	}); ok {
+		return c.Clock()
+	}
+	return DefaultClock
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewManualClock(start)
+	if now := c.Now(); !start.Equal(now) {
+		t.Fatal(now)
+	}
+	c.Add(time.Minute)
+	if now := c.Now(); !start.Add(time.Minute).Equal(now) {
+		t.Fatal(now)
+	}
+	c.Set(start)
+	if now := c.Now(); !start.Equal(now) {
+		t.Fatal(now)
+	}
+}
+
+func TestRegistryClock(t *testing.T) {
+	c := NewManualClock(time.Unix(1000, 0))
+	r := NewRegistryWithClock(c)
+	if registryClock(r) != Clock(c) {
+		t.Fatal("registry clock not used")
+	}
+	if registryClock(NewPrefixedChildRegistry(r, "prefix.")) != Clock(c) {
+		t.Fatal("prefixed registry does not use the clock of its parent")
+	}
+	if registryClock(NewRegistry()) != DefaultClock {
+		t.Fatal("new registry does not use DefaultClock")
+	}
+}
+
+func TestRegistryClockTimer(t *testing.T) {
+	c := NewManualClock(time.Unix(1000, 0))
+	r := NewRegistryWithClock(c)
+	for _, tm := range []Timer{
+		GetOrRegisterTimer("foo", r),
+		NewRegisteredTimer("bar", r),
+		GetOrRegisterTimerVec("baz", r, "method").WithLabelValues("GET"),
+	} {
+		tm.Time(func() { c.Add(time.Second) })
+		tm.UpdateSince(c.Now().Add(-3 * time.Second))
+		if min, max := tm.Min(), tm.Max(); int64(time.Second) != min || int64(3*time.Second) != max {
+			t.Fatal(min, max)
+		}
+		c.Add(9 * time.Second)
+		if rateMean := tm.RateMean(); 0.2 != rateMean {
+			t.Fatal(rateMean)
+		}
+		// two events in the first tick, decayed by the second
+		if rate1, expected := tm.Rate1(), 0.4*math.Exp(-5.0/60); math.Abs(rate1-expected) > 1e-9 {
+			t.Fatal(rate1)
+		}
+		c.Set(time.Unix(1000, 0))
+	}
+}
+
+func TestRegistryClockHistogram(t *testing.T) {
+	c := NewManualClock(time.Unix(1000, 0))
+	r := NewRegistryWithClock(c)
+	h := GetOrRegisterHistogram("foo", r, NewSlidingTimeWindowSample(time.Minute, 60))
+	h.Update(1)
+	c.Add(2 * time.Minute)
+	if n := h.Count(); 0 != n {
+		t.Fatal("the sample does not read the registry clock", n)
+	}
+
+	s := NewExpDecaySample(1028, 0.015).(*ExpDecaySample)
+	NewRegisteredHistogram("bar", r, s)
+	if Clock(c) != s.clock {
+		t.Fatal("the sample does not read the registry clock")
+	}
+
+	// a sample with values or a clock of its own keeps its clock
+	other := NewManualClock(time.Unix(0, 0))
+	s = NewExpDecaySampleWithClock(1028, 0.015, other).(*ExpDecaySample)
+	GetOrRegisterHistogram("baz", r, s)
+	if Clock(other) != s.clock {
+		t.Fatal("the clock of the sample was replaced")
+	}
+	s = NewExpDecaySample(1028, 0.015).(*ExpDecaySample)
+	s.Update(1)
+	GetOrRegisterHistogram("qux", r, s)
+	if DefaultClock != s.clock {
+		t.Fatal("the clock of a sample with values was replaced")
+	}
+}
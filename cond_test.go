@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCondIntWritable(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	g := GetOrRegisterCondInt("foo", NewRegistryWithClock(clock), time.Minute)
+	g.Update(47)
+	if g.Writable() {
+		t.Fatal("writable before the period elapsed")
+	}
+	if s := g.Snapshot(); s.Writable() || 47 != s.Value() {
+		t.Fatal(s)
+	}
+
+	clock.Add(time.Minute)
+	if !g.Writable() {
+		t.Fatal("not writable after the period elapsed")
+	}
+	if s := g.Snapshot(); !s.Writable() || 47 != s.Value() {
+		t.Fatal(s)
+	}
+	if g.Writable() {
+		t.Fatal("writable right after a snapshot")
+	}
+}
+
+func TestCondFloatWritable(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	g := NewCondFloatWithClock(time.Minute, clock)
+	g.Update(4.7)
+	clock.Add(30 * time.Second)
+	if s := g.Snapshot(); s.Writable() {
+		t.Fatal(s)
+	}
+	clock.Add(30 * time.Second)
+	if s := g.Snapshot(); !s.Writable() || 4.7 != s.Value() {
+		t.Fatal(s)
+	}
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// GetOrRegisterStripedCounter returns an existing Counter or constructs and
+// registers a new StripedCounter.
+func GetOrRegisterStripedCounter(name string, r Registry) Counter {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, NewStripedCounter, nil).(Counter)
+}
+
+// NewStripedCounter constructs a new StripedCounter with one cell per
+// processor, as given by GOMAXPROCS, rounded up to a power of two.
+func NewStripedCounter() Counter {
+	if UseNilMetrics {
+		return NilCounter{}
+	}
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return &StripedCounter{cells: make([]stripedCell, n)}
+}
+
+// NewRegisteredStripedCounter constructs and registers a new StripedCounter.
+func NewRegisteredStripedCounter(name string, r Registry) Counter {
+	c := NewStripedCounter()
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, c)
+	return c
+}
+
+// StripedCounter is a Counter for hot paths which spreads its count over
+// cells of their own cache line, so that goroutines incrementing it on
+// different processors do not contend on a single int64 like they do on a
+// StandardCounter.  Count sums the cells, which makes reading slower, and
+// the counter takes a cache line per processor.
+type StripedCounter struct {
+	cells []stripedCell
+}
+
+type stripedCell struct {
+	count int64
+	_     [56]byte // pads the cell to a cache line
+}
+
+// stripes hands out cell indexes.  A sync.Pool keeps an object per
+// processor, so goroutines running on the same processor mostly get the same
+// index and those on different processors different ones.
+var (
+	stripes    = sync.Pool{New: func() interface{} { i := atomic.AddUint32(&nextStripe, 1); return &i }}
+	nextStripe uint32
+)
+
+// Clear sets the counter to zero.  Increments made while clearing may
+// survive it.
+func (c *StripedCounter) Clear() {
+	for i := range c.cells {
+		atomic.StoreInt64(&c.cells[i].count, 0)
+	}
+}
+
+// Count returns the current count.
+func (c *StripedCounter) Count() int64 {
+	var count int64
+	for i := range c.cells {
+		count += atomic.LoadInt64(&c.cells[i].count)
+	}
+	return count
+}
+
+// Dec decrements the counter by the given amount.
+func (c *StripedCounter) Dec(i int64) {
+	c.Inc(-i)
+}
+
+// Inc increments the counter by the given amount.
+func (c *StripedCounter) Inc(i int64) {
+	stripe := stripes.Get().(*uint32)
+	atomic.AddInt64(&c.cells[*stripe&uint32(len(c.cells)-1)].count, i)
+	stripes.Put(stripe)
+}
+
+// Snapshot returns a read-only copy of the counter.
+func (c *StripedCounter) Snapshot() Counter {
+	return CounterSnapshot(c.Count())
+}
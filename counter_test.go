@@ -1,6 +1,9 @@
 package metrics
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 func BenchmarkCounter(b *testing.B) {
 	c := NewCounter()
@@ -10,6 +13,32 @@ func BenchmarkCounter(b *testing.B) {
 	}
 }
 
+// Compare with BenchmarkStripedCounterParallel under -cpu 1,4,16,64.
+func BenchmarkCounterParallel(b *testing.B) {
+	benchmarkCounterParallel(b, NewCounter())
+}
+
+func BenchmarkStripedCounter(b *testing.B) {
+	c := NewStripedCounter()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Inc(1)
+	}
+}
+
+func BenchmarkStripedCounterParallel(b *testing.B) {
+	benchmarkCounterParallel(b, NewStripedCounter())
+}
+
+func benchmarkCounterParallel(b *testing.B, c Counter) {
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Inc(1)
+		}
+	})
+}
+
 func TestCounterClear(t *testing.T) {
 	c := NewCounter()
 	c.Inc(1)
@@ -75,3 +104,41 @@ func TestGetOrRegisterCounter(t *testing.T) {
 		t.Fatal(c)
 	}
 }
+
+func TestStripedCounter(t *testing.T) {
+	c := NewStripedCounter()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Inc(2)
+				c.Dec(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if count := c.Count(); 16000 != count {
+		t.Errorf("c.Count(): 16000 != %v\n", count)
+	}
+	snapshot := c.Snapshot()
+	c.Clear()
+	if count := c.Count(); 0 != count {
+		t.Errorf("c.Count(): 0 != %v\n", count)
+	}
+	if count := snapshot.Count(); 16000 != count {
+		t.Errorf("snapshot.Count(): 16000 != %v\n", count)
+	}
+}
+
+func TestGetOrRegisterStripedCounter(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredStripedCounter("foo", r).Inc(47)
+	if c := GetOrRegisterStripedCounter("foo", r); 47 != c.Count() {
+		t.Fatal(c)
+	}
+	if _, ok := r.Get("foo").(*StripedCounter); !ok {
+		t.Fatal(r.Get("foo"))
+	}
+}
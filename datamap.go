@@ -1,508 +1,944 @@
-package metrics
-
-import (
-	"fmt"
-	"reflect"
-	"sync"
-	"time"
-
-	"github.com/guotie/days"
-)
-
-// DataMap hold an int64 value that can be set arbitrarily.
-// DataMap保存一组数据, 和这组数据的历史数据, 并设置可以计算数据关系的函数来计算因变量的值
-type DataMap interface {
-	Snapshot(r Registry) []interface{}
-
-	UpdateInt64(string, int64)     // 设置自变量的值 int64
-	UpdateFloat64(string, float64) // 设置自变量的值 float64
-
-	// Value函数无锁
-	Value(string) interface{}    // 自变量的值
-	ValueInt64(string) int64     // 自变量的值int64
-	ValueFloat64(string) float64 // 自变量的值float64
-	ValueHistory(string, string) (interface{}, bool)
-
-	// DependentValue(string) interface{}    // 因变量的值
-	// DependentValueInt64(string) int64     // 因变量的值int64
-	// DependentValueFloat64(string) float64 // 因变量的值float64
-
-	Periods() []string       // 保存那些历史数据
-	Keys() []string          // 自变量列表
-	DependentKeys() []string // 因变量列表
-
-	SetPeriods(map[string]time.Duration)                              // 历史数据
-	SetKeyType(string, reflect.Type, bool)                            // 设置 key type, 自变量
-	SetDependentVar(string, interface{}, reflect.Type, time.Duration) // 因变量
-}
-
-// DataMapOption datamap options
-// option of DataMap
-type DataMapOption struct {
-	Prefix        string
-	Interval      time.Duration
-	Periods       map[string]time.Duration
-	KeyTypes      map[string]reflect.Type
-	KeyPeriod     time.Duration // 自变量入库间隔
-	DependentVars map[string]*DependentVar
-}
-
-// DependentVar depend var
-type DependentVar struct {
-	Name     string
-	Func     interface{} // 计算规则
-	Typ      reflect.Type
-	Period   time.Duration
-	lastSnap time.Time // 上次snapshot时间
-}
-
-// 各种meter type
-var (
-	counterType      = reflect.TypeOf(&StandardCounter{0})
-	gaugeType        = reflect.TypeOf(&StandardGauge{})
-	gaugeFloat64Type = reflect.TypeOf(&StandardGaugeFloat64{})
-	histogramType    = reflect.TypeOf(&StandardHistogram{})
-	meterType        = reflect.TypeOf(&StandardMeter{})
-	timerType        = reflect.TypeOf(&StandardTimer{})
-
-	condIntType   = reflect.TypeOf(&StandardCondInt{})
-	condFloatType = reflect.TypeOf(&StandardCondFloat{})
-)
-
-// GetOrRegisterDataMap returns an existing datamap or constructs and registers a
-// new StandardDataMap.
-func GetOrRegisterDataMap(name string, r Registry, opt *DataMapOption) DataMap {
-	if nil == r {
-		r = DefaultRegistry
-	}
-
-	return r.GetOrRegister(name, NewDataMap, opt).(DataMap)
-}
-
-// NewDataMap constructs a new StandardDataMap.
-func NewDataMap(prefix string, opt *DataMapOption) DataMap {
-	gm := &StandardDataMap{
-		minInterval:    60,
-		latestSnapshot: time.Now().Unix(),
-		prefix:         prefix,
-		values:         make(map[string]interface{}),
-		valuesHistory:  make(map[string]map[string]interface{}),
-		//dependentFuncs: make(map[string]interface{}),
-		keyTypes: make(map[string]reflect.Type),
-		//dependentTypes: make(map[string]reflect.Type),
-		dependentVars: make(map[string]*DependentVar),
-		periods:       make(map[string]time.Duration),
-		nextTs:        make(map[string]int64),
-	}
-
-	if opt == nil {
-		panic("NewDataMap: param opt should NOT be nil")
-	}
-
-	if opt.Interval != 0 {
-		// 设置 minInterval
-		gm.minInterval = int64(opt.Interval / time.Second)
-	}
-
-	if opt.KeyPeriod != 0 {
-		gm.keyPeriod = opt.KeyPeriod
-	} else {
-		gm.keyPeriod = opt.Interval
-	}
-
-	// 设置自变量下次记录的时间戳
-	gm.SetPeriods(opt.Periods)
-
-	// key types
-	for k, t := range opt.KeyTypes {
-		gm.SetKeyType(k, t, false)
-	}
-	// dependent key types
-	for k, v := range opt.DependentVars {
-		gm.SetDependentVar(k, v.Func, v.Typ, v.Period)
-	}
-
-	// dependent key types
-	//for k, t := range opt.DepenentTypes {
-	//	gm.SetKeyType(k, t, true)
-	//}
-
-	return gm
-}
-
-// NewRegisteredDataMap constructs and registers a new StandardDataMap.
-func NewRegisteredDataMap(name string, r Registry, opt *DataMapOption) DataMap {
-	c := NewDataMap(name, opt)
-	if nil == r {
-		r = DefaultRegistry
-	}
-	r.Register(name, c)
-	return c
-}
-
-// FloatValueFunc func which return float64
-type FloatValueFunc func(DataMap) float64
-
-// IntValueFunc func return int64
-type IntValueFunc func(DataMap) int64
-
-// StandardDataMap is the standard implementation of a Gauge and uses the
-// sync/atomic package to manage a single int64 value.
-type StandardDataMap struct {
-	sync.RWMutex
-
-	minInterval    int64 // 最小间隔
-	latestSnapshot int64
-
-	prefix string // 加在产生的meter前作为前缀
-
-	values        map[string]interface{}            // 当前值
-	valuesHistory map[string]map[string]interface{} // 历史值
-	//dependentFuncs map[string]interface{}
-
-	keyTypes  map[string]reflect.Type
-	keyPeriod time.Duration
-	//dependentTypes map[string]reflect.Type
-
-	dependentVars map[string]*DependentVar // 因变量
-
-	periods map[string]time.Duration
-	nextTs  map[string]int64 // period下次入库的timestamp(second)
-}
-
-// Prefix prefix of datamap
-func (g *StandardDataMap) Prefix() string {
-	return g.prefix
-}
-
-// snapshotable return whether snapshot
-func (g *StandardDataMap) snapshotable() bool {
-	tm := time.Now().Unix()
-	if tm-g.latestSnapshot >= g.minInterval {
-		g.latestSnapshot = tm
-		return true
-	}
-
-	return false
-}
-
-// Snapshot returns a read-only copy of the gauge.
-// 根据key的类型，输入相应的 meter
-// 同时, snapshot 需要判断是否需要计算历史数据
-func (g *StandardDataMap) Snapshot(r Registry) []interface{} {
-	g.Lock()
-	defer g.Unlock()
-
-	if g.snapshotable() == false {
-		return nil
-	}
-
-	//fmt.Printf("Snap shot data map keyTypes: %d dependentKeyTypes: %d ....\n",
-	//	len(g.keyTypes), len(g.dependentTypes))
-	var meters []interface{}
-	for k, t := range g.keyTypes {
-		// 自变量
-		val, ok := g.values[k]
-		if !ok {
-			continue
-		}
-
-		// keyType period is 1 分钟
-		meters = append(meters, g.generateMeter(k, val, false, r, t, g.keyPeriod))
-	}
-
-	now := time.Now()
-
-	for k, t := range g.dependentVars {
-		if now.Sub(t.lastSnap) >= t.Period {
-			//fmt.Printf("%v: snapshot dependent meter %s, type: %v lastSnap: %v\n", now, k, t.Typ, t.lastSnap)
-			t.lastSnap = now
-			fn := t.Func
-			// 因变量
-			meters = append(meters, g.generateMeter(k, fn, true, r, t.Typ, t.Period))
-		}
-	}
-
-	// 更新历史数据
-	g.updateHistory()
-	return meters
-}
-
-// 生成响应的 meter
-func (g *StandardDataMap) generateMeter(key string, val interface{},
-	dependent bool, r Registry, typ reflect.Type, arg interface{}) interface{} {
-	if dependent {
-		// 计算val的值
-		switch val.(type) {
-		case IntValueFunc:
-			fn := val.(IntValueFunc)
-			val = fn(g)
-
-		case func(DataMap) int64:
-			fn := val.(func(DataMap) int64)
-			val = fn(g)
-
-		case FloatValueFunc:
-			fn := val.(FloatValueFunc)
-			val = fn(g)
-
-		case func(DataMap) float64:
-			fn := val.(func(DataMap) float64)
-			val = fn(g)
-
-		default:
-			panic(fmt.Sprintf("invalid func type: key=%s func typ: %v",
-				key, reflect.TypeOf(val)))
-		}
-	}
-
-	switch typ {
-	case condIntType:
-		period, ok := arg.(time.Duration)
-		if !ok {
-			return nil
-		}
-		m := GetOrRegisterCondInt(g.prefix+"-"+key, r, period)
-		m.Update(val.(int64))
-		return m
-
-	case condFloatType:
-		period, ok := arg.(time.Duration)
-		if !ok {
-			return nil
-		}
-		m := GetOrRegisterCondFloat(g.prefix+"-"+key, r, period)
-		m.Update(val.(float64))
-		return m
-
-	default:
-		fmt.Printf("invalid meter type: %s-%s %v\n", g.prefix, key, typ)
-	}
-
-	return nil
-}
-
-// updateHistory 更新历史数据
-// caller lock
-func (g *StandardDataMap) updateHistory() {
-	ts := time.Now().Unix()
-
-	for p, nts := range g.nextTs {
-		if ts >= nts {
-			du, ok := g.periods[p]
-			if !ok {
-				panic("Not found period " + p)
-			}
-
-			//fmt.Printf("update period %s\n", p)
-			// update history values
-			his, ok := g.valuesHistory[p]
-			if !ok {
-				g.valuesHistory[p] = make(map[string]interface{})
-				his = g.valuesHistory[p]
-			}
-
-			for k, v := range g.values {
-				his[k] = v
-			}
-
-			g.nextTs[p] += int64(du / time.Second)
-		}
-	}
-}
-
-// Periods return periods
-func (g *StandardDataMap) Periods() []string {
-	g.Lock()
-	defer g.Unlock()
-
-	ps := make([]string, len(g.periods))
-	i := 0
-	for k := range g.periods {
-		ps[i] = k
-	}
-	return ps
-}
-
-// SetPeriods set periods
-func (g *StandardDataMap) SetPeriods(p map[string]time.Duration) {
-	g.Lock()
-	defer g.Unlock()
-
-	ts := time.Now()
-	for s, t := range p {
-		g.setPeriod(s, t, ts)
-	}
-}
-
-// setPeriod set period, lock before called
-// 按照时间规则, 尽可能取整, 例如分钟从00秒开始, 5分钟从00分钟开始
-func (g *StandardDataMap) setPeriod(p string, du time.Duration, tm time.Time) {
-	if du == 0 {
-		panic("setPeriod: invalid duration: 0")
-	}
-	// period是否已经存在
-	if _, ok := g.periods[p]; ok {
-		return
-	}
-
-	nts := tm.Unix()
-	g.periods[p] = du
-	mod := int64(60)
-	// 设置下次汇报的时间戳
-	// 如果是5分钟，15分钟，30分钟，60分钟，1天，设置为整点对齐
-	switch du {
-	case M5:
-		mod = 300
-	case M15:
-		mod = 15 * 60
-	case M30:
-		mod = 30 * 60
-
-	case H1:
-		mod = 3600
-	case D1:
-		mod = 86400
-	default:
-		// 小于1分钟
-		if du < M1 {
-			mod = 1
-		}
-	}
-
-	// 间隔时间为天时, 需修正时区
-	if du == D1 {
-		nts = days.Tomorrow(tm).Unix()
-	} else {
-		nts = nts - nts%mod + mod
-	}
-	g.nextTs[p] = nts
-}
-
-// SetKeyType 设置 key type
-func (g *StandardDataMap) SetKeyType(key string, ty reflect.Type, isDependent bool) {
-	g.Lock()
-	defer g.Unlock()
-
-	if isDependent == false {
-		// 因变量
-		// dependent variables
-		g.keyTypes[key] = ty
-	} else {
-		// 自变量
-		// independent variables
-		//g.dependentTypes[key] = ty
-	}
-}
-
-// UpdateInt64 updates the gauge's value.
-func (g *StandardDataMap) UpdateInt64(key string, v int64) {
-	g.Lock()
-	defer g.Unlock()
-
-	g.values[key] = v
-	//fmt.Println(key, "prev=", g.valuePrev[key], g.value[key])
-}
-
-// UpdateFloat64 updates the gauge's value.
-func (g *StandardDataMap) UpdateFloat64(key string, v float64) {
-	g.Lock()
-	defer g.Unlock()
-
-	g.values[key] = v
-}
-
-// Value returns the gauge's current value.
-// caller should lock
-func (g *StandardDataMap) Value(key string) interface{} {
-	return g.values[key]
-}
-
-// ValueInt64 get int64 value
-// caller should lock
-func (g *StandardDataMap) ValueInt64(key string) int64 {
-	v, ok := g.values[key]
-	if !ok {
-		return 0
-	}
-	return v.(int64)
-}
-
-// ValueFloat64 return the gauge's float64 value of key.
-// caller should lock
-func (g *StandardDataMap) ValueFloat64(key string) float64 {
-	vf, ok := g.values[key]
-	if !ok {
-		return 0.0
-	}
-	return vf.(float64)
-}
-
-// ValueHistory 历史值
-// caller should lock
-func (g *StandardDataMap) ValueHistory(key, period string) (interface{}, bool) {
-	if his, ok := g.valuesHistory[period]; ok {
-		return his[key], true
-	}
-
-	return nil, false
-}
-
-// Keys return keys
-func (g *StandardDataMap) Keys() []string {
-	g.Lock()
-	g.Unlock()
-
-	keys := make([]string, len(g.values))
-	i := 0
-	for k := range g.values {
-		keys[i] = k
-	}
-	return keys
-}
-
-// DependentKeys return keys
-func (g *StandardDataMap) DependentKeys() []string {
-	g.RLock()
-	defer g.RUnlock()
-
-	keys := make([]string, len(g.dependentVars))
-	i := 0
-	for k := range g.dependentVars {
-		keys[i] = k
-	}
-	return keys
-}
-
-// SetDependentVar set IntValueFunc
-func (g *StandardDataMap) SetDependentVar(key string, fn interface{}, typ reflect.Type, period time.Duration) {
-	var dv DependentVar
-
-	g.Lock()
-	defer g.Unlock()
-
-	switch fn.(type) {
-	case IntValueFunc:
-		dv.Func = fn
-
-	case func(DataMap) int64:
-		dv.Func = IntValueFunc(fn.(func(DataMap) int64))
-
-	case FloatValueFunc:
-		dv.Func = fn
-
-	case func(DataMap) float64:
-		dv.Func = FloatValueFunc(fn.(func(DataMap) float64))
-
-	default:
-		panic(fmt.Sprintf("invalid type of param fn, should be IntValueFunc or FloatValueFunc: %v",
-			reflect.TypeOf(fn)))
-	}
-	dv.Name = key
-	dv.Typ = typ
-	dv.Period = period
-	dv.lastSnap = time.Now()
-	g.dependentVars[key] = &dv
-
-	return
-}
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/guotie/days"
+)
+
+// DataMap hold an int64 value that can be set arbitrarily.
+// DataMap保存一组数据, 和这组数据的历史数据, 并设置可以计算数据关系的函数来计算因变量的值
+type DataMap interface {
+	Snapshot(r Registry) []interface{}
+
+	UpdateInt64(string, int64)     // 设置自变量的值 int64
+	UpdateFloat64(string, float64) // 设置自变量的值 float64
+
+	// Value函数无锁, 只能在因变量的函数中调用, 其他情况使用 View
+	Value(string) interface{}    // 自变量的值
+	ValueInt64(string) int64     // 自变量的值int64
+	ValueFloat64(string) float64 // 自变量的值float64
+	ValueHistory(string, string) (interface{}, bool)
+	View(func(DataMapView))         // 加读锁调用 f, f 可以读取所有值
+	Values() map[string]interface{} // 所有自变量当前值的拷贝, 有锁
+	State() DataMapState            // 当前值和历史值的拷贝, 有锁
+	Restore(DataMapState)           // 恢复当前值和历史值
+
+	// 历史值函数无锁, 每个 period 保存 DataMapOption.HistoryDepth 个历史值
+	HistoryN(string, string, int) (interface{}, bool) // n 个 period 边界之前的历史值, n 为 1 时等于 ValueHistory
+	Delta(string, string) float64                     // 当前值与上一个 period 边界的历史值之差, 没有历史值时为 0
+	Rate(string, string) float64                      // Delta 除以距上一个 period 边界的秒数
+	Avg(string, string, int) float64                  // 最近 n 个历史值的平均值, 没有历史值时为 0
+
+	// DependentValue(string) interface{}    // 因变量的值
+	// DependentValueInt64(string) int64     // 因变量的值int64
+	// DependentValueFloat64(string) float64 // 因变量的值float64
+
+	Periods() []string       // 保存那些历史数据
+	Keys() []string          // 自变量列表
+	DependentKeys() []string // 因变量列表
+
+	SetPeriods(map[string]time.Duration)                              // 历史数据
+	SetKeyType(string, reflect.Type, bool)                            // 设置 key type, 自变量
+	SetDependentVar(string, interface{}, reflect.Type, time.Duration) // 因变量
+}
+
+// DataMapView reads the values of a DataMap: a DataMap itself in the
+// functions of its dependent variables, which are called with its lock held,
+// and the view passed by DataMap.View to other readers.  Values are converted
+// to the requested type, and missing keys read as 0.
+type DataMapView interface {
+	Value(string) interface{}
+	ValueInt64(string) int64
+	ValueFloat64(string) float64
+	ValueHistory(string, string) (interface{}, bool)
+	HistoryN(string, string, int) (interface{}, bool)
+	Delta(string, string) float64
+	Rate(string, string) float64
+	Avg(string, string, int) float64
+}
+
+// dataMapState is implemented by StandardDataMap and TypedDataMap, which
+// registries, reporters and snapshots handle alike through their state.
+type dataMapState interface {
+	State() DataMapState
+	Restore(DataMapState)
+}
+
+// DataMapState is the restorable state of a DataMap: the current values of
+// its keys and their values at the last boundary of every period.  Values are
+// int64 or float64.
+type DataMapState struct {
+	Values  map[string]interface{}
+	History map[string]map[string]interface{}   // period -> key -> value
+	Rings   map[string][]map[string]interface{} // period -> oldest first, the last equal to History[period]
+}
+
+// DataMapOption datamap options
+// option of DataMap
+type DataMapOption struct {
+	Prefix        string
+	Interval      time.Duration
+	Periods       map[string]time.Duration
+	KeyTypes      map[string]reflect.Type
+	KeyPeriod     time.Duration // 自变量入库间隔
+	HistoryDepth  int           // 每个 period 保存的历史值个数, 默认 1
+	DependentVars map[string]*DependentVar
+	Clock         Clock       // 时钟, nil 时使用 registry 的时钟或 DefaultClock
+	OnError       func(error) // snapshot 时生成 meter 出错时调用, 可以为 nil
+}
+
+// DependentVar depend var
+type DependentVar struct {
+	Name     string
+	Func     interface{} // 计算规则: IntValueFunc, FloatValueFunc, 表达式字符串或 *Expr
+	Typ      reflect.Type
+	Period   time.Duration
+	lastSnap time.Time // 上次snapshot时间
+}
+
+// 各种meter type
+var (
+	counterType      = reflect.TypeOf(&StandardCounter{0})
+	gaugeType        = reflect.TypeOf(&StandardGauge{})
+	gaugeFloat64Type = reflect.TypeOf(&StandardGaugeFloat64{})
+	histogramType    = reflect.TypeOf(&StandardHistogram{})
+	meterType        = reflect.TypeOf(&StandardMeter{})
+	timerType        = reflect.TypeOf(&StandardTimer{})
+
+	condIntType   = reflect.TypeOf(&StandardCondInt{})
+	condFloatType = reflect.TypeOf(&StandardCondFloat{})
+
+	periodCounterType = reflect.TypeOf(&StandardPeriodCounter{})
+)
+
+// DataMapKind is the type of the meter driven by a key of a DataMap: the
+// kinds of a TypedDataMap stand for the reflect.Types of a StandardDataMap.
+type DataMapKind int
+
+// 各种 meter kind
+const (
+	DataMapCondInt DataMapKind = iota + 1
+	DataMapCondFloat
+	DataMapCounter
+	DataMapGauge
+	DataMapGaugeFloat64
+	DataMapHistogram
+	DataMapMeter
+	DataMapTimer
+	DataMapPeriodCounter
+)
+
+// dataMapKinds 可以由 DataMap 生成的 meter type
+var dataMapKinds = map[reflect.Type]DataMapKind{
+	condIntType:       DataMapCondInt,
+	condFloatType:     DataMapCondFloat,
+	counterType:       DataMapCounter,
+	gaugeType:         DataMapGauge,
+	gaugeFloat64Type:  DataMapGaugeFloat64,
+	histogramType:     DataMapHistogram,
+	meterType:         DataMapMeter,
+	timerType:         DataMapTimer,
+	periodCounterType: DataMapPeriodCounter,
+}
+
+// UnsupportedMeterType is the error of a key or a dependent variable of a
+// DataMap whose meter type is not one of the types above, or whose kind is
+// not one of the DataMapKinds for a TypedDataMap.
+type UnsupportedMeterType struct {
+	Key  string
+	Type reflect.Type
+	Kind DataMapKind
+}
+
+func (err UnsupportedMeterType) Error() string {
+	if nil == err.Type {
+		return fmt.Sprintf("unsupported meter kind of DataMap key %s: %d", err.Key, err.Kind)
+	}
+	return fmt.Sprintf("unsupported meter type of DataMap key %s: %v", err.Key, err.Type)
+}
+
+// supportedMeterType 是否可以由 DataMap 生成
+func supportedMeterType(typ reflect.Type) bool {
+	_, ok := dataMapKinds[typ]
+	return ok
+}
+
+// Validate checks the meter types of the keys and the dependent variables of
+// the option, compiling their expressions, and returns the first invalid one
+// as an error.
+func (opt *DataMapOption) Validate() error {
+	depth := opt.HistoryDepth
+	if depth < 1 {
+		depth = 1
+	}
+	for k, t := range opt.KeyTypes {
+		if !supportedMeterType(t) {
+			return UnsupportedMeterType{Key: k, Type: t}
+		}
+	}
+	for k, v := range opt.DependentVars {
+		if nil == v {
+			return fmt.Errorf("dependent var %s: nil", k)
+		}
+		if !supportedMeterType(v.Typ) {
+			return UnsupportedMeterType{Key: k, Type: v.Typ}
+		}
+		if _, err := dependentFunc(v.Func, opt.Periods, depth); nil != err {
+			return fmt.Errorf("dependent var %s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// dependentFunc returns the function of a dependent variable, compiling
+// expressions and checking that the periods of their history are in periods
+// and that they read at most depth history values of a period.
+func dependentFunc(fn interface{}, periods map[string]time.Duration, depth int) (interface{}, error) {
+	switch fn := fn.(type) {
+	case IntValueFunc, FloatValueFunc:
+		return fn, nil
+	case func(DataMap) int64:
+		return IntValueFunc(fn), nil
+	case func(DataMap) float64:
+		return FloatValueFunc(fn), nil
+	case string:
+		e, err := ParseExpr(fn)
+		if nil != err {
+			return nil, err
+		}
+		return dependentFunc(e, periods, depth)
+	case *Expr:
+		for _, p := range fn.Periods() {
+			if _, ok := periods[p]; !ok {
+				return nil, fmt.Errorf("expression %q: unknown period %q", fn, p)
+			}
+		}
+		if fn.HistoryDepth() > depth {
+			return nil, fmt.Errorf("expression %q: reads %d history values of a period, more than the HistoryDepth of %d",
+				fn, fn.HistoryDepth(), depth)
+		}
+		return fn, nil
+	}
+	return nil, fmt.Errorf("invalid type of func, should be IntValueFunc, FloatValueFunc or an expression: %v",
+		reflect.TypeOf(fn))
+}
+
+// GetOrRegisterDataMap returns an existing datamap or constructs and registers a
+// new StandardDataMap.
+func GetOrRegisterDataMap(name string, r Registry, opt *DataMapOption) DataMap {
+	if nil == r {
+		r = DefaultRegistry
+	}
+
+	c := registryClock(r)
+	return r.GetOrRegister(name, func(prefix string, opt *DataMapOption) DataMap {
+		return newDataMap(prefix, opt, c)
+	}, opt).(DataMap)
+}
+
+// NewDataMap constructs a new StandardDataMap.
+func NewDataMap(prefix string, opt *DataMapOption) DataMap {
+	return newDataMap(prefix, opt, DefaultClock)
+}
+
+// newDataMap constructs a new StandardDataMap using opt.Clock, or c when the
+// option does not set one.
+func newDataMap(prefix string, opt *DataMapOption, c Clock) DataMap {
+	if opt == nil {
+		panic("NewDataMap: param opt should NOT be nil")
+	}
+	if err := opt.Validate(); err != nil {
+		panic("NewDataMap: " + err.Error())
+	}
+	if opt.Clock != nil {
+		c = opt.Clock
+	}
+
+	gm := &StandardDataMap{
+		clock:          c,
+		minInterval:    60,
+		latestSnapshot: c.Now().Unix(),
+		prefix:         prefix,
+		values:         make(map[string]interface{}),
+		valuesHistory:  make(map[string]map[string]interface{}),
+		historyRings:   make(map[string][]map[string]interface{}),
+		historyDepth:   1,
+		//dependentFuncs: make(map[string]interface{}),
+		keyTypes: make(map[string]reflect.Type),
+		//dependentTypes: make(map[string]reflect.Type),
+		dependentVars: make(map[string]*DependentVar),
+		periods:       make(map[string]time.Duration),
+		nextTs:        make(map[string]int64),
+		lastCounts:    make(map[string]int64),
+		onError:       opt.OnError,
+	}
+
+	if opt.Interval != 0 {
+		// 设置 minInterval
+		gm.minInterval = int64(opt.Interval / time.Second)
+	}
+
+	if opt.HistoryDepth > 1 {
+		gm.historyDepth = opt.HistoryDepth
+	}
+
+	if opt.KeyPeriod != 0 {
+		gm.keyPeriod = opt.KeyPeriod
+	} else {
+		gm.keyPeriod = opt.Interval
+	}
+
+	// 设置自变量下次记录的时间戳
+	gm.SetPeriods(opt.Periods)
+
+	// key types
+	for k, t := range opt.KeyTypes {
+		gm.SetKeyType(k, t, false)
+	}
+	// dependent key types
+	for k, v := range opt.DependentVars {
+		gm.SetDependentVar(k, v.Func, v.Typ, v.Period)
+	}
+
+	// dependent key types
+	//for k, t := range opt.DepenentTypes {
+	//	gm.SetKeyType(k, t, true)
+	//}
+
+	return gm
+}
+
+// NewRegisteredDataMap constructs and registers a new StandardDataMap.
+func NewRegisteredDataMap(name string, r Registry, opt *DataMapOption) DataMap {
+	c := NewDataMap(name, opt)
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, c)
+	return c
+}
+
+// FloatValueFunc func which return float64
+type FloatValueFunc func(DataMap) float64
+
+// IntValueFunc func return int64
+type IntValueFunc func(DataMap) int64
+
+// StandardDataMap is the standard implementation of a Gauge and uses the
+// sync/atomic package to manage a single int64 value.
+type StandardDataMap struct {
+	sync.RWMutex
+
+	clock Clock
+
+	minInterval    int64 // 最小间隔
+	latestSnapshot int64
+
+	prefix string // 加在产生的meter前作为前缀
+
+	values        map[string]interface{}            // 当前值
+	valuesHistory map[string]map[string]interface{} // 历史值
+
+	historyRings map[string][]map[string]interface{} // 每个 period 最近 historyDepth 个历史值, 最旧的在前
+	historyDepth int
+	//dependentFuncs map[string]interface{}
+
+	keyTypes  map[string]reflect.Type
+	keyPeriod time.Duration
+	//dependentTypes map[string]reflect.Type
+
+	dependentVars map[string]*DependentVar // 因变量
+
+	periods map[string]time.Duration
+	nextTs  map[string]int64 // period下次入库的timestamp(second)
+
+	lastCounts map[string]int64 // counter, meter 和 PeriodCounter 上次的值, 用来计算增量
+	onError    func(error)
+}
+
+// Prefix prefix of datamap
+func (g *StandardDataMap) Prefix() string {
+	return g.prefix
+}
+
+// snapshotable return whether snapshot
+func (g *StandardDataMap) snapshotable() bool {
+	tm := g.clock.Now().Unix()
+	if tm-g.latestSnapshot >= g.minInterval {
+		g.latestSnapshot = tm
+		return true
+	}
+
+	return false
+}
+
+// Snapshot returns a read-only copy of the gauge.
+// 根据key的类型，输入相应的 meter
+// 同时, snapshot 需要判断是否需要计算历史数据
+func (g *StandardDataMap) Snapshot(r Registry) []interface{} {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.snapshotable() == false {
+		return nil
+	}
+
+	//fmt.Printf("Snap shot data map keyTypes: %d dependentKeyTypes: %d ....\n",
+	//	len(g.keyTypes), len(g.dependentTypes))
+	var meters []interface{}
+	for k, t := range g.keyTypes {
+		// 自变量
+		val, ok := g.values[k]
+		if !ok {
+			continue
+		}
+
+		// keyType period is 1 分钟
+		g.appendMeter(&meters, k, val, false, r, t, g.keyPeriod)
+	}
+
+	now := g.clock.Now()
+
+	for k, t := range g.dependentVars {
+		if now.Sub(t.lastSnap) >= t.Period {
+			//fmt.Printf("%v: snapshot dependent meter %s, type: %v lastSnap: %v\n", now, k, t.Typ, t.lastSnap)
+			t.lastSnap = now
+			fn := t.Func
+			// 因变量
+			g.appendMeter(&meters, k, fn, true, r, t.Typ, t.Period)
+		}
+	}
+
+	// 更新历史数据
+	g.updateHistory()
+	return meters
+}
+
+// appendMeter 生成 meter 并添加到 meters, 出错时调用 onError
+func (g *StandardDataMap) appendMeter(meters *[]interface{}, key string, val interface{},
+	dependent bool, r Registry, typ reflect.Type, arg interface{}) {
+	m, err := g.generateMeter(key, val, dependent, r, typ, arg)
+	if err != nil {
+		if g.onError != nil {
+			g.onError(err)
+		}
+		return
+	}
+	*meters = append(*meters, m)
+}
+
+// 生成响应的 meter
+// counter, meter 和 PeriodCounter 增加上次 snapshot 以来的增量, 值变小时认为重新计数;
+// histogram 和 timer 每次 snapshot 更新一次, timer 的值为纳秒
+func (g *StandardDataMap) generateMeter(key string, val interface{},
+	dependent bool, r Registry, typ reflect.Type, arg interface{}) (interface{}, error) {
+	if dependent {
+		// 计算val的值
+		switch fn := val.(type) {
+		case IntValueFunc:
+			val = fn(g)
+
+		case func(DataMap) int64:
+			val = fn(g)
+
+		case FloatValueFunc:
+			val = fn(g)
+
+		case func(DataMap) float64:
+			val = fn(g)
+
+		case *Expr:
+			val = fn.Eval(g)
+
+		default:
+			return nil, fmt.Errorf("invalid func type: key=%s func typ: %v",
+				key, reflect.TypeOf(val))
+		}
+	}
+
+	kind, ok := dataMapKinds[typ]
+	if !ok {
+		return nil, UnsupportedMeterType{Key: key, Type: typ}
+	}
+	period, _ := arg.(time.Duration)
+	delta := func(v int64) int64 { return g.delta(key, v) }
+	return updateDataMapMeter(r, g.prefix+"-"+key, kind, dataMapInt64(val), exprValue(val), delta, period, g.periods)
+}
+
+// updateDataMapMeter 更新 r 中 name 对应的 meter, 类型为 kind, 值为 i 或 f
+// counter, meter 和 PeriodCounter 增加 delta 返回的增量, cond 使用 period, PeriodCounter 使用 periods
+func updateDataMapMeter(r Registry, name string, kind DataMapKind, i int64, f float64,
+	delta func(int64) int64, period time.Duration, periods map[string]time.Duration) (interface{}, error) {
+	switch kind {
+	case DataMapCondInt:
+		m := GetOrRegisterCondInt(name, r, period)
+		m.Update(i)
+		return m, nil
+
+	case DataMapCondFloat:
+		m := GetOrRegisterCondFloat(name, r, period)
+		m.Update(f)
+		return m, nil
+
+	case DataMapCounter:
+		m := GetOrRegisterCounter(name, r)
+		m.Inc(delta(i))
+		return m, nil
+
+	case DataMapGauge:
+		m := GetOrRegisterGauge(name, r)
+		m.Update(i)
+		return m, nil
+
+	case DataMapGaugeFloat64:
+		m := GetOrRegisterGaugeFloat64(name, r)
+		m.Update(f)
+		return m, nil
+
+	case DataMapHistogram:
+		m := r.GetOrRegister(name, func() Histogram {
+			return NewHistogram(NewExpDecaySample(1028, 0.015))
+		}, nil).(Histogram)
+		m.Update(i)
+		return m, nil
+
+	case DataMapMeter:
+		m := GetOrRegisterMeter(name, r)
+		m.Mark(delta(i))
+		return m, nil
+
+	case DataMapTimer:
+		m := GetOrRegisterTimer(name, r)
+		m.Update(time.Duration(i))
+		return m, nil
+
+	case DataMapPeriodCounter:
+		ps := make(map[string]time.Duration, len(periods))
+		for p, du := range periods {
+			ps[p] = du
+		}
+		m := GetOrRegisterPeriodCounter(name, r, ps)
+		m.Inc(delta(i))
+		return m, nil
+	}
+
+	return nil, UnsupportedMeterType{Key: name, Kind: kind}
+}
+
+// delta 返回 key 上次 snapshot 以来的增量
+// caller lock
+func (g *StandardDataMap) delta(key string, v int64) int64 {
+	last, ok := g.lastCounts[key]
+	g.lastCounts[key] = v
+	if !ok || v < last {
+		return v
+	}
+	return v - last
+}
+
+// dataMapInt64 converts a value of a DataMap to int64.
+func dataMapInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// updateHistory 更新历史数据
+// caller lock
+func (g *StandardDataMap) updateHistory() {
+	ts := g.clock.Now().Unix()
+
+	for p, nts := range g.nextTs {
+		if ts >= nts {
+			du, ok := g.periods[p]
+			if !ok {
+				panic("Not found period " + p)
+			}
+
+			//fmt.Printf("update period %s\n", p)
+			// update history values
+			his, ok := g.valuesHistory[p]
+			if !ok {
+				g.valuesHistory[p] = make(map[string]interface{})
+				his = g.valuesHistory[p]
+			}
+
+			for k, v := range g.values {
+				his[k] = v
+			}
+			g.pushHistory(p, his)
+
+			g.nextTs[p] += int64(du / time.Second)
+		}
+	}
+}
+
+// pushHistory 把 his 的拷贝加入 period 的历史值环, 只保留最近 historyDepth 个
+// caller lock
+func (g *StandardDataMap) pushHistory(p string, his map[string]interface{}) {
+	point := make(map[string]interface{}, len(his))
+	for k, v := range his {
+		point[k] = v
+	}
+	ring := append(g.historyRings[p], point)
+	if len(ring) > g.historyDepth {
+		ring = append(ring[:0], ring[len(ring)-g.historyDepth:]...)
+	}
+	g.historyRings[p] = ring
+}
+
+// Periods return periods
+func (g *StandardDataMap) Periods() []string {
+	g.Lock()
+	defer g.Unlock()
+
+	ps := make([]string, 0, len(g.periods))
+	for k := range g.periods {
+		ps = append(ps, k)
+	}
+	return ps
+}
+
+// SetPeriods set periods
+func (g *StandardDataMap) SetPeriods(p map[string]time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+
+	ts := g.clock.Now()
+	for s, t := range p {
+		g.setPeriod(s, t, ts)
+	}
+}
+
+// setPeriod set period, lock before called
+// 按照时间规则, 尽可能取整, 例如分钟从00秒开始, 5分钟从00分钟开始
+func (g *StandardDataMap) setPeriod(p string, du time.Duration, tm time.Time) {
+	if du == 0 {
+		panic("setPeriod: invalid duration: 0")
+	}
+	// period是否已经存在
+	if _, ok := g.periods[p]; ok {
+		return
+	}
+
+	g.periods[p] = du
+	g.nextTs[p] = nextPeriodTs(du, tm)
+}
+
+// nextPeriodTs 返回 tm 之后 period 第一个对齐的时间戳
+func nextPeriodTs(du time.Duration, tm time.Time) int64 {
+	nts := tm.Unix()
+	mod := int64(60)
+	// 设置下次汇报的时间戳
+	// 如果是5分钟，15分钟，30分钟，60分钟，1天，设置为整点对齐
+	switch du {
+	case M5:
+		mod = 300
+	case M15:
+		mod = 15 * 60
+	case M30:
+		mod = 30 * 60
+
+	case H1:
+		mod = 3600
+	case D1:
+		mod = 86400
+	default:
+		// 小于1分钟
+		if du < M1 {
+			mod = 1
+		}
+	}
+
+	// 间隔时间为天时, 需修正时区
+	if du == D1 {
+		nts = days.Tomorrow(tm).Unix()
+	} else {
+		nts = nts - nts%mod + mod
+	}
+	return nts
+}
+
+// SetKeyType 设置 key type
+func (g *StandardDataMap) SetKeyType(key string, ty reflect.Type, isDependent bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	if isDependent == false {
+		// 因变量
+		// dependent variables
+		g.keyTypes[key] = ty
+	} else {
+		// 自变量
+		// independent variables
+		//g.dependentTypes[key] = ty
+	}
+}
+
+// UpdateInt64 updates the gauge's value.
+func (g *StandardDataMap) UpdateInt64(key string, v int64) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.values[key] = v
+	//fmt.Println(key, "prev=", g.valuePrev[key], g.value[key])
+}
+
+// UpdateFloat64 updates the gauge's value.
+func (g *StandardDataMap) UpdateFloat64(key string, v float64) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.values[key] = v
+}
+
+// Value returns the gauge's current value.
+// caller should lock
+func (g *StandardDataMap) Value(key string) interface{} {
+	return g.values[key]
+}
+
+// ValueInt64 get int64 value
+// caller should lock
+func (g *StandardDataMap) ValueInt64(key string) int64 {
+	return dataMapInt64(g.values[key])
+}
+
+// ValueFloat64 return the gauge's float64 value of key.
+// caller should lock
+func (g *StandardDataMap) ValueFloat64(key string) float64 {
+	return exprValue(g.values[key])
+}
+
+// Values returns a copy of the current values of all keys.
+func (g *StandardDataMap) Values() map[string]interface{} {
+	g.RLock()
+	defer g.RUnlock()
+
+	values := make(map[string]interface{}, len(g.values))
+	for k, v := range g.values {
+		values[k] = v
+	}
+	return values
+}
+
+// State returns a copy of the current and the historical values.
+func (g *StandardDataMap) State() DataMapState {
+	g.RLock()
+	defer g.RUnlock()
+
+	state := DataMapState{
+		Values:  make(map[string]interface{}, len(g.values)),
+		History: make(map[string]map[string]interface{}, len(g.valuesHistory)),
+		Rings:   make(map[string][]map[string]interface{}, len(g.historyRings)),
+	}
+	for k, v := range g.values {
+		state.Values[k] = v
+	}
+	for p, his := range g.valuesHistory {
+		state.History[p] = make(map[string]interface{}, len(his))
+		for k, v := range his {
+			state.History[p][k] = v
+		}
+	}
+	for p, ring := range g.historyRings {
+		state.Rings[p] = make([]map[string]interface{}, len(ring))
+		for i, his := range ring {
+			state.Rings[p][i] = make(map[string]interface{}, len(his))
+			for k, v := range his {
+				state.Rings[p][i][k] = v
+			}
+		}
+	}
+	return state
+}
+
+// Restore replaces the current and the historical values with those of
+// state.  The history of a period without a ring in state starts with its
+// last value.
+func (g *StandardDataMap) Restore(state DataMapState) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.values = make(map[string]interface{}, len(state.Values))
+	for k, v := range state.Values {
+		g.values[k] = v
+	}
+	g.valuesHistory = make(map[string]map[string]interface{}, len(state.History))
+	for p, his := range state.History {
+		g.valuesHistory[p] = make(map[string]interface{}, len(his))
+		for k, v := range his {
+			g.valuesHistory[p][k] = v
+		}
+	}
+	g.historyRings = make(map[string][]map[string]interface{}, len(state.History))
+	for p, ring := range state.Rings {
+		for _, his := range ring {
+			g.pushHistory(p, his)
+		}
+	}
+	for p, his := range g.valuesHistory {
+		if _, ok := g.historyRings[p]; !ok {
+			g.pushHistory(p, his)
+		}
+	}
+}
+
+// ValueHistory 历史值
+// caller should lock
+func (g *StandardDataMap) ValueHistory(key, period string) (interface{}, bool) {
+	if his, ok := g.valuesHistory[period]; ok {
+		return his[key], true
+	}
+
+	return nil, false
+}
+
+// HistoryN n 个 period 边界之前的历史值, n 为 1 时等于 ValueHistory
+// 最多保存 HistoryDepth 个
+// caller should lock
+func (g *StandardDataMap) HistoryN(key, period string, n int) (interface{}, bool) {
+	ring := g.historyRings[period]
+	if n < 1 || n > len(ring) {
+		return nil, false
+	}
+	v, ok := ring[len(ring)-n][key]
+	return v, ok
+}
+
+// Delta 当前值与上一个 period 边界的历史值之差, 没有历史值时为 0
+// caller should lock
+func (g *StandardDataMap) Delta(key, period string) float64 {
+	his, ok := g.HistoryN(key, period, 1)
+	if !ok {
+		return 0
+	}
+	return exprValue(g.values[key]) - exprValue(his)
+}
+
+// Rate 每秒的变化量, 即 Delta 除以距上一个 period 边界的秒数, 刚过边界时为 0
+// caller should lock
+func (g *StandardDataMap) Rate(key, period string) float64 {
+	du, ok := g.periods[period]
+	if !ok {
+		return 0
+	}
+	elapsed := sinceBoundary(g.clock.Now(), g.nextTs[period], du)
+	if elapsed <= 0 {
+		return 0
+	}
+	return g.Delta(key, period) / elapsed
+}
+
+// sinceBoundary 距上一个 period 边界的秒数, next 是下一个边界的 timestamp(second)
+func sinceBoundary(now time.Time, next int64, du time.Duration) float64 {
+	return now.Sub(time.Unix(next, 0).Add(-du)).Seconds()
+}
+
+// Avg 最近 n 个历史值的平均值, 历史值不足 n 个时为所有历史值的平均值, 没有历史值时为 0
+// caller should lock
+func (g *StandardDataMap) Avg(key, period string, n int) float64 {
+	if ring := g.historyRings[period]; n > len(ring) {
+		n = len(ring)
+	}
+	var sum float64
+	count := 0
+	for i := 1; i <= n; i++ {
+		v, ok := g.HistoryN(key, period, i)
+		if !ok {
+			continue
+		}
+		sum += exprValue(v)
+		count++
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// View calls f with a view of the values under the read lock, so that
+// readers outside the functions of the dependent variables do not race with
+// the updates.  The view is only valid during the call.
+func (g *StandardDataMap) View(f func(DataMapView)) {
+	g.RLock()
+	defer g.RUnlock()
+
+	f(dataMapView{g})
+}
+
+// dataMapView is the view of View, which hides the methods taking the lock.
+type dataMapView struct {
+	g *StandardDataMap
+}
+
+func (v dataMapView) Value(key string) interface{}     { return v.g.Value(key) }
+func (v dataMapView) ValueInt64(key string) int64      { return v.g.ValueInt64(key) }
+func (v dataMapView) ValueFloat64(key string) float64  { return v.g.ValueFloat64(key) }
+func (v dataMapView) Delta(key, period string) float64 { return v.g.Delta(key, period) }
+func (v dataMapView) Rate(key, period string) float64  { return v.g.Rate(key, period) }
+
+func (v dataMapView) ValueHistory(key, period string) (interface{}, bool) {
+	return v.g.ValueHistory(key, period)
+}
+
+func (v dataMapView) HistoryN(key, period string, n int) (interface{}, bool) {
+	return v.g.HistoryN(key, period, n)
+}
+
+func (v dataMapView) Avg(key, period string, n int) float64 {
+	return v.g.Avg(key, period, n)
+}
+
+// Keys return keys
+func (g *StandardDataMap) Keys() []string {
+	g.RLock()
+	defer g.RUnlock()
+
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// DependentKeys return keys
+func (g *StandardDataMap) DependentKeys() []string {
+	g.RLock()
+	defer g.RUnlock()
+
+	keys := make([]string, 0, len(g.dependentVars))
+	for k := range g.dependentVars {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// SetDependentVar set IntValueFunc, FloatValueFunc or an expression, see Expr
+func (g *StandardDataMap) SetDependentVar(key string, fn interface{}, typ reflect.Type, period time.Duration) {
+	var dv DependentVar
+
+	g.Lock()
+	defer g.Unlock()
+
+	f, err := dependentFunc(fn, g.periods, g.historyDepth)
+	if err != nil {
+		panic(fmt.Sprintf("SetDependentVar %s: %v", key, err))
+	}
+	dv.Func = f
+	dv.Name = key
+	dv.Typ = typ
+	dv.Period = period
+	dv.lastSnap = g.clock.Now()
+	g.dependentVars[key] = &dv
+
+	return
+}
@@ -0,0 +1,242 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DataMapConfig is the serializable form of a DataMapOption: meter types are
+// named and dependent variables are expressions, see Expr, so that a DataMap
+// is configured in JSON or YAML rather than in code, such as
+//
+//	{
+//		"prefix":   "pdp",
+//		"interval": "1m",
+//		"periods":  ["5m", "1d"],
+//		"keys":     {"total": "counter", "failed": "counter"},
+//		"dependent": {
+//			"fail_rate": {"expr": "delta(failed, \"5m\") / delta(total, \"5m\")", "type": "condfloat", "period": "5m"}
+//		}
+//	}
+//
+// Durations are those of time.ParseDuration, in whole seconds, or a number
+// of days such as "1d", and periods are named by their duration, as MS5 and
+// DS1 are.  The meter types are condint, condfloat, counter, gauge,
+// gaugefloat64, histogram, meter, timer and periodcounter.  When keys are
+// declared, the expressions may only read them, so that a misspelled key is
+// an error rather than a value of 0.
+//
+// JSON is decoded by ParseDataMapConfig.  The fields are tagged for YAML
+// too, so that YAML is decoded into a DataMapConfig with the YAML library
+// of the caller, which keeps this package free of the dependency, and
+// registered by its Register method.
+type DataMapConfig struct {
+	Prefix       string                        `json:"prefix" yaml:"prefix"`
+	Interval     string                        `json:"interval" yaml:"interval"`
+	KeyPeriod    string                        `json:"key_period,omitempty" yaml:"key_period,omitempty"` // 默认等于 Interval
+	Periods      []string                      `json:"periods,omitempty" yaml:"periods,omitempty"`
+	HistoryDepth int                           `json:"history_depth,omitempty" yaml:"history_depth,omitempty"`
+	Keys         map[string]string             `json:"keys,omitempty" yaml:"keys,omitempty"` // key -> meter type
+	Dependent    map[string]DependentVarConfig `json:"dependent,omitempty" yaml:"dependent,omitempty"`
+}
+
+// DependentVarConfig is the serializable form of a DependentVar.
+type DependentVarConfig struct {
+	Expr   string `json:"expr" yaml:"expr"`
+	Type   string `json:"type" yaml:"type"`
+	Period string `json:"period,omitempty" yaml:"period,omitempty"` // 默认等于 Interval
+}
+
+// dataMapTypeNames DataMapConfig 中 meter type 的名字
+var dataMapTypeNames = map[string]reflect.Type{
+	"condint":       condIntType,
+	"condfloat":     condFloatType,
+	"counter":       counterType,
+	"gauge":         gaugeType,
+	"gaugefloat64":  gaugeFloat64Type,
+	"histogram":     histogramType,
+	"meter":         meterType,
+	"timer":         timerType,
+	"periodcounter": periodCounterType,
+}
+
+// ParseDataMapConfig decodes a DataMapConfig from JSON, rejecting unknown
+// fields, and validates it.
+func ParseDataMapConfig(b []byte) (*DataMapConfig, error) {
+	var c DataMapConfig
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); nil != err {
+		return nil, fmt.Errorf("datamap config: %v", err)
+	}
+	if _, err := c.Option(); nil != err {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// LoadDataMapConfig decodes a DataMapConfig from JSON and registers its
+// DataMap in r.  Configurations in YAML are decoded by the caller into a
+// DataMapConfig and registered by its Register method.
+func LoadDataMapConfig(b []byte, r Registry) (DataMap, error) {
+	c, err := ParseDataMapConfig(b)
+	if nil != err {
+		return nil, err
+	}
+	return c.Register(r)
+}
+
+// Register validates the configuration, constructs its DataMap and registers
+// it in r under its prefix.  It returns an error if a metric, a DataMap or
+// any other, is already registered under the prefix, rather than ignoring
+// the configuration.
+func (c *DataMapConfig) Register(r Registry) (DataMap, error) {
+	opt, err := c.Option()
+	if nil != err {
+		return nil, err
+	}
+	if nil == r {
+		r = DefaultRegistry
+	}
+	if existing := r.Get(c.Prefix); nil != existing {
+		return nil, fmt.Errorf("datamap config %s: %T already registered", c.Prefix, existing)
+	}
+	g := newDataMap(c.Prefix, opt, registryClock(r))
+	if err := r.Register(c.Prefix, g); nil != err {
+		return nil, fmt.Errorf("datamap config %s: %v", c.Prefix, err)
+	}
+	return g, nil
+}
+
+// Option validates every field of the configuration and returns the
+// equivalent DataMapOption.
+func (c *DataMapConfig) Option() (*DataMapOption, error) {
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("datamap config %s: %s", c.Prefix, fmt.Sprintf(format, args...))
+	}
+	if "" == c.Prefix {
+		return nil, errorf("empty prefix")
+	}
+	if c.HistoryDepth < 0 {
+		return nil, errorf("negative history_depth %d", c.HistoryDepth)
+	}
+	opt := &DataMapOption{
+		Prefix:        c.Prefix,
+		HistoryDepth:  c.HistoryDepth,
+		Periods:       make(map[string]time.Duration, len(c.Periods)),
+		KeyTypes:      make(map[string]reflect.Type, len(c.Keys)),
+		DependentVars: make(map[string]*DependentVar, len(c.Dependent)),
+	}
+
+	var err error
+	if opt.Interval, err = parseDataMapDuration(c.Interval); nil != err {
+		return nil, errorf("interval: %v", err)
+	}
+	opt.KeyPeriod = opt.Interval
+	if "" != c.KeyPeriod {
+		if opt.KeyPeriod, err = parseDataMapDuration(c.KeyPeriod); nil != err {
+			return nil, errorf("key_period: %v", err)
+		}
+	}
+	for _, p := range c.Periods {
+		du, err := parseDataMapDuration(p)
+		if nil != err {
+			return nil, errorf("period: %v", err)
+		}
+		if _, ok := opt.Periods[p]; ok {
+			return nil, errorf("duplicate period %q", p)
+		}
+		opt.Periods[p] = du
+	}
+
+	for _, k := range sortedKeys(c.Keys) {
+		typ, ok := dataMapTypeNames[c.Keys[k]]
+		if !ok {
+			return nil, errorf("key %s: unknown meter type %q", k, c.Keys[k])
+		}
+		opt.KeyTypes[k] = typ
+	}
+
+	names := make([]string, 0, len(c.Dependent))
+	for k := range c.Dependent {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		v := c.Dependent[k]
+		if _, ok := c.Keys[k]; ok {
+			return nil, errorf("dependent var %s: also a key", k)
+		}
+		typ, ok := dataMapTypeNames[v.Type]
+		if !ok {
+			return nil, errorf("dependent var %s: unknown meter type %q", k, v.Type)
+		}
+		e, err := ParseExpr(v.Expr)
+		if nil != err {
+			return nil, errorf("dependent var %s: %v", k, err)
+		}
+		// a misspelled key would always read 0
+		if 0 != len(c.Keys) {
+			for _, key := range e.Keys() {
+				if _, ok := c.Keys[key]; !ok {
+					return nil, errorf("dependent var %s: unknown key %s in %q", k, key, v.Expr)
+				}
+			}
+		}
+		period := opt.Interval
+		if "" != v.Period {
+			if period, err = parseDataMapDuration(v.Period); nil != err {
+				return nil, errorf("dependent var %s: period: %v", k, err)
+			}
+		}
+		opt.DependentVars[k] = &DependentVar{Name: k, Func: e, Typ: typ, Period: period}
+	}
+
+	if err := opt.Validate(); nil != err {
+		return nil, errorf("%v", err)
+	}
+	return opt, nil
+}
+
+// parseDataMapDuration parses a positive duration of time.ParseDuration or a
+// whole number of days such as "1d".  The duration must be a whole number of
+// seconds, since the boundaries of the periods are counted in seconds.
+func parseDataMapDuration(s string) (time.Duration, error) {
+	var du time.Duration
+	if n := strings.TrimSuffix(s, "d"); n != s {
+		days, err := strconv.Atoi(n)
+		if nil != err {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		du = time.Duration(days) * D1
+	} else {
+		var err error
+		if du, err = time.ParseDuration(s); nil != err {
+			return 0, err
+		}
+	}
+	if du <= 0 {
+		return 0, fmt.Errorf("invalid duration %q: not positive", s)
+	}
+	if 0 != du%time.Second {
+		return 0, fmt.Errorf("invalid duration %q: not a whole number of seconds", s)
+	}
+	return du, nil
+}
+
+// sortedKeys returns the keys of m in order, so that the first invalid
+// field reported is the same every time.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
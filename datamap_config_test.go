@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDataMapConfig = `{
+	"prefix":        "pdp",
+	"interval":      "1m",
+	"periods":       ["5m", "1d"],
+	"history_depth": 3,
+	"keys":          {"total": "counter", "failed": "counter", "online": "gauge"},
+	"dependent": {
+		"fail_rate": {"expr": "delta(failed, \"5m\") / delta(total, \"5m\")", "type": "gaugefloat64", "period": "5m"},
+		"ok":        {"expr": "total - failed", "type": "gauge"}
+	}
+}`
+
+func TestLoadDataMapConfig(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	g, err := LoadDataMapConfig([]byte(testDataMapConfig), r)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if g != r.Get("pdp") {
+		t.Fatal(r.Get("pdp"))
+	}
+	for i := int64(1); i <= 10; i++ {
+		g.UpdateInt64("total", 10*i)
+		g.UpdateInt64("failed", i)
+		g.UpdateInt64("online", 5)
+		clock.Add(time.Minute)
+		g.Snapshot(r)
+	}
+	if c := r.Get("pdp-total").(Counter).Count(); 100 != c {
+		t.Fatal(c)
+	}
+	if v := r.Get("pdp-ok").(Gauge).Value(); 90 != v {
+		t.Fatal(v)
+	}
+	if v := r.Get("pdp-fail_rate").(GaugeFloat64).Value(); 0.1 != v {
+		t.Fatal(v)
+	}
+}
+
+func TestDataMapConfigRegistered(t *testing.T) {
+	r := NewRegistry()
+	if _, err := LoadDataMapConfig([]byte(testDataMapConfig), r); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := LoadDataMapConfig([]byte(testDataMapConfig), r); nil == err || !strings.Contains(err.Error(), "StandardDataMap already registered") {
+		t.Fatal(err)
+	}
+
+	r = NewRegistry()
+	GetOrRegisterCounter("pdp", r)
+	if _, err := LoadDataMapConfig([]byte(testDataMapConfig), r); nil == err || !strings.Contains(err.Error(), "StandardCounter already registered") {
+		t.Fatal(err)
+	}
+}
+
+func TestDataMapConfigOption(t *testing.T) {
+	c, err := ParseDataMapConfig([]byte(testDataMapConfig))
+	if nil != err {
+		t.Fatal(err)
+	}
+	opt, err := c.Option()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if M5 != opt.Periods[MS5] || D1 != opt.Periods[DS1] || time.Minute != opt.KeyPeriod {
+		t.Fatal(opt)
+	}
+	if counterType != opt.KeyTypes["total"] || gaugeType != opt.KeyTypes["online"] {
+		t.Fatal(opt.KeyTypes)
+	}
+	if v := opt.DependentVars["ok"]; gaugeType != v.Typ || time.Minute != v.Period {
+		t.Fatal(v)
+	}
+}
+
+func TestDataMapConfigInvalid(t *testing.T) {
+	for _, c := range []struct{ config, err string }{
+		{`{"interval": "1m"}`, "empty prefix"},
+		{`{"prefix": "p", "interval": "soon"}`, "interval"},
+		{`{"prefix": "p", "interval": "1m", "periods": ["0d"]}`, "not positive"},
+		{`{"prefix": "p", "interval": "1m", "periods": ["5m", "5m"]}`, "duplicate period"},
+		{`{"prefix": "p", "interval": "500ms"}`, "not a whole number of seconds"},
+		{`{"prefix": "p", "interval": "1m", "periods": ["1.5s"]}`, "not a whole number of seconds"},
+		{`{"prefix": "p", "interval": "1m", "dependent": {"d": {"expr": "1", "type": "gauge", "period": "-1s"}}}`, "not positive"},
+		{`{"prefix": "p", "interval": "1m", "keys": {"a": "gauge", "b": "bogus"}}`, `key b: unknown meter type "bogus"`},
+		{`{"prefix": "p", "interval": "1m", "dependent": {"d": {"expr": "a +", "type": "gauge"}}}`, "dependent var d: invalid expression"},
+		{`{"prefix": "p", "interval": "1m", "dependent": {"d": {"expr": "hist(a, \"1h\")", "type": "gauge"}}}`, `unknown period "1h"`},
+		{`{"prefix": "p", "interval": "1m", "keys": {"d": "gauge"}, "dependent": {"d": {"expr": "1", "type": "gauge"}}}`, "also a key"},
+		{`{"prefix": "p", "interval": "1m", "periods": ["5m"], "dependent": {"d": {"expr": "avg(a, \"5m\", 12)", "type": "gaugefloat64"}}}`, "more than the HistoryDepth of 1"},
+		{`{"prefix": "p", "interval": "1m", "key_types": {}}`, "unknown field"},
+		{`{"prefix": "p", "interval": "1m", "keys": {"ok": "counter"}, "dependent": {"d": {"expr": "okk / 2", "type": "gauge"}}}`, "dependent var d: unknown key okk"},
+		{`{"prefix": "p", "interval": "1m", "periods": ["5m"], "keys": {"ok": "counter"}, "dependent": {"d": {"expr": "delta(ko, \"5m\")", "type": "gauge"}}}`, "unknown key ko"},
+	} {
+		_, err := ParseDataMapConfig([]byte(c.config))
+		if nil == err || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v", c.config, err)
+		}
+	}
+}
+
+func TestDataMapConfigYAMLTags(t *testing.T) {
+	// YAML libraries lower-case untagged names, which would not match
+	// key_period or history_depth
+	for _, typ := range []reflect.Type{reflect.TypeOf(DataMapConfig{}), reflect.TypeOf(DependentVarConfig{})} {
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.Tag.Get("json") != f.Tag.Get("yaml") {
+				t.Errorf("%s.%s: yaml tag %q != json tag %q", typ.Name(), f.Name, f.Tag.Get("yaml"), f.Tag.Get("json"))
+			}
+		}
+	}
+}
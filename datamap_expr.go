@@ -0,0 +1,444 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is an arithmetic expression over the values of the keys of a DataMap,
+// which DependentVar.Func accepts in place of a compiled function so that
+// dependent variables can be configured without a redeploy, such as
+//
+//	ok / (ok + fail)
+//	max(ok - hist(ok, "m5"), 0)
+//
+// Expressions have the operators + - * / of float64 arithmetic, the
+// comparisons < <= > >= == != which evaluate to 1 or 0, parentheses, the
+// functions min, max and abs, and the functions of the history of a key,
+// which evaluate like the DataMap methods of the same name:
+//
+//	hist(key, "period")     // ValueHistory, the value at the last boundary
+//	hist(key, "period", n)  // HistoryN, the value n boundaries ago
+//	delta(key, "period")    // Delta
+//	rate(key, "period")     // Rate
+//	avg(key, "period", n)   // Avg
+//
+// Keys without a value evaluate to 0, as do divisions by zero.
+type Expr struct {
+	src     string
+	eval    func(DataMapView) float64
+	keys    []string
+	periods []string
+	depth   int // most history values read of a period
+}
+
+// ExprError is the error returned by ParseExpr for an invalid expression.
+type ExprError struct {
+	Expr string
+	Pos  int // byte offset of the error in Expr
+	Msg  string
+}
+
+func (err *ExprError) Error() string {
+	return fmt.Sprintf("invalid expression %q: %s at offset %d", err.Expr, err.Msg, err.Pos)
+}
+
+// ParseExpr compiles an expression over the keys of a DataMap.
+func ParseExpr(s string) (*Expr, error) {
+	p := &exprParser{src: s}
+	p.next()
+	eval, err := p.parseComparison()
+	if nil == err && exprEOF != p.tok.kind {
+		err = p.errorf("unexpected %s", p.tok)
+	}
+	if nil != err {
+		return nil, err
+	}
+	return &Expr{src: s, eval: eval, keys: p.keys, periods: p.periods, depth: p.depth}, nil
+}
+
+// MustParseExpr is like ParseExpr but panics if the expression is invalid.
+func MustParseExpr(s string) *Expr {
+	e, err := ParseExpr(s)
+	if nil != err {
+		panic(err)
+	}
+	return e
+}
+
+// Eval evaluates the expression with the values of dm, a DataMap in the
+// functions of its dependent variables or the view passed by DataMap.View.
+func (e *Expr) Eval(dm DataMapView) float64 {
+	return e.eval(dm)
+}
+
+// Keys returns the keys the expression reads.
+func (e *Expr) Keys() []string {
+	return append([]string(nil), e.keys...)
+}
+
+// Periods returns the periods of the history the expression reads.
+func (e *Expr) Periods() []string {
+	return append([]string(nil), e.periods...)
+}
+
+// HistoryDepth returns the largest number of history values of a period the
+// expression reads, such as 12 for avg(key, "5m", 12), which the
+// HistoryDepth of the DataMap must keep.  It is 0 without history.
+func (e *Expr) HistoryDepth() int {
+	return e.depth
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// exprValue converts a value of a DataMap to float64.
+func exprValue(v interface{}) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+type exprTokenKind int
+
+const (
+	exprEOF exprTokenKind = iota
+	exprNumber
+	exprIdent
+	exprString
+	exprOperator
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	if exprEOF == t.kind {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+type exprParser struct {
+	src     string
+	pos     int
+	tok     exprToken
+	keys    []string
+	periods []string
+	depth   int
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return &ExprError{Expr: p.src, Pos: p.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// next scans the next token into p.tok, leaving an invalid character as a
+// single character operator for the parser to reject.
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos == len(p.src) {
+		p.tok = exprToken{exprEOF, "", start}
+		return
+	}
+	c := p.src[p.pos]
+	switch {
+	case isExprDigit(c) || '.' == c:
+		for p.pos < len(p.src) && (isExprDigit(p.src[p.pos]) || '.' == p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = exprToken{exprNumber, p.src[start:p.pos], start}
+	case isExprIdent(c):
+		for p.pos < len(p.src) && (isExprIdent(p.src[p.pos]) || isExprDigit(p.src[p.pos]) || '.' == p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = exprToken{exprIdent, p.src[start:p.pos], start}
+	case '"' == c:
+		end := strings.IndexByte(p.src[start+1:], '"')
+		if end < 0 {
+			p.pos = len(p.src)
+			p.tok = exprToken{exprOperator, `"`, start}
+			return
+		}
+		p.pos = start + end + 2
+		p.tok = exprToken{exprString, p.src[start+1 : p.pos-1], start}
+	default:
+		p.pos++
+		if p.pos < len(p.src) && '=' == p.src[p.pos] && strings.IndexByte("<>=!", c) >= 0 {
+			p.pos++
+		}
+		p.tok = exprToken{exprOperator, p.src[start:p.pos], start}
+	}
+}
+
+func (p *exprParser) isOperator(text string) bool {
+	return exprOperator == p.tok.kind && text == p.tok.text
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.isOperator(text) {
+		return p.errorf("expected %q, found %s", text, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseComparison() (func(DataMapView) float64, error) {
+	x, err := p.parseSum()
+	if nil != err {
+		return nil, err
+	}
+	if exprOperator != p.tok.kind {
+		return x, nil
+	}
+	var cmp func(a, b float64) bool
+	switch p.tok.text {
+	case "<":
+		cmp = func(a, b float64) bool { return a < b }
+	case "<=":
+		cmp = func(a, b float64) bool { return a <= b }
+	case ">":
+		cmp = func(a, b float64) bool { return a > b }
+	case ">=":
+		cmp = func(a, b float64) bool { return a >= b }
+	case "==":
+		cmp = func(a, b float64) bool { return a == b }
+	case "!=":
+		cmp = func(a, b float64) bool { return a != b }
+	default:
+		return x, nil
+	}
+	p.next()
+	y, err := p.parseSum()
+	if nil != err {
+		return nil, err
+	}
+	return func(dm DataMapView) float64 {
+		if cmp(x(dm), y(dm)) {
+			return 1
+		}
+		return 0
+	}, nil
+}
+
+func (p *exprParser) parseSum() (func(DataMapView) float64, error) {
+	x, err := p.parseProduct()
+	if nil != err {
+		return nil, err
+	}
+	for p.isOperator("+") || p.isOperator("-") {
+		op := p.tok.text
+		p.next()
+		y, err := p.parseProduct()
+		if nil != err {
+			return nil, err
+		}
+		a := x
+		if "+" == op {
+			x = func(dm DataMapView) float64 { return a(dm) + y(dm) }
+		} else {
+			x = func(dm DataMapView) float64 { return a(dm) - y(dm) }
+		}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseProduct() (func(DataMapView) float64, error) {
+	x, err := p.parseUnary()
+	if nil != err {
+		return nil, err
+	}
+	for p.isOperator("*") || p.isOperator("/") {
+		op := p.tok.text
+		p.next()
+		y, err := p.parseUnary()
+		if nil != err {
+			return nil, err
+		}
+		a := x
+		if "*" == op {
+			x = func(dm DataMapView) float64 { return a(dm) * y(dm) }
+		} else {
+			x = func(dm DataMapView) float64 {
+				d := y(dm)
+				if 0 == d {
+					return 0
+				}
+				return a(dm) / d
+			}
+		}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (func(DataMapView) float64, error) {
+	if p.isOperator("-") {
+		p.next()
+		x, err := p.parseUnary()
+		if nil != err {
+			return nil, err
+		}
+		return func(dm DataMapView) float64 { return -x(dm) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (func(DataMapView) float64, error) {
+	tok := p.tok
+	switch tok.kind {
+	case exprNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if nil != err {
+			return nil, p.errorf("invalid number %s", tok)
+		}
+		p.next()
+		return func(DataMapView) float64 { return f }, nil
+	case exprIdent:
+		p.next()
+		if p.isOperator("(") {
+			return p.parseCall(tok)
+		}
+		p.keys = append(p.keys, tok.text)
+		return func(dm DataMapView) float64 { return exprValue(dm.Value(tok.text)) }, nil
+	case exprOperator:
+		if "(" == tok.text {
+			p.next()
+			x, err := p.parseComparison()
+			if nil != err {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+// parseCall parses the arguments of the function fn, whose name has been
+// scanned.
+func (p *exprParser) parseCall(fn exprToken) (func(DataMapView) float64, error) {
+	p.next()
+	switch fn.text {
+	case "hist", "delta", "rate", "avg":
+		return p.parseHistory(fn)
+	}
+	var args []func(DataMapView) float64
+	for !p.isOperator(")") {
+		if 0 != len(args) {
+			if err := p.expect(","); nil != err {
+				return nil, err
+			}
+		}
+		x, err := p.parseComparison()
+		if nil != err {
+			return nil, err
+		}
+		args = append(args, x)
+	}
+	p.next()
+	switch fn.text {
+	case "abs":
+		if 1 != len(args) {
+			return nil, &ExprError{p.src, fn.pos, fmt.Sprintf("abs takes 1 argument, not %d", len(args))}
+		}
+		x := args[0]
+		return func(dm DataMapView) float64 { return math.Abs(x(dm)) }, nil
+	case "min", "max":
+		if 0 == len(args) {
+			return nil, &ExprError{p.src, fn.pos, fn.text + " takes at least 1 argument"}
+		}
+		pick := math.Min
+		if "max" == fn.text {
+			pick = math.Max
+		}
+		return func(dm DataMapView) float64 {
+			v := args[0](dm)
+			for _, x := range args[1:] {
+				v = pick(v, x(dm))
+			}
+			return v
+		}, nil
+	}
+	return nil, &ExprError{p.src, fn.pos, "unknown function " + fn.text}
+}
+
+// parseHistory parses the arguments of a function of the history of a key,
+// such as hist(key, "period"), whose opening parenthesis has been scanned.
+func (p *exprParser) parseHistory(fn exprToken) (func(DataMapView) float64, error) {
+	if exprIdent != p.tok.kind && exprString != p.tok.kind {
+		return nil, p.errorf("%s expects a key, found %s", fn.text, p.tok)
+	}
+	key := p.tok.text
+	p.next()
+	if err := p.expect(","); nil != err {
+		return nil, err
+	}
+	if exprString != p.tok.kind {
+		return nil, p.errorf("%s expects a quoted period, found %s", fn.text, p.tok)
+	}
+	period := p.tok.text
+	p.next()
+	n := 0
+	if ("hist" == fn.text || "avg" == fn.text) && p.isOperator(",") {
+		p.next()
+		var err error
+		if n, err = strconv.Atoi(p.tok.text); exprNumber != p.tok.kind || nil != err || n < 1 {
+			return nil, p.errorf("%s expects a positive number of periods, found %s", fn.text, p.tok)
+		}
+		p.next()
+	} else if "avg" == fn.text {
+		return nil, p.errorf("avg expects a number of periods, found %s", p.tok)
+	}
+	if err := p.expect(")"); nil != err {
+		return nil, err
+	}
+	p.keys = append(p.keys, key)
+	p.periods = append(p.periods, period)
+	// delta, rate and hist without n read the last history value
+	depth := n
+	if 0 == depth {
+		depth = 1
+	}
+	if depth > p.depth {
+		p.depth = depth
+	}
+	switch fn.text {
+	case "delta":
+		return func(dm DataMapView) float64 { return dm.Delta(key, period) }, nil
+	case "rate":
+		return func(dm DataMapView) float64 { return dm.Rate(key, period) }, nil
+	case "avg":
+		return func(dm DataMapView) float64 { return dm.Avg(key, period, n) }, nil
+	}
+	if 0 != n {
+		return func(dm DataMapView) float64 {
+			v, _ := dm.HistoryN(key, period, n)
+			return exprValue(v)
+		}, nil
+	}
+	return func(dm DataMapView) float64 {
+		v, _ := dm.ValueHistory(key, period)
+		return exprValue(v)
+	}, nil
+}
+
+func isExprDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isExprIdent(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '_' == c
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newExprDataMap() *StandardDataMap {
+	g := NewDataMap("test", &DataMapOption{
+		Periods: map[string]time.Duration{"m5": M5},
+	}).(*StandardDataMap)
+	g.UpdateInt64("ok", 90)
+	g.UpdateInt64("fail", 10)
+	g.UpdateFloat64("load", -0.5)
+	g.valuesHistory["m5"] = map[string]interface{}{"ok": int64(40)}
+	return g
+}
+
+func TestExprEval(t *testing.T) {
+	g := newExprDataMap()
+	for s, want := range map[string]float64{
+		"ok / (ok + fail)":              0.9,
+		"ok - hist(ok, \"m5\")":         50,
+		"ok - hist(\"ok\", \"m5\")":     50,
+		"fail - hist(fail, \"m5\")":     10,
+		"-ok + 2 * fail":                -70,
+		"1 + 2 * 3 - 4 / 2":             5,
+		"abs(load)":                     0.5,
+		"min(ok, fail, 50)":             10,
+		"max(ok, 100)":                  100,
+		"ok > fail":                     1,
+		"ok <= fail":                    0,
+		"(ok == 90) + (fail != 10)":     1,
+		"ok / missing":                  0,
+		"ok / (fail - 10)":              0,
+		"missing + hist(ok, \"h1\")":    0,
+		"ok/(ok+fail) * 100 >= 90":      1,
+		"max(ok - hist(ok, \"m5\"), 0)": 50,
+	} {
+		e, err := ParseExpr(s)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if v := e.Eval(g); math.Abs(want-v) > 1e-9 {
+			t.Errorf("%s: %v != %v", s, v, want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for s, msg := range map[string]string{
+		"":                     "unexpected end of expression at offset 0",
+		"ok +":                 "unexpected end of expression at offset 4",
+		"ok fail":              "unexpected \"fail\" at offset 3",
+		"(ok":                  "expected \")\", found end of expression at offset 3",
+		"ok $ 1":               "unexpected \"$\" at offset 3",
+		"sqrt(ok)":             "unknown function sqrt at offset 0",
+		"abs(ok, fail)":        "abs takes 1 argument, not 2 at offset 0",
+		"min()":                "min takes at least 1 argument at offset 0",
+		"hist(ok, m5)":         "hist expects a quoted period, found \"m5\" at offset 9",
+		"hist(ok, \"m5)":       "hist expects a quoted period, found \"\\\"\" at offset 9",
+		"1..2":                 "invalid number \"1..2\" at offset 0",
+		"ok < fail < 1":        "unexpected \"<\" at offset 10",
+		"hist(1, \"m5\")":      "hist expects a key, found \"1\" at offset 5",
+		"max(ok, hist(ok))":    "expected \",\", found \")\" at offset 15",
+		"ok / (ok + fail))":    "unexpected \")\" at offset 16",
+		"ok ** 2":              "unexpected \"*\" at offset 4",
+		"ok = 2":               "unexpected \"=\" at offset 3",
+		"ok ! 2":               "unexpected \"!\" at offset 3",
+		"ok + (fail":           "expected \")\", found end of expression at offset 10",
+		"min(ok fail)":         "expected \",\", found \"fail\" at offset 7",
+		"hist(ok \"m5\")":      "expected \",\", found \"m5\" at offset 8",
+		"hist(ok, \"m5\"":      "expected \")\", found end of expression at offset 13",
+		"delta(ok, \"m5\", 1)": "expected \")\", found \",\" at offset 14",
+		"avg(ok, \"m5\")":      "avg expects a number of periods, found \")\" at offset 12",
+		"hist(ok, \"m5\", 0)":  "hist expects a positive number of periods, found \"0\" at offset 15",
+		"avg(ok, \"m5\", ok)":  "avg expects a positive number of periods, found \"ok\" at offset 14",
+	} {
+		_, err := ParseExpr(s)
+		if nil == err {
+			t.Errorf("%s: no error", s)
+			continue
+		}
+		if _, ok := err.(*ExprError); !ok || !strings.HasSuffix(err.Error(), msg) {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+}
+
+func TestDataMapOptionValidate(t *testing.T) {
+	opt := &DataMapOption{
+		Periods: map[string]time.Duration{"m5": M5},
+		DependentVars: map[string]*DependentVar{
+			"rate": {Func: "ok / (ok + fail)", Typ: condFloatType},
+		},
+	}
+	if err := opt.Validate(); nil != err {
+		t.Fatal(err)
+	}
+	opt.DependentVars["delta"] = &DependentVar{Func: "ok - hist(ok, \"h1\")", Typ: condIntType}
+	if err := opt.Validate(); nil == err || !strings.Contains(err.Error(), "unknown period \"h1\"") {
+		t.Fatal(err)
+	}
+	opt.DependentVars["delta"] = &DependentVar{Func: "ok -", Typ: condIntType}
+	if err := opt.Validate(); nil == err || !strings.HasPrefix(err.Error(), "dependent var delta: invalid expression") {
+		t.Fatal(err)
+	}
+	opt.DependentVars["delta"] = &DependentVar{Func: 47, Typ: condIntType}
+	if err := opt.Validate(); nil == err {
+		t.Fatal("invalid func validated")
+	}
+
+	// the history read must be kept
+	for _, e := range []string{`avg(ok, "m5", 12)`, `hist(ok, "m5", 3)`} {
+		opt.DependentVars["delta"] = &DependentVar{Func: e, Typ: condFloatType}
+		if err := opt.Validate(); nil == err || !strings.Contains(err.Error(), "more than the HistoryDepth of 1") {
+			t.Fatal(e, err)
+		}
+	}
+	opt.HistoryDepth = 12
+	if err := opt.Validate(); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestExprHistoryDepth(t *testing.T) {
+	for e, depth := range map[string]int{
+		"ok":                                    0,
+		`delta(ok, "m5") + rate(ok, "m5")`:      1,
+		`hist(ok, "m5")`:                        1,
+		`hist(ok, "m5", 3) + avg(ok, "m5", 12)`: 12,
+		`avg(ok, "m5", 2) - hist(ok, "d1", 7)`:  7,
+	} {
+		if d := MustParseExpr(e).HistoryDepth(); depth != d {
+			t.Errorf("%s: %d != %d", e, depth, d)
+		}
+	}
+}
+
+func TestDataMapExpr(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	g := GetOrRegisterDataMap("test", r, &DataMapOption{
+		Periods: map[string]time.Duration{"m5": M5},
+		DependentVars: map[string]*DependentVar{
+			"rate":  {Func: "ok / (ok + fail)", Typ: condFloatType, Period: time.Minute},
+			"total": {Func: "ok + fail", Typ: condIntType, Period: time.Minute},
+		},
+	})
+	g.SetDependentVar("up", MustParseExpr("ok > 0"), reflect.TypeOf(&StandardCondInt{}), time.Minute)
+	g.UpdateInt64("ok", 3)
+	g.UpdateInt64("fail", 1)
+	clock.Add(time.Minute)
+	g.Snapshot(r)
+	if v := r.Get("test-rate").(CondFloat).Value(); 0.75 != v {
+		t.Fatal(v)
+	}
+	if v := r.Get("test-total").(CondInt).Value(); 4 != v {
+		t.Fatal(v)
+	}
+	if v := r.Get("test-up").(CondInt).Value(); 1 != v {
+		t.Fatal(v)
+	}
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// newHistoryDataMap returns a DataMap whose key n was 10, 20 ... 50 at the
+// last 5 boundaries of the minute period and is 60 now, 30 seconds after the
+// last boundary.
+func newHistoryDataMap(depth int) DataMap {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	g := GetOrRegisterDataMap("dm", r, &DataMapOption{
+		Interval:     time.Minute,
+		Periods:      map[string]time.Duration{"m1": M1},
+		HistoryDepth: depth,
+	})
+	for i := int64(1); i <= 5; i++ {
+		g.UpdateInt64("n", 10*i)
+		clock.Add(time.Minute)
+		g.Snapshot(r)
+	}
+	clock.Add(30 * time.Second)
+	g.UpdateInt64("n", 60)
+	return g
+}
+
+func TestDataMapHistoryN(t *testing.T) {
+	g := newHistoryDataMap(3)
+	for n, want := range map[int]int64{1: 50, 2: 40, 3: 30} {
+		if v, ok := g.HistoryN("n", "m1", n); !ok || want != v {
+			t.Fatal(n, v, ok)
+		}
+	}
+	if v, ok := g.HistoryN("n", "m1", 4); ok {
+		t.Fatal("history deeper than configured", v)
+	}
+	if v, ok := g.HistoryN("n", "m5", 1); ok {
+		t.Fatal(v)
+	}
+	if v, _ := g.ValueHistory("n", "m1"); int64(50) != v {
+		t.Fatal(v)
+	}
+}
+
+func TestDataMapHistoryDefaultDepth(t *testing.T) {
+	g := newHistoryDataMap(0)
+	if v, ok := g.HistoryN("n", "m1", 1); !ok || int64(50) != v {
+		t.Fatal(v, ok)
+	}
+	if _, ok := g.HistoryN("n", "m1", 2); ok {
+		t.Fatal("history deeper than 1")
+	}
+}
+
+func TestDataMapDeltaRateAvg(t *testing.T) {
+	g := newHistoryDataMap(12)
+	if d := g.Delta("n", "m1"); 10 != d {
+		t.Fatal(d)
+	}
+	if r := g.Rate("n", "m1"); 10.0/30 != r {
+		t.Fatal(r)
+	}
+	if a := g.Avg("n", "m1", 2); 45 != a {
+		t.Fatal(a)
+	}
+	if a := g.Avg("n", "m1", 12); 30 != a {
+		t.Fatal(a)
+	}
+	if d := g.Delta("missing", "m1"); 0 != d {
+		t.Fatal(d)
+	}
+	if a := g.Avg("n", "m5", 3); 0 != a {
+		t.Fatal(a)
+	}
+	e := MustParseExpr("delta(n, \"m1\") + hist(n, \"m1\", 3) + avg(n, \"m1\", 2) + rate(n, \"m1\") * 60")
+	if v := e.Eval(g); 10+30+45+20 != v {
+		t.Fatal(v)
+	}
+}
+
+func TestDataMapRateMidPeriod(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	g := GetOrRegisterDataMap("dm", r, &DataMapOption{
+		Interval: time.Minute,
+		Periods:  map[string]time.Duration{"m5": M5},
+	})
+	// 10 per second for 6 minutes, 60 seconds into the second period
+	for s := int64(1); s <= 360; s++ {
+		clock.Add(time.Second)
+		g.UpdateInt64("n", 10*s)
+		if 0 == s%60 {
+			g.Snapshot(r)
+		}
+	}
+	if r := g.Rate("n", "m5"); math.Abs(r-10) > 0.5 {
+		t.Fatal(r)
+	}
+
+	// right at the boundary nothing has changed yet
+	clock.Add(4 * time.Minute)
+	g.Snapshot(r)
+	if r := g.Rate("n", "m5"); 0 != r {
+		t.Fatal(r)
+	}
+}
+
+func TestDataMapHistoryState(t *testing.T) {
+	g := newHistoryDataMap(3)
+	state := g.State()
+	if 3 != len(state.Rings["m1"]) {
+		t.Fatal(state.Rings)
+	}
+
+	restored := NewDataMap("dm", &DataMapOption{
+		Periods:      map[string]time.Duration{"m1": M1},
+		HistoryDepth: 2,
+	})
+	restored.Restore(state)
+	if v, ok := restored.HistoryN("n", "m1", 2); !ok || int64(40) != v {
+		t.Fatal(v, ok)
+	}
+	if _, ok := restored.HistoryN("n", "m1", 3); ok {
+		t.Fatal("restored history deeper than configured")
+	}
+
+	// a state without rings starts the history with the last values
+	state.Rings = nil
+	restored.Restore(state)
+	if v, ok := restored.HistoryN("n", "m1", 1); !ok || int64(50) != v {
+		t.Fatal(v, ok)
+	}
+}
+
+func TestDataMapView(t *testing.T) {
+	g := newHistoryDataMap(3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int64(0); i < 100; i++ {
+			g.UpdateInt64("n", 60+i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		g.View(func(v DataMapView) {
+			if n := v.ValueInt64("n"); n < 60 {
+				t.Fatal(n)
+			}
+			if h, ok := v.HistoryN("n", "m1", 2); !ok || int64(40) != h {
+				t.Fatal(h, ok)
+			}
+			if f := v.ValueFloat64("n"); f < 60 {
+				t.Fatal(f)
+			}
+		})
+	}
+	<-done
+	if n := g.ValueInt64("missing"); 0 != n {
+		t.Fatal(n)
+	}
+}
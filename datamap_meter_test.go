@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDataMapMeterTypes(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	g := GetOrRegisterDataMap("dm", r, &DataMapOption{
+		Interval: time.Minute,
+		Periods:  map[string]time.Duration{"m5": M5},
+		KeyTypes: map[string]reflect.Type{
+			"requests": counterType,
+			"inflight": gaugeType,
+			"load":     gaugeFloat64Type,
+			"size":     histogramType,
+			"events":   meterType,
+			"latency":  timerType,
+			"online":   periodCounterType,
+		},
+		DependentVars: map[string]*DependentVar{
+			"errors": {Func: "requests - ok", Typ: counterType, Period: time.Minute},
+		},
+	})
+	update := func(n int64) {
+		for _, k := range []string{"requests", "inflight", "size", "events", "latency", "online"} {
+			g.UpdateInt64(k, n)
+		}
+		g.UpdateInt64("ok", n/2)
+		g.UpdateFloat64("load", float64(n)/4)
+		clock.Add(time.Minute)
+		g.Snapshot(r)
+	}
+	update(10)
+	update(30)
+	update(20) // reset of the source
+
+	if c := r.Get("dm-requests").(Counter).Count(); 50 != c {
+		t.Fatal(c)
+	}
+	if c := r.Get("dm-errors").(Counter).Count(); 25 != c {
+		t.Fatal(c)
+	}
+	if v := r.Get("dm-inflight").(Gauge).Value(); 20 != v {
+		t.Fatal(v)
+	}
+	if v := r.Get("dm-load").(GaugeFloat64).Value(); 5 != v {
+		t.Fatal(v)
+	}
+	if h := r.Get("dm-size").(Histogram); 3 != h.Count() || 30 != h.Max() {
+		t.Fatal(h.Count(), h.Max())
+	}
+	if c := r.Get("dm-events").(Meter).Count(); 50 != c {
+		t.Fatal(c)
+	}
+	if tm := r.Get("dm-latency").(Timer); 3 != tm.Count() || 10 != tm.Min() {
+		t.Fatal(tm.Count(), tm.Min())
+	}
+	if c := r.Get("dm-online").(PeriodCounter).Count(); 50 != c {
+		t.Fatal(c)
+	}
+	r.Unregister("dm-events")
+	r.Unregister("dm-latency")
+}
+
+func TestDataMapUnsupportedMeterType(t *testing.T) {
+	opt := &DataMapOption{
+		KeyTypes: map[string]reflect.Type{"foo": reflect.TypeOf(&StandardHealthcheck{})},
+	}
+	err := opt.Validate()
+	if e, ok := err.(UnsupportedMeterType); !ok || "foo" != e.Key {
+		t.Fatal(err)
+	}
+
+	var errs []error
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	g := GetOrRegisterDataMap("dm", r, &DataMapOption{
+		Interval: time.Minute,
+		OnError:  func(err error) { errs = append(errs, err) },
+	})
+	g.SetKeyType("foo", reflect.TypeOf(&StandardHealthcheck{}), false)
+	g.UpdateInt64("foo", 1)
+	clock.Add(time.Minute)
+	if ms := g.Snapshot(r); 0 != len(ms) {
+		t.Fatal(ms)
+	}
+	if 1 != len(errs) {
+		t.Fatal(errs)
+	}
+	if _, ok := errs[0].(UnsupportedMeterType); !ok {
+		t.Fatal(errs[0])
+	}
+}
@@ -1,47 +1,22 @@
 package metrics
 
 import (
-	"fmt"
 	"reflect"
 	"testing"
 	"time"
-
-	"github.com/guotie/assert"
 )
 
 func TestZDataMap(t *testing.T) {
-	intHistoryFn := func(k string, p string) (fn func(DataMap) int64) {
-		return func(g DataMap) int64 {
-			vc := g.ValueInt64(k)
-			vs5, ok := g.ValueHistory(k, p)
-			if !ok {
-				fmt.Printf("Not found history value: key=%s period=%s\n",
-					k, p)
-				return vc
-			}
-			//fmt.Printf("key=%s period=%s vc=%d vp=%v\n",
-			//	k, p, vc, vs5)
-			return vc - vs5.(int64)
-		}
+	// value(k, curr) - value(k, p)
+	deltaExpr := func(k, p string) string {
+		return k + ` - hist(` + k + `, "` + p + `")`
 	}
-
 	// ( value(k1, curr) - value(k1, p) ) / ( value(k2, curr) - value(k2, p) )
-	rateFn := func(k1, k2, p string) func(DataMap) float64 {
-		return func(g DataMap) float64 {
-			k1c := g.ValueInt64(k1)
-			k1p, ok := g.ValueHistory(k1, p)
-			if !ok {
-				k1p = int64(0)
-			}
-
-			k2c := g.ValueInt64(k2)
-			k2p, ok := g.ValueHistory(k2, p)
-			if !ok {
-				k2p = int64(0)
-			}
-
-			return float64(k1c-k1p.(int64)) / float64(k2c-k2p.(int64))
-		}
+	rateExpr := func(k1, k2, p string) string {
+		return "(" + deltaExpr(k1, p) + ") / (" + deltaExpr(k2, p) + ")"
+	}
+	dependent := func(expr string, typ reflect.Type) *DependentVar {
+		return &DependentVar{Func: expr, Typ: typ, Period: time.Second * 2}
 	}
 
 	opt := &DataMapOption{
@@ -52,66 +27,62 @@ func TestZDataMap(t *testing.T) {
 			MS1:   M1,
 		},
 
-		DependentFuncs: map[string]interface{}{
-			"pdponline-s5":    intHistoryFn("pdponline", "s5"),
-			"pdptimeout-s5":   intHistoryFn("pdptimeout", "s5"),
-			"timeout_rate-s5": rateFn("pdptimeout", "pdponline", "s5"),
-
-			"pdponline-s10":    intHistoryFn("pdponline", "s10"),
-			"pdptimeout-s10":   intHistoryFn("pdptimeout", "s10"),
-			"timeout_rate-s10": rateFn("pdptimeout", "pdponline", "s10"),
-		},
-
 		KeyTypes: map[string]reflect.Type{
-			"pdponline": reflect.TypeOf(&StandardCounter{}),
+			"pdponline": condIntType,
 		},
-		DepenentTypes: map[string]reflect.Type{
+		DependentVars: map[string]*DependentVar{
 			// 5秒钟的变化量
-			"pdponline-s5":    reflect.TypeOf(&StandardCounter{}),
-			"pdptimeout-s5":   reflect.TypeOf(&StandardGauge{}),
-			"timeout_rate-s5": reflect.TypeOf(&StandardGaugeFloat64{}),
+			"pdponline-s5":    dependent(deltaExpr("pdponline", "s5"), condIntType),
+			"pdptimeout-s5":   dependent(deltaExpr("pdptimeout", "s5"), condIntType),
+			"timeout_rate-s5": dependent(rateExpr("pdptimeout", "pdponline", "s5"), condFloatType),
 
 			// 10秒变化量
-			"pdponline-s10":    reflect.TypeOf(&StandardCounter{}),
-			"pdptimeout-s10":   reflect.TypeOf(&StandardGauge{}),
-			"timeout_rate-s10": reflect.TypeOf(&StandardGaugeFloat64{}),
+			"pdponline-s10":    dependent(deltaExpr("pdponline", "s10"), condIntType),
+			"pdptimeout-s10":   dependent(deltaExpr("pdptimeout", "s10"), condIntType),
+			"timeout_rate-s10": dependent(rateExpr("pdptimeout", "pdponline", "s10"), condFloatType),
 		},
 	}
 
-	dm := GetOrRegisterDataMap("pdpdata", nil, opt)
-
-	ms := dm.Snapshot(DefaultRegistry)
-	assert.Assert(ms == nil, "Snapshot should be nil on first call")
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	dm := GetOrRegisterDataMap("pdpdata", r, opt)
 
-	dm = GetOrRegisterDataMap("pdpdata", nil, opt)
+	if ms := dm.Snapshot(r); nil != ms {
+		t.Fatal("Snapshot should be nil on first call", ms)
+	}
+	if dm != GetOrRegisterDataMap("pdpdata", r, opt) {
+		t.Fatal("DataMap not registered")
+	}
 
 	for i := 0; i < 40; i++ {
 		dm.UpdateInt64("pdponline", int64(i*12))
 		dm.UpdateInt64("pdptimeout", int64(i*4))
+		clock.Add(time.Second)
 
-		ms = dm.Snapshot(DefaultRegistry)
-		if i%2 != 0 || i == 0 {
-			assert.Assert(ms == nil, "snapshot should be nil because of interval too short")
-		} else {
-			assert.Assert(ms != nil, "snapshot should not be nil")
-			for _, m := range ms {
-				printMeter(m)
+		ms := dm.Snapshot(r)
+		if i%2 == 0 {
+			if nil != ms {
+				t.Fatal(i, "snapshot should be nil because of interval too short", ms)
 			}
+		} else if 7 != len(ms) {
+			t.Fatal(i, "snapshot should return every meter", ms)
 		}
-		fmt.Println(time.Now(), "i =", i, "----------------------------------------------")
-		time.Sleep(time.Second)
 	}
-}
-
-// print meter
-func printMeter(m interface{}) {
 
-	switch m.(type) {
-	case Counter:
-		fmt.Printf("Counter: %d\n", m.(Counter).Count())
-	case Gauge:
-		fmt.Printf("Gauge: %d\n", m.(Gauge).Value())
-	case GaugeFloat64:
-		fmt.Printf("GaugeFloat64: %f\n", m.(GaugeFloat64).Value())
+	for name, want := range map[string]int64{
+		"pdpdata-pdponline":      39 * 12,
+		"pdpdata-pdponline-s5":   4 * 12,
+		"pdpdata-pdptimeout-s5":  4 * 4,
+		"pdpdata-pdponline-s10":  8 * 12,
+		"pdpdata-pdptimeout-s10": 8 * 4,
+	} {
+		if v := r.Get(name).(CondInt).Value(); want != v {
+			t.Error(name, v)
+		}
+	}
+	for _, name := range []string{"pdpdata-timeout_rate-s5", "pdpdata-timeout_rate-s10"} {
+		if v := r.Get(name).(CondFloat).Value(); 1.0/3 != v {
+			t.Error(name, v)
+		}
 	}
 }
@@ -0,0 +1,478 @@
+//go:build go1.18
+// +build go1.18
+
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TypedDataMapOption options of a TypedDataMap, see DataMapOption
+type TypedDataMapOption[K ~string, V int64 | float64] struct {
+	Interval      time.Duration
+	Periods       map[string]time.Duration
+	HistoryDepth  int               // 每个 period 保存的历史值个数, 默认 1
+	KeyKinds      map[K]DataMapKind // 自变量的 meter kind
+	KeyPeriod     time.Duration     // 自变量入库间隔
+	DependentVars map[K]TypedDependentVar[K, V]
+	Clock         Clock       // 时钟, nil 时使用 registry 的时钟或 DefaultClock
+	OnError       func(error) // snapshot 时生成 meter 出错时调用, 可以为 nil
+}
+
+// TypedDependentVar dependent var of a TypedDataMap, see DependentVar
+type TypedDependentVar[K ~string, V int64 | float64] struct {
+	Func   func(TypedDataMapView[K, V]) V // 计算规则
+	Kind   DataMapKind
+	Period time.Duration
+}
+
+// Validate checks the meter kinds of the keys and the dependent variables of
+// the option and returns the first invalid one as an error.
+func (opt *TypedDataMapOption[K, V]) Validate() error {
+	for k, kind := range opt.KeyKinds {
+		if kind < DataMapCondInt || kind > DataMapPeriodCounter {
+			return UnsupportedMeterType{Key: string(k), Kind: kind}
+		}
+	}
+	for k, v := range opt.DependentVars {
+		if nil == v.Func {
+			return fmt.Errorf("dependent var %s: nil func", string(k))
+		}
+		if v.Kind < DataMapCondInt || v.Kind > DataMapPeriodCounter {
+			return UnsupportedMeterType{Key: string(k), Kind: v.Kind}
+		}
+	}
+	return nil
+}
+
+// GetOrRegisterTypedDataMap returns an existing TypedDataMap or constructs and
+// registers a new one.
+func GetOrRegisterTypedDataMap[K ~string, V int64 | float64](name string, r Registry, opt *TypedDataMapOption[K, V]) *TypedDataMap[K, V] {
+	if nil == r {
+		r = DefaultRegistry
+	}
+
+	c := registryClock(r)
+	return r.GetOrRegister(name, func() *TypedDataMap[K, V] {
+		return newTypedDataMap(name, opt, c)
+	}, nil).(*TypedDataMap[K, V])
+}
+
+// NewTypedDataMap constructs a new TypedDataMap.
+func NewTypedDataMap[K ~string, V int64 | float64](prefix string, opt *TypedDataMapOption[K, V]) *TypedDataMap[K, V] {
+	return newTypedDataMap(prefix, opt, DefaultClock)
+}
+
+// NewRegisteredTypedDataMap constructs and registers a new TypedDataMap.
+func NewRegisteredTypedDataMap[K ~string, V int64 | float64](name string, r Registry, opt *TypedDataMapOption[K, V]) *TypedDataMap[K, V] {
+	c := NewTypedDataMap(name, opt)
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, c)
+	return c
+}
+
+func newTypedDataMap[K ~string, V int64 | float64](prefix string, opt *TypedDataMapOption[K, V], c Clock) *TypedDataMap[K, V] {
+	if opt == nil {
+		panic("NewTypedDataMap: param opt should NOT be nil")
+	}
+	if err := opt.Validate(); err != nil {
+		panic("NewTypedDataMap: " + err.Error())
+	}
+	if opt.Clock != nil {
+		c = opt.Clock
+	}
+
+	m := &TypedDataMap[K, V]{
+		clock:          c,
+		minInterval:    60,
+		latestSnapshot: c.Now().Unix(),
+		prefix:         prefix,
+		values:         make(map[K]V),
+		history:        make(map[string][]map[K]V),
+		historyDepth:   1,
+		periods:        make(map[string]time.Duration),
+		nextTs:         make(map[string]int64),
+		kinds:          make(map[K]DataMapKind),
+		dependentVars:  make(map[K]*typedDependentVar[K, V]),
+		lastCounts:     make(map[K]int64),
+		onError:        opt.OnError,
+	}
+	if opt.Interval != 0 {
+		m.minInterval = int64(opt.Interval / time.Second)
+	}
+	if opt.HistoryDepth > 1 {
+		m.historyDepth = opt.HistoryDepth
+	}
+	if opt.KeyPeriod != 0 {
+		m.keyPeriod = opt.KeyPeriod
+	} else {
+		m.keyPeriod = opt.Interval
+	}
+
+	m.SetPeriods(opt.Periods)
+	for k, kind := range opt.KeyKinds {
+		m.SetKeyKind(k, kind)
+	}
+	for k, v := range opt.DependentVars {
+		m.SetDependentVar(k, v.Func, v.Kind, v.Period)
+	}
+	return m
+}
+
+// TypedDataMap is a DataMap whose keys are of type K and whose values are
+// all of type V, without the boxing of the values of a StandardDataMap in
+// interface{} and with DataMapKinds in place of reflect.Types.  Every method
+// takes the lock, and the dependent variables read the values through a
+// TypedDataMapView.
+type TypedDataMap[K ~string, V int64 | float64] struct {
+	mutex sync.RWMutex
+	clock Clock
+
+	minInterval    int64 // 最小间隔
+	latestSnapshot int64
+
+	prefix string // 加在产生的meter前作为前缀
+
+	values       map[K]V              // 当前值
+	history      map[string][]map[K]V // 每个 period 最近 historyDepth 个历史值, 最旧的在前
+	historyDepth int
+
+	kinds         map[K]DataMapKind
+	keyPeriod     time.Duration
+	dependentVars map[K]*typedDependentVar[K, V] // 因变量
+
+	periods map[string]time.Duration
+	nextTs  map[string]int64 // period下次入库的timestamp(second)
+
+	lastCounts map[K]int64 // counter, meter 和 PeriodCounter 上次的值, 用来计算增量
+	onError    func(error)
+}
+
+type typedDependentVar[K ~string, V int64 | float64] struct {
+	TypedDependentVar[K, V]
+	lastSnap time.Time // 上次snapshot时间
+}
+
+// Prefix prefix of datamap
+func (m *TypedDataMap[K, V]) Prefix() string {
+	return m.prefix
+}
+
+// Update sets the value of key.
+func (m *TypedDataMap[K, V]) Update(key K, v V) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[key] = v
+}
+
+// Value returns the value of key, 0 if it has none.
+func (m *TypedDataMap[K, V]) Value(key K) V {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.values[key]
+}
+
+// Values returns a copy of the current values of all keys.
+func (m *TypedDataMap[K, V]) Values() map[K]V {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	values := make(map[K]V, len(m.values))
+	for k, v := range m.values {
+		values[k] = v
+	}
+	return values
+}
+
+// View calls f with a view of the values under the read lock.  The view is
+// only valid during the call.
+func (m *TypedDataMap[K, V]) View(f func(TypedDataMapView[K, V])) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	f(TypedDataMapView[K, V]{m})
+}
+
+// Keys return keys
+func (m *TypedDataMap[K, V]) Keys() []K {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return TypedDataMapView[K, V]{m}.Keys()
+}
+
+// Periods return periods
+func (m *TypedDataMap[K, V]) Periods() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ps := make([]string, 0, len(m.periods))
+	for p := range m.periods {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// SetPeriods set periods
+func (m *TypedDataMap[K, V]) SetPeriods(periods map[string]time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.clock.Now()
+	for p, du := range periods {
+		if du == 0 {
+			panic("SetPeriods: invalid duration: 0")
+		}
+		if _, ok := m.periods[p]; ok {
+			continue
+		}
+		m.periods[p] = du
+		m.nextTs[p] = nextPeriodTs(du, now)
+	}
+}
+
+// SetKeyKind sets the kind of the meter driven by key.
+func (m *TypedDataMap[K, V]) SetKeyKind(key K, kind DataMapKind) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.kinds[key] = kind
+}
+
+// SetDependentVar sets a dependent variable computed by fn.
+func (m *TypedDataMap[K, V]) SetDependentVar(key K, fn func(TypedDataMapView[K, V]) V, kind DataMapKind, period time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dependentVars[key] = &typedDependentVar[K, V]{
+		TypedDependentVar: TypedDependentVar[K, V]{Func: fn, Kind: kind, Period: period},
+		lastSnap:          m.clock.Now(),
+	}
+}
+
+// Snapshot updates the meters of the keys and of the dependent variables due,
+// like StandardDataMap.Snapshot, and returns them.
+func (m *TypedDataMap[K, V]) Snapshot(r Registry) []interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ts := m.clock.Now().Unix()
+	if ts-m.latestSnapshot < m.minInterval {
+		return nil
+	}
+	m.latestSnapshot = ts
+
+	var meters []interface{}
+	for k, kind := range m.kinds {
+		v, ok := m.values[k]
+		if !ok {
+			continue
+		}
+		m.appendMeter(&meters, r, k, kind, v, m.keyPeriod)
+	}
+	now := m.clock.Now()
+	view := TypedDataMapView[K, V]{m}
+	for k, dv := range m.dependentVars {
+		if now.Sub(dv.lastSnap) >= dv.Period {
+			dv.lastSnap = now
+			m.appendMeter(&meters, r, k, dv.Kind, dv.Func(view), dv.Period)
+		}
+	}
+
+	m.updateHistory()
+	return meters
+}
+
+// appendMeter 生成 meter 并添加到 meters, 出错时调用 onError
+// caller lock
+func (m *TypedDataMap[K, V]) appendMeter(meters *[]interface{}, r Registry, key K, kind DataMapKind, v V, period time.Duration) {
+	delta := func(v int64) int64 {
+		last, ok := m.lastCounts[key]
+		m.lastCounts[key] = v
+		if !ok || v < last {
+			return v
+		}
+		return v - last
+	}
+	meter, err := updateDataMapMeter(r, m.prefix+"-"+string(key), kind, int64(v), float64(v), delta, period, m.periods)
+	if err != nil {
+		if m.onError != nil {
+			m.onError(err)
+		}
+		return
+	}
+	*meters = append(*meters, meter)
+}
+
+// updateHistory 更新历史数据
+// caller lock
+func (m *TypedDataMap[K, V]) updateHistory() {
+	ts := m.clock.Now().Unix()
+	for p, nts := range m.nextTs {
+		if ts < nts {
+			continue
+		}
+		point := make(map[K]V, len(m.values))
+		if ring := m.history[p]; 0 != len(ring) {
+			for k, v := range ring[len(ring)-1] {
+				point[k] = v
+			}
+		}
+		for k, v := range m.values {
+			point[k] = v
+		}
+		m.pushHistory(p, point)
+		m.nextTs[p] += int64(m.periods[p] / time.Second)
+	}
+}
+
+// pushHistory 把 point 加入 period 的历史值环, 只保留最近 historyDepth 个
+// caller lock
+func (m *TypedDataMap[K, V]) pushHistory(p string, point map[K]V) {
+	ring := append(m.history[p], point)
+	if len(ring) > m.historyDepth {
+		ring = append(ring[:0], ring[len(ring)-m.historyDepth:]...)
+	}
+	m.history[p] = ring
+}
+
+// State returns a copy of the current and the historical values.
+func (m *TypedDataMap[K, V]) State() DataMapState {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	box := func(values map[K]V) map[string]interface{} {
+		boxed := make(map[string]interface{}, len(values))
+		for k, v := range values {
+			boxed[string(k)] = v
+		}
+		return boxed
+	}
+	state := DataMapState{
+		Values:  box(m.values),
+		History: make(map[string]map[string]interface{}, len(m.history)),
+		Rings:   make(map[string][]map[string]interface{}, len(m.history)),
+	}
+	for p, ring := range m.history {
+		if 0 == len(ring) {
+			continue
+		}
+		state.History[p] = box(ring[len(ring)-1])
+		state.Rings[p] = make([]map[string]interface{}, len(ring))
+		for i, point := range ring {
+			state.Rings[p][i] = box(point)
+		}
+	}
+	return state
+}
+
+// Restore replaces the current and the historical values with those of
+// state, converting them to V.  The history of a period without a ring in
+// state starts with its last value.
+func (m *TypedDataMap[K, V]) Restore(state DataMapState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	unbox := func(boxed map[string]interface{}) map[K]V {
+		values := make(map[K]V, len(boxed))
+		for k, v := range boxed {
+			switch v := v.(type) {
+			case int64:
+				values[K(k)] = V(v)
+			case float64:
+				values[K(k)] = V(v)
+			}
+		}
+		return values
+	}
+	m.values = unbox(state.Values)
+	m.history = make(map[string][]map[K]V, len(state.History))
+	for p, ring := range state.Rings {
+		for _, point := range ring {
+			m.pushHistory(p, unbox(point))
+		}
+	}
+	for p, his := range state.History {
+		if _, ok := m.history[p]; !ok {
+			m.pushHistory(p, unbox(his))
+		}
+	}
+}
+
+// TypedDataMapView reads the values of a TypedDataMap without taking its
+// lock: it is passed to the functions of the dependent variables, which are
+// called with the lock held, and by View.  It is only valid during the call.
+type TypedDataMapView[K ~string, V int64 | float64] struct {
+	m *TypedDataMap[K, V]
+}
+
+// Value returns the value of key, 0 if it has none.
+func (v TypedDataMapView[K, V]) Value(key K) V {
+	return v.m.values[key]
+}
+
+// ValueHistory returns the value of key at the last boundary of the period.
+func (v TypedDataMapView[K, V]) ValueHistory(key K, period string) (V, bool) {
+	return v.HistoryN(key, period, 1)
+}
+
+// HistoryN returns the value of key n boundaries of the period ago, 1 being
+// the last boundary.
+func (v TypedDataMapView[K, V]) HistoryN(key K, period string, n int) (V, bool) {
+	ring := v.m.history[period]
+	if n < 1 || n > len(ring) {
+		return 0, false
+	}
+	value, ok := ring[len(ring)-n][key]
+	return value, ok
+}
+
+// Delta returns the difference between the value of key and its value at
+// the last boundary of the period, 0 without history.
+func (v TypedDataMapView[K, V]) Delta(key K, period string) V {
+	his, ok := v.HistoryN(key, period, 1)
+	if !ok {
+		return 0
+	}
+	return v.m.values[key] - his
+}
+
+// Rate returns Delta per second since the last boundary of the period, 0
+// right at the boundary.
+func (v TypedDataMapView[K, V]) Rate(key K, period string) float64 {
+	du, ok := v.m.periods[period]
+	if !ok {
+		return 0
+	}
+	elapsed := sinceBoundary(v.m.clock.Now(), v.m.nextTs[period], du)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(v.Delta(key, period)) / elapsed
+}
+
+// Avg returns the average of the values of key at the last n boundaries of
+// the period, or at as many as are kept, 0 without history.
+func (v TypedDataMapView[K, V]) Avg(key K, period string, n int) float64 {
+	if ring := v.m.history[period]; n > len(ring) {
+		n = len(ring)
+	}
+	var sum float64
+	count := 0
+	for i := 1; i <= n; i++ {
+		if value, ok := v.HistoryN(key, period, i); ok {
+			sum += float64(value)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// Keys returns the keys with a value.
+func (v TypedDataMapView[K, V]) Keys() []K {
+	keys := make([]K, 0, len(v.m.values))
+	for k := range v.m.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
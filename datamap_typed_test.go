@@ -0,0 +1,106 @@
+//go:build go1.18
+// +build go1.18
+
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type typedKey string
+
+func TestTypedDataMap(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	opt := &TypedDataMapOption[typedKey, int64]{
+		Interval:     time.Minute,
+		Periods:      map[string]time.Duration{"m1": M1},
+		HistoryDepth: 3,
+		KeyKinds:     map[typedKey]DataMapKind{"requests": DataMapCounter},
+		DependentVars: map[typedKey]TypedDependentVar[typedKey, int64]{
+			"ok": {
+				Func: func(v TypedDataMapView[typedKey, int64]) int64 {
+					return v.Value("requests") - v.Value("errors")
+				},
+				Kind:   DataMapGauge,
+				Period: time.Minute,
+			},
+		},
+	}
+	g := GetOrRegisterTypedDataMap("dm", r, opt)
+	if g != GetOrRegisterTypedDataMap("dm", r, opt) {
+		t.Fatal("not registered")
+	}
+	for i := int64(1); i <= 4; i++ {
+		g.Update("requests", 10*i)
+		g.Update("errors", i)
+		clock.Add(time.Minute)
+		g.Snapshot(r)
+	}
+
+	if c := r.Get("dm-requests").(Counter).Count(); 40 != c {
+		t.Fatal(c)
+	}
+	if v := r.Get("dm-ok").(Gauge).Value(); 36 != v {
+		t.Fatal(v)
+	}
+	g.Update("requests", 50)
+	g.View(func(v TypedDataMapView[typedKey, int64]) {
+		if h, ok := v.HistoryN("requests", "m1", 3); !ok || 20 != h {
+			t.Fatal(h, ok)
+		}
+		if d := v.Delta("requests", "m1"); 10 != d {
+			t.Fatal(d)
+		}
+		if a := v.Avg("requests", "m1", 2); 35 != a {
+			t.Fatal(a)
+		}
+	})
+
+	restored := NewTypedDataMap[typedKey, float64]("dm", &TypedDataMapOption[typedKey, float64]{
+		Periods:      map[string]time.Duration{"m1": M1},
+		HistoryDepth: 2,
+	})
+	restored.Restore(g.State())
+	if v := restored.Value("requests"); 50 != v {
+		t.Fatal(v)
+	}
+	restored.View(func(v TypedDataMapView[typedKey, float64]) {
+		if h, ok := v.HistoryN("requests", "m1", 2); !ok || 30 != h {
+			t.Fatal(h, ok)
+		}
+	})
+}
+
+func TestTypedDataMapRateMidPeriod(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	g := GetOrRegisterTypedDataMap("dm", r, &TypedDataMapOption[typedKey, int64]{
+		Interval: time.Minute,
+		Periods:  map[string]time.Duration{"m5": M5},
+	})
+	// 10 per second for 6 minutes, 60 seconds into the second period
+	for s := int64(1); s <= 360; s++ {
+		clock.Add(time.Second)
+		g.Update("n", 10*s)
+		if 0 == s%60 {
+			g.Snapshot(r)
+		}
+	}
+	g.View(func(v TypedDataMapView[typedKey, int64]) {
+		if r := v.Rate("n", "m5"); math.Abs(r-10) > 0.5 {
+			t.Fatal(r)
+		}
+	})
+}
+
+func TestTypedDataMapInvalidKind(t *testing.T) {
+	opt := &TypedDataMapOption[string, float64]{
+		KeyKinds: map[string]DataMapKind{"foo": 0},
+	}
+	if err, ok := opt.Validate().(UnsupportedMeterType); !ok || "foo" != err.Key {
+		t.Fatal(err)
+	}
+}
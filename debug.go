@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"context"
 	"runtime/debug"
 	"time"
 )
@@ -27,6 +28,16 @@ func CaptureDebugGCStats(r Registry, d time.Duration) {
 	}
 }
 
+// Capture new values for the Go garbage collector statistics exported in
+// debug.GCStats until ctx is done, capturing them one last time before
+// returning.  An InvalidInterval is passed to onError.
+func CaptureDebugGCStatsWithContext(ctx context.Context, r Registry, d time.Duration, onError func(error)) {
+	ReportLoop(ctx, d, func() error {
+		CaptureDebugGCStatsOnce(r)
+		return nil
+	}, onError)
+}
+
 // Capture new values for the Go garbage collector statistics exported in
 // debug.GCStats.  This is designed to be called in a background goroutine.
 // Giving a registry which has not been given to RegisterDebugGCStats will
@@ -67,6 +78,10 @@ func RegisterDebugGCStats(r Registry) {
 	//r.Register("debug.GCStats.PauseQuantiles", debugMetrics.GCStats.PauseQuantiles)
 	r.Register("debug.GCStats.PauseTotal", debugMetrics.GCStats.PauseTotal)
 	r.Register("debug.ReadGCStats", debugMetrics.ReadGCStats)
+
+	for _, name := range []string{"debug.GCStats.LastGC", "debug.GCStats.Pause", "debug.GCStats.PauseTotal", "debug.ReadGCStats"} {
+		r.SetMeta(name, Metadata{Unit: "ns"})
+	}
 }
 
 // Allocate an initial slice for gcStats.Pause to avoid allocations during
@@ -4,6 +4,7 @@ import (
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // EWMAs continuously calculate an exponentially-weighted moving average
@@ -15,7 +16,8 @@ type EWMA interface {
 	Update(int64)
 }
 
-// NewEWMA constructs a new EWMA with the given alpha.
+// NewEWMA constructs a new EWMA with the given alpha which is ticked every
+// five seconds.
 func NewEWMA(alpha float64) EWMA {
 	if UseNilMetrics {
 		return NilEWMA{}
@@ -23,6 +25,15 @@ func NewEWMA(alpha float64) EWMA {
 	return &StandardEWMA{alpha: alpha}
 }
 
+// NewEWMAWithInterval constructs a new EWMA for a moving average over the
+// given number of minutes which is ticked every interval.
+func NewEWMAWithInterval(minutes float64, interval time.Duration) EWMA {
+	if UseNilMetrics {
+		return NilEWMA{}
+	}
+	return &StandardEWMA{alpha: 1 - math.Exp(-interval.Minutes()/minutes), interval: interval}
+}
+
 // NewEWMA1 constructs a new EWMA for a one-minute moving average.
 func NewEWMA1() EWMA {
 	return NewEWMA(1 - math.Exp(-5.0/60.0/1))
@@ -81,6 +92,7 @@ type StandardEWMA struct {
 	alpha     float64
 	rate      float64
 	init      bool
+	interval  time.Duration // between ticks, five seconds if zero
 	mutex     sync.Mutex
 }
 
@@ -97,13 +109,13 @@ func (a *StandardEWMA) Snapshot() EWMA {
 }
 
 // Tick ticks the clock to update the moving average.  It assumes it is called
-// every five seconds.
+// every interval given to NewEWMAWithInterval, or every five seconds.
 func (a *StandardEWMA) Tick() {
 	count := atomic.LoadInt64(&a.uncounted)
 	atomic.AddInt64(&a.uncounted, -count)
-	instantRate := float64(count) / float64(5e9)
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
+	instantRate := float64(count) / float64(a.tickInterval())
 	if a.init {
 		a.rate += a.alpha * (instantRate - a.rate)
 	} else {
@@ -116,3 +128,20 @@ func (a *StandardEWMA) Tick() {
 func (a *StandardEWMA) Update(n int64) {
 	atomic.AddInt64(&a.uncounted, n)
 }
+
+func (a *StandardEWMA) tickInterval() time.Duration {
+	if a.interval <= 0 {
+		return 5 * time.Second
+	}
+	return a.interval
+}
+
+// setInterval changes the interval between ticks, adjusting alpha so that
+// the moving average keeps its time window.
+func (a *StandardEWMA) setInterval(interval time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ratio := float64(interval) / float64(a.tickInterval())
+	a.alpha = 1 - math.Pow(1-a.alpha, ratio)
+	a.interval = interval
+}
@@ -1,6 +1,10 @@
 package metrics
 
-import "testing"
+import (
+	"math"
+	"testing"
+	"time"
+)
 
 func BenchmarkEWMA(b *testing.B) {
 	a := NewEWMA1()
@@ -223,3 +227,19 @@ func elapseMinute(a EWMA) {
 		a.Tick()
 	}
 }
+
+func TestEWMAWithInterval(t *testing.T) {
+	a := NewEWMAWithInterval(1, time.Second)
+	a.Update(3)
+	a.Tick()
+	if rate := a.Rate(); 3 != rate {
+		t.Errorf("initial a.Rate(): 3 != %v\n", rate)
+	}
+	for i := 0; i < 60; i++ {
+		a.Tick()
+	}
+	// the same decay as NewEWMA1 over a minute
+	if rate := a.Rate(); math.Abs(rate-3*0.22072766470286553/0.6) > 1e-9 {
+		t.Errorf("1 minute a.Rate(): %v != %v\n", 3*0.22072766470286553/0.6, rate)
+	}
+}
@@ -78,79 +78,47 @@ func (exp *exp) getFloat(name string) *expvar.Float {
 	return v
 }
 
-func (exp *exp) publishCounter(name string, metric metrics.Counter) {
-	v := exp.getInt(name)
-	v.Set(metric.Count())
-}
-
-func (exp *exp) publishGauge(name string, metric metrics.Gauge) {
-	v := exp.getInt(name)
-	v.Set(metric.Value())
-}
-func (exp *exp) publishGaugeFloat64(name string, metric metrics.GaugeFloat64) {
-	exp.getFloat(name).Set(metric.Value())
-}
-
-func (exp *exp) publishHistogram(name string, metric metrics.Histogram) {
-	h := metric.Snapshot()
-	ps := h.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-	exp.getInt(name + ".count").Set(h.Count())
-	exp.getFloat(name + ".min").Set(float64(h.Min()))
-	exp.getFloat(name + ".max").Set(float64(h.Max()))
-	exp.getFloat(name + ".mean").Set(float64(h.Mean()))
-	exp.getFloat(name + ".std-dev").Set(float64(h.StdDev()))
-	exp.getFloat(name + ".50-percentile").Set(float64(ps[0]))
-	exp.getFloat(name + ".75-percentile").Set(float64(ps[1]))
-	exp.getFloat(name + ".95-percentile").Set(float64(ps[2]))
-	exp.getFloat(name + ".99-percentile").Set(float64(ps[3]))
-	exp.getFloat(name + ".999-percentile").Set(float64(ps[4]))
-}
-
-func (exp *exp) publishMeter(name string, metric metrics.Meter) {
-	m := metric.Snapshot()
-	exp.getInt(name + ".count").Set(m.Count())
-	exp.getFloat(name + ".one-minute").Set(float64(m.Rate1()))
-	exp.getFloat(name + ".five-minute").Set(float64(m.Rate5()))
-	exp.getFloat(name + ".fifteen-minute").Set(float64((m.Rate15())))
-	exp.getFloat(name + ".mean").Set(float64(m.RateMean()))
+// publishMeta publishes the metadata of the metric with the given name under
+// name.meta unless it is published already.  The expvar reads the metadata
+// from the registry, so it stays up to date.
+func (exp *exp) publishMeta(name string) {
+	exp.expvarLock.Lock()
+	defer exp.expvarLock.Unlock()
+	if expvar.Get(name+".meta") != nil {
+		return
+	}
+	expvar.Publish(name+".meta", expvar.Func(func() interface{} {
+		meta, _ := metrics.MetaOf(exp.registry, name)
+		return meta
+	}))
 }
 
-func (exp *exp) publishTimer(name string, metric metrics.Timer) {
-	t := metric.Snapshot()
-	ps := t.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-	exp.getInt(name + ".count").Set(t.Count())
-	exp.getFloat(name + ".min").Set(float64(t.Min()))
-	exp.getFloat(name + ".max").Set(float64(t.Max()))
-	exp.getFloat(name + ".mean").Set(float64(t.Mean()))
-	exp.getFloat(name + ".std-dev").Set(float64(t.StdDev()))
-	exp.getFloat(name + ".50-percentile").Set(float64(ps[0]))
-	exp.getFloat(name + ".75-percentile").Set(float64(ps[1]))
-	exp.getFloat(name + ".95-percentile").Set(float64(ps[2]))
-	exp.getFloat(name + ".99-percentile").Set(float64(ps[3]))
-	exp.getFloat(name + ".999-percentile").Set(float64(ps[4]))
-	exp.getFloat(name + ".one-minute").Set(float64(t.Rate1()))
-	exp.getFloat(name + ".five-minute").Set(float64(t.Rate5()))
-	exp.getFloat(name + ".fifteen-minute").Set(float64((t.Rate15())))
-	exp.getFloat(name + ".mean-rate").Set(float64(t.RateMean()))
+// publish sets the expvar of every field of m.  A metric with a single field,
+// such as a counter or a gauge, is published under its own name and the
+// fields of other metrics under name.field.  The metadata of metrics
+// registered with some is published under name.meta.
+func (exp *exp) publish(m metrics.FlatMetric) {
+	if _, ok := metrics.MetaOf(exp.registry, m.Name); ok {
+		exp.publishMeta(m.Name)
+	}
+	name := m.Name + m.Labels.String()
+	for _, f := range m.Fields {
+		fieldName := name
+		if len(m.Fields) > 1 {
+			fieldName += "." + f.Name
+		}
+		switch v := f.Value.(type) {
+		case int64:
+			exp.getInt(fieldName).Set(v)
+		case float64:
+			exp.getFloat(fieldName).Set(v)
+		}
+	}
 }
 
+// syncToExpvar is called on every request, so it does not gate the
+// conditional metrics: a scrape would consume the write window the periodic
+// reporters rely on.
 func (exp *exp) syncToExpvar() {
-	exp.registry.Each(func(name string, i interface{}) {
-		switch i.(type) {
-		case metrics.Counter:
-			exp.publishCounter(name, i.(metrics.Counter))
-		case metrics.Gauge:
-			exp.publishGauge(name, i.(metrics.Gauge))
-		case metrics.GaugeFloat64:
-			exp.publishGaugeFloat64(name, i.(metrics.GaugeFloat64))
-		case metrics.Histogram:
-			exp.publishHistogram(name, i.(metrics.Histogram))
-		case metrics.Meter:
-			exp.publishMeter(name, i.(metrics.Meter))
-		case metrics.Timer:
-			exp.publishTimer(name, i.(metrics.Timer))
-		default:
-			panic(fmt.Sprintf("unsupported type for '%s': %T", name, i))
-		}
-	})
+	metrics.Flatten(exp.registry, metrics.FlattenOptions{}, exp.publish)
 }
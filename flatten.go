@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPercentiles are the percentiles of histograms and timers flattened
+// when FlattenOptions does not name any.
+var DefaultPercentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// Field is a single named numeric value of a flattened metric.
+type Field struct {
+	Name     string
+	Value    interface{} // int64 or float64
+	Duration bool        // Value is a duration in FlattenOptions.DurationUnit
+}
+
+// Float64 returns the value of the field as a float64.
+func (f Field) Float64() float64 {
+	switch v := f.Value.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// FlatMetric is a metric flattened into a list of named numeric fields.
+//
+// Field names follow the Graphite reporter: count, value, min, max, mean,
+// std-dev, 50-percentile, one-minute, five-minute, fifteen-minute, mean-rate
+// and so on; a BucketHistogram has count, sum and the cumulative count of
+// every bucket, such as le-25.  Type is one of counter, gauge, healthcheck,
+// histogram, buckethistogram, meter, timer or periodcounter, or the type of
+// a Metric or of a type added with RegisterMetricType.
+type FlatMetric struct {
+	Name   string
+	Labels Labels
+	Type   string
+	Fields []Field
+	Error  error // the error of a failed healthcheck
+}
+
+// FlattenOptions controls how metrics are flattened.
+type FlattenOptions struct {
+	Percentiles  []float64     // Percentiles of histograms and timers, DefaultPercentiles if nil
+	DurationUnit time.Duration // Unit of timer durations, nanoseconds if zero
+
+	// Gated makes the conditional metrics of this package (PeriodCounter,
+	// CondInt and CondFloat) be read through Snapshot, which consumes their
+	// write window, and skipped when the snapshot is not Writable.  Push
+	// reporters which write to a store set it; reporters which only show
+	// the current state leave it unset so they have no side effects.
+	Gated bool
+}
+
+// Flatten calls f with every metric registered in r, expanding labeled metric
+// families, flattened into fields.
+func Flatten(r Registry, opts FlattenOptions, f func(FlatMetric)) {
+	EachLabeled(r, func(name string, labels Labels, i interface{}) {
+		for _, m := range FlattenMetric(name, labels, i, opts) {
+			f(m)
+		}
+	})
+}
+
+// FlattenMetric flattens a single metric.  It usually returns one FlatMetric
+// but returns none for unknown types and gated metrics which are not
+// writable, and one gauge per key labeled with key=<key> for a DataMap.
+func FlattenMetric(name string, labels Labels, i interface{}, opts FlattenOptions) []FlatMetric {
+	ps := opts.Percentiles
+	if nil == ps {
+		ps = DefaultPercentiles
+	}
+	du := opts.DurationUnit
+	if du <= 0 {
+		du = time.Nanosecond
+	}
+
+	m := FlatMetric{Name: name, Labels: labels}
+	switch metric := i.(type) {
+	case Counter:
+		m.Type = "counter"
+		m.add("count", metric.Count())
+	case Gauge:
+		m.Type = "gauge"
+		m.add("value", metric.Value())
+	case GaugeFloat64:
+		m.Type = "gauge"
+		m.add("value", metric.Value())
+	case Healthcheck:
+		m.Type = "healthcheck"
+		metric.Check()
+		m.Error = metric.Error()
+	case Histogram:
+		h := metric.Snapshot()
+		m.Type = "histogram"
+		m.add("count", h.Count())
+		m.add("min", h.Min())
+		m.add("max", h.Max())
+		m.add("mean", h.Mean())
+		m.add("std-dev", h.StdDev())
+		for j, p := range h.Percentiles(ps) {
+			m.add(percentileFieldName(ps[j]), p)
+		}
+	case BucketHistogram:
+		h := metric.Snapshot()
+		m.Type = "buckethistogram"
+		m.add("count", h.Count())
+		m.add("sum", h.Sum())
+		counts := h.Counts()
+		for j, b := range h.Buckets() {
+			m.add(bucketFieldName(b), counts[j])
+		}
+	case Meter:
+		s := metric.Snapshot()
+		m.Type = "meter"
+		m.add("count", s.Count())
+		m.add("one-minute", s.Rate1())
+		m.add("five-minute", s.Rate5())
+		m.add("fifteen-minute", s.Rate15())
+		m.add("mean", s.RateMean())
+	case Timer:
+		t := metric.Snapshot()
+		m.Type = "timer"
+		m.add("count", t.Count())
+		if du == time.Nanosecond {
+			m.addDuration("min", t.Min())
+			m.addDuration("max", t.Max())
+		} else {
+			m.addDuration("min", float64(t.Min())/float64(du))
+			m.addDuration("max", float64(t.Max())/float64(du))
+		}
+		m.addDuration("mean", t.Mean()/float64(du))
+		m.addDuration("std-dev", t.StdDev()/float64(du))
+		for j, p := range t.Percentiles(ps) {
+			m.addDuration(percentileFieldName(ps[j]), p/float64(du))
+		}
+		m.add("one-minute", t.Rate1())
+		m.add("five-minute", t.Rate5())
+		m.add("fifteen-minute", t.Rate15())
+		m.add("mean-rate", t.RateMean())
+	case PeriodCounter:
+		m.Type = "periodcounter"
+		if !opts.Gated {
+			m.add("count", metric.Count())
+			break
+		}
+		s := metric.Snapshot()
+		if !s.Writable() {
+			return nil
+		}
+		m.add("count", s.Count())
+		periods := s.Periods()
+		sort.Strings(periods)
+		for _, p := range periods {
+			// periods which are not due yet report -1
+			if count, rate := s.LatestPeriodCountRate(p); count >= 0 {
+				m.add(p+"-count", count)
+				m.add(p+"-rate", rate)
+			}
+		}
+	case CondInt:
+		m.Type = "gauge"
+		if !opts.Gated {
+			m.add("value", metric.Value())
+			break
+		}
+		s := metric.Snapshot()
+		if !s.Writable() {
+			return nil
+		}
+		m.add("value", s.Value())
+	case CondFloat:
+		m.Type = "gauge"
+		if !opts.Gated {
+			m.add("value", metric.Value())
+			break
+		}
+		s := metric.Snapshot()
+		if !s.Writable() {
+			return nil
+		}
+		m.add("value", s.Value())
+	case dataMapState:
+		values := metric.State().Values
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ms := make([]FlatMetric, 0, len(keys))
+		for _, k := range keys {
+			km := FlatMetric{
+				Name:   name,
+				Labels: append(append(Labels(nil), labels...), Label{"key", k}),
+				Type:   "gauge",
+			}
+			km.add("value", values[k])
+			ms = append(ms, km)
+		}
+		return ms
+	case Metric:
+		m.Type = metric.MetricType()
+		m.Fields = metric.Fields()
+	default:
+		t, ok := lookupMetricType(i)
+		if !ok {
+			return nil
+		}
+		m.Type = t.name
+		m.Fields = t.flatten(i)
+	}
+	return []FlatMetric{m}
+}
+
+func (m *FlatMetric) add(name string, v interface{}) {
+	m.Fields = append(m.Fields, Field{Name: name, Value: v})
+}
+
+func (m *FlatMetric) addDuration(name string, v interface{}) {
+	m.Fields = append(m.Fields, Field{Name: name, Value: v, Duration: true})
+}
+
+// percentileFieldName returns the field name of percentile p, for example
+// 99-percentile for 0.99 and 999-percentile for 0.999.
+func percentileFieldName(p float64) string {
+	return strings.Replace(strconv.FormatFloat(p*100.0, 'f', -1, 64), ".", "", 1) + "-percentile"
+}
+
+// bucketFieldName returns the name of the cumulative count of the bucket
+// with upper bound b, such as le-25 or le-0_5, since dots separate the path
+// of a Graphite metric.
+func bucketFieldName(b float64) string {
+	return "le-" + strings.Replace(strconv.FormatFloat(b, 'f', -1, 64), ".", "_", 1)
+}
+
+// formatField formats the value of f the way the line-based reporters always
+// have: integers as integers, gauge values in full and derived statistics
+// with two decimals.
+func formatField(f Field) string {
+	switch v := f.Value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		if "value" == f.Name {
+			return fmt.Sprintf("%f", v)
+		}
+		return fmt.Sprintf("%.2f", v)
+	}
+	return fmt.Sprint(f.Value)
+}
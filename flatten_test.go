@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlattenMetric(t *testing.T) {
+	c := NewCounter()
+	c.Inc(47)
+	ms := FlattenMetric("foo", nil, c, FlattenOptions{})
+	if 1 != len(ms) || "counter" != ms[0].Type || !reflect.DeepEqual([]Field{{"count", int64(47), false}}, ms[0].Fields) {
+		t.Fatal(ms)
+	}
+	if ms := FlattenMetric("foo", nil, struct{}{}, FlattenOptions{}); 0 != len(ms) {
+		t.Fatal(ms)
+	}
+}
+
+func TestFlattenMetricTimer(t *testing.T) {
+	tm := NewTimer()
+	tm.Update(1500 * time.Microsecond)
+	ms := FlattenMetric("foo", nil, tm, FlattenOptions{
+		Percentiles:  []float64{0.5, 0.999},
+		DurationUnit: time.Millisecond,
+	})
+	var names []string
+	for _, f := range ms[0].Fields {
+		names = append(names, f.Name)
+		if "max" == f.Name && (1.5 != f.Value || !f.Duration) {
+			t.Fatal(f)
+		}
+	}
+	if s := strings.Join(names, ","); "count,min,max,mean,std-dev,50-percentile,999-percentile,one-minute,five-minute,fifteen-minute,mean-rate" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestFlattenMetricHealthcheck(t *testing.T) {
+	h := NewHealthcheck(func(h Healthcheck) { h.Unhealthy(errors.New("down")) })
+	ms := FlattenMetric("foo", nil, h, FlattenOptions{})
+	if 1 != len(ms) || "healthcheck" != ms[0].Type || nil == ms[0].Error || 0 != len(ms[0].Fields) {
+		t.Fatal(ms)
+	}
+}
+
+func TestFlattenMetricGated(t *testing.T) {
+	clock := NewManualClock(time.Date(2016, 1, 1, 10, 0, 0, 0, time.Local))
+	r := NewRegistryWithClock(clock)
+	GetOrRegisterCondInt("cond", r, time.Minute).Update(47)
+	GetOrRegisterPeriodCounter("period", r, map[string]time.Duration{MS1: M1}).Inc(60)
+
+	count := func(opts FlattenOptions) int {
+		n := 0
+		Flatten(r, opts, func(FlatMetric) { n++ })
+		return n
+	}
+	if n := count(FlattenOptions{Gated: true}); 0 != n {
+		t.Fatalf("%d metrics flattened before their period elapsed", n)
+	}
+	if n := count(FlattenOptions{}); 2 != n {
+		t.Fatalf("%d metrics flattened without gating", n)
+	}
+
+	clock.Add(time.Minute)
+	var ms []FlatMetric
+	Flatten(r, FlattenOptions{Gated: true}, func(m FlatMetric) { ms = append(ms, m) })
+	if 2 != len(ms) {
+		t.Fatal(ms)
+	}
+	for _, m := range ms {
+		switch m.Name {
+		case "cond":
+			if !reflect.DeepEqual([]Field{{"value", int64(47), false}}, m.Fields) {
+				t.Fatal(m)
+			}
+		case "period":
+			if !reflect.DeepEqual([]Field{
+				{"count", int64(60), false},
+				{"1m-count", int64(60), false},
+				{"1m-rate", 1.0, false},
+			}, m.Fields) {
+				t.Fatal(m)
+			}
+		default:
+			t.Fatal(m)
+		}
+	}
+	if n := count(FlattenOptions{Gated: true}); 0 != n {
+		t.Fatalf("%d metrics flattened twice in one period", n)
+	}
+}
+
+func TestFlattenMetricDataMap(t *testing.T) {
+	dm := NewDataMap("dm", &DataMapOption{})
+	dm.UpdateInt64("b", 2)
+	dm.UpdateFloat64("a", 1.5)
+	ms := FlattenMetric("dm", Labels{{"host", "h"}}, dm, FlattenOptions{})
+	if 2 != len(ms) {
+		t.Fatal(ms)
+	}
+	if `{host="h",key="a"}` != ms[0].Labels.String() || 1.5 != ms[0].Fields[0].Value {
+		t.Fatal(ms[0])
+	}
+	if `{host="h",key="b"}` != ms[1].Labels.String() || int64(2) != ms[1].Fields[0].Value {
+		t.Fatal(ms[1])
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredGauge("bar", r).Update(47)
+	NewRegisteredCounter("foo", r).Inc(1)
+	GetOrRegisterCondFloat("cond", r, time.Minute).Update(0.5)
+	b := &bytes.Buffer{}
+	WriteOnce(r, b)
+	if s := b.String(); "gauge bar\n"+
+		"  value:              47\n"+
+		"gauge cond\n"+
+		"  value:       0.500000\n"+
+		"counter foo\n"+
+		"  count:               1\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestRegistryMarshalJSONFlattened(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredMeter("meter", r)
+	dm := NewRegisteredDataMap("dm", r, &DataMapOption{})
+	dm.UpdateInt64("k", 3)
+	b := &bytes.Buffer{}
+	WriteJSONOnce(r, b)
+	if s := b.String(); `{"dm":{"k":{"value":3}},"meter":{"15m.rate":0,"1m.rate":0,"5m.rate":0,"count":0,"mean.rate":0}}`+"\n" != s {
+		t.Fatal(s)
+	}
+}
@@ -23,7 +23,8 @@ func GetOrRegisterHistogram(name string, r Registry, s Sample) Histogram {
 	if nil == r {
 		r = DefaultRegistry
 	}
-	return r.GetOrRegister(name, func() Histogram { return NewHistogram(s) }, nil).(Histogram)
+	c := registryClock(r)
+	return r.GetOrRegister(name, func() Histogram { return NewHistogram(sampleWithClock(s, c)) }, nil).(Histogram)
 }
 
 // NewHistogram constructs a new StandardHistogram from a Sample.
@@ -37,10 +38,10 @@ func NewHistogram(s Sample) Histogram {
 // NewRegisteredHistogram constructs and registers a new StandardHistogram from
 // a Sample.
 func NewRegisteredHistogram(name string, r Registry, s Sample) Histogram {
-	c := NewHistogram(s)
 	if nil == r {
 		r = DefaultRegistry
 	}
+	c := NewHistogram(sampleWithClock(s, registryClock(r)))
 	r.Register(name, c)
 	return c
 }
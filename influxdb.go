@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxDBConfig provides a container with configuration parameters for
+// the InfluxDB exporter
+type InfluxDBConfig struct {
+	URL           string            // Base URL of the HTTP API, points are posted to URL/write
+	Database      string            // Database to write to over HTTP
+	Username      string            // User to authenticate as over HTTP, if any
+	Password      string            // Password of Username
+	UDPAddr       *net.UDPAddr      // UDP socket to write to instead of the HTTP API
+	MaxPacketSize int               // Maximum UDP payload in bytes, 1432 if zero
+	Registry      Registry          // Registry to be exported
+	FlushInterval time.Duration     // Flush interval
+	DurationUnit  time.Duration     // Time conversion unit for durations
+	Prefix        string            // Prefix to be prepended to measurement names
+	Percentiles   []float64         // Percentiles to export from timers and histograms
+	Tags          map[string]string // Tags added to every point, such as host and service
+}
+
+// InfluxDB is a blocking exporter function which writes metrics in r to the
+// database of the InfluxDB HTTP API at url every d duration.
+func InfluxDB(r Registry, d time.Duration, url, database string) {
+	InfluxDBWithConfig(InfluxDBConfig{
+		URL:           url,
+		Database:      database,
+		Registry:      r,
+		FlushInterval: d,
+		DurationUnit:  time.Nanosecond,
+		Percentiles:   []float64{0.5, 0.75, 0.95, 0.99, 0.999},
+	})
+}
+
+// InfluxDBWithConfig is a blocking exporter function just like InfluxDB,
+// but it takes an InfluxDBConfig instead.
+func InfluxDBWithConfig(c InfluxDBConfig) {
+	InfluxDBWithContext(context.Background(), c, func(err error) { log.Println(err) })
+}
+
+// InfluxDBWithContext is an exporter function just like InfluxDBWithConfig,
+// but it returns after a final flush once ctx is done and passes errors to
+// onError instead of logging them.
+func InfluxDBWithContext(ctx context.Context, c InfluxDBConfig, onError func(error)) {
+	ReportLoop(ctx, c.FlushInterval, func() error { return InfluxDBOnce(c) }, onError)
+}
+
+// InfluxDBOnce performs a single write to InfluxDB, returning a non-nil
+// error on failed connections and rejected writes.
+func InfluxDBOnce(c InfluxDBConfig) error {
+	if nil != c.UDPAddr {
+		return influxDBUDP(&c)
+	}
+	return influxDBHTTP(&c)
+}
+
+// WriteInfluxDBOnce writes metrics in the given registry to the given
+// io.Writer in the InfluxDB line protocol, timestamped with now.
+//
+// Every metric is a measurement whose fields are the fields of the
+// flattened metric, such as the count, min, max, mean, percentiles and
+// rates of a Timer.  Labels become tags next to the tags of the config.
+func WriteInfluxDBOnce(c InfluxDBConfig, w io.Writer, now time.Time) error {
+	var err error
+	writeInfluxDB(&c, now, func(line string) {
+		if nil == err {
+			_, err = io.WriteString(w, line+"\n")
+		}
+	})
+	return err
+}
+
+func writeInfluxDB(c *InfluxDBConfig, now time.Time, write func(string)) {
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	opts := FlattenOptions{Percentiles: c.Percentiles, DurationUnit: c.DurationUnit, Gated: true}
+	EachLabeled(c.Registry, func(name string, labels Labels, i interface{}) {
+		// the keys of a DataMap hold integers or floats depending on their
+		// last update, and InfluxDB rejects a field changing its type
+		_, float := i.(dataMapState)
+		for _, m := range FlattenMetric(name, labels, i, opts) {
+			fields := make([]string, 0, len(m.Fields))
+			for _, f := range m.Fields {
+				if value, ok := influxDBValue(f.Value, float); ok {
+					fields = append(fields, influxDBEscape(f.Name, ",= ")+"="+value)
+				}
+			}
+			if 0 == len(fields) {
+				continue
+			}
+			name := m.Name
+			if "" != c.Prefix {
+				name = c.Prefix + "." + name
+			}
+			write(influxDBEscape(name, ", ") + influxDBTags(c.Tags, m.Labels) + " " + strings.Join(fields, ",") + " " + ts)
+		}
+	})
+}
+
+func influxDBHTTP(c *InfluxDBConfig) error {
+	b := &bytes.Buffer{}
+	if err := WriteInfluxDBOnce(*c, b, time.Now()); nil != err {
+		return err
+	}
+	if 0 == b.Len() {
+		return nil
+	}
+	u := strings.TrimRight(c.URL, "/") + "/write?" + url.Values{
+		"db":        {c.Database},
+		"precision": {"ns"},
+	}.Encode()
+	req, err := http.NewRequest("POST", u, b)
+	if nil != err {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if "" != c.Username {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influxdb: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func influxDBUDP(c *InfluxDBConfig) error {
+	conn, err := net.DialUDP("udp", nil, c.UDPAddr)
+	if nil != err {
+		return err
+	}
+	defer conn.Close()
+	max := c.MaxPacketSize
+	if max <= 0 {
+		max = maxUDPPayload
+	}
+	p := &linePacket{w: conn, max: max}
+	writeInfluxDB(c, time.Now(), p.write)
+	p.flush()
+	return p.err
+}
+
+// influxDBTags formats tags and labels, which take precedence, as the
+// ,key=value,... tag set of a point, sorted by key.
+func influxDBTags(tags map[string]string, labels Labels) string {
+	merged := make(map[string]string, len(tags)+len(labels))
+	for k, v := range tags {
+		merged[k] = v
+	}
+	for _, l := range labels {
+		merged[l.Name] = l.Value
+	}
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := ""
+	for _, k := range keys {
+		// InfluxDB rejects tags with empty values
+		if "" != merged[k] {
+			s += "," + influxDBEscape(k, ",= ") + "=" + influxDBEscape(merged[k], ",= ")
+		}
+	}
+	return s
+}
+
+// influxDBValue formats a field value, with an i suffix for integers unless
+// float is set.  NaN and infinite values can not be written.
+func influxDBValue(v interface{}, float bool) (string, bool) {
+	switch v := v.(type) {
+	case int64:
+		if float {
+			return strconv.FormatFloat(float64(v), 'f', -1, 64), true
+		}
+		return strconv.FormatInt(v, 10) + "i", true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// influxDBEscape escapes the given special characters with backslashes.
+func influxDBEscape(s, special string) string {
+	for _, c := range special {
+		s = strings.Replace(s, string(c), `\`+string(c), -1)
+	}
+	return s
+}
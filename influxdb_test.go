@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ExampleInfluxDBWithConfig() {
+	go InfluxDBWithConfig(InfluxDBConfig{
+		URL:           "http://127.0.0.1:8086",
+		Database:      "metrics",
+		Registry:      DefaultRegistry,
+		FlushInterval: 10 * time.Second,
+		DurationUnit:  time.Millisecond,
+		Tags:          map[string]string{"host": "web1", "service": "api"},
+	})
+}
+
+func TestWriteInfluxDBOnce(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter("requests", r).Inc(3)
+	NewRegisteredGaugeFloat64("load avg", r).Update(0.5)
+	tm := NewRegisteredTimer("latency", r)
+	tm.Update(2 * time.Millisecond)
+	NewRegisteredCounterVec("hits", r, "code").WithLabelValues("200").Inc(1)
+
+	b := &bytes.Buffer{}
+	err := WriteInfluxDBOnce(InfluxDBConfig{
+		Registry:     r,
+		DurationUnit: time.Millisecond,
+		Percentiles:  []float64{0.5},
+		Prefix:       "app",
+		Tags:         map[string]string{"service": "api", "host": "web1"},
+	}, b, time.Unix(1, 5))
+	if nil != err {
+		t.Fatal(err)
+	}
+	s := b.String()
+	for _, line := range []string{
+		"app.requests,host=web1,service=api count=3i 1000000005\n",
+		"app.load\\ avg,host=web1,service=api value=0.5 1000000005\n",
+		"app.latency,host=web1,service=api count=1i,min=2,max=2,mean=2,std-dev=0,50-percentile=2,",
+		"app.hits,code=200,host=web1,service=api count=1i 1000000005\n",
+	} {
+		if !strings.Contains(s, line) {
+			t.Errorf("missing %q in:\n%s", line, s)
+		}
+	}
+}
+
+func TestWriteInfluxDBOnceDataMap(t *testing.T) {
+	r := NewRegistry()
+	dm := NewRegisteredDataMap("dm", r, &DataMapOption{})
+	dm.UpdateInt64("a", 2)
+	dm.UpdateFloat64("b", 1.5)
+	b := &bytes.Buffer{}
+	if err := WriteInfluxDBOnce(InfluxDBConfig{Registry: r}, b, time.Unix(1, 0)); nil != err {
+		t.Fatal(err)
+	}
+	dm.UpdateFloat64("a", 2.5)
+	if err := WriteInfluxDBOnce(InfluxDBConfig{Registry: r}, b, time.Unix(2, 0)); nil != err {
+		t.Fatal(err)
+	}
+	if s := b.String(); "dm,key=a value=2 1000000000\n"+
+		"dm,key=b value=1.5 1000000000\n"+
+		"dm,key=a value=2.5 2000000000\n"+
+		"dm,key=b value=1.5 2000000000\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestInfluxDBHTTP(t *testing.T) {
+	var body, query, user string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		body, query = string(b), req.URL.RawQuery
+		user, _, _ = req.BasicAuth()
+		if "/write" != req.URL.Path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	r := NewRegistry()
+	NewRegisteredGauge("queue", r).Update(47)
+	c := InfluxDBConfig{URL: ts.URL, Database: "metrics", Username: "u", Password: "p", Registry: r}
+	if err := InfluxDBOnce(c); nil != err {
+		t.Fatal(err)
+	}
+	if "db=metrics&precision=ns" != query || "u" != user || !strings.HasPrefix(body, "queue value=47i ") {
+		t.Fatalf("query=%q user=%q body=%q", query, user, body)
+	}
+
+	c.URL += "/missing"
+	if err := InfluxDBOnce(c); nil == err {
+		t.Fatal("rejected write did not return an error")
+	}
+}
+
+func TestInfluxDBUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := NewRegistry()
+	NewRegisteredCounter("requests", r).Inc(1)
+	c := InfluxDBConfig{UDPAddr: conn.LocalAddr().(*net.UDPAddr), Registry: r}
+	if err := InfluxDBOnce(c); nil != err {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if s := string(buf[:n]); !strings.HasPrefix(s, "requests count=1i ") {
+		t.Fatal(s)
+	}
+}
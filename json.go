@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"time"
@@ -8,72 +9,121 @@ import (
 
 // MarshalJSON returns a byte slice containing a JSON representation of all
 // the metrics in the Registry.
+//
+// Labeled metrics, the children of labeled metric families and the keys of
+// a DataMap, are nested under the metric name, one object level per label
+// value.  The description, unit and stability of metrics registered with
+// metadata are added to their values.
+//
+// Conditional metrics are not gated, so marshaling a registry on demand does
+// not consume their write window; WriteJSON and WriteJSONWithContext, which
+// write periodically, gate them like the other periodic reporters.
 func (r *StandardRegistry) MarshalJSON() ([]byte, error) {
-	data := make(map[string]map[string]interface{})
-	r.Each(func(name string, i interface{}) {
-		values := make(map[string]interface{})
-		switch metric := i.(type) {
-		case Counter:
-			values["count"] = metric.Count()
-		case Gauge:
-			values["value"] = metric.Value()
-		case GaugeFloat64:
-			values["value"] = metric.Value()
-		case Healthcheck:
-			values["error"] = nil
-			metric.Check()
-			if err := metric.Error(); nil != err {
-				values["error"] = metric.Error().Error()
+	return marshalJSON(r, FlattenOptions{})
+}
+
+// marshalJSON returns the JSON representation of every metric in r flattened
+// with opts.
+func marshalJSON(r Registry, opts FlattenOptions) ([]byte, error) {
+	data := make(map[string]interface{})
+	Flatten(r, opts, func(m FlatMetric) {
+		meta, _ := MetaOf(r, m.Name)
+		if len(m.Labels) == 0 {
+			data[m.Name] = jsonValues(m, meta)
+			return
+		}
+		node, ok := data[m.Name].(map[string]interface{})
+		if !ok {
+			node = make(map[string]interface{})
+			data[m.Name] = node
+		}
+		for _, l := range m.Labels[:len(m.Labels)-1] {
+			next, ok := node[l.Value].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				node[l.Value] = next
 			}
-		case Histogram:
-			h := metric.Snapshot()
-			ps := h.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-			values["count"] = h.Count()
-			values["min"] = h.Min()
-			values["max"] = h.Max()
-			values["mean"] = h.Mean()
-			values["stddev"] = h.StdDev()
-			values["median"] = ps[0]
-			values["75%"] = ps[1]
-			values["95%"] = ps[2]
-			values["99%"] = ps[3]
-			values["99.9%"] = ps[4]
-		case Meter:
-			m := metric.Snapshot()
-			values["count"] = m.Count()
-			values["1m.rate"] = m.Rate1()
-			values["5m.rate"] = m.Rate5()
-			values["15m.rate"] = m.Rate15()
-			values["mean.rate"] = m.RateMean()
-		case Timer:
-			t := metric.Snapshot()
-			ps := t.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-			values["count"] = t.Count()
-			values["min"] = t.Min()
-			values["max"] = t.Max()
-			values["mean"] = t.Mean()
-			values["stddev"] = t.StdDev()
-			values["median"] = ps[0]
-			values["75%"] = ps[1]
-			values["95%"] = ps[2]
-			values["99%"] = ps[3]
-			values["99.9%"] = ps[4]
-			values["1m.rate"] = t.Rate1()
-			values["5m.rate"] = t.Rate5()
-			values["15m.rate"] = t.Rate15()
-			values["mean.rate"] = t.RateMean()
+			node = next
 		}
-		data[name] = values
+		node[m.Labels[len(m.Labels)-1].Value] = jsonValues(m, meta)
 	})
 	return json.Marshal(data)
 }
 
+// jsonFieldNames maps field names to the keys of the JSON representation.
+var jsonFieldNames = map[string]string{
+	"std-dev":        "stddev",
+	"50-percentile":  "median",
+	"75-percentile":  "75%",
+	"95-percentile":  "95%",
+	"99-percentile":  "99%",
+	"999-percentile": "99.9%",
+	"one-minute":     "1m.rate",
+	"five-minute":    "5m.rate",
+	"fifteen-minute": "15m.rate",
+	"mean-rate":      "mean.rate",
+}
+
+// jsonValues returns the JSON representation of a single flattened metric
+// with its metadata.
+func jsonValues(m FlatMetric, meta Metadata) map[string]interface{} {
+	values := make(map[string]interface{})
+	if "" != meta.Description {
+		values["description"] = meta.Description
+	}
+	if "" != meta.Unit {
+		values["unit"] = meta.Unit
+	}
+	if "" != meta.Stability {
+		values["stability"] = meta.Stability
+	}
+	if "healthcheck" == m.Type {
+		values["error"] = nil
+		if nil != m.Error {
+			values["error"] = m.Error.Error()
+		}
+	}
+	for _, f := range m.Fields {
+		name, ok := jsonFieldNames[f.Name]
+		if !ok {
+			name = f.Name
+		}
+		// the mean of a meter is its mean rate
+		if "meter" == m.Type && "mean" == f.Name {
+			name = "mean.rate"
+		}
+		values[name] = f.Value
+	}
+	return values
+}
+
 // WriteJSON writes metrics from the given registry  periodically to the
 // specified io.Writer as JSON.
 func WriteJSON(r Registry, d time.Duration, w io.Writer) {
 	for _ = range time.Tick(d) {
-		WriteJSONOnce(r, w)
+		writeGatedJSON(r, w)
+	}
+}
+
+// WriteJSONWithContext writes metrics from the given registry periodically to
+// the specified io.Writer as JSON until ctx is done, then writes them one
+// last time.  Encoding and write errors are passed to onError.
+func WriteJSONWithContext(ctx context.Context, r Registry, d time.Duration, w io.Writer, onError func(error)) {
+	ReportLoop(ctx, d, func() error { return writeGatedJSON(r, w) }, onError)
+}
+
+// writeGatedJSON writes the metrics of r to w as JSON on a line, gating the
+// conditional metrics.
+func writeGatedJSON(r Registry, w io.Writer) error {
+	if base, _ := findPrefix(r, ""); nil != base {
+		r = base // like PrefixedRegistry.MarshalJSON
+	}
+	b, err := marshalJSON(r, FlattenOptions{Gated: true})
+	if nil != err {
+		return err
 	}
+	_, err = w.Write(append(b, '\n'))
+	return err
 }
 
 // WriteJSONOnce writes metrics from the given registry to the specified
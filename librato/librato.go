@@ -1,9 +1,9 @@
 package librato
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"math"
 	"regexp"
 	"time"
 
@@ -21,6 +21,26 @@ func translateTimerAttributes(d time.Duration) (attrs map[string]interface{}) {
 	return
 }
 
+// applyMeta adds the description and the unit of a metric registered with
+// metadata to a measurement of it.
+func applyMeta(m Measurement, meta metrics.Metadata) {
+	if meta.Description != "" {
+		m[Description] = meta.Description
+	}
+	if meta.Unit != "" {
+		// attribute maps may be shared between measurements
+		attrs := make(map[string]interface{})
+		if old, ok := m[Attributes].(map[string]interface{}); ok {
+			for k, v := range old {
+				attrs[k] = v
+			}
+		}
+		attrs[DisplayUnitsLong] = meta.Unit
+		attrs[DisplayUnitsShort] = meta.Unit
+		m[Attributes] = attrs
+	}
+}
+
 type Reporter struct {
 	Email, Token    string
 	Namespace       string
@@ -29,11 +49,12 @@ type Reporter struct {
 	Registry        metrics.Registry
 	Percentiles     []float64              // percentiles to report on histogram metrics
 	TimerAttributes map[string]interface{} // units in which timers will be displayed
+	OnError         func(error)            // called with request errors by RunWithContext; nil discards them
 	intervalSec     int64
 }
 
 func NewReporter(r metrics.Registry, d time.Duration, e string, t string, s string, p []float64, u time.Duration) *Reporter {
-	return &Reporter{e, t, "", s, d, r, p, translateTimerAttributes(u), int64(d / time.Second)}
+	return &Reporter{e, t, "", s, d, r, p, translateTimerAttributes(u), nil, int64(d / time.Second)}
 }
 
 func Librato(r metrics.Registry, d time.Duration, e string, t string, s string, p []float64, u time.Duration) {
@@ -42,43 +63,31 @@ func Librato(r metrics.Registry, d time.Duration, e string, t string, s string,
 
 func (self *Reporter) Run() {
 	log.Printf("WARNING: This client has been DEPRECATED! It has been moved to https://github.com/mihasya/go-metrics-librato and will be removed from rcrowley/go-metrics on August 5th 2015")
-	ticker := time.Tick(self.Interval)
-	metricsApi := &LibratoClient{self.Email, self.Token}
-	for now := range ticker {
-		var metrics Batch
-		var err error
-		if metrics, err = self.BuildRequest(now, self.Registry); err != nil {
-			log.Printf("ERROR constructing librato request body %s", err)
-			continue
-		}
-		if err := metricsApi.PostMetrics(metrics); err != nil {
-			log.Printf("ERROR sending metrics to librato %s", err)
-			continue
-		}
+	if self.OnError == nil {
+		self.OnError = func(err error) { log.Printf("ERROR %s", err) }
 	}
+	self.RunWithContext(context.Background())
 }
 
-// calculate sum of squares from data provided by metrics.Histogram
-// see http://en.wikipedia.org/wiki/Standard_deviation#Rapid_calculation_methods
-func sumSquares(s metrics.Sample) float64 {
-	count := float64(s.Count())
-	sumSquared := math.Pow(count*s.Mean(), 2)
-	sumSquares := math.Pow(count*s.StdDev(), 2) + sumSquared/count
-	if math.IsNaN(sumSquares) {
-		return 0.0
-	}
-	return sumSquares
-}
-func sumSquaresTimer(t metrics.Timer) float64 {
-	count := float64(t.Count())
-	sumSquared := math.Pow(count*t.Mean(), 2)
-	sumSquares := math.Pow(count*t.StdDev(), 2) + sumSquared/count
-	if math.IsNaN(sumSquares) {
-		return 0.0
-	}
-	return sumSquares
+// RunWithContext reports to librato every Interval until ctx is done, then
+// reports one last time.  Errors are passed to OnError.
+func (self *Reporter) RunWithContext(ctx context.Context) {
+	metricsApi := &LibratoClient{self.Email, self.Token}
+	metrics.ReportLoop(ctx, self.Interval, func() error {
+		batch, err := self.BuildRequest(time.Now(), self.Registry)
+		if err != nil {
+			return fmt.Errorf("constructing librato request body %s", err)
+		}
+		if err := metricsApi.PostMetrics(batch); err != nil {
+			return fmt.Errorf("sending metrics to librato %s", err)
+		}
+		return nil
+	}, self.OnError)
 }
 
+// BuildRequest flattens every metric of r into fields, reporting the count
+// fields as counters and every other field as a gauge named after the metric
+// and, for metrics of several fields, the field.
 func (self *Reporter) BuildRequest(now time.Time, r metrics.Registry) (snapshot Batch, err error) {
 	snapshot = Batch{
 		// coerce timestamps to a stepping fn so that they line up in Librato graphs
@@ -87,147 +96,50 @@ func (self *Reporter) BuildRequest(now time.Time, r metrics.Registry) (snapshot
 	}
 	snapshot.Gauges = make([]Measurement, 0)
 	snapshot.Counters = make([]Measurement, 0)
-	histogramGaugeCount := 1 + len(self.Percentiles)
-	r.Each(func(name string, metric interface{}) {
+	opts := metrics.FlattenOptions{Percentiles: self.Percentiles, Gated: true}
+	if nil == opts.Percentiles {
+		opts.Percentiles = []float64{}
+	}
+	metrics.EachLabeled(r, func(name string, labels metrics.Labels, metric interface{}) {
+		meta, _ := metrics.MetaOf(r, name)
 		if self.Namespace != "" {
 			name = fmt.Sprintf("%s.%s", self.Namespace, name)
 		}
-		measurement := Measurement{}
-		measurement[Period] = self.Interval.Seconds()
-		switch m := metric.(type) {
-		case metrics.Counter:
-			if m.Count() > 0 {
-				measurement[Name] = fmt.Sprintf("%s.%s", name, "count")
-				measurement[Value] = float64(m.Count())
-				measurement[Attributes] = map[string]interface{}{
-					DisplayUnitsLong:  Operations,
-					DisplayUnitsShort: OperationsShort,
-					DisplayMin:        "0",
+		for _, fm := range metrics.FlattenMetric(name, labels, metric, opts) {
+			for _, f := range fm.Fields {
+				fieldName := name
+				if len(fm.Fields) > 1 {
+					fieldName = fmt.Sprintf("%s.%s", name, f.Name)
 				}
-				snapshot.Counters = append(snapshot.Counters, measurement)
-			}
-		case metrics.Gauge:
-			measurement[Name] = name
-			measurement[Value] = float64(m.Value())
-			snapshot.Gauges = append(snapshot.Gauges, measurement)
-		case metrics.GaugeFloat64:
-			measurement[Name] = name
-			measurement[Value] = float64(m.Value())
-			snapshot.Gauges = append(snapshot.Gauges, measurement)
-		case metrics.Histogram:
-			if m.Count() > 0 {
-				gauges := make([]Measurement, histogramGaugeCount, histogramGaugeCount)
-				s := m.Sample()
-				measurement[Name] = fmt.Sprintf("%s.%s", name, "hist")
-				measurement[Count] = uint64(s.Count())
-				measurement[Max] = float64(s.Max())
-				measurement[Min] = float64(s.Min())
-				measurement[Sum] = float64(s.Sum())
-				measurement[SumSquares] = sumSquares(s)
-				gauges[0] = measurement
-				for i, p := range self.Percentiles {
-					gauges[i+1] = Measurement{
-						Name:   fmt.Sprintf("%s.%.2f", measurement[Name], p),
-						Value:  s.Percentile(p),
-						Period: measurement[Period],
-					}
+				// librato metric names only allow [A-Za-z0-9.:-_], so labels
+				// are appended as .name.value path segments
+				for _, l := range fm.Labels {
+					fieldName = fmt.Sprintf("%s.%s.%s", fieldName, l.Name, l.Value)
 				}
-				snapshot.Gauges = append(snapshot.Gauges, gauges...)
-			}
-		case metrics.Meter:
-			measurement[Name] = name
-			measurement[Value] = float64(m.Count())
-			snapshot.Counters = append(snapshot.Counters, measurement)
-			snapshot.Gauges = append(snapshot.Gauges,
-				Measurement{
-					Name:   fmt.Sprintf("%s.%s", name, "1min"),
-					Value:  m.Rate1(),
-					Period: int64(self.Interval.Seconds()),
-					Attributes: map[string]interface{}{
-						DisplayUnitsLong:  Operations,
-						DisplayUnitsShort: OperationsShort,
-						DisplayMin:        "0",
-					},
-				},
-				Measurement{
-					Name:   fmt.Sprintf("%s.%s", name, "5min"),
-					Value:  m.Rate5(),
-					Period: int64(self.Interval.Seconds()),
-					Attributes: map[string]interface{}{
-						DisplayUnitsLong:  Operations,
-						DisplayUnitsShort: OperationsShort,
-						DisplayMin:        "0",
-					},
-				},
-				Measurement{
-					Name:   fmt.Sprintf("%s.%s", name, "15min"),
-					Value:  m.Rate15(),
-					Period: int64(self.Interval.Seconds()),
-					Attributes: map[string]interface{}{
+				measurement := Measurement{
+					Name:   fieldName,
+					Value:  f.Float64(),
+					Period: self.Interval.Seconds(),
+				}
+				if f.Duration {
+					// durations are displayed in TimerAttributes
+					measurement[Attributes] = self.TimerAttributes
+					applyMeta(measurement, metrics.Metadata{Description: meta.Description})
+					snapshot.Gauges = append(snapshot.Gauges, measurement)
+					continue
+				}
+				if "count" == f.Name {
+					measurement[Attributes] = map[string]interface{}{
 						DisplayUnitsLong:  Operations,
 						DisplayUnitsShort: OperationsShort,
 						DisplayMin:        "0",
-					},
-				},
-			)
-		case metrics.Timer:
-			measurement[Name] = name
-			measurement[Value] = float64(m.Count())
-			snapshot.Counters = append(snapshot.Counters, measurement)
-			if m.Count() > 0 {
-				libratoName := fmt.Sprintf("%s.%s", name, "timer.mean")
-				gauges := make([]Measurement, histogramGaugeCount, histogramGaugeCount)
-				gauges[0] = Measurement{
-					Name:       libratoName,
-					Count:      uint64(m.Count()),
-					Sum:        m.Mean() * float64(m.Count()),
-					Max:        float64(m.Max()),
-					Min:        float64(m.Min()),
-					SumSquares: sumSquaresTimer(m),
-					Period:     int64(self.Interval.Seconds()),
-					Attributes: self.TimerAttributes,
-				}
-				for i, p := range self.Percentiles {
-					gauges[i+1] = Measurement{
-						Name:       fmt.Sprintf("%s.timer.%2.0f", name, p*100),
-						Value:      m.Percentile(p),
-						Period:     int64(self.Interval.Seconds()),
-						Attributes: self.TimerAttributes,
 					}
+					applyMeta(measurement, meta)
+					snapshot.Counters = append(snapshot.Counters, measurement)
+					continue
 				}
-				snapshot.Gauges = append(snapshot.Gauges, gauges...)
-				snapshot.Gauges = append(snapshot.Gauges,
-					Measurement{
-						Name:   fmt.Sprintf("%s.%s", name, "rate.1min"),
-						Value:  m.Rate1(),
-						Period: int64(self.Interval.Seconds()),
-						Attributes: map[string]interface{}{
-							DisplayUnitsLong:  Operations,
-							DisplayUnitsShort: OperationsShort,
-							DisplayMin:        "0",
-						},
-					},
-					Measurement{
-						Name:   fmt.Sprintf("%s.%s", name, "rate.5min"),
-						Value:  m.Rate5(),
-						Period: int64(self.Interval.Seconds()),
-						Attributes: map[string]interface{}{
-							DisplayUnitsLong:  Operations,
-							DisplayUnitsShort: OperationsShort,
-							DisplayMin:        "0",
-						},
-					},
-					Measurement{
-						Name:   fmt.Sprintf("%s.%s", name, "rate.15min"),
-						Value:  m.Rate15(),
-						Period: int64(self.Interval.Seconds()),
-						Attributes: map[string]interface{}{
-							DisplayUnitsLong:  Operations,
-							DisplayUnitsShort: OperationsShort,
-							DisplayMin:        "0",
-						},
-					},
-				)
+				applyMeta(measurement, meta)
+				snapshot.Gauges = append(snapshot.Gauges, measurement)
 			}
 		}
 	})
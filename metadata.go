@@ -0,0 +1,29 @@
+package metrics
+
+// Stability tells the consumers of a metric how much they can rely on it.
+type Stability string
+
+// Stabilities of metrics.
+const (
+	StabilityStable       Stability = "stable"
+	StabilityExperimental Stability = "experimental"
+	StabilityDeprecated   Stability = "deprecated"
+)
+
+// Metadata describes a registered metric to dashboards and reporters.  Every
+// field is optional.
+type Metadata struct {
+	Description string    `json:"description,omitempty"`
+	Unit        string    `json:"unit,omitempty"` // such as ns, bytes or requests
+	Stability   Stability `json:"stability,omitempty"`
+}
+
+// MetaOf returns the metadata of the metric r passed to an Each callback
+// under name.  Unlike r.Meta it takes the full names the Each method of a
+// PrefixedRegistry passes, so reporters should use it.
+func MetaOf(r Registry, name string) (Metadata, bool) {
+	if base, _ := findPrefix(r, ""); nil != base {
+		return base.Meta(name)
+	}
+	return r.Meta(name)
+}
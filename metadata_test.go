@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegisterWithMeta(t *testing.T) {
+	r := NewRegistry()
+	meta := Metadata{Description: "Requests served", Unit: "requests", Stability: StabilityStable}
+	if err := r.RegisterWithMeta("foo", NewCounter(), meta); nil != err {
+		t.Fatal(err)
+	}
+	if m, ok := r.Meta("foo"); !ok || meta != m {
+		t.Fatal(m, ok)
+	}
+	if err := r.RegisterWithMeta("foo", NewCounter(), Metadata{Unit: "bytes"}); nil == err {
+		t.Fatal("duplicate registered")
+	}
+	if m, _ := r.Meta("foo"); meta != m {
+		t.Fatal(m)
+	}
+	r.Unregister("foo")
+	if m, ok := r.Meta("foo"); ok {
+		t.Fatal(m)
+	}
+}
+
+func TestSetMeta(t *testing.T) {
+	r := NewRegistry()
+	GetOrRegisterTimer("foo", r)
+	r.SetMeta("foo", Metadata{Unit: "ns"})
+	if m, ok := r.Meta("foo"); !ok || "ns" != m.Unit {
+		t.Fatal(m, ok)
+	}
+	r.UnregisterAll()
+	if m, ok := r.Meta("foo"); ok {
+		t.Fatal(m)
+	}
+}
+
+func TestPrefixedRegistryMeta(t *testing.T) {
+	r := NewPrefixedRegistry("prefix.")
+	r.RegisterWithMeta("foo", NewCounter(), Metadata{Unit: "requests"})
+	if m, ok := r.Meta("foo"); !ok || "requests" != m.Unit {
+		t.Fatal(m, ok)
+	}
+	r.Each(func(name string, i interface{}) {
+		if m, ok := MetaOf(r, name); !ok || "requests" != m.Unit {
+			t.Fatal(name, m, ok)
+		}
+	})
+}
+
+func TestMetaJSON(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterWithMeta("foo", NewCounter(), Metadata{Description: "Requests served", Unit: "requests"})
+	b := &bytes.Buffer{}
+	WriteJSONOnce(r, b)
+	if s := b.String(); "{\"foo\":{\"count\":0,\"description\":\"Requests served\",\"unit\":\"requests\"}}\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestMetaPrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterWithMeta("foo", NewCounter(), Metadata{Description: "Requests\nserved"})
+	b := &bytes.Buffer{}
+	WritePrometheusOnce(r, b)
+	if s := b.String(); !strings.HasPrefix(s, "# HELP foo_total Requests\\nserved\n# TYPE foo_total counter\n") {
+		t.Fatal(s)
+	}
+}
+
+func TestRuntimeMemStatsMeta(t *testing.T) {
+	r := NewRegistry()
+	RegisterRuntimeMemStats(r)
+	if m, ok := r.Meta("runtime.MemStats.PauseNs"); !ok || "ns" != m.Unit {
+		t.Fatal(m, ok)
+	}
+}
@@ -2,9 +2,14 @@ package metrics
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultMeterTickInterval is the interval at which meters update their
+// moving averages unless SetMeterTickInterval is called.
+const DefaultMeterTickInterval = 5 * time.Second
+
 // Meters count events to produce exponentially-weighted moving average rates
 // at one-, five-, and fifteen-minutes and a mean rate.
 type Meter interface {
@@ -23,32 +28,61 @@ func GetOrRegisterMeter(name string, r Registry) Meter {
 	if nil == r {
 		r = DefaultRegistry
 	}
-	return r.GetOrRegister(name, NewMeter, nil).(Meter)
+	c := registryClock(r)
+	return r.GetOrRegister(name, func() Meter { return NewMeterWithClock(c) }, nil).(Meter)
 }
 
-// NewMeter constructs a new StandardMeter and launches a goroutine.
+// NewMeter constructs a new StandardMeter and launches a goroutine, shared by
+// every meter, which ticks it until it is stopped.
 func NewMeter() Meter {
+	return NewMeterWithClock(DefaultClock)
+}
+
+// NewMeterWithClock constructs a new StandardMeter which computes its rates
+// with the given clock and launches a goroutine.  The moving averages decay
+// once per tick interval elapsed on the clock, so that a ManualClock drives
+// them without the goroutine.
+func NewMeterWithClock(c Clock) Meter {
 	if UseNilMetrics {
 		return NilMeter{}
 	}
-	m := newStandardMeter()
 	arbiter.Lock()
 	defer arbiter.Unlock()
-	arbiter.meters = append(arbiter.meters, m)
-	if !arbiter.started {
-		arbiter.started = true
-		go arbiter.tick()
-	}
+	m := newStandardMeter(arbiter.tickInterval())
+	m.clock = c
+	m.startTime = c.Now()
+	m.lastTick = m.startTime
+	arbiter.add(m)
 	return m
 }
 
+// SetMeterTickInterval sets the interval at which meters update their moving
+// averages, five seconds by default.  A shorter interval makes the rates
+// follow bursts more closely at the cost of more frequent wakeups.  Existing
+// meters are adjusted so that their rates keep their time windows.
+func SetMeterTickInterval(d time.Duration) {
+	if d <= 0 {
+		d = DefaultMeterTickInterval
+	}
+	arbiter.Lock()
+	defer arbiter.Unlock()
+	arbiter.interval = d
+	for m := range arbiter.meters {
+		m.setTickInterval(d)
+	}
+	if arbiter.started {
+		arbiter.halt()
+		arbiter.start()
+	}
+}
+
 // NewMeter constructs and registers a new StandardMeter and launches a
 // goroutine.
 func NewRegisteredMeter(name string, r Registry) Meter {
-	c := NewMeter()
 	if nil == r {
 		r = DefaultRegistry
 	}
+	c := NewMeterWithClock(registryClock(r))
 	r.Register(name, c)
 	return c
 }
@@ -112,19 +146,29 @@ func (NilMeter) Snapshot() Meter { return NilMeter{} }
 
 // StandardMeter is the standard implementation of a Meter.
 type StandardMeter struct {
+	stopped     uint32
 	lock        sync.RWMutex
 	snapshot    *MeterSnapshot
 	a1, a5, a15 EWMA
+	clock       Clock
 	startTime   time.Time
+
+	// the moving averages are ticked every interval since lastTick
+	interval time.Duration
+	lastTick time.Time
 }
 
-func newStandardMeter() *StandardMeter {
+func newStandardMeter(interval time.Duration) *StandardMeter {
+	now := DefaultClock.Now()
 	return &StandardMeter{
 		snapshot:  &MeterSnapshot{},
-		a1:        NewEWMA1(),
-		a5:        NewEWMA5(),
-		a15:       NewEWMA15(),
-		startTime: time.Now(),
+		a1:        NewEWMAWithInterval(1, interval),
+		a5:        NewEWMAWithInterval(5, interval),
+		a15:       NewEWMAWithInterval(15, interval),
+		clock:     DefaultClock,
+		startTime: now,
+		interval:  interval,
+		lastTick:  now,
 	}
 }
 
@@ -136,90 +180,176 @@ func (m *StandardMeter) Count() int64 {
 	return count
 }
 
-// Mark records the occurance of n events.
+// Mark records the occurance of n events.  It is a no-op once the meter is
+// stopped.
 func (m *StandardMeter) Mark(n int64) {
+	if 1 == atomic.LoadUint32(&m.stopped) {
+		return
+	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	now := m.clock.Now()
+
+	// events marked after the elapsed ticks must not decay with them
+	m.tickTo(now)
 	m.snapshot.count += n
 	m.a1.Update(n)
 	m.a5.Update(n)
 	m.a15.Update(n)
-	m.updateSnapshot()
+	m.updateSnapshot(now)
 }
 
 // Rate1 returns the one-minute moving average rate of events per second.
 func (m *StandardMeter) Rate1() float64 {
-	m.lock.RLock()
-	rate1 := m.snapshot.rate1
-	m.lock.RUnlock()
-	return rate1
+	return m.current().rate1
 }
 
 // Rate5 returns the five-minute moving average rate of events per second.
 func (m *StandardMeter) Rate5() float64 {
-	m.lock.RLock()
-	rate5 := m.snapshot.rate5
-	m.lock.RUnlock()
-	return rate5
+	return m.current().rate5
 }
 
 // Rate15 returns the fifteen-minute moving average rate of events per second.
 func (m *StandardMeter) Rate15() float64 {
-	m.lock.RLock()
-	rate15 := m.snapshot.rate15
-	m.lock.RUnlock()
-	return rate15
+	return m.current().rate15
 }
 
 // RateMean returns the meter's mean rate of events per second.
 func (m *StandardMeter) RateMean() float64 {
-	m.lock.RLock()
-	rateMean := m.snapshot.rateMean
-	m.lock.RUnlock()
-	return rateMean
+	return m.current().rateMean
+}
+
+// Stop detaches the meter from the goroutine ticking it, so that it can be
+// garbage collected, and freezes its count and rates.  Registry.Unregister
+// stops the meters it removes.
+func (m *StandardMeter) Stop() {
+	if atomic.CompareAndSwapUint32(&m.stopped, 0, 1) {
+		arbiter.Lock()
+		defer arbiter.Unlock()
+		arbiter.remove(m)
+	}
 }
 
 // Snapshot returns a read-only copy of the meter.
 func (m *StandardMeter) Snapshot() Meter {
-	m.lock.RLock()
-	snapshot := *m.snapshot
-	m.lock.RUnlock()
+	snapshot := m.current()
 	return &snapshot
 }
 
-func (m *StandardMeter) updateSnapshot() {
+// current ticks the meter up to the time of its clock, unless it is stopped,
+// and returns a copy of its snapshot.
+func (m *StandardMeter) current() MeterSnapshot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if 0 == atomic.LoadUint32(&m.stopped) {
+		if now := m.clock.Now(); m.tickTo(now) {
+			m.updateSnapshot(now)
+		}
+	}
+	return *m.snapshot
+}
+
+func (m *StandardMeter) updateSnapshot(now time.Time) {
 	// should run with write lock held on m.lock
 	snapshot := m.snapshot
 	snapshot.rate1 = m.a1.Rate()
 	snapshot.rate5 = m.a5.Rate()
 	snapshot.rate15 = m.a15.Rate()
-	snapshot.rateMean = float64(snapshot.count) / time.Since(m.startTime).Seconds()
+	snapshot.rateMean = float64(snapshot.count) / now.Sub(m.startTime).Seconds()
 }
 
+// tick ticks the meter up to the time of its clock; the arbiter calls it so
+// that the snapshot follows the clock between reads.
 func (m *StandardMeter) tick() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	m.a1.Tick()
-	m.a5.Tick()
-	m.a15.Tick()
-	m.updateSnapshot()
+	now := m.clock.Now()
+	m.tickTo(now)
+	m.updateSnapshot(now)
+}
+
+// tickTo ticks the moving averages once per interval elapsed since the last
+// tick and reports whether it did; called with the write lock held.
+func (m *StandardMeter) tickTo(now time.Time) bool {
+	ticked := false
+	for m.interval > 0 && now.Sub(m.lastTick) >= m.interval {
+		m.a1.Tick()
+		m.a5.Tick()
+		m.a15.Tick()
+		m.lastTick = m.lastTick.Add(m.interval)
+		ticked = true
+	}
+	return ticked
+}
+
+func (m *StandardMeter) setTickInterval(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.interval = d
+	for _, a := range []EWMA{m.a1, m.a5, m.a15} {
+		if a, ok := a.(*StandardEWMA); ok {
+			a.setInterval(d)
+		}
+	}
 }
 
+// meterArbiter ticks every running meter up to its clock from a single
+// goroutine, which runs as long as there are meters.
 type meterArbiter struct {
 	sync.RWMutex
-	started bool
-	meters  []*StandardMeter
-	ticker  *time.Ticker
+	started  bool
+	meters   map[*StandardMeter]struct{}
+	interval time.Duration
+	stop     chan struct{}
 }
 
-var arbiter = meterArbiter{ticker: time.NewTicker(5e9)}
+var arbiter = meterArbiter{meters: make(map[*StandardMeter]struct{})}
+
+func (ma *meterArbiter) tickInterval() time.Duration {
+	if ma.interval <= 0 {
+		return DefaultMeterTickInterval
+	}
+	return ma.interval
+}
+
+// add adds a meter and starts the goroutine if it is the first; called with
+// the lock held.
+func (ma *meterArbiter) add(m *StandardMeter) {
+	ma.meters[m] = struct{}{}
+	if !ma.started {
+		ma.start()
+	}
+}
+
+// remove removes a meter and stops the goroutine if it was the last; called
+// with the lock held.
+func (ma *meterArbiter) remove(m *StandardMeter) {
+	delete(ma.meters, m)
+	if ma.started && 0 == len(ma.meters) {
+		ma.halt()
+	}
+}
+
+func (ma *meterArbiter) start() {
+	ma.started = true
+	ma.stop = make(chan struct{})
+	go ma.tick(time.NewTicker(ma.tickInterval()), ma.stop)
+}
+
+func (ma *meterArbiter) halt() {
+	ma.started = false
+	close(ma.stop)
+}
 
 // Ticks meters on the scheduled interval
-func (ma *meterArbiter) tick() {
+func (ma *meterArbiter) tick(ticker *time.Ticker, stop chan struct{}) {
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ma.ticker.C:
+		case <-ticker.C:
 			ma.tickMeters()
+		case <-stop:
+			return
 		}
 	}
 }
@@ -227,7 +357,7 @@ func (ma *meterArbiter) tick() {
 func (ma *meterArbiter) tickMeters() {
 	ma.RLock()
 	defer ma.RUnlock()
-	for _, meter := range ma.meters {
+	for meter := range ma.meters {
 		meter.tick()
 	}
 }
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"math"
 	"testing"
 	"time"
 )
@@ -23,11 +24,18 @@ func TestGetOrRegisterMeter(t *testing.T) {
 
 func TestMeterDecay(t *testing.T) {
 	ma := meterArbiter{
-		ticker: time.NewTicker(time.Millisecond),
+		meters:   make(map[*StandardMeter]struct{}),
+		interval: time.Millisecond,
 	}
-	m := newStandardMeter()
-	ma.meters = append(ma.meters, m)
-	go ma.tick()
+	m := newStandardMeter(time.Millisecond)
+	ma.Lock()
+	ma.add(m)
+	ma.Unlock()
+	defer func() {
+		ma.Lock()
+		ma.remove(m)
+		ma.Unlock()
+	}()
 	m.Mark(1)
 	rateMean := m.RateMean()
 	time.Sleep(100 * time.Millisecond)
@@ -58,3 +66,109 @@ func TestMeterZero(t *testing.T) {
 		t.Errorf("m.Count(): 0 != %v\n", count)
 	}
 }
+
+func TestMeterRateMeanWithClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	m := GetOrRegisterMeter("foo", NewRegistryWithClock(clock)).(*StandardMeter)
+	m.Mark(10)
+	clock.Add(10 * time.Second)
+	m.tick()
+	if rateMean := m.RateMean(); 1.0 != rateMean {
+		t.Errorf("m.RateMean(): 1.0 != %v\n", rateMean)
+	}
+	clock.Add(10 * time.Second)
+	m.tick()
+	if rateMean := m.RateMean(); 0.5 != rateMean {
+		t.Errorf("m.RateMean(): 0.5 != %v\n", rateMean)
+	}
+}
+
+func TestMeterRatesWithClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	m := GetOrRegisterMeter("foo", NewRegistryWithClock(clock))
+	m.Mark(10)
+	if rate := m.Rate1(); 0 != rate {
+		t.Errorf("m.Rate1(): 0 != %v\n", rate)
+	}
+	clock.Add(DefaultMeterTickInterval)
+	if rate := m.Rate1(); 2 != rate {
+		t.Errorf("m.Rate1(): 2 != %v\n", rate)
+	}
+	// a minute without events decays the one-minute rate by e
+	clock.Add(time.Minute)
+	if rate, expected := m.Snapshot().Rate1(), 2/math.E; math.Abs(rate-expected) > 1e-9 {
+		t.Errorf("m.Rate1(): %v != %v\n", expected, rate)
+	}
+	// events marked after the elapsed ticks are not decayed by them
+	clock.Add(time.Hour)
+	m.Mark(5)
+	clock.Add(DefaultMeterTickInterval)
+	if rate, expected := m.Rate1(), 1-math.Exp(-5.0/60); math.Abs(rate-expected) > 1e-9 {
+		t.Errorf("m.Rate1(): %v != %v\n", expected, rate)
+	}
+}
+
+func TestMeterStop(t *testing.T) {
+	r := NewRegistry()
+	m := NewRegisteredMeter("foo", r).(*StandardMeter)
+	tm := NewRegisteredTimer("bar", r).(*StandardTimer)
+	v := NewRegisteredTimerVec("baz", r, "tenant")
+	child := v.WithLabelValues("a").(*StandardTimer)
+	for _, m := range []*StandardMeter{m, tm.meter.(*StandardMeter), child.meter.(*StandardMeter)} {
+		if !meterRunning(m) {
+			t.Fatal("meter not ticked")
+		}
+	}
+
+	r.Unregister("foo")
+	r.Unregister("bar")
+	v.DeleteLabelValues("a")
+	for _, m := range []*StandardMeter{m, tm.meter.(*StandardMeter), child.meter.(*StandardMeter)} {
+		if meterRunning(m) {
+			t.Fatal("unregistered meter still ticked")
+		}
+	}
+	m.Mark(1)
+	if count := m.Count(); 0 != count {
+		t.Errorf("m.Count(): 0 != %v\n", count)
+	}
+	m.Stop()
+}
+
+func TestMeterArbiterStops(t *testing.T) {
+	ma := meterArbiter{meters: make(map[*StandardMeter]struct{})}
+	m := newStandardMeter(DefaultMeterTickInterval)
+	ma.Lock()
+	ma.add(m)
+	started := ma.started
+	ma.remove(m)
+	ma.Unlock()
+	if !started || ma.started {
+		t.Errorf("started: %v, %v\n", started, ma.started)
+	}
+}
+
+func TestSetMeterTickInterval(t *testing.T) {
+	defer SetMeterTickInterval(DefaultMeterTickInterval)
+	clock := NewManualClock(time.Unix(0, 0))
+	m := NewMeterWithClock(clock).(*StandardMeter)
+	defer m.Stop()
+	SetMeterTickInterval(time.Second)
+	m.Mark(5)
+	clock.Add(time.Second)
+	// 5 events in the first one second tick
+	if rate := m.Rate1(); 5 != rate {
+		t.Errorf("m.Rate1(): 5 != %v\n", rate)
+	}
+	clock.Add(time.Second)
+	if rate, expected := m.Rate1(), 5*math.Exp(-1.0/60); math.Abs(rate-expected) > 1e-9 {
+		t.Errorf("m.Rate1(): %v != %v\n", expected, rate)
+	}
+}
+
+func meterRunning(m *StandardMeter) bool {
+	arbiter.RLock()
+	defer arbiter.RUnlock()
+	_, ok := arbiter.meters[m]
+	return ok
+}
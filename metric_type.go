@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// UnsupportedMetric is the error returned by Registry.Register when the value
+// is not a metric of this package, a Metric or of a type registered with
+// RegisterMetricType.
+type UnsupportedMetric struct {
+	Name  string
+	Value interface{}
+}
+
+func (err UnsupportedMetric) Error() string {
+	return fmt.Sprintf("unsupported metric type %T: %s", err.Value, err.Name)
+}
+
+// Metric is implemented by metric types defined outside this package so that
+// registries accept them and reporters flatten them like the metrics of this
+// package.
+type Metric interface {
+	// Fields returns the current values of the metric, such as a single
+	// value field for a gauge.
+	Fields() []Field
+
+	// MetricType returns the type of the metric for FlatMetric.Type, such as
+	// counter or gauge.
+	MetricType() string
+}
+
+// metricType is a metric type added with RegisterMetricType.
+type metricType struct {
+	name    string
+	flatten func(interface{}) []Field
+}
+
+var metricTypes = struct {
+	sync.RWMutex
+	m map[reflect.Type]metricType
+}{m: make(map[reflect.Type]metricType)}
+
+// RegisterMetricType makes registries accept metrics of the same type as
+// example, such as the metrics of another library which can not implement
+// Metric.  Reporters flatten them into the fields returned by flatten with
+// the given type for FlatMetric.Type.
+func RegisterMetricType(example interface{}, typ string, flatten func(interface{}) []Field) {
+	metricTypes.Lock()
+	defer metricTypes.Unlock()
+	metricTypes.m[reflect.TypeOf(example)] = metricType{typ, flatten}
+}
+
+func lookupMetricType(i interface{}) (metricType, bool) {
+	metricTypes.RLock()
+	defer metricTypes.RUnlock()
+	t, ok := metricTypes.m[reflect.TypeOf(i)]
+	return t, ok
+}
+
+// MetricSnapshot is a read-only copy of the fields of a Metric or of a metric
+// of a type registered with RegisterMetricType, as taken by
+// Registry.Snapshot.
+type MetricSnapshot struct {
+	typ    string
+	fields []Field
+}
+
+// snapshotCustomMetric returns a MetricSnapshot of i, or nil if i is neither
+// a Metric nor of a registered type.
+func snapshotCustomMetric(i interface{}) *MetricSnapshot {
+	if m, ok := i.(Metric); ok {
+		return &MetricSnapshot{typ: m.MetricType(), fields: append([]Field(nil), m.Fields()...)}
+	}
+	if t, ok := lookupMetricType(i); ok {
+		return &MetricSnapshot{typ: t.name, fields: t.flatten(i)}
+	}
+	return nil
+}
+
+// Fields returns the fields at the time the snapshot was taken.
+func (m *MetricSnapshot) Fields() []Field { return append([]Field(nil), m.fields...) }
+
+// MetricType returns the type of the metric.
+func (m *MetricSnapshot) MetricType() string { return m.typ }
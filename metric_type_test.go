@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// testMetric is a gauge implementing Metric.
+type testMetric int64
+
+func (m testMetric) Fields() []Field    { return []Field{{Name: "value", Value: int64(m)}} }
+func (m testMetric) MetricType() string { return "gauge" }
+
+// testForeignMetric is a counter of another library.
+type testForeignMetric struct{ n int64 }
+
+func (m *testForeignMetric) Load() int64 { return m.n }
+
+func TestRegisterUnsupportedMetric(t *testing.T) {
+	r := NewRegistry()
+	err := r.Register("foo", NewUniformSample(100))
+	if _, ok := err.(UnsupportedMetric); !ok {
+		t.Fatal(err)
+	}
+	if nil != r.Get("foo") {
+		t.Fatal(r.Get("foo"))
+	}
+}
+
+func TestRegisterMetric(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register("foo", testMetric(47)); nil != err {
+		t.Fatal(err)
+	}
+	b := &bytes.Buffer{}
+	WriteJSONOnce(r, b)
+	if s := b.String(); "{\"foo\":{\"value\":47}}\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestRegisterMetricType(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register("foo", &testForeignMetric{47}); nil == err {
+		t.Fatal("unregistered type registered")
+	}
+	RegisterMetricType(&testForeignMetric{}, "counter", func(i interface{}) []Field {
+		return []Field{{Name: "count", Value: i.(*testForeignMetric).Load()}}
+	})
+	if err := r.Register("foo", &testForeignMetric{47}); nil != err {
+		t.Fatal(err)
+	}
+	var names []string
+	r.Each(func(name string, i interface{}) { names = append(names, name) })
+	if 1 != len(names) {
+		t.Fatal(names)
+	}
+	b := &bytes.Buffer{}
+	WritePrometheusOnce(r, b)
+	if s := b.String(); "# TYPE foo_total counter\nfoo_total 47\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestGetOrRegisterUnsupportedMetric(t *testing.T) {
+	r := NewRegistry()
+	defer func() {
+		if err, ok := recover().(UnsupportedMetric); !ok || "foo" != err.Name {
+			t.Fatal(err)
+		}
+		if nil != r.Get("foo") {
+			t.Fatal(r.Get("foo"))
+		}
+	}()
+	r.GetOrRegister("foo", NewUniformSample, 100)
+	t.Fatal("no panic")
+}
+
+func TestSnapshotMetric(t *testing.T) {
+	// a type of its own, since types can not be unregistered
+	type foreignMetric struct{ testForeignMetric }
+	RegisterMetricType(&foreignMetric{}, "counter", func(i interface{}) []Field {
+		return []Field{{Name: "count", Value: i.(*foreignMetric).Load()}}
+	})
+	r := NewRegistry()
+	r.Register("foo", testMetric(47))
+	foreign := &foreignMetric{testForeignMetric{3}}
+	r.Register("bar", foreign)
+	r.Register("baz", testFloatMetric(0.5))
+	s := r.Snapshot()
+	foreign.n = 4
+
+	b, err := json.Marshal(s)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var decoded RegistrySnapshot
+	if err := json.Unmarshal(b, &decoded); nil != err {
+		t.Fatal(err)
+	}
+	for _, snapshot := range []*RegistrySnapshot{s, &decoded} {
+		if 3 != snapshot.Len() {
+			t.Fatal(snapshot.Len())
+		}
+		for name, expected := range map[string]interface{}{"foo": int64(47), "bar": int64(3), "baz": 0.5} {
+			m, ok := snapshot.Get(name, nil).(Metric)
+			if !ok {
+				t.Fatalf("%s: %T", name, snapshot.Get(name, nil))
+			}
+			if fields := m.Fields(); 1 != len(fields) || expected != fields[0].Value {
+				t.Errorf("%s: %v != %v", name, expected, fields)
+			}
+		}
+		if typ := snapshot.Get("bar", nil).(Metric).MetricType(); "counter" != typ {
+			t.Error(typ)
+		}
+	}
+}
+
+// testFloatMetric is a float gauge implementing Metric.
+type testFloatMetric float64
+
+func (m testFloatMetric) Fields() []Field    { return []Field{{Name: "value", Value: float64(m)}} }
+func (m testFloatMetric) MetricType() string { return "gauge" }
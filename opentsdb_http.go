@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenTSDBHTTPConfig provides a container with configuration parameters for
+// the OpenTSDB HTTP API exporter
+type OpenTSDBHTTPConfig struct {
+	URL           string            // Base URL of the HTTP API, datapoints are posted to URL/api/put
+	Registry      Registry          // Registry to be exported
+	FlushInterval time.Duration     // Flush interval
+	DurationUnit  time.Duration     // Time conversion unit for durations
+	Prefix        string            // Prefix to be prepended to metric names
+	Percentiles   []float64         // Percentiles to export from timers and histograms
+	Tags          map[string]string // Tags of every datapoint, host defaults to the short hostname
+	MaxBatchSize  int               // Maximum number of datapoints per request, 50 if zero
+	Failed        Counter           // Counts datapoints OpenTSDB failed to store, if not nil
+}
+
+// OpenTSDBHTTPMaxBatchSize is the default number of datapoints posted in a
+// single request.
+const OpenTSDBHTTPMaxBatchSize = 50
+
+// OpenTSDBHTTPWithConfig is a blocking exporter function which posts metrics
+// to the OpenTSDB HTTP API every FlushInterval.
+func OpenTSDBHTTPWithConfig(c OpenTSDBHTTPConfig) {
+	OpenTSDBHTTPWithContext(context.Background(), c, func(err error) { log.Println(err) })
+}
+
+// OpenTSDBHTTPWithContext is an exporter function just like
+// OpenTSDBHTTPWithConfig, but it returns after a final flush once ctx is
+// done and passes errors to onError instead of logging them.
+func OpenTSDBHTTPWithContext(ctx context.Context, c OpenTSDBHTTPConfig, onError func(error)) {
+	ReportLoop(ctx, c.FlushInterval, func() error { return OpenTSDBHTTPOnce(c) }, onError)
+}
+
+// OpenTSDBHTTPOnce posts every metric to the OpenTSDB HTTP API once, in
+// batches of at most MaxBatchSize datapoints.  Every batch is posted even if
+// an earlier one fails.  The datapoints OpenTSDB reports as failed are added
+// to Failed and the first error is returned.
+func OpenTSDBHTTPOnce(c OpenTSDBHTTPConfig) error {
+	size := c.MaxBatchSize
+	if size <= 0 {
+		size = OpenTSDBHTTPMaxBatchSize
+	}
+	points := openTSDBHTTPPoints(&c, time.Now())
+	var err error
+	for len(points) > 0 {
+		n := size
+		if n > len(points) {
+			n = len(points)
+		}
+		if e := openTSDBHTTPPut(&c, points[:n]); nil != e && nil == err {
+			err = e
+		}
+		points = points[n:]
+	}
+	return err
+}
+
+// openTSDBDatapoint is a datapoint of the /api/put JSON body.
+type openTSDBDatapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// openTSDBPutResponse is the body returned by /api/put?details.
+type openTSDBPutResponse struct {
+	Failed  int64 `json:"failed"`
+	Success int64 `json:"success"`
+	Errors  []struct {
+		Datapoint openTSDBDatapoint `json:"datapoint"`
+		Error     string            `json:"error"`
+	} `json:"errors"`
+}
+
+func openTSDBHTTPPoints(c *OpenTSDBHTTPConfig, now time.Time) []openTSDBDatapoint {
+	var points []openTSDBDatapoint
+	opts := FlattenOptions{Percentiles: c.Percentiles, DurationUnit: c.DurationUnit, Gated: true}
+	Flatten(c.Registry, opts, func(m FlatMetric) {
+		tags := openTSDBTagMap(c.Tags, m.Labels)
+		name := m.Name
+		if "" != c.Prefix {
+			name = c.Prefix + "." + name
+		}
+		for _, f := range m.Fields {
+			if v, ok := f.Value.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+				continue
+			}
+			points = append(points, openTSDBDatapoint{
+				Metric:    name + "." + f.Name,
+				Timestamp: now.Unix(),
+				Value:     f.Value,
+				Tags:      tags,
+			})
+		}
+	})
+	return points
+}
+
+func openTSDBHTTPPut(c *OpenTSDBHTTPConfig, points []openTSDBDatapoint) error {
+	body, err := json.Marshal(points)
+	if nil != err {
+		return err
+	}
+	resp, err := http.Post(strings.TrimRight(c.URL, "/")+"/api/put?details", "application/json", bytes.NewReader(body))
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	var details openTSDBPutResponse
+	if err := json.Unmarshal(b, &details); nil != err {
+		// without details every datapoint of a rejected request failed
+		if resp.StatusCode/100 != 2 {
+			if nil != c.Failed {
+				c.Failed.Inc(int64(len(points)))
+			}
+			return fmt.Errorf("opentsdb: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+		}
+		return nil
+	}
+	if nil != c.Failed {
+		c.Failed.Inc(details.Failed)
+	}
+	if details.Failed > 0 {
+		if len(details.Errors) > 0 {
+			return fmt.Errorf("opentsdb: %d of %d datapoints failed, %s: %s", details.Failed,
+				len(points), details.Errors[0].Datapoint.Metric, details.Errors[0].Error)
+		}
+		return fmt.Errorf("opentsdb: %d of %d datapoints failed", details.Failed, len(points))
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("opentsdb: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleOpenTSDBHTTPWithConfig() {
+	go OpenTSDBHTTPWithConfig(OpenTSDBHTTPConfig{
+		URL:           "http://127.0.0.1:4242",
+		Registry:      DefaultRegistry,
+		FlushInterval: 10 * time.Second,
+		DurationUnit:  time.Millisecond,
+		Tags:          map[string]string{"service": "api"},
+	})
+}
+
+func TestOpenTSDBHTTPOnce(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		batches [][]openTSDBDatapoint
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if "/api/put" != req.URL.Path || "details" != req.URL.RawQuery {
+			t.Errorf("%s?%s", req.URL.Path, req.URL.RawQuery)
+		}
+		var points []openTSDBDatapoint
+		if err := json.NewDecoder(req.Body).Decode(&points); nil != err {
+			t.Error(err)
+		}
+		mutex.Lock()
+		batches = append(batches, points)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"failed":0,"success":%d,"errors":[]}`, len(points))
+	}))
+	defer ts.Close()
+
+	r := NewRegistry()
+	NewRegisteredCounter("requests", r).Inc(3)
+	NewRegisteredGaugeFloat64("load", r).Update(0.5)
+	NewRegisteredHistogram("sizes", r, NewUniformSample(10)).Update(1)
+	err := OpenTSDBHTTPOnce(OpenTSDBHTTPConfig{
+		URL:          ts.URL,
+		Registry:     r,
+		Prefix:       "app",
+		Percentiles:  []float64{0.5},
+		Tags:         map[string]string{"host": "web1", "service": "api"},
+		MaxBatchSize: 3,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	// 1 counter, 1 gauge and 6 histogram datapoints
+	if 3 != len(batches) || 3 != len(batches[0]) || 3 != len(batches[1]) || 2 != len(batches[2]) {
+		t.Fatal(batches)
+	}
+	seen := make(map[string]interface{})
+	for _, batch := range batches {
+		for _, p := range batch {
+			if "web1" != p.Tags["host"] || "api" != p.Tags["service"] {
+				t.Error(p)
+			}
+			seen[p.Metric] = p.Value
+		}
+	}
+	if 3.0 != seen["app.requests.count"] || 0.5 != seen["app.load.value"] || 1.0 != seen["app.sizes.50-percentile"] {
+		t.Fatal(seen)
+	}
+}
+
+func TestOpenTSDBHTTPOnceFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"failed":1,"success":0,"errors":[{"datapoint":{"metric":"bad.count"},"error":"Unknown metric"}]}`)
+	}))
+	defer ts.Close()
+
+	r := NewRegistry()
+	NewRegisteredCounter("bad", r)
+	failed := NewCounter()
+	err := OpenTSDBHTTPOnce(OpenTSDBHTTPConfig{URL: ts.URL, Registry: r, Failed: failed})
+	if nil == err || !strings.Contains(err.Error(), "Unknown metric") {
+		t.Fatal(err)
+	}
+	if 1 != failed.Count() {
+		t.Fatal(failed.Count())
+	}
+}
+
+func TestOpenTSDBHTTPOnceRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	r := NewRegistry()
+	NewRegisteredCounter("a", r)
+	NewRegisteredCounter("b", r)
+	failed := NewCounter()
+	if err := OpenTSDBHTTPOnce(OpenTSDBHTTPConfig{URL: ts.URL, Registry: r, Failed: failed}); nil == err {
+		t.Fatal("rejected request did not return an error")
+	}
+	if 2 != failed.Count() {
+		t.Fatal(failed.Count())
+	}
+}
@@ -0,0 +1,265 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusContentType is the Content-Type of the Prometheus text exposition
+// format version 0.0.4.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// prometheusQuantiles are the quantiles exported for histograms and timers.
+var prometheusQuantiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// PrometheusHandler returns an http.Handler which renders every metric in r
+// in the Prometheus text exposition format on each request.
+func PrometheusHandler(r Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var b bytes.Buffer
+		if err := WritePrometheusOnce(r, &b); nil != err {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", PrometheusContentType)
+		w.Write(b.Bytes())
+	})
+}
+
+// WritePrometheusOnce sorts and writes metrics in the given registry to the
+// given io.Writer in the Prometheus text exposition format.
+//
+// Counters are exported as counters with a _total suffix, gauges as gauges,
+// bucket histograms as histograms and histograms and timers as summaries.
+// Meters export their count as a counter and their rates as gauges.  Every
+// other metric is exported through FlattenMetric without gating, so scraping
+// never consumes the write window of the conditional types of this package.
+// The children of labeled metric families are grouped under one family.
+// The description of metrics registered with metadata is written as HELP;
+// units have no place in this version of the format.
+//
+// Metrics whose names differ only in characters that PrometheusName replaces,
+// such as a.b and a_b, would be written as the same family, which Prometheus
+// rejects: the first in order is written and the error returned names the
+// others, which are skipped.
+func WritePrometheusOnce(r Registry, w io.Writer) error {
+	var namedMetrics namedMetricSlice
+	r.Each(func(name string, i interface{}) {
+		namedMetrics = append(namedMetrics, namedMetric{name, i})
+	})
+	sort.Sort(namedMetrics)
+
+	var err error
+	owners := make(map[string]string) // family -> name of the metric written as it
+	bw := bufio.NewWriter(w)
+	for _, namedMetric := range namedMetrics {
+		name := PrometheusName(namedMetric.name)
+		p := &prometheusFamilies{index: make(map[string]*prometheusFamily)}
+		if meta, ok := MetaOf(r, namedMetric.name); ok {
+			p.help = meta.Description
+		}
+		if vec, ok := namedMetric.m.(MetricVec); ok {
+			vec.Each(func(labels Labels, child interface{}) {
+				p.add(name, labels, child)
+			})
+		} else {
+			p.add(name, nil, namedMetric.m)
+		}
+		if collision := p.collision(namedMetric.name, owners); nil != collision {
+			if nil == err {
+				err = collision
+			}
+			continue
+		}
+		p.write(bw)
+	}
+	if flushErr := bw.Flush(); nil != flushErr {
+		return flushErr
+	}
+	return err
+}
+
+// PrometheusCollision is the error of two metrics written as the same
+// Prometheus family.
+type PrometheusCollision struct {
+	Family, Name, Other string
+}
+
+func (err PrometheusCollision) Error() string {
+	return fmt.Sprintf("metrics: %s and %s are both written as the Prometheus family %s", err.Other, err.Name, err.Family)
+}
+
+// collision returns the error of a family of the metric name already written
+// by another metric, or records name as the owner of its families.
+func (p *prometheusFamilies) collision(name string, owners map[string]string) error {
+	for _, f := range p.families {
+		if other, ok := owners[f.name]; ok {
+			return PrometheusCollision{Family: f.name, Name: name, Other: other}
+		}
+	}
+	for _, f := range p.families {
+		owners[f.name] = name
+	}
+	return nil
+}
+
+// prometheusFamilies groups the samples of one registered metric by family
+// so that each family is written as a single block with one TYPE line.
+type prometheusFamilies struct {
+	families []*prometheusFamily
+	index    map[string]*prometheusFamily
+	help     string // of every family
+}
+
+type prometheusFamily struct {
+	name    string
+	typ     string
+	samples []string
+}
+
+func (p *prometheusFamilies) add(name string, labels Labels, i interface{}) {
+	switch metric := i.(type) {
+	case Counter:
+		p.sample(name+"_total", "counter", "", labels, float64(metric.Count()))
+	case Gauge:
+		p.sample(name, "gauge", "", labels, float64(metric.Value()))
+	case GaugeFloat64:
+		p.sample(name, "gauge", "", labels, metric.Value())
+	case Histogram:
+		h := metric.Snapshot()
+		p.summary(name, labels, h.Percentiles(prometheusQuantiles), float64(h.Sum()), h.Count())
+	case BucketHistogram:
+		h := metric.Snapshot()
+		counts := h.Counts()
+		for i, b := range h.Buckets() {
+			p.bucket(name, labels, formatPrometheusValue(b), counts[i])
+		}
+		p.bucket(name, labels, "+Inf", h.Count())
+		p.sample(name, "histogram", "_sum", labels, float64(h.Sum()))
+		p.sample(name, "histogram", "_count", labels, float64(h.Count()))
+	case Meter:
+		m := metric.Snapshot()
+		p.sample(name+"_total", "counter", "", labels, float64(m.Count()))
+		p.rates(name, labels, m.Rate1(), m.Rate5(), m.Rate15(), m.RateMean())
+	case Timer:
+		t := metric.Snapshot()
+		p.summary(name, labels, t.Percentiles(prometheusQuantiles), float64(t.Sum()), t.Count())
+		p.rates(name, labels, t.Rate1(), t.Rate5(), t.Rate15(), t.RateMean())
+	default:
+		// every other metric is exported through its flattened fields: a
+		// count as a counter, a value as a gauge under the metric name and
+		// any other field as a gauge suffixed with the field name
+		for _, m := range FlattenMetric(name, labels, i, FlattenOptions{}) {
+			for _, f := range m.Fields {
+				switch f.Name {
+				case "count":
+					p.sample(name+"_total", "counter", "", m.Labels, f.Float64())
+				case "value":
+					p.sample(name, "gauge", "", m.Labels, f.Float64())
+				default:
+					p.sample(name+"_"+PrometheusName(f.Name), "gauge", "", m.Labels, f.Float64())
+				}
+			}
+		}
+	}
+}
+
+func (p *prometheusFamilies) family(name, typ string) *prometheusFamily {
+	f, ok := p.index[name]
+	if !ok {
+		f = &prometheusFamily{name: name, typ: typ}
+		p.index[name] = f
+		p.families = append(p.families, f)
+	}
+	return f
+}
+
+// sample adds the sample name+suffix to the family name.
+func (p *prometheusFamilies) sample(name, typ, suffix string, labels Labels, v float64) {
+	f := p.family(name, typ)
+	f.samples = append(f.samples, fmt.Sprintf("%s%s%s %s",
+		name, suffix, formatPrometheusLabels(labels), formatPrometheusValue(v)))
+}
+
+func (p *prometheusFamilies) summary(name string, labels Labels, ps []float64, sum float64, count int64) {
+	for i, q := range prometheusQuantiles {
+		quantileLabels := append(append(Labels(nil), labels...), Label{"quantile", strconv.FormatFloat(q, 'g', -1, 64)})
+		p.sample(name, "summary", "", quantileLabels, ps[i])
+	}
+	p.sample(name, "summary", "_sum", labels, sum)
+	p.sample(name, "summary", "_count", labels, float64(count))
+}
+
+func (p *prometheusFamilies) bucket(name string, labels Labels, le string, count int64) {
+	bucketLabels := append(append(Labels(nil), labels...), Label{"le", le})
+	p.sample(name, "histogram", "_bucket", bucketLabels, float64(count))
+}
+
+func (p *prometheusFamilies) rates(name string, labels Labels, rate1, rate5, rate15, rateMean float64) {
+	p.sample(name+"_rate1", "gauge", "", labels, rate1)
+	p.sample(name+"_rate5", "gauge", "", labels, rate5)
+	p.sample(name+"_rate15", "gauge", "", labels, rate15)
+	p.sample(name+"_rate_mean", "gauge", "", labels, rateMean)
+}
+
+func (p *prometheusFamilies) write(w io.Writer) {
+	help := strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(p.help)
+	for _, f := range p.families {
+		if "" != help {
+			fmt.Fprintf(w, "# HELP %s %s\n", f.name, help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintf(w, "%s\n", s)
+		}
+	}
+}
+
+// PrometheusName sanitizes name so that it is a valid Prometheus metric name.
+// Every character outside [a-zA-Z0-9_:] is replaced by an underscore and a
+// leading digit is prefixed with one.
+func PrometheusName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == ':') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || ('0' <= b[0] && b[0] <= '9') {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// formatPrometheusLabels formats labels as {name="value",...} with sanitized
+// names and escaped values, or "" when there are none.
+func formatPrometheusLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", PrometheusName(l.Name), escapePrometheusLabel(l.Value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapePrometheusLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+// formatPrometheusValue formats v the way Prometheus expects, including NaN,
+// +Inf and -Inf.  Integral values are written without an exponent.
+func formatPrometheusValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusName(t *testing.T) {
+	for in, out := range map[string]string{
+		"foo":               "foo",
+		"http.GET.200":      "http_GET_200",
+		"runtime.MemStats":  "runtime_MemStats",
+		"9lives":            "_9lives",
+		"ns:sub-system/bar": "ns:sub_system_bar",
+	} {
+		if name := PrometheusName(in); out != name {
+			t.Errorf("PrometheusName(%q): %q != %q\n", in, out, name)
+		}
+	}
+}
+
+func TestWritePrometheusOnce(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter("foo.count", r).Inc(3)
+	NewRegisteredGauge("bar", r).Update(47)
+	NewRegisteredGaugeFloat64("baz", r).Update(1.5)
+	h := NewRegisteredHistogram("hist", r, NewUniformSample(100))
+	h.Update(1)
+	h.Update(3)
+	GetOrRegisterPeriodCounter("period", r, map[string]time.Duration{}).Inc(5)
+	GetOrRegisterCondInt("cond", r, time.Minute).Update(-2)
+
+	b := &bytes.Buffer{}
+	if err := WritePrometheusOnce(r, b); nil != err {
+		t.Fatal(err)
+	}
+	s := b.String()
+	for _, line := range []string{
+		"# TYPE foo_count_total counter\nfoo_count_total 3\n",
+		"# TYPE bar gauge\nbar 47\n",
+		"# TYPE baz gauge\nbaz 1.5\n",
+		"# TYPE hist summary\n",
+		"hist{quantile=\"0.5\"} 2\n",
+		"hist_sum 4\n",
+		"hist_count 2\n",
+		"# TYPE period_total counter\nperiod_total 5\n",
+		"# TYPE cond gauge\ncond -2\n",
+	} {
+		if !strings.Contains(s, line) {
+			t.Errorf("missing %q in:\n%s", line, s)
+		}
+	}
+	if strings.Index(s, "bar") > strings.Index(s, "foo_count") {
+		t.Errorf("metrics are not sorted:\n%s", s)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(1)
+	w := httptest.NewRecorder()
+	PrometheusHandler(r).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); PrometheusContentType != ct {
+		t.Fatal(ct)
+	}
+	if s := w.Body.String(); "# TYPE foo_total counter\nfoo_total 1\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestWritePrometheusOnceLabeled(t *testing.T) {
+	r := NewRegistry()
+	c := NewRegisteredCounterVec("requests", r, "method", "code")
+	c.WithLabelValues("GET", "200").Inc(2)
+	c.WithLabelValues("POST", "500").Inc(1)
+
+	b := &bytes.Buffer{}
+	WritePrometheusOnce(r, b)
+	if s := b.String(); "# TYPE requests_total counter\n"+
+		"requests_total{method=\"GET\",code=\"200\"} 2\n"+
+		"requests_total{method=\"POST\",code=\"500\"} 1\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestWritePrometheusOnceCollision(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter("a.b", r).Inc(1)
+	NewRegisteredCounter("a_b", r).Inc(2)
+	NewRegisteredGauge("c", r).Update(3)
+
+	b := &bytes.Buffer{}
+	err := WritePrometheusOnce(r, b)
+	if e, ok := err.(PrometheusCollision); !ok || "a_b_total" != e.Family || "a.b" != e.Other || "a_b" != e.Name {
+		t.Fatal(err)
+	}
+	if s := b.String(); "# TYPE a_b_total counter\na_b_total 1\n# TYPE c gauge\nc 3\n" != s {
+		t.Fatal(s)
+	}
+
+	w := httptest.NewRecorder()
+	PrometheusHandler(r).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if 500 != w.Code || !strings.Contains(w.Body.String(), "a_b_total") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
@@ -34,12 +34,24 @@ type Registry interface {
 	// or a function returning the metric for lazy instantiation.
 	GetOrRegister(string, interface{}, interface{}) interface{}
 
+	// Get the metadata of the metric by the given name.
+	Meta(string) (Metadata, bool)
+
 	// Register the given metric under the given name.
 	Register(string, interface{}) error
 
+	// Register the given metric under the given name with metadata.
+	RegisterWithMeta(string, interface{}, Metadata) error
+
 	// Run all registered healthchecks.
 	RunHealthchecks()
 
+	// Set the metadata of the metric by the given name.
+	SetMeta(string, Metadata)
+
+	// Take a read-only snapshot of every registered metric.
+	Snapshot() *RegistrySnapshot
+
 	// Unregister the metric with the given name.
 	Unregister(string)
 
@@ -47,16 +59,56 @@ type Registry interface {
 	UnregisterAll()
 }
 
+// Stoppable is implemented by metrics which hold resources until they are
+// stopped, such as a StandardMeter, which is ticked by a goroutine shared by
+// every meter.  Registries stop the metrics they unregister.
+type Stoppable interface {
+	Stop()
+}
+
+// stopMetric stops i if it is Stoppable and every child of a labeled family.
+func stopMetric(i interface{}) {
+	switch metric := i.(type) {
+	case Stoppable:
+		metric.Stop()
+	case MetricVec:
+		metric.Each(func(_ Labels, child interface{}) { stopMetric(child) })
+	}
+}
+
 // The standard implementation of a Registry is a mutex-protected map
 // of names to metrics.
 type StandardRegistry struct {
 	metrics map[string]interface{}
+	meta    map[string]Metadata
 	mutex   sync.Mutex
+	clock   Clock
+
+	limits    []*registryLimit
+	expiry    *registryExpiry
+	idle      map[string]idleState // guarded by idleMutex
+	idleMutex sync.Mutex
 }
 
 // Create a new registry.
 func NewRegistry() Registry {
-	return &StandardRegistry{metrics: make(map[string]interface{})}
+	return NewRegistryWithClock(DefaultClock)
+}
+
+// Create a new registry whose GetOrRegister helpers construct time-dependent
+// metrics with the given clock.
+func NewRegistryWithClock(c Clock) Registry {
+	return &StandardRegistry{
+		metrics: make(map[string]interface{}),
+		meta:    make(map[string]Metadata),
+		clock:   c,
+	}
+}
+
+// Clock returns the clock given to metrics constructed by the GetOrRegister
+// helpers.
+func (r *StandardRegistry) Clock() Clock {
+	return r.clock
 }
 
 // Call the given function for each registered metric.
@@ -77,12 +129,29 @@ func (r *StandardRegistry) Get(name string) interface{} {
 // alternative to calling Get and Register on failure.
 // The interface can be the metric to register if not found in registry,
 // or a function returning the metric for lazy instantiation.
+// Past the limit set with SetMaxMetrics it returns a shared overflow metric.
+// It panics with an UnsupportedMetric if the value is not a metric, rather
+// than returning a value it did not register.
 func (r *StandardRegistry) GetOrRegister(name string, i interface{}, cb interface{}) interface{} {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	if metric, ok := r.metrics[name]; ok {
+		r.touch(name)
 		return metric
 	}
+	if l := r.limitReached(name); nil != l {
+		return r.overflow(l, name, i, cb)
+	}
+	i = construct(name, i, cb)
+	if err := r.register(name, i); nil != err {
+		panic(err)
+	}
+	return i
+}
+
+// construct calls i with cb and the name as GetOrRegister does if it is a
+// function returning the metric, otherwise it returns i.
+func construct(name string, i interface{}, cb interface{}) interface{} {
 	if v := reflect.ValueOf(i); v.Kind() == reflect.Func {
 		if reflect.TypeOf(i).NumIn() == 0 {
 			i = v.Call(nil)[0].Interface()
@@ -92,17 +161,38 @@ func (r *StandardRegistry) GetOrRegister(name string, i interface{}, cb interfac
 			i = v.Call([]reflect.Value{reflect.ValueOf(name), reflect.ValueOf(cb)})[0].Interface()
 		}
 	}
-
-	r.register(name, i)
 	return i
 }
 
+// Get the metadata of the metric by the given name.
+func (r *StandardRegistry) Meta(name string) (Metadata, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	meta, ok := r.meta[name]
+	return meta, ok
+}
+
 // Register the given metric under the given name.  Returns a DuplicateMetric
-// if a metric by the given name is already registered.
+// if a metric by the given name is already registered, an UnsupportedMetric
+// if the value is not a metric and a CardinalityLimit past the limit set with
+// SetMaxMetrics.
 func (r *StandardRegistry) Register(name string, i interface{}) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	return r.register(name, i)
+	return r.registerLimited(name, i)
+}
+
+// Register the given metric under the given name with metadata.  Returns a
+// DuplicateMetric, leaving the metadata alone, if a metric by the given name
+// is already registered.
+func (r *StandardRegistry) RegisterWithMeta(name string, i interface{}, meta Metadata) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.registerLimited(name, i); nil != err {
+		return err
+	}
+	r.meta[name] = meta
+	return nil
 }
 
 // Run all registered healthchecks.
@@ -116,20 +206,42 @@ func (r *StandardRegistry) RunHealthchecks() {
 	}
 }
 
-// Unregister the metric with the given name.
+// Set the metadata of the metric by the given name, such as one returned by
+// GetOrRegister.  It is removed when the metric is unregistered.
+func (r *StandardRegistry) SetMeta(name string, meta Metadata) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.meta[name] = meta
+}
+
+// Take a read-only snapshot of every registered metric.
+func (r *StandardRegistry) Snapshot() *RegistrySnapshot {
+	return snapshotRegistry(r)
+}
+
+// Unregister the metric with the given name, stopping it if it is
+// Stoppable.
 func (r *StandardRegistry) Unregister(name string) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	delete(r.metrics, name)
+	r.unregister(name)
 }
 
 // Unregister all metrics.  (Mostly for testing.)
 func (r *StandardRegistry) UnregisterAll() {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	for name, _ := range r.metrics {
+	for name, i := range r.metrics {
+		stopMetric(i)
 		delete(r.metrics, name)
 	}
+	r.meta = make(map[string]Metadata)
+
+	// the limits stay, along with their counts of rejected registrations
+	for _, l := range r.limits {
+		l.count = 0
+		r.registerRejected(l)
+	}
 }
 
 func (r *StandardRegistry) register(name string, i interface{}) error {
@@ -137,15 +249,51 @@ func (r *StandardRegistry) register(name string, i interface{}) error {
 		return DuplicateMetric(name)
 	}
 	switch i.(type) {
-	case Counter, PeriodCounter, Gauge, GaugeFloat64, Healthcheck, Histogram, Meter, Timer:
+	case Counter, PeriodCounter, Gauge, GaugeFloat64, Healthcheck, Histogram, BucketHistogram, Meter, Timer:
 		r.metrics[name] = i
-	case DataMap, CondInt, CondFloat:
+	case MetricVec:
+		r.metrics[name] = i
+	case DataMap, dataMapState, CondInt, CondFloat:
 		//fmt.Printf("register meter type: %s %v\n", name, reflect.TypeOf(i))
 		r.metrics[name] = i
+	case Metric:
+		r.metrics[name] = i
+	default:
+		if _, ok := lookupMetricType(i); !ok {
+			return UnsupportedMetric{name, i}
+		}
+		r.metrics[name] = i
 	}
+	r.countMetric(name, 1)
+	r.touch(name)
 	return nil
 }
 
+// registerLimited registers i unless the name is past a limit; called with
+// the lock held.
+func (r *StandardRegistry) registerLimited(name string, i interface{}) error {
+	if _, ok := r.metrics[name]; !ok {
+		if l := r.limitReached(name); nil != l {
+			l.reject()
+			return CardinalityLimit(name)
+		}
+	}
+	return r.register(name, i)
+}
+
+// unregister stops and removes the metric with the given name; called with
+// the lock held.
+func (r *StandardRegistry) unregister(name string) {
+	i, ok := r.metrics[name]
+	if !ok {
+		return
+	}
+	stopMetric(i)
+	delete(r.metrics, name)
+	delete(r.meta, name)
+	r.countMetric(name, -1)
+}
+
 func (r *StandardRegistry) registered() map[string]interface{} {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -201,6 +349,11 @@ func findPrefix(registry Registry, prefix string) (Registry, string) {
 	return nil, ""
 }
 
+// Clock returns the clock of the underlying registry.
+func (r *PrefixedRegistry) Clock() Clock {
+	return registryClock(r.underlying)
+}
+
 // Get the metric by the given name or nil if none is registered.
 func (r *PrefixedRegistry) Get(name string) interface{} {
 	realName := r.prefix + name
@@ -215,17 +368,43 @@ func (r *PrefixedRegistry) GetOrRegister(name string, metric interface{}, cb int
 	return r.underlying.GetOrRegister(realName, metric, cb)
 }
 
+// Get the metadata of the metric by the given name. The name will be
+// prefixed.
+func (r *PrefixedRegistry) Meta(name string) (Metadata, bool) {
+	realName := r.prefix + name
+	return r.underlying.Meta(realName)
+}
+
 // Register the given metric under the given name. The name will be prefixed.
 func (r *PrefixedRegistry) Register(name string, metric interface{}) error {
 	realName := r.prefix + name
 	return r.underlying.Register(realName, metric)
 }
 
+// Register the given metric under the given name with metadata. The name
+// will be prefixed.
+func (r *PrefixedRegistry) RegisterWithMeta(name string, metric interface{}, meta Metadata) error {
+	realName := r.prefix + name
+	return r.underlying.RegisterWithMeta(realName, metric, meta)
+}
+
 // Run all registered healthchecks.
 func (r *PrefixedRegistry) RunHealthchecks() {
 	r.underlying.RunHealthchecks()
 }
 
+// Set the metadata of the metric by the given name. The name will be
+// prefixed.
+func (r *PrefixedRegistry) SetMeta(name string, meta Metadata) {
+	realName := r.prefix + name
+	r.underlying.SetMeta(realName, meta)
+}
+
+// Take a read-only snapshot of the metrics whose names have the prefix.
+func (r *PrefixedRegistry) Snapshot() *RegistrySnapshot {
+	return snapshotRegistry(r)
+}
+
 // Unregister the metric with the given name. The name will be prefixed.
 func (r *PrefixedRegistry) Unregister(name string) {
 	realName := r.prefix + name
@@ -256,11 +435,18 @@ func GetOrRegister(name string, i interface{}, cb interface{}) interface{} {
 }
 
 // Register the given metric under the given name.  Returns a DuplicateMetric
-// if a metric by the given name is already registered.
+// if a metric by the given name is already registered and an
+// UnsupportedMetric if the value is not a metric.
 func Register(name string, i interface{}) error {
 	return DefaultRegistry.Register(name, i)
 }
 
+// Register the given metric under the given name with metadata.  Returns a
+// DuplicateMetric if a metric by the given name is already registered.
+func RegisterWithMeta(name string, i interface{}, meta Metadata) error {
+	return DefaultRegistry.RegisterWithMeta(name, i, meta)
+}
+
 // Register the given metric under the given name.  Panics if a metric by the
 // given name is already registered.
 func MustRegister(name string, i interface{}) {
@@ -274,6 +460,21 @@ func RunHealthchecks() {
 	DefaultRegistry.RunHealthchecks()
 }
 
+// Get the metadata of the metric by the given name.
+func Meta(name string) (Metadata, bool) {
+	return DefaultRegistry.Meta(name)
+}
+
+// Set the metadata of the metric by the given name.
+func SetMeta(name string, meta Metadata) {
+	DefaultRegistry.SetMeta(name, meta)
+}
+
+// Take a read-only snapshot of every metric of the default registry.
+func Snapshot() *RegistrySnapshot {
+	return DefaultRegistry.Snapshot()
+}
+
 // Unregister the metric with the given name.
 func Unregister(name string) {
 	DefaultRegistry.Unregister(name)
@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// ExpiryConfig configures the expiry of idle metrics of a StandardRegistry,
+// for metrics created dynamically, such as one per customer, which would
+// otherwise be registered forever.
+//
+// A metric is idle while its count or value does not change and it is not
+// looked up with GetOrRegister.  The children of labeled metric families
+// expire on their own.  Healthchecks and DataMaps never expire.
+type ExpiryConfig struct {
+	TTL      time.Duration                                   // Idle time after which a metric is unregistered, zero to disable expiry
+	Interval time.Duration                                   // Time between sweeps, a quarter of TTL if zero
+	Filter   func(name string) bool                          // Metrics which may expire, every metric if nil
+	OnEvict  func(name string, labels Labels, i interface{}) // Called with every expired metric, may be nil
+	Evicted  Counter                                         // Incremented for every expired metric if set; it never expires itself
+}
+
+type registryExpiry struct {
+	config  ExpiryConfig
+	stop    chan struct{}
+	touched map[string]time.Time // last GetOrRegister of every name
+}
+
+// idleState is the last change of a metric seen by a sweep.
+type idleState struct {
+	signature interface{}
+	since     time.Time
+}
+
+// SetExpiry sets the expiry policy of the registry and starts a goroutine
+// which expires idle metrics every c.Interval, replacing the one of the
+// previous policy.  A zero TTL stops expiring metrics.
+func (r *StandardRegistry) SetExpiry(c ExpiryConfig) {
+	if c.Interval <= 0 {
+		c.Interval = c.TTL / 4
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if nil != r.expiry {
+		close(r.expiry.stop)
+		r.expiry = nil
+	}
+	if c.TTL <= 0 {
+		return
+	}
+	r.expiry = &registryExpiry{config: c, stop: make(chan struct{}), touched: make(map[string]time.Time)}
+	go r.expire(c.Interval, r.expiry.stop)
+}
+
+func (r *StandardRegistry) expire(d time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.ExpireIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ExpireIdle unregisters the metrics which have been idle for longer than
+// the TTL of the expiry policy, stopping them, and returns how many it
+// unregistered.  It is called every interval once SetExpiry is called.
+func (r *StandardRegistry) ExpireIdle() int {
+	r.idleMutex.Lock()
+	defer r.idleMutex.Unlock()
+	r.mutex.Lock()
+	if nil == r.expiry {
+		r.mutex.Unlock()
+		return 0
+	}
+	c := r.expiry.config
+	touched := make(map[string]time.Time, len(r.expiry.touched))
+	for name, ts := range r.expiry.touched {
+		touched[name] = ts
+	}
+	r.mutex.Unlock()
+
+	now := r.clock.Now()
+	seen := make(map[string]idleState, len(r.idle))
+	expired := 0
+	// idle reports whether the metric under key has been idle for longer
+	// than the TTL, noting when its signature last changed
+	idle := func(key, name string, i interface{}) bool {
+		signature, ok := idleSignature(i)
+		if !ok {
+			return false
+		}
+		state, ok := r.idle[key]
+		if !ok || state.signature != signature {
+			state = idleState{signature, now}
+		}
+		seen[key] = state
+		since := state.since
+		if ts, ok := touched[name]; ok && ts.After(since) {
+			since = ts
+		}
+		return now.Sub(since) >= c.TTL
+	}
+	evicted := func(name string, labels Labels, i interface{}) {
+		expired++
+		if nil != c.Evicted {
+			c.Evicted.Inc(1)
+		}
+		if nil != c.OnEvict {
+			c.OnEvict(name, labels, i)
+		}
+	}
+
+	for name, i := range r.registered() {
+		if nil != c.Filter && !c.Filter(name) || sameMetric(i, c.Evicted) {
+			continue
+		}
+		if vec, ok := i.(MetricVec); ok {
+			vec.Each(func(labels Labels, child interface{}) {
+				key := name + labels.String()
+				if !idle(key, name, child) {
+					return
+				}
+				values := make([]string, len(labels))
+				for j, l := range labels {
+					values[j] = l.Value
+				}
+				if vec.DeleteLabelValues(values...) {
+					delete(seen, key)
+					evicted(name, labels, child)
+				}
+			})
+			continue
+		}
+		if !idle(name, name, i) {
+			continue
+		}
+		r.mutex.Lock()
+		ok := sameMetric(r.metrics[name], i)
+		if ok {
+			r.unregister(name)
+			if nil != r.expiry {
+				delete(r.expiry.touched, name)
+			}
+		}
+		r.mutex.Unlock()
+		if ok {
+			delete(seen, name)
+			evicted(name, nil, i)
+		}
+	}
+	r.idle = seen
+
+	// forget the names unregistered since
+	r.mutex.Lock()
+	if nil != r.expiry {
+		for name := range r.expiry.touched {
+			if _, ok := r.metrics[name]; !ok {
+				delete(r.expiry.touched, name)
+			}
+		}
+	}
+	r.mutex.Unlock()
+	return expired
+}
+
+// touch notes that the metric with the given name is in use; called with
+// the lock held.
+func (r *StandardRegistry) touch(name string) {
+	if nil != r.expiry {
+		r.expiry.touched[name] = r.clock.Now()
+	}
+}
+
+// idleSignature returns a value which changes whenever the metric is
+// updated, or false if the metric never expires.
+func idleSignature(i interface{}) (interface{}, bool) {
+	switch metric := i.(type) {
+	case Counter:
+		return metric.Count(), true
+	case Gauge:
+		return metric.Value(), true
+	case GaugeFloat64:
+		return metric.Value(), true
+	case Histogram:
+		return metric.Count(), true
+	case BucketHistogram:
+		return metric.Count(), true
+	case Meter:
+		return metric.Count(), true
+	case Timer:
+		return metric.Count(), true
+	case PeriodCounter:
+		return metric.Count(), true
+	case CondInt:
+		return metric.Value(), true
+	case CondFloat:
+		return metric.Value(), true
+	case Healthcheck, dataMapState:
+		return nil, false
+	}
+	ms := FlattenMetric("", nil, i, FlattenOptions{})
+	if 0 == len(ms) {
+		return nil, false
+	}
+	return fmt.Sprint(ms[0].Fields), true
+}
+
+// sameMetric reports whether a and b are the same metric without panicking
+// on metrics of types which are not comparable.
+func sameMetric(a, b interface{}) bool {
+	if nil == a || nil == b || reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newExpiringRegistry(c ExpiryConfig) (*StandardRegistry, *ManualClock) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock).(*StandardRegistry)
+	r.SetExpiry(c)
+	return r, clock
+}
+
+func TestExpireIdle(t *testing.T) {
+	var evicted []string
+	r, clock := newExpiringRegistry(ExpiryConfig{
+		TTL:      time.Minute,
+		Interval: time.Hour,
+		OnEvict:  func(name string, _ Labels, _ interface{}) { evicted = append(evicted, name) },
+		Evicted:  NewCounter(),
+	})
+	defer r.SetExpiry(ExpiryConfig{})
+	idle := GetOrRegisterCounter("idle", r)
+	busy := GetOrRegisterCounter("busy", r)
+	r.Register("health", NewHealthcheck(func(Healthcheck) {}))
+	r.Register("evicted", r.expiry.config.Evicted)
+	if n := r.ExpireIdle(); 0 != n {
+		t.Fatal(n)
+	}
+	clock.Add(40 * time.Second)
+	idle.Inc(1)
+	busy.Inc(1)
+	r.ExpireIdle()
+	clock.Add(40 * time.Second)
+	busy.Inc(1)
+	if n := r.ExpireIdle(); 0 != n {
+		t.Fatal(n)
+	}
+	clock.Add(40 * time.Second)
+	if n := r.ExpireIdle(); 1 != n {
+		t.Fatal(n)
+	}
+	if nil != r.Get("idle") || nil == r.Get("busy") || nil == r.Get("health") || nil == r.Get("evicted") {
+		t.Fatal(r.registered())
+	}
+	if 1 != len(evicted) || "idle" != evicted[0] {
+		t.Fatal(evicted)
+	}
+	if count := r.expiry.config.Evicted.Count(); 1 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestExpireIdleGetOrRegister(t *testing.T) {
+	r, clock := newExpiringRegistry(ExpiryConfig{TTL: time.Minute, Interval: time.Hour})
+	defer r.SetExpiry(ExpiryConfig{})
+	GetOrRegisterGauge("foo", r)
+	r.ExpireIdle()
+	clock.Add(50 * time.Second)
+	GetOrRegisterGauge("foo", r)
+	clock.Add(50 * time.Second)
+	if n := r.ExpireIdle(); 0 != n {
+		t.Fatal(n)
+	}
+	clock.Add(10 * time.Second)
+	if n := r.ExpireIdle(); 1 != n {
+		t.Fatal(n)
+	}
+}
+
+func TestExpireIdleMeter(t *testing.T) {
+	r, clock := newExpiringRegistry(ExpiryConfig{TTL: time.Minute, Interval: time.Hour})
+	defer r.SetExpiry(ExpiryConfig{})
+	m := GetOrRegisterMeter("foo", r).(*StandardMeter)
+	r.ExpireIdle()
+	clock.Add(time.Minute)
+	if n := r.ExpireIdle(); 1 != n {
+		t.Fatal(n)
+	}
+	arbiter.Lock()
+	_, ok := arbiter.meters[m]
+	arbiter.Unlock()
+	if ok {
+		t.Fatal("expired meter still ticked")
+	}
+}
+
+func TestExpireIdleFilter(t *testing.T) {
+	r, clock := newExpiringRegistry(ExpiryConfig{
+		TTL:      time.Minute,
+		Interval: time.Hour,
+		Filter:   func(name string) bool { return strings.HasPrefix(name, "customer.") },
+	})
+	defer r.SetExpiry(ExpiryConfig{})
+	GetOrRegisterCounter("customer.foo", r)
+	GetOrRegisterCounter("requests", r)
+	r.ExpireIdle()
+	clock.Add(time.Minute)
+	if n := r.ExpireIdle(); 1 != n {
+		t.Fatal(n)
+	}
+	if nil == r.Get("requests") {
+		t.Fatal("filtered metric expired")
+	}
+}
+
+func TestExpireIdleVec(t *testing.T) {
+	var labels []Labels
+	r, clock := newExpiringRegistry(ExpiryConfig{
+		TTL:      time.Minute,
+		Interval: time.Hour,
+		OnEvict:  func(_ string, ls Labels, _ interface{}) { labels = append(labels, ls) },
+	})
+	defer r.SetExpiry(ExpiryConfig{})
+	v := NewRegisteredCounterVec("requests", r, "customer")
+	v.WithLabelValues("foo").Inc(1)
+	v.WithLabelValues("bar").Inc(1)
+	r.ExpireIdle()
+	clock.Add(30 * time.Second)
+	v.WithLabelValues("bar").Inc(1)
+	r.ExpireIdle()
+	clock.Add(30 * time.Second)
+	if n := r.ExpireIdle(); 1 != n {
+		t.Fatal(n)
+	}
+	if 1 != len(labels) || "foo" != labels[0][0].Value {
+		t.Fatal(labels)
+	}
+	if nil == r.Get("requests") {
+		t.Fatal("family unregistered")
+	}
+	n := 0
+	v.Each(func(Labels, interface{}) { n++ })
+	if 1 != n {
+		t.Fatal(n)
+	}
+}
+
+func TestExpireIdleDisabled(t *testing.T) {
+	r, clock := newExpiringRegistry(ExpiryConfig{})
+	GetOrRegisterCounter("foo", r)
+	r.ExpireIdle()
+	clock.Add(time.Hour)
+	if n := r.ExpireIdle(); 0 != n {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,204 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// OverflowName is the name, after the prefix of a cardinality limit, of the
+// metrics shared by the names registered past the limit.  They are named
+// after their type, such as __overflow__.timer, next to the gauge
+// __overflow__.rejected of the number of rejected registrations.  The
+// overflow metrics of a limit, and of the limits on longer prefixes within
+// it, are not counted against it.
+const OverflowName = "__overflow__"
+
+// CardinalityLimit is the error returned by Registry.Register when the
+// registry already holds the maximum number of metrics.
+type CardinalityLimit string
+
+func (err CardinalityLimit) Error() string {
+	return fmt.Sprintf("too many metrics: %s", string(err))
+}
+
+// registryLimit is the maximum number of metrics whose names have a prefix.
+type registryLimit struct {
+	prefix   string
+	max      int
+	count    int
+	rejected Gauge
+
+	// names of the overflow families of rejected family names and types,
+	// at most max of them
+	vecs map[string]string
+}
+
+// reject counts a registration rejected by the limit.
+func (l *registryLimit) reject() {
+	l.rejected.Update(l.rejected.Value() + 1)
+}
+
+// SetMaxMetrics limits the number of metrics of the registry to n, or
+// removes the limit if n is zero.  Past the limit, GetOrRegister returns a
+// metric of the same type shared by every new name, registered under
+// OverflowName, and Register returns a CardinalityLimit.
+func (r *StandardRegistry) SetMaxMetrics(n int) {
+	r.setLimit("", n)
+}
+
+// SetMaxMetrics limits the number of metrics whose names have the prefix to
+// n, or removes the limit if n is zero.  Metrics past the limit are
+// registered under the prefix followed by OverflowName.  It does nothing if
+// the underlying registry is not a StandardRegistry.
+func (r *PrefixedRegistry) SetMaxMetrics(n int) {
+	if base, prefix := findPrefix(r, ""); nil != base {
+		base.(*StandardRegistry).setLimit(prefix, n)
+	}
+}
+
+func (r *StandardRegistry) setLimit(prefix string, n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for j, l := range r.limits {
+		if prefix != l.prefix {
+			continue
+		}
+		if n <= 0 {
+			r.limits = append(r.limits[:j], r.limits[j+1:]...)
+
+			// the overflow metrics of the removed limit count now
+			for _, l := range r.limits {
+				r.recount(l)
+			}
+		} else {
+			l.max = n
+		}
+		return
+	}
+	if n <= 0 {
+		return
+	}
+	l := &registryLimit{prefix: prefix, max: n, rejected: NewGauge()}
+	r.limits = append(r.limits, l)
+	r.recount(l)
+
+	// the most specific limit applies first
+	sort.Slice(r.limits, func(a, b int) bool {
+		return len(r.limits[a].prefix) > len(r.limits[b].prefix)
+	})
+	r.registerRejected(l)
+}
+
+// recount counts the metrics of l; called with the lock held.
+func (r *StandardRegistry) recount(l *registryLimit) {
+	l.count = 0
+	for name := range r.metrics {
+		if strings.HasPrefix(name, l.prefix) && !r.isOverflow(l, name) {
+			l.count++
+		}
+	}
+}
+
+// registerRejected registers the gauge of the rejected registrations of l.
+func (r *StandardRegistry) registerRejected(l *registryLimit) {
+	name := l.prefix + OverflowName + ".rejected"
+	if _, ok := r.metrics[name]; !ok {
+		r.register(name, l.rejected)
+	}
+}
+
+// limitReached returns the limit which name may not be registered past or
+// nil; called with the lock held.
+func (r *StandardRegistry) limitReached(name string) *registryLimit {
+	for _, l := range r.limits {
+		if strings.HasPrefix(name, l.prefix) && l.count >= l.max && !r.isOverflow(l, name) {
+			return l
+		}
+	}
+	return nil
+}
+
+// countMetric adds delta to the count of every limit of name; called with
+// the lock held.
+func (r *StandardRegistry) countMetric(name string, delta int) {
+	for _, l := range r.limits {
+		if strings.HasPrefix(name, l.prefix) && !r.isOverflow(l, name) {
+			l.count += delta
+		}
+	}
+}
+
+// overflow returns the overflow metric of l of the type of i for the
+// rejected name, constructing it from i and cb as GetOrRegister does if
+// there is none yet; called with the lock held.
+func (r *StandardRegistry) overflow(l *registryLimit, rejected string, i interface{}, cb interface{}) interface{} {
+	l.reject()
+	t := reflect.TypeOf(i)
+	if reflect.Func == t.Kind() && 1 == t.NumOut() {
+		t = t.Out(0)
+	}
+	name := l.prefix + OverflowName + "." + overflowKind(t)
+
+	// families only share an overflow family with the same label names,
+	// which takes constructing the family once per rejected name
+	var metric interface{}
+	if t.Implements(metricVecType) {
+		key := rejected + "\x00" + name
+		if cached, ok := l.vecs[key]; ok {
+			if existing, ok := r.metrics[cached]; ok {
+				return existing
+			}
+		}
+		metric = construct(name, i, cb)
+		name += "." + strings.Join(metric.(MetricVec).LabelNames(), ".")
+		l.cacheVec(key, name)
+	}
+	if existing, ok := r.metrics[name]; ok {
+		return existing
+	}
+	if nil == metric {
+		metric = construct(name, i, cb)
+	}
+	if err := r.register(name, metric); nil != err {
+		panic(err)
+	}
+	return metric
+}
+
+// cacheVec remembers the name of the overflow family of key.
+func (l *registryLimit) cacheVec(key, name string) {
+	if nil == l.vecs {
+		l.vecs = make(map[string]string)
+	}
+	if _, ok := l.vecs[key]; ok || len(l.vecs) < l.max {
+		l.vecs[key] = name
+	}
+}
+
+var metricVecType = reflect.TypeOf((*MetricVec)(nil)).Elem()
+
+// overflowKind names the overflow metric of type t, such as timer for a
+// Timer or a *StandardTimer.
+func overflowKind(t reflect.Type) string {
+	if reflect.Ptr == t.Kind() {
+		t = t.Elem()
+	}
+	name := strings.TrimPrefix(t.Name(), "Standard")
+	if "" == name {
+		return "metric"
+	}
+	return strings.ToLower(name)
+}
+
+// isOverflow reports whether name is an overflow metric of l or of a limit
+// on a longer prefix within l; called with the lock held.
+func (r *StandardRegistry) isOverflow(l *registryLimit, name string) bool {
+	for _, o := range r.limits {
+		if strings.HasPrefix(o.prefix, l.prefix) && strings.HasPrefix(name, o.prefix+OverflowName+".") {
+			return true
+		}
+	}
+	return false
+}
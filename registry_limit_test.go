@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMaxMetrics(t *testing.T) {
+	r := NewRegistry().(*StandardRegistry)
+	r.SetMaxMetrics(2)
+	foo := GetOrRegisterTimer("foo", r)
+	GetOrRegisterTimer("bar", r)
+	baz := GetOrRegisterTimer("baz", r)
+	qux := GetOrRegisterTimer("qux", r)
+	if baz != qux || baz == foo {
+		t.Fatal(baz, qux)
+	}
+	if nil != r.Get("baz") || baz != r.Get(OverflowName+".timer") {
+		t.Fatal(r.registered())
+	}
+	if foo != GetOrRegisterTimer("foo", r) {
+		t.Fatal("registered metric overflowed")
+	}
+	c := GetOrRegisterCounter("counter", r)
+	if c != r.Get(OverflowName+".counter") {
+		t.Fatal(r.registered())
+	}
+	if err := r.Register("meter", NewMeter()); nil == err {
+		t.Fatal("registered past the limit")
+	} else if _, ok := err.(CardinalityLimit); !ok {
+		t.Fatal(err)
+	}
+	if v := r.Get(OverflowName + ".rejected").(Gauge).Value(); 4 != v {
+		t.Fatal(v)
+	}
+	r.Unregister("bar")
+	if err := r.Register("meter", NewMeter()); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxMetricsUnlimited(t *testing.T) {
+	r := NewRegistry().(*StandardRegistry)
+	r.SetMaxMetrics(1)
+	r.SetMaxMetrics(0)
+	GetOrRegisterCounter("foo", r)
+	if c := GetOrRegisterCounter("bar", r); c != r.Get("bar") {
+		t.Fatal(r.registered())
+	}
+}
+
+func TestMaxMetricsExisting(t *testing.T) {
+	r := NewRegistry().(*StandardRegistry)
+	GetOrRegisterCounter("foo", r)
+	GetOrRegisterCounter("bar", r)
+	r.SetMaxMetrics(2)
+	if err := r.Register("baz", NewCounter()); nil == err {
+		t.Fatal("registered past the limit")
+	}
+	r.UnregisterAll()
+	if err := r.Register("baz", NewCounter()); nil != err {
+		t.Fatal(err)
+	}
+	if nil == r.Get(OverflowName+".rejected") {
+		t.Fatal(r.registered())
+	}
+}
+
+func TestMaxMetricsPrefixed(t *testing.T) {
+	r := NewRegistry()
+	p := NewPrefixedChildRegistry(r, "http.").(*PrefixedRegistry)
+	p.SetMaxMetrics(1)
+	GetOrRegisterCounter("requests./", p)
+	c := GetOrRegisterCounter("requests./foo", p)
+	if c != r.Get("http."+OverflowName+".counter") {
+		t.Fatal(r.(*StandardRegistry).registered())
+	}
+	GetOrRegisterCounter("foo", r)
+	if c := GetOrRegisterCounter("bar", r); c != r.Get("bar") {
+		t.Fatal("limited outside the prefix")
+	}
+	if v := p.Get(OverflowName + ".rejected").(Gauge).Value(); 1 != v {
+		t.Fatal(v)
+	}
+}
+
+func TestMaxMetricsOverflowName(t *testing.T) {
+	r := NewRegistry().(*StandardRegistry)
+	r.SetMaxMetrics(1)
+	GetOrRegisterCounter("foo", r)
+	for _, name := range []string{"foo." + OverflowName, "http." + OverflowName + ".counter"} {
+		if c := GetOrRegisterCounter(name, r); c != r.Get(OverflowName+".counter") {
+			t.Fatal(name, r.registered())
+		}
+	}
+}
+
+func TestMaxMetricsOverflowNested(t *testing.T) {
+	r := NewRegistry().(*StandardRegistry)
+	p := NewPrefixedChildRegistry(r, "http.").(*PrefixedRegistry)
+	r.SetMaxMetrics(2)
+	p.SetMaxMetrics(1)
+	GetOrRegisterCounter("requests./", p)
+	c := GetOrRegisterCounter("requests./foo", p)
+	if c != r.Get("http."+OverflowName+".counter") {
+		t.Fatal(r.registered())
+	}
+	if c := GetOrRegisterCounter("foo", r); c != r.Get("foo") {
+		t.Fatal("counted the nested overflow metrics", r.registered())
+	}
+	p.SetMaxMetrics(0)
+	if c := GetOrRegisterCounter("bar", r); c != r.Get(OverflowName+".counter") {
+		t.Fatal(r.registered())
+	}
+}
+
+func TestMaxMetricsVec(t *testing.T) {
+	r := NewRegistry().(*StandardRegistry)
+	r.SetMaxMetrics(1)
+	GetOrRegisterCounter("foo", r)
+	a := GetOrRegisterCounterVec("a", r, "method")
+	b := GetOrRegisterCounterVec("b", r, "method")
+	c := GetOrRegisterCounterVec("c", r, "method", "code")
+	if a != b || a == c {
+		t.Fatal(a, b, c)
+	}
+	c.WithLabelValues("GET", "200").Inc(1)
+	if c != r.Get(OverflowName+".countervec.method.code") {
+		t.Fatal(r.registered())
+	}
+}
+
+func TestMaxMetricsVecConstructedOnce(t *testing.T) {
+	r := NewRegistry().(*StandardRegistry)
+	r.SetMaxMetrics(1)
+	GetOrRegisterCounter("foo", r)
+	constructed := 0
+	newVec := func() CounterVec {
+		constructed++
+		return NewCounterVec("method")
+	}
+	a := r.GetOrRegister("a", newVec, nil)
+	for i := 0; i < 10; i++ {
+		if a != r.GetOrRegister("a", newVec, nil) {
+			t.Fatal("overflow family changed")
+		}
+	}
+	if 1 != constructed {
+		t.Errorf("constructed: 1 != %v\n", constructed)
+	}
+	if a != r.GetOrRegister("b", newVec, nil) || 2 != constructed {
+		t.Errorf("constructed: 2 != %v\n", constructed)
+	}
+
+	// the cache is bounded by the limit
+	for i := 0; i < 10; i++ {
+		r.GetOrRegister(fmt.Sprintf("c%d", i), newVec, nil)
+		r.GetOrRegister(fmt.Sprintf("c%d", i), newVec, nil)
+	}
+	if 1 != len(r.limits[0].vecs) {
+		t.Errorf("len(vecs): 1 != %v\n", len(r.limits[0].vecs))
+	}
+}
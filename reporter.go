@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReportLoop calls report every d until ctx is done, then calls it one last
+// time so the final partial interval is flushed before ReportLoop returns.
+// Errors returned by report are passed to onError, which may be nil to
+// discard them.  This is the loop shared by every stoppable reporter.
+//
+// A d that is not positive is passed to onError as an InvalidInterval and
+// ReportLoop returns without reporting.
+func ReportLoop(ctx context.Context, d time.Duration, report func() error, onError func(error)) {
+	if d <= 0 {
+		if nil != onError {
+			onError(InvalidInterval(d))
+		}
+		return
+	}
+	flush := func() {
+		if err := report(); nil != err && nil != onError {
+			onError(err)
+		}
+	}
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			flush()
+			return
+		}
+	}
+}
+
+// InvalidInterval is the error of a reporter started with an interval that
+// is not positive.
+type InvalidInterval time.Duration
+
+func (err InvalidInterval) Error() string {
+	return fmt.Sprintf("metrics: invalid report interval %v", time.Duration(err))
+}
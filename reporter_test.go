@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportLoopFinalFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls, errs := 0, 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ReportLoop(ctx, time.Hour, func() error {
+			calls++
+			return errors.New("flush failed")
+		}, func(error) { errs++ })
+	}()
+	cancel()
+	<-done
+	if 1 != calls {
+		t.Errorf("calls: 1 != %v\n", calls)
+	}
+	if 1 != errs {
+		t.Errorf("errs: 1 != %v\n", errs)
+	}
+}
+
+func TestReportLoopTicks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	ReportLoop(ctx, time.Millisecond, func() error {
+		if calls++; 3 == calls {
+			cancel()
+		}
+		return nil
+	}, nil)
+	// a tick may race the cancellation, but the final flush always follows it
+	if calls < 4 {
+		t.Errorf("calls: 4 > %v\n", calls)
+	}
+}
+
+func TestWriteJSONWithContext(t *testing.T) {
+	r := NewRegistry()
+	r.Register("counter", NewCounter())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := &bytes.Buffer{}
+	WriteJSONWithContext(ctx, r, time.Hour, b, func(err error) { t.Fatal(err) })
+	if s := b.String(); "{\"counter\":{\"count\":0}}\n" != s {
+		t.Fatal(s)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteWithContextError(t *testing.T) {
+	r := NewRegistry()
+	r.Register("foo", NewCounter())
+	r.Register("bar", NewCounter())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var errs []error
+	WriteWithContext(ctx, r, time.Hour, failingWriter{}, func(err error) { errs = append(errs, err) })
+	if 1 != len(errs) || "write failed" != errs[0].Error() {
+		t.Fatal(errs)
+	}
+}
+
+func TestCaptureWithContextInvalidInterval(t *testing.T) {
+	r := NewRegistry()
+	var errs []error
+	onError := func(err error) { errs = append(errs, err) }
+	LogWithContext(context.Background(), r, 0, &bufferLogger{}, onError)
+	CaptureRuntimeMemStatsWithContext(context.Background(), r, 0, onError)
+	CaptureDebugGCStatsWithContext(context.Background(), r, 0, onError)
+	if 3 != len(errs) {
+		t.Fatal(errs)
+	}
+}
+
+func TestReportLoopInvalidInterval(t *testing.T) {
+	var errs []error
+	ReportLoop(context.Background(), 0, func() error {
+		t.Fatal("reported")
+		return nil
+	}, func(err error) { errs = append(errs, err) })
+	if 1 != len(errs) {
+		t.Fatal(errs)
+	}
+	if _, ok := errs[0].(InvalidInterval); !ok {
+		t.Fatal(errs[0])
+	}
+}
+
+type bufferLogger struct{ bytes.Buffer }
+
+func (l *bufferLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(&l.Buffer, format, v...)
+}
+
+func TestPeriodicReportersGated(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	GetOrRegisterCondInt("cond", r, time.Minute).Update(47)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for name, write := range map[string]func(w *bytes.Buffer){
+		"json":   func(w *bytes.Buffer) { WriteJSONWithContext(ctx, r, time.Hour, w, nil) },
+		"writer": func(w *bytes.Buffer) { WriteWithContext(ctx, r, time.Hour, w, nil) },
+		"log": func(w *bytes.Buffer) {
+			l := &bufferLogger{}
+			LogWithContext(ctx, r, time.Hour, l, nil)
+			w.Write(l.Bytes())
+		},
+	} {
+		clock.Add(time.Minute)
+		b := &bytes.Buffer{}
+		write(b)
+		if !strings.Contains(b.String(), "47") {
+			t.Fatalf("%s: cond not written once its window elapsed: %q", name, b.String())
+		}
+		b.Reset()
+		write(b)
+		if strings.Contains(b.String(), "47") {
+			t.Fatalf("%s: cond written twice in its window: %q", name, b.String())
+		}
+	}
+
+	// one-shot writes do not consume the window
+	b := &bytes.Buffer{}
+	WriteOnce(r, b)
+	WriteJSONOnce(r, b)
+	if 2 != strings.Count(b.String(), "47") {
+		t.Fatal(b.String())
+	}
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"context"
 	"runtime"
 	"runtime/pprof"
 	"time"
@@ -60,6 +61,16 @@ func CaptureRuntimeMemStats(r Registry, d time.Duration) {
 	}
 }
 
+// Capture new values for the Go runtime statistics exported in
+// runtime.MemStats until ctx is done, capturing them one last time before
+// returning.  An InvalidInterval is passed to onError.
+func CaptureRuntimeMemStatsWithContext(ctx context.Context, r Registry, d time.Duration, onError func(error)) {
+	ReportLoop(ctx, d, func() error {
+		CaptureRuntimeMemStatsOnce(r)
+		return nil
+	}, onError)
+}
+
 // Capture new values for the Go runtime statistics exported in
 // runtime.MemStats.  This is designed to be called in a background
 // goroutine.  Giving a registry which has not been given to
@@ -209,4 +220,32 @@ func RegisterRuntimeMemStats(r Registry) {
 	r.Register("runtime.NumGoroutine", runtimeMetrics.NumGoroutine)
 	r.Register("runtime.NumThread", runtimeMetrics.NumThread)
 	r.Register("runtime.ReadMemStats", runtimeMetrics.ReadMemStats)
+
+	for name, unit := range runtimeMemStatsUnits {
+		r.SetMeta(name, Metadata{Unit: unit})
+	}
+}
+
+// runtimeMemStatsUnits are the units of the runtime metrics which have one.
+var runtimeMemStatsUnits = map[string]string{
+	"runtime.MemStats.Alloc":        "bytes",
+	"runtime.MemStats.BuckHashSys":  "bytes",
+	"runtime.MemStats.HeapAlloc":    "bytes",
+	"runtime.MemStats.HeapIdle":     "bytes",
+	"runtime.MemStats.HeapInuse":    "bytes",
+	"runtime.MemStats.HeapReleased": "bytes",
+	"runtime.MemStats.HeapSys":      "bytes",
+	"runtime.MemStats.LastGC":       "ns", // since the Unix epoch
+	"runtime.MemStats.MCacheInuse":  "bytes",
+	"runtime.MemStats.MCacheSys":    "bytes",
+	"runtime.MemStats.MSpanInuse":   "bytes",
+	"runtime.MemStats.MSpanSys":     "bytes",
+	"runtime.MemStats.NextGC":       "bytes",
+	"runtime.MemStats.PauseNs":      "ns",
+	"runtime.MemStats.PauseTotalNs": "ns",
+	"runtime.MemStats.StackInuse":   "bytes",
+	"runtime.MemStats.StackSys":     "bytes",
+	"runtime.MemStats.Sys":          "bytes",
+	"runtime.MemStats.TotalAlloc":   "bytes",
+	"runtime.ReadMemStats":          "ns",
 }
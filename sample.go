@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"encoding/binary"
+	"errors"
 	"math"
 	"math/rand"
 	"sort"
@@ -36,6 +38,7 @@ type Sample interface {
 // <http://dimacs.rutgers.edu/~graham/pubs/papers/fwddecay.pdf>
 type ExpDecaySample struct {
 	alpha         float64
+	clock         Clock
 	count         int64
 	mutex         sync.Mutex
 	reservoirSize int
@@ -46,13 +49,20 @@ type ExpDecaySample struct {
 // NewExpDecaySample constructs a new exponentially-decaying sample with the
 // given reservoir size and alpha.
 func NewExpDecaySample(reservoirSize int, alpha float64) Sample {
+	return NewExpDecaySampleWithClock(reservoirSize, alpha, DefaultClock)
+}
+
+// NewExpDecaySampleWithClock constructs a new exponentially-decaying sample
+// which timestamps and rescales its values with the given clock.
+func NewExpDecaySampleWithClock(reservoirSize int, alpha float64, c Clock) Sample {
 	if UseNilMetrics {
 		return NilSample{}
 	}
 	s := &ExpDecaySample{
 		alpha:         alpha,
+		clock:         c,
 		reservoirSize: reservoirSize,
-		t0:            time.Now(),
+		t0:            c.Now(),
 		values:        newExpDecaySampleHeap(reservoirSize),
 	}
 	s.t1 = s.t0.Add(rescaleThreshold)
@@ -64,11 +74,22 @@ func (s *ExpDecaySample) Clear() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.count = 0
-	s.t0 = time.Now()
+	s.t0 = s.clock.Now()
 	s.t1 = s.t0.Add(rescaleThreshold)
 	s.values.Clear()
 }
 
+func (s *ExpDecaySample) adoptClock(c Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if DefaultClock != s.clock || 0 != s.count {
+		return
+	}
+	s.clock = c
+	s.t0 = c.Now()
+	s.t1 = s.t0.Add(rescaleThreshold)
+}
+
 // Count returns the number of samples recorded, which may exceed the
 // reservoir size.
 func (s *ExpDecaySample) Count() int64 {
@@ -139,7 +160,7 @@ func (s *ExpDecaySample) Sum() int64 {
 
 // Update samples a new value.
 func (s *ExpDecaySample) Update(v int64) {
-	s.update(time.Now(), v)
+	s.update(s.clock.Now(), v)
 }
 
 // Values returns a copy of the values in the sample.
@@ -300,6 +321,187 @@ func SamplePercentiles(values int64Slice, ps []float64) []float64 {
 type SampleSnapshot struct {
 	count  int64
 	values []int64
+	stats  sampleStats // statistics of samples which keep no values
+}
+
+// sampleStats are the statistics of a Sample which summarizes the values
+// recorded instead of keeping them.  A SampleSnapshot with stats answers
+// from them instead of from its values.
+type sampleStats interface {
+	Max() int64
+	Mean() float64
+	Min() int64
+	Percentiles([]float64) []float64
+	Size() int
+	StdDev() float64
+	Sum() int64
+	Variance() float64
+}
+
+// sampleMoments are the exact count, minimum, maximum, sum, mean and
+// variance of the values recorded by a sample which keeps no values.
+type sampleMoments struct {
+	count    int64
+	min, max int64
+	sum      int64
+	mean, m2 float64 // running mean and sum of squared deviations
+}
+
+func (m *sampleMoments) add(v int64) {
+	if 0 == m.count || v < m.min {
+		m.min = v
+	}
+	if 0 == m.count || v > m.max {
+		m.max = v
+	}
+	m.count++
+	m.sum += v
+	d := float64(v) - m.mean
+	m.mean += d / float64(m.count)
+	m.m2 += d * (float64(v) - m.mean)
+}
+
+// merge adds the values recorded by o.
+func (m *sampleMoments) merge(o sampleMoments) {
+	if 0 == o.count {
+		return
+	}
+	if 0 == m.count {
+		*m = o
+		return
+	}
+	if o.min < m.min {
+		m.min = o.min
+	}
+	if o.max > m.max {
+		m.max = o.max
+	}
+	count := float64(m.count + o.count)
+	d := o.mean - m.mean
+	m.mean += d * float64(o.count) / count
+	m.m2 += o.m2 + d*d*float64(m.count)*float64(o.count)/count
+	m.count += o.count
+	m.sum += o.sum
+}
+
+func (m *sampleMoments) Max() int64 { return m.max }
+
+// Mean returns the running mean, which unlike the sum cannot overflow.
+func (m *sampleMoments) Mean() float64 { return m.mean }
+
+func (m *sampleMoments) Min() int64 { return m.min }
+
+func (m *sampleMoments) Size() int { return int(m.count) }
+
+func (m *sampleMoments) StdDev() float64 { return math.Sqrt(m.Variance()) }
+
+func (m *sampleMoments) Sum() int64 { return m.sum }
+
+func (m *sampleMoments) Variance() float64 {
+	if 0 == m.count {
+		return 0.0
+	}
+	return m.m2 / float64(m.count)
+}
+
+// appendMoments appends the binary encoding of m to b.
+func appendMoments(b []byte, m *sampleMoments) []byte {
+	b = appendVarint(b, m.count)
+	b = appendVarint(b, m.min)
+	b = appendVarint(b, m.max)
+	b = appendVarint(b, m.sum)
+	b = appendFloat64(b, m.mean)
+	return appendFloat64(b, m.m2)
+}
+
+func appendFloat64(b []byte, f float64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+	return append(b, buf[:]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// binaryReader decodes what the append functions encode.  The first error
+// is kept in err and every read after it returns zero.
+type binaryReader struct {
+	b   []byte
+	err error
+}
+
+var errShortBuffer = errors.New("unexpected end of data")
+
+func (r *binaryReader) byte() byte {
+	if nil != r.err || 0 == len(r.b) {
+		r.err = errShortBuffer
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *binaryReader) float64() float64 {
+	if nil != r.err || len(r.b) < 8 {
+		r.err = errShortBuffer
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(r.b))
+	r.b = r.b[8:]
+	return f
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if nil != r.err {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if nil != r.err {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// count reads a uvarint which must fit in an int64.
+func (r *binaryReader) count() int64 {
+	v := r.uvarint()
+	if v > math.MaxInt64 {
+		r.err = errors.New("count out of range")
+		return 0
+	}
+	return int64(v)
+}
+
+func (r *binaryReader) moments(m *sampleMoments) {
+	m.count = r.varint()
+	m.min = r.varint()
+	m.max = r.varint()
+	m.sum = r.varint()
+	m.mean = r.float64()
+	m.m2 = r.float64()
 }
 
 func NewSampleSnapshot(count int64, values []int64) *SampleSnapshot {
@@ -318,38 +520,71 @@ func (*SampleSnapshot) Clear() {
 func (s *SampleSnapshot) Count() int64 { return s.count }
 
 // Max returns the maximal value at the time the snapshot was taken.
-func (s *SampleSnapshot) Max() int64 { return SampleMax(s.values) }
+func (s *SampleSnapshot) Max() int64 {
+	if nil != s.stats {
+		return s.stats.Max()
+	}
+	return SampleMax(s.values)
+}
 
 // Mean returns the mean value at the time the snapshot was taken.
-func (s *SampleSnapshot) Mean() float64 { return SampleMean(s.values) }
+func (s *SampleSnapshot) Mean() float64 {
+	if nil != s.stats {
+		return s.stats.Mean()
+	}
+	return SampleMean(s.values)
+}
 
 // Min returns the minimal value at the time the snapshot was taken.
-func (s *SampleSnapshot) Min() int64 { return SampleMin(s.values) }
+func (s *SampleSnapshot) Min() int64 {
+	if nil != s.stats {
+		return s.stats.Min()
+	}
+	return SampleMin(s.values)
+}
 
 // Percentile returns an arbitrary percentile of values at the time the
 // snapshot was taken.
 func (s *SampleSnapshot) Percentile(p float64) float64 {
-	return SamplePercentile(s.values, p)
+	return s.Percentiles([]float64{p})[0]
 }
 
 // Percentiles returns a slice of arbitrary percentiles of values at the time
 // the snapshot was taken.
 func (s *SampleSnapshot) Percentiles(ps []float64) []float64 {
+	if nil != s.stats {
+		return s.stats.Percentiles(ps)
+	}
 	return SamplePercentiles(s.values, ps)
 }
 
 // Size returns the size of the sample at the time the snapshot was taken.
-func (s *SampleSnapshot) Size() int { return len(s.values) }
+func (s *SampleSnapshot) Size() int {
+	if nil != s.stats {
+		return s.stats.Size()
+	}
+	return len(s.values)
+}
 
 // Snapshot returns the snapshot.
 func (s *SampleSnapshot) Snapshot() Sample { return s }
 
 // StdDev returns the standard deviation of values at the time the snapshot was
 // taken.
-func (s *SampleSnapshot) StdDev() float64 { return SampleStdDev(s.values) }
+func (s *SampleSnapshot) StdDev() float64 {
+	if nil != s.stats {
+		return s.stats.StdDev()
+	}
+	return SampleStdDev(s.values)
+}
 
 // Sum returns the sum of values at the time the snapshot was taken.
-func (s *SampleSnapshot) Sum() int64 { return SampleSum(s.values) }
+func (s *SampleSnapshot) Sum() int64 {
+	if nil != s.stats {
+		return s.stats.Sum()
+	}
+	return SampleSum(s.values)
+}
 
 // Update panics.
 func (*SampleSnapshot) Update(int64) {
@@ -364,7 +599,12 @@ func (s *SampleSnapshot) Values() []int64 {
 }
 
 // Variance returns the variance of values at the time the snapshot was taken.
-func (s *SampleSnapshot) Variance() float64 { return SampleVariance(s.values) }
+func (s *SampleSnapshot) Variance() float64 {
+	if nil != s.stats {
+		return s.stats.Variance()
+	}
+	return SampleVariance(s.values)
+}
 
 // SampleStdDev returns the standard deviation of the slice of int64.
 func SampleStdDev(values []int64) float64 {
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// BufferedSample is a Sample which also keeps the values it was updated with
+// since they were last drained, so that a push reporter such as the StatsD
+// reporter can send the updates made since its previous flush rather than
+// values drawn from a reservoir, which are neither recent nor unbiased.
+//
+// At most size values are kept between drains: beyond that they are
+// replaced at random so that the buffer stays a uniform sample of the
+// updates, and Drain reports how many updates it stands for.  Only one
+// reporter should drain a sample.
+type BufferedSample struct {
+	Sample
+
+	mutex  sync.Mutex
+	size   int
+	count  int64 // updates since the last drain
+	values []int64
+}
+
+// NewBufferedSample constructs a new BufferedSample which records every value
+// in s and keeps at most size of them until they are drained.
+func NewBufferedSample(s Sample, size int) Sample {
+	if UseNilMetrics {
+		return NilSample{}
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &BufferedSample{Sample: s, size: size}
+}
+
+// Clear clears the sample and the buffer.
+func (s *BufferedSample) Clear() {
+	s.Sample.Clear()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.count = 0
+	s.values = nil
+}
+
+// Drain returns the values kept since the previous drain and the number of
+// updates they stand for, and empties the buffer.
+func (s *BufferedSample) Drain() ([]int64, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	values, count := s.values, s.count
+	s.values, s.count = nil, 0
+	return values, count
+}
+
+// Update samples a new value and keeps it in the buffer.
+func (s *BufferedSample) Update(v int64) {
+	s.Sample.Update(v)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.count++
+	if len(s.values) < s.size {
+		s.values = append(s.values, v)
+	} else if r := rand.Int63n(s.count); r < int64(s.size) {
+		s.values[int(r)] = v
+	}
+}
+
+// sampleDrainer is implemented by the samples which keep their updates for
+// push reporters.
+type sampleDrainer interface {
+	Drain() ([]int64, int64)
+}
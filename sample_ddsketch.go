@@ -0,0 +1,357 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// DDSketchSample is a Sample backed by a DDSketch, which counts every value
+// recorded in logarithmic buckets so that every percentile is within a given
+// relative accuracy of the true one.  Min, Max, Sum and Mean are exact.
+//
+// Sketches of many processes with the same relative accuracy can be combined
+// with Merge, for instance after encoding them with MarshalBinary, to
+// compute the percentiles over all their values.  It keeps no individual
+// values, so Values returns an empty slice and Size returns the number of
+// values recorded.
+//
+// <https://arxiv.org/abs/1908.10693>
+type DDSketchSample struct {
+	mutex sync.Mutex
+	s     *ddsketch
+}
+
+// NewDDSketchSample constructs a new DDSketch sample whose percentiles are
+// within the given relative accuracy, such as 0.01 for 1%.  Covering every
+// positive int64 at 1% takes about 2200 buckets.
+//
+// The sample is a *DDSketchSample, on which Merge and the binary encoding
+// are at hand, unless UseNilMetrics is set.
+func NewDDSketchSample(relativeAccuracy float64) Sample {
+	if !(relativeAccuracy > 0 && relativeAccuracy < 1) {
+		panic(fmt.Sprintf("NewDDSketchSample: relative accuracy %v not between 0 and 1", relativeAccuracy))
+	}
+	if UseNilMetrics {
+		return NilSample{}
+	}
+	return &DDSketchSample{s: newDDSketch(relativeAccuracy)}
+}
+
+// Clear clears all samples.
+func (s *DDSketchSample) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.s = newDDSketch(s.s.alpha)
+}
+
+// Count returns the number of samples recorded.
+func (s *DDSketchSample) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.count
+}
+
+// Max returns the maximum value recorded.
+func (s *DDSketchSample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.Max()
+}
+
+// Mean returns the mean of the values recorded.
+func (s *DDSketchSample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.Mean()
+}
+
+// Merge adds the values summarized by other, which must be a DDSketchSample
+// with the same relative accuracy or a snapshot of one, to the sample.
+func (s *DDSketchSample) Merge(other Sample) error {
+	var o *ddsketch
+	switch other := other.(type) {
+	case *DDSketchSample:
+		if other == s {
+			return errors.New("metrics: DDSketch merged with itself")
+		}
+		other.mutex.Lock()
+		o = other.s.copy()
+		other.mutex.Unlock()
+	case *SampleSnapshot:
+		o, _ = other.stats.(*ddsketch)
+	}
+	if nil == o {
+		return fmt.Errorf("metrics: can not merge %T into a DDSketch", other)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if o.alpha != s.s.alpha {
+		return fmt.Errorf("metrics: can not merge a DDSketch of relative accuracy %v into one of %v", o.alpha, s.s.alpha)
+	}
+	s.s.merge(o)
+	return nil
+}
+
+// Min returns the minimum value recorded.
+func (s *DDSketchSample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.Min()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded.
+func (s *DDSketchSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded.
+func (s *DDSketchSample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.Percentiles(ps)
+}
+
+// Size returns the number of values recorded.
+func (s *DDSketchSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.Size()
+}
+
+// Snapshot returns a read-only copy of the sample, which can be merged into
+// another DDSketchSample.
+func (s *DDSketchSample) Snapshot() Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &SampleSnapshot{count: s.s.count, stats: s.s.copy()}
+}
+
+// StdDev returns the standard deviation of the values recorded.
+func (s *DDSketchSample) StdDev() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.StdDev()
+}
+
+// Sum returns the sum of the values recorded.
+func (s *DDSketchSample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.Sum()
+}
+
+// Update records a new value.
+func (s *DDSketchSample) Update(v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.s.add(v)
+}
+
+// Values returns an empty slice since the sample keeps no values.
+func (s *DDSketchSample) Values() []int64 {
+	return []int64{}
+}
+
+// Variance returns the variance of the values recorded.
+func (s *DDSketchSample) Variance() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.s.Variance()
+}
+
+// MarshalBinary encodes the sketch compactly.
+func (s *DDSketchSample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b := []byte{ddsketchEncodingVersion}
+	b = appendFloat64(b, s.s.alpha)
+	b = appendMoments(b, &s.s.sampleMoments)
+	b = appendUvarint(b, uint64(s.s.zero))
+	b = s.s.positive.append(b)
+	return s.s.negative.append(b), nil
+}
+
+// UnmarshalBinary replaces the sample with a sketch encoded by
+// MarshalBinary.  It can be called on a zero DDSketchSample.
+func (s *DDSketchSample) UnmarshalBinary(b []byte) error {
+	r := &binaryReader{b: b}
+	if ddsketchEncodingVersion != r.byte() {
+		return errors.New("metrics: unknown DDSketch encoding")
+	}
+	alpha := r.float64()
+	if !(alpha > 0 && alpha < 1) {
+		return errors.New("metrics: invalid DDSketch relative accuracy")
+	}
+	d := newDDSketch(alpha)
+	// every bucket of an int64 is between 0 and the bucket of 2^63
+	maxIndex := math.Ceil(math.Log(math.MaxInt64) / d.logGamma)
+	if !(maxIndex < math.MaxInt32) {
+		return errors.New("metrics: invalid DDSketch relative accuracy")
+	}
+	r.moments(&d.sampleMoments)
+	d.zero = r.count()
+	d.positive.read(r, int(maxIndex))
+	d.negative.read(r, int(maxIndex))
+	if nil != r.err {
+		return fmt.Errorf("metrics: invalid DDSketch encoding: %v", r.err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.s = d
+	return nil
+}
+
+const ddsketchEncodingVersion = 1
+
+// ddsketch is the unsynchronized sketch of a DDSketchSample.  A positive
+// value v is counted in the bucket ceil(log(v)/log(gamma)) of the positive
+// store, a negative one in the bucket of -v of the negative store.
+type ddsketch struct {
+	alpha              float64
+	gamma, logGamma    float64
+	positive, negative ddsketchStore
+	zero               int64
+	sampleMoments
+}
+
+func newDDSketch(alpha float64) *ddsketch {
+	gamma := (1 + alpha) / (1 - alpha)
+	return &ddsketch{alpha: alpha, gamma: gamma, logGamma: math.Log(gamma)}
+}
+
+func (d *ddsketch) copy() *ddsketch {
+	c := *d
+	c.positive = d.positive.copy()
+	c.negative = d.negative.copy()
+	return &c
+}
+
+func (d *ddsketch) add(v int64) {
+	d.sampleMoments.add(v)
+	switch {
+	case v > 0:
+		d.positive.add(d.index(float64(v)), 1)
+	case v < 0:
+		d.negative.add(d.index(-float64(v)), 1)
+	default:
+		d.zero++
+	}
+}
+
+func (d *ddsketch) merge(o *ddsketch) {
+	d.sampleMoments.merge(o.sampleMoments)
+	d.positive.merge(&o.positive)
+	d.negative.merge(&o.negative)
+	d.zero += o.zero
+}
+
+func (d *ddsketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / d.logGamma))
+}
+
+// value returns the value of bucket i, within alpha of every value in it.
+func (d *ddsketch) value(i int) float64 {
+	return 2 * math.Pow(d.gamma, float64(i)) / (d.gamma + 1)
+}
+
+// Percentiles returns the value of the bucket of the value of rank
+// p*(count-1), bounded by the minimum and the maximum.
+func (d *ddsketch) Percentiles(ps []float64) []float64 {
+	scores := make([]float64, len(ps))
+	if 0 == d.count {
+		return scores
+	}
+	for j, p := range ps {
+		scores[j] = math.Max(float64(d.min), math.Min(float64(d.max), d.percentile(p)))
+	}
+	return scores
+}
+
+func (d *ddsketch) percentile(p float64) float64 {
+	rank := p * float64(d.count-1)
+	var cum int64
+	for i := len(d.negative.counts) - 1; i >= 0; i-- {
+		if cum += d.negative.counts[i]; float64(cum) > rank {
+			return -d.value(d.negative.offset + i)
+		}
+	}
+	if cum += d.zero; float64(cum) > rank {
+		return 0
+	}
+	for i, c := range d.positive.counts {
+		if cum += c; float64(cum) > rank {
+			return d.value(d.positive.offset + i)
+		}
+	}
+	return float64(d.max)
+}
+
+// ddsketchStore holds the counts of a contiguous range of buckets starting
+// at offset.
+type ddsketchStore struct {
+	offset int
+	counts []int64
+}
+
+func (st *ddsketchStore) add(i int, n int64) {
+	switch {
+	case 0 == len(st.counts):
+		st.offset = i
+		st.counts = []int64{0}
+	case i < st.offset:
+		st.counts = append(make([]int64, st.offset-i), st.counts...)
+		st.offset = i
+	case i >= st.offset+len(st.counts):
+		st.counts = append(st.counts, make([]int64, i-st.offset-len(st.counts)+1)...)
+	}
+	st.counts[i-st.offset] += n
+}
+
+func (st *ddsketchStore) merge(o *ddsketchStore) {
+	for j, c := range o.counts {
+		if 0 != c {
+			st.add(o.offset+j, c)
+		}
+	}
+}
+
+func (st *ddsketchStore) copy() ddsketchStore {
+	c := ddsketchStore{offset: st.offset, counts: make([]int64, len(st.counts))}
+	copy(c.counts, st.counts)
+	return c
+}
+
+func (st *ddsketchStore) append(b []byte) []byte {
+	b = appendVarint(b, int64(st.offset))
+	b = appendUvarint(b, uint64(len(st.counts)))
+	for _, c := range st.counts {
+		b = appendUvarint(b, uint64(c))
+	}
+	return b
+}
+
+// read decodes a store whose buckets are between 0 and maxIndex.
+func (st *ddsketchStore) read(r *binaryReader, maxIndex int) {
+	offset := r.varint()
+	n := r.uvarint()
+	if nil != r.err {
+		return
+	}
+	if n > uint64(len(r.b)) {
+		// every count takes at least a byte
+		r.err = errShortBuffer
+		return
+	}
+	if 0 != n && (offset < 0 || offset+int64(n) > int64(maxIndex)+1) {
+		r.err = fmt.Errorf("buckets %d to %d out of range 0 to %d", offset, offset+int64(n)-1, maxIndex)
+		return
+	}
+	st.offset = int(offset)
+	st.counts = make([]int64, n)
+	for i := range st.counts {
+		st.counts[i] = r.count()
+	}
+}
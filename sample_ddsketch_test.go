@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func BenchmarkDDSketchSample(b *testing.B) {
+	benchmarkSample(b, NewDDSketchSample(0.01))
+}
+
+func TestDDSketchSample(t *testing.T) {
+	s := NewDDSketchSample(0.01)
+	for _, i := range rand.Perm(100000) {
+		s.Update(int64(i + 1))
+	}
+	if count := s.Count(); 100000 != count {
+		t.Errorf("s.Count(): 100000 != %v\n", count)
+	}
+	if min, max := s.Min(), s.Max(); 1 != min || 100000 != max {
+		t.Errorf("s.Min(), s.Max(): 1, 100000 != %v, %v\n", min, max)
+	}
+	testQuantiles(t, s, 100000, 0.01)
+	s.Clear()
+	if count, p := s.Count(), s.Percentile(0.5); 0 != count || 0 != p {
+		t.Errorf("s.Count(), s.Percentile(0.5): 0, 0 != %v, %v\n", count, p)
+	}
+}
+
+func TestDDSketchSampleNegative(t *testing.T) {
+	s := NewDDSketchSample(0.01)
+	for i := -1000; i <= 1000; i++ {
+		s.Update(int64(i))
+	}
+	if p := s.Percentile(0.5); 0 != p {
+		t.Errorf("s.Percentile(0.5): 0 != %v\n", p)
+	}
+	if p := s.Percentile(0.05); p > -891 || p < -909 {
+		t.Errorf("s.Percentile(0.05): -900 != %v\n", p)
+	}
+	if p := s.Percentile(0.95); p < 891 || p > 909 {
+		t.Errorf("s.Percentile(0.95): 900 != %v\n", p)
+	}
+}
+
+func TestDDSketchSampleMerge(t *testing.T) {
+	a, b, c := NewDDSketchSample(0.01).(*DDSketchSample), NewDDSketchSample(0.01).(*DDSketchSample), NewDDSketchSample(0.01).(*DDSketchSample)
+	for i := 1; i <= 100000; i++ {
+		if i <= 50000 {
+			a.Update(int64(i))
+		} else {
+			b.Update(int64(i))
+		}
+	}
+	if err := c.Merge(a.Snapshot()); nil != err {
+		t.Fatal(err)
+	}
+	buf, err := b.MarshalBinary()
+	if nil != err {
+		t.Fatal(err)
+	}
+	var decoded DDSketchSample
+	if err := decoded.UnmarshalBinary(buf); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Merge(&decoded); nil != err {
+		t.Fatal(err)
+	}
+	if count := c.Count(); 100000 != count {
+		t.Errorf("c.Count(): 100000 != %v\n", count)
+	}
+	if mean := c.Mean(); 50000.5 != mean {
+		t.Errorf("c.Mean(): 50000.5 != %v\n", mean)
+	}
+	testQuantiles(t, c, 100000, 0.01)
+
+	if err := c.Merge(NewDDSketchSample(0.02)); nil == err {
+		t.Error("no error merging a DDSketch of another relative accuracy")
+	}
+	if err := c.Merge(NewTDigestSample(100)); nil == err {
+		t.Error("no error merging a t-digest")
+	}
+}
+
+func TestDDSketchSampleUnmarshalBinaryInvalid(t *testing.T) {
+	s := NewDDSketchSample(0.01).(*DDSketchSample)
+	s.Update(10)
+	buf, _ := s.MarshalBinary()
+	var decoded DDSketchSample
+	if err := decoded.UnmarshalBinary(buf[:len(buf)-3]); nil == err {
+		t.Error("no error decoding a truncated sketch")
+	}
+}
+
+func TestDDSketchSampleUnmarshalBinaryCorrupt(t *testing.T) {
+	s := NewDDSketchSample(0.01).(*DDSketchSample)
+	for _, v := range []int64{-1000, -1, 0, 1, 10, 1000, math.MaxInt64} {
+		s.Update(v)
+	}
+	buf, _ := s.MarshalBinary()
+
+	// a positive store starting at bucket 2^40 would take terabytes to merge
+	b := []byte{ddsketchEncodingVersion}
+	b = appendFloat64(b, 0.01)
+	b = appendMoments(b, &sampleMoments{count: 1, min: 1, max: 1, sum: 1, mean: 1})
+	b = appendUvarint(b, 0)
+	b = (&ddsketchStore{offset: 1 << 40, counts: []int64{1}}).append(b)
+	b = (&ddsketchStore{}).append(b)
+	var decoded DDSketchSample
+	if err := decoded.UnmarshalBinary(b); nil == err {
+		t.Error("no error decoding a store out of range")
+	}
+
+	// no corruption of a single byte panics or runs out of memory, and
+	// every sketch decoded merges into one of the same relative accuracy
+	for i := range buf {
+		for _, c := range []byte{0x00, 0x7f, 0x80, 0xff, buf[i] ^ 0x01} {
+			corrupt := append([]byte{}, buf...)
+			corrupt[i] = c
+			var decoded DDSketchSample
+			if err := decoded.UnmarshalBinary(corrupt); nil != err {
+				continue
+			}
+			decoded.Percentiles([]float64{0.5, 0.99})
+			if err := NewDDSketchSample(0.01).(*DDSketchSample).Merge(&decoded); nil != err && 0.01 == decoded.s.alpha {
+				t.Errorf("byte %d = %#x: %v", i, c, err)
+			}
+		}
+	}
+}
+
+func TestSketchSampleUseNilMetrics(t *testing.T) {
+	UseNilMetrics = true
+	defer func() { UseNilMetrics = false }()
+	for _, s := range []Sample{NewDDSketchSample(0.01), NewTDigestSample(100)} {
+		if _, ok := s.(NilSample); !ok {
+			t.Errorf("%T != NilSample", s)
+		}
+	}
+}
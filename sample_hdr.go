@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// HDRSample is a Sample backed by an HDR histogram which counts every value
+// recorded in buckets whose width keeps a given number of significant decimal
+// digits.  Unlike the reservoir samples it forgets no value, so its
+// percentiles hold over everything recorded since it was last cleared and
+// are exact up to the bucket width.  Min, Max, Sum and Mean are exact.
+//
+// It keeps no individual values, so Values returns an empty slice and Size
+// returns the number of values recorded.
+//
+// <http://hdrhistogram.org/>
+type HDRSample struct {
+	mutex sync.Mutex
+	h     *hdrHistogram
+}
+
+// NewHDRSample constructs a new HDR sample which tracks values between lowest
+// and highest with the given number of significant decimal digits, between 1
+// and 5.  Values lower than lowest are counted with a resolution of lowest,
+// negative values are recorded as zero and values higher than highest as
+// highest.
+//
+// With 3 significant digits, values from 1 to 3600e9 (an hour in
+// nanoseconds) take about 270 kB.
+func NewHDRSample(lowest, highest int64, digits int) Sample {
+	if UseNilMetrics {
+		return NilSample{}
+	}
+	return &HDRSample{h: newHDRHistogram(lowest, highest, digits)}
+}
+
+// Clear clears all samples.
+func (s *HDRSample) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.h.clear()
+}
+
+// Count returns the number of samples recorded.
+func (s *HDRSample) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.count
+}
+
+// Max returns the maximum value recorded.
+func (s *HDRSample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.Max()
+}
+
+// Mean returns the mean of the values recorded.
+func (s *HDRSample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.Mean()
+}
+
+// Min returns the minimum value recorded.
+func (s *HDRSample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.Min()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded.
+func (s *HDRSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded.
+func (s *HDRSample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.Percentiles(ps)
+}
+
+// Size returns the number of values recorded.
+func (s *HDRSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.Size()
+}
+
+// Snapshot returns a read-only copy of the sample.
+func (s *HDRSample) Snapshot() Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &SampleSnapshot{count: s.h.count, stats: s.h.copy()}
+}
+
+// StdDev returns the standard deviation of the values recorded.
+func (s *HDRSample) StdDev() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.StdDev()
+}
+
+// Sum returns the sum of the values recorded.
+func (s *HDRSample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.Sum()
+}
+
+// Update records a new value.
+func (s *HDRSample) Update(v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.h.record(v)
+}
+
+// Values returns an empty slice since the sample keeps no values.
+func (s *HDRSample) Values() []int64 {
+	return []int64{}
+}
+
+// Variance returns the variance of the values recorded.
+func (s *HDRSample) Variance() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.h.Variance()
+}
+
+// hdrHistogram is the unsynchronized histogram of an HDRSample.  Its buckets
+// are laid out as in HdrHistogram: every bucket covers twice the range of the
+// previous one with the same number of sub-buckets, only the upper half of
+// which is stored for all but the first bucket.
+type hdrHistogram struct {
+	lowest, highest             int64
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+	subBucketCount              int64
+	subBucketHalfCount          int64
+	subBucketMask               int64
+	counts                      []int64
+	sampleMoments
+}
+
+func newHDRHistogram(lowest, highest int64, digits int) *hdrHistogram {
+	if lowest < 1 {
+		lowest = 1
+	}
+	if digits < 1 || digits > 5 {
+		panic(fmt.Sprintf("NewHDRSample: digits %d not between 1 and 5", digits))
+	}
+	if highest < 2*lowest {
+		panic(fmt.Sprintf("NewHDRSample: highest %d less than twice lowest %d", highest, lowest))
+	}
+
+	// the values below this are counted one unit apart
+	singleUnitResolution := 2 * int64(math.Pow10(digits))
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(float64(singleUnitResolution))))
+	h := &hdrHistogram{
+		lowest:                      lowest,
+		highest:                     highest,
+		unitMagnitude:               uint(math.Floor(math.Log2(float64(lowest)))),
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+		subBucketCount:              1 << subBucketCountMagnitude,
+	}
+	h.subBucketHalfCount = h.subBucketCount / 2
+	h.subBucketMask = (h.subBucketCount - 1) << h.unitMagnitude
+
+	buckets := int64(1)
+	for smallestUntrackable := h.subBucketCount << h.unitMagnitude; smallestUntrackable <= highest; buckets++ {
+		if smallestUntrackable > math.MaxInt64/2 {
+			buckets++
+			break
+		}
+		smallestUntrackable <<= 1
+	}
+	h.counts = make([]int64, (buckets+1)*h.subBucketHalfCount)
+	h.clear()
+	return h
+}
+
+func (h *hdrHistogram) clear() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.sampleMoments = sampleMoments{}
+}
+
+func (h *hdrHistogram) copy() *hdrHistogram {
+	c := *h
+	c.counts = make([]int64, len(h.counts))
+	copy(c.counts, h.counts)
+	return &c
+}
+
+// merge adds the values recorded by o, which has the same layout.
+func (h *hdrHistogram) merge(o *hdrHistogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.sampleMoments.merge(o.sampleMoments)
+}
+
+func (h *hdrHistogram) record(v int64) {
+	if v < 0 {
+		v = 0
+	} else if v > h.highest {
+		v = h.highest
+	}
+	h.counts[h.index(v)]++
+	h.add(v)
+}
+
+// bucket returns the bucket and sub-bucket of v.
+func (h *hdrHistogram) bucket(v int64) (int, int64) {
+	pow2Ceiling := 64 - bits.LeadingZeros64(uint64(v|h.subBucketMask))
+	bucket := pow2Ceiling - int(h.unitMagnitude) - int(h.subBucketHalfCountMagnitude+1)
+	return bucket, v >> (uint(bucket) + h.unitMagnitude)
+}
+
+func (h *hdrHistogram) index(v int64) int {
+	bucket, sub := h.bucket(v)
+	return int(int64(bucket+1)<<h.subBucketHalfCountMagnitude + sub - h.subBucketHalfCount)
+}
+
+// highestEquivalentValue returns the highest value counted at index i.
+func (h *hdrHistogram) highestEquivalentValue(i int) int64 {
+	bucket := (i >> h.subBucketHalfCountMagnitude) - 1
+	sub := int64(i)&(h.subBucketHalfCount-1) + h.subBucketHalfCount
+	if bucket < 0 {
+		sub -= h.subBucketHalfCount
+		bucket = 0
+	}
+	lowest := sub << (uint(bucket) + h.unitMagnitude)
+	return lowest + int64(1)<<(uint(bucket)+h.unitMagnitude) - 1
+}
+
+// Percentiles returns the highest value counted in the bucket of the value
+// below which the given fraction of the values recorded fall, bounded by
+// the minimum and the maximum.
+func (h *hdrHistogram) Percentiles(ps []float64) []float64 {
+	scores := make([]float64, len(ps))
+	if 0 == h.count {
+		return scores
+	}
+	for j, p := range ps {
+		rank := int64(p*float64(h.count) + 0.5)
+		if rank < 1 {
+			rank = 1
+		}
+		var total int64
+		for i, c := range h.counts {
+			if total += c; total >= rank {
+				v := h.highestEquivalentValue(i)
+				if v > h.max {
+					v = h.max
+				}
+				if v < h.min {
+					v = h.min
+				}
+				scores[j] = float64(v)
+				break
+			}
+		}
+	}
+	return scores
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func BenchmarkHDRSample(b *testing.B) {
+	benchmarkSample(b, NewHDRSample(1, int64(time.Hour), 3))
+}
+
+func TestHDRSample(t *testing.T) {
+	s := NewHDRSample(1, 1000000, 3)
+	for i := 1; i <= 100000; i++ {
+		s.Update(int64(i))
+	}
+	if count := s.Count(); 100000 != count {
+		t.Errorf("s.Count(): 100000 != %v\n", count)
+	}
+	if min := s.Min(); 1 != min {
+		t.Errorf("s.Min(): 1 != %v\n", min)
+	}
+	if max := s.Max(); 100000 != max {
+		t.Errorf("s.Max(): 100000 != %v\n", max)
+	}
+	if mean := s.Mean(); 50000.5 != mean {
+		t.Errorf("s.Mean(): 50000.5 != %v\n", mean)
+	}
+	if sum := s.Sum(); 5000050000 != sum {
+		t.Errorf("s.Sum(): 5000050000 != %v\n", sum)
+	}
+	if stdDev := s.StdDev(); math.Abs(stdDev-28867.513) > 0.001 {
+		t.Errorf("s.StdDev(): 28867.513 != %v\n", stdDev)
+	}
+	// every percentile is within the resolution of 3 significant digits
+	ps := []float64{0.5, 0.75, 0.99, 0.999}
+	for i, p := range s.Percentiles(ps) {
+		expected := ps[i] * 100000
+		if math.Abs(p-expected)/expected > 0.001 {
+			t.Errorf("s.Percentile(%v): %v != %v\n", ps[i], expected, p)
+		}
+	}
+	if 0 != len(s.Values()) {
+		t.Errorf("len(s.Values()): 0 != %v\n", len(s.Values()))
+	}
+}
+
+func TestHDRSampleExactBelowResolution(t *testing.T) {
+	s := NewHDRSample(1, 1000, 3)
+	for i := 0; i < 1000; i++ {
+		s.Update(int64(i % 10))
+	}
+	if p := s.Percentile(0.95); 9 != p {
+		t.Errorf("s.Percentile(0.95): 9 != %v\n", p)
+	}
+	if p := s.Percentile(0.05); 0 != p {
+		t.Errorf("s.Percentile(0.05): 0 != %v\n", p)
+	}
+}
+
+func TestHDRSampleOutOfRange(t *testing.T) {
+	s := NewHDRSample(1, 1000, 2)
+	s.Update(-5)
+	s.Update(5000)
+	if min := s.Min(); 0 != min {
+		t.Errorf("s.Min(): 0 != %v\n", min)
+	}
+	if max := s.Max(); 1000 != max {
+		t.Errorf("s.Max(): 1000 != %v\n", max)
+	}
+	if p := s.Percentile(1); 1000 != p {
+		t.Errorf("s.Percentile(1): 1000 != %v\n", p)
+	}
+}
+
+func TestHDRSampleClear(t *testing.T) {
+	s := NewHDRSample(1, 1000, 3)
+	s.Update(10)
+	s.Clear()
+	if count := s.Count(); 0 != count {
+		t.Errorf("s.Count(): 0 != %v\n", count)
+	}
+	if p := s.Percentile(0.5); 0 != p {
+		t.Errorf("s.Percentile(0.5): 0 != %v\n", p)
+	}
+	s.Update(20)
+	if min, max := s.Min(), s.Max(); 20 != min || 20 != max {
+		t.Errorf("s.Min(), s.Max(): 20, 20 != %v, %v\n", min, max)
+	}
+}
+
+func TestHDRSampleSnapshot(t *testing.T) {
+	s := NewHDRSample(1, 1000000, 3)
+	for i := 1; i <= 10000; i++ {
+		s.Update(int64(i))
+	}
+	snapshot := s.Snapshot()
+	s.Update(1000000)
+	if count := snapshot.Count(); 10000 != count {
+		t.Errorf("snapshot.Count(): 10000 != %v\n", count)
+	}
+	if max := snapshot.Max(); 10000 != max {
+		t.Errorf("snapshot.Max(): 10000 != %v\n", max)
+	}
+	if p := snapshot.Percentile(0.99); math.Abs(p-9900) > 10 {
+		t.Errorf("snapshot.Percentile(0.99): 9900 != %v\n", p)
+	}
+}
+
+func TestHDRSampleHistogramTimer(t *testing.T) {
+	h := NewHistogram(NewHDRSample(1, 1000000, 3))
+	for i := 1; i <= 1000; i++ {
+		h.Update(int64(i))
+	}
+	if p := h.Snapshot().Percentile(0.999); 999 != p {
+		t.Errorf("h.Snapshot().Percentile(0.999): 999 != %v\n", p)
+	}
+
+	tm := NewCustomTimer(NewHistogram(NewHDRSample(1, int64(time.Minute), 3)), NewMeter())
+	tm.Update(time.Millisecond)
+	tm.Update(3 * time.Millisecond)
+	ts := tm.Snapshot()
+	if min, max := ts.Min(), ts.Max(); int64(time.Millisecond) != min || int64(3*time.Millisecond) != max {
+		t.Errorf("ts.Min(), ts.Max(): 1ms, 3ms != %v, %v\n", min, max)
+	}
+	if mean := ts.Mean(); float64(2*time.Millisecond) != mean {
+		t.Errorf("ts.Mean(): 2ms != %v\n", mean)
+	}
+}
+
+func TestSampleMomentsMeanOverflow(t *testing.T) {
+	var m sampleMoments
+	for i := 0; i < 4; i++ {
+		m.add(math.MaxInt64 / 2)
+	}
+	if mean := m.Mean(); math.Abs(mean-math.MaxInt64/2)/(math.MaxInt64/2) > 1e-9 {
+		t.Errorf("m.Mean(): %v != %v\n", float64(math.MaxInt64/2), mean)
+	}
+	var o sampleMoments
+	o.merge(m)
+	o.merge(m)
+	if mean := o.Mean(); math.Abs(mean-math.MaxInt64/2)/(math.MaxInt64/2) > 1e-9 {
+		t.Errorf("o.Mean(): %v != %v\n", float64(math.MaxInt64/2), mean)
+	}
+}
@@ -0,0 +1,522 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SlidingTimeWindowBuckets is the number of buckets a
+// SlidingTimeWindowSample divides its window into.
+const SlidingTimeWindowBuckets = 60
+
+// SlidingTimeWindowSample is a sample of the values recorded during the last
+// window, such as the last minute, so that its statistics forget older
+// values entirely.  The window is divided into SlidingTimeWindowBuckets
+// buckets which expire one at a time, so it covers the last window to the
+// resolution of one bucket.
+//
+// Every bucket keeps a uniform sample of its values, so that memory stays
+// bounded by the reservoir size however many values are recorded.  Count
+// returns the exact number of values recorded during the window, which may
+// exceed the reservoir size.  The statistics weigh every value kept by the
+// number of values of its bucket it stands for, so that a busy second
+// counts for more than a quiet one; Values returns the unweighted values.
+type SlidingTimeWindowSample struct {
+	mutex      sync.Mutex
+	ring       windowRing
+	buckets    []slidingBucket
+	bucketSize int
+}
+
+type slidingBucket struct {
+	count  int64
+	values []int64
+}
+
+// NewSlidingTimeWindowSample constructs a new sliding time window sample
+// covering the given window and keeping at most reservoirSize values.
+func NewSlidingTimeWindowSample(window time.Duration, reservoirSize int) Sample {
+	return NewSlidingTimeWindowSampleWithClock(window, reservoirSize, DefaultClock)
+}
+
+// NewSlidingTimeWindowSampleWithClock constructs a new sliding time window
+// sample which expires its buckets with the given clock.
+func NewSlidingTimeWindowSampleWithClock(window time.Duration, reservoirSize int, c Clock) Sample {
+	if UseNilMetrics {
+		return NilSample{}
+	}
+	size := reservoirSize / SlidingTimeWindowBuckets
+	if size < 1 {
+		size = 1
+	}
+	return &SlidingTimeWindowSample{
+		ring:       newWindowRing(window, SlidingTimeWindowBuckets, c),
+		buckets:    make([]slidingBucket, SlidingTimeWindowBuckets),
+		bucketSize: size,
+	}
+}
+
+// Clear clears all samples.
+func (s *SlidingTimeWindowSample) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.buckets {
+		s.buckets[i] = slidingBucket{}
+	}
+	s.ring.reset()
+}
+
+func (s *SlidingTimeWindowSample) adoptClock(c Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if count, _ := s.window(); 0 == count {
+		s.ring.adoptClock(c)
+	}
+}
+
+// Count returns the number of values recorded during the window.
+func (s *SlidingTimeWindowSample) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count, _ := s.window()
+	return count
+}
+
+// Max returns the maximum value in the sample.
+func (s *SlidingTimeWindowSample) Max() int64 {
+	return s.Snapshot().Max()
+}
+
+// Mean returns the mean of the values in the sample.
+func (s *SlidingTimeWindowSample) Mean() float64 {
+	return s.Snapshot().Mean()
+}
+
+// Min returns the minimum value in the sample.
+func (s *SlidingTimeWindowSample) Min() int64 {
+	return s.Snapshot().Min()
+}
+
+// Percentile returns an arbitrary percentile of values in the sample.
+func (s *SlidingTimeWindowSample) Percentile(p float64) float64 {
+	return s.Snapshot().Percentile(p)
+}
+
+// Percentiles returns a slice of arbitrary percentiles of values in the
+// sample.
+func (s *SlidingTimeWindowSample) Percentiles(ps []float64) []float64 {
+	return s.Snapshot().Percentiles(ps)
+}
+
+// Size returns the size of the sample, which is at most the reservoir size.
+func (s *SlidingTimeWindowSample) Size() int {
+	return len(s.Values())
+}
+
+// Snapshot returns a read-only copy of the sample.
+func (s *SlidingTimeWindowSample) Snapshot() Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count, values := s.window()
+	return &SampleSnapshot{count: count, values: values, stats: newWeightedValues(s.buckets)}
+}
+
+// StdDev returns the standard deviation of the values in the sample.
+func (s *SlidingTimeWindowSample) StdDev() float64 {
+	return s.Snapshot().StdDev()
+}
+
+// Sum returns the sum of the values in the sample.
+func (s *SlidingTimeWindowSample) Sum() int64 {
+	return s.Snapshot().Sum()
+}
+
+// Update samples a new value.
+func (s *SlidingTimeWindowSample) Update(v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ring.advance(func(i int) { s.buckets[i] = slidingBucket{} })
+	b := &s.buckets[s.ring.head]
+	b.count++
+	if len(b.values) < s.bucketSize {
+		b.values = append(b.values, v)
+	} else if r := rand.Int63n(b.count); r < int64(len(b.values)) {
+		b.values[int(r)] = v
+	}
+}
+
+// Values returns a copy of the values in the sample.
+func (s *SlidingTimeWindowSample) Values() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, values := s.window()
+	return values
+}
+
+// Variance returns the variance of the values in the sample.
+func (s *SlidingTimeWindowSample) Variance() float64 {
+	return s.Snapshot().Variance()
+}
+
+// window expires old buckets and returns the count and a copy of the values
+// of the others.
+func (s *SlidingTimeWindowSample) window() (int64, []int64) {
+	s.ring.advance(func(i int) { s.buckets[i] = slidingBucket{} })
+	var count int64
+	values := make([]int64, 0, len(s.buckets)*s.bucketSize)
+	for _, b := range s.buckets {
+		count += b.count
+		values = append(values, b.values...)
+	}
+	return count, values
+}
+
+// weightedValues are the values kept by the buckets of a
+// SlidingTimeWindowSample in order, each weighted by the number of values of
+// its bucket it stands for.
+type weightedValues struct {
+	values  []int64
+	weights []float64
+	total   float64 // sum of the weights
+}
+
+func newWeightedValues(buckets []slidingBucket) *weightedValues {
+	w := &weightedValues{}
+	for _, b := range buckets {
+		if 0 == len(b.values) {
+			continue
+		}
+		weight := float64(b.count) / float64(len(b.values))
+		for _, v := range b.values {
+			w.values = append(w.values, v)
+			w.weights = append(w.weights, weight)
+		}
+		w.total += float64(b.count)
+	}
+	sort.Sort(w)
+	return w
+}
+
+func (w *weightedValues) Len() int           { return len(w.values) }
+func (w *weightedValues) Less(i, j int) bool { return w.values[i] < w.values[j] }
+func (w *weightedValues) Swap(i, j int) {
+	w.values[i], w.values[j] = w.values[j], w.values[i]
+	w.weights[i], w.weights[j] = w.weights[j], w.weights[i]
+}
+
+func (w *weightedValues) Max() int64 {
+	if 0 == len(w.values) {
+		return 0
+	}
+	return w.values[len(w.values)-1]
+}
+
+func (w *weightedValues) Mean() float64 {
+	if 0 == len(w.values) {
+		return 0.0
+	}
+	var sum float64
+	for i, v := range w.values {
+		sum += w.weights[i] * float64(v)
+	}
+	return sum / w.total
+}
+
+func (w *weightedValues) Min() int64 {
+	if 0 == len(w.values) {
+		return 0
+	}
+	return w.values[0]
+}
+
+// Percentiles places every value at the middle of the ranks it stands for
+// and interpolates between them, which for values of weight one is what
+// SamplePercentiles does.
+func (w *weightedValues) Percentiles(ps []float64) []float64 {
+	scores := make([]float64, len(ps))
+	if 0 == len(w.values) {
+		return scores
+	}
+	ranks := make([]float64, len(w.values))
+	var cum float64
+	for i, weight := range w.weights {
+		ranks[i] = cum + (weight+1)/2
+		cum += weight
+	}
+	for j, p := range ps {
+		pos := p * (w.total + 1)
+		i := sort.SearchFloat64s(ranks, pos)
+		switch {
+		case 0 == i:
+			scores[j] = float64(w.values[0])
+		case len(ranks) == i:
+			scores[j] = float64(w.values[len(w.values)-1])
+		default:
+			lower, upper := float64(w.values[i-1]), float64(w.values[i])
+			scores[j] = lower + (pos-ranks[i-1])/(ranks[i]-ranks[i-1])*(upper-lower)
+		}
+	}
+	return scores
+}
+
+func (w *weightedValues) Size() int { return len(w.values) }
+
+func (w *weightedValues) StdDev() float64 { return math.Sqrt(w.Variance()) }
+
+// Sum estimates the sum of the values of the window.
+func (w *weightedValues) Sum() int64 {
+	var sum float64
+	for i, v := range w.values {
+		sum += w.weights[i] * float64(v)
+	}
+	return int64(math.Round(sum))
+}
+
+func (w *weightedValues) Variance() float64 {
+	if 0 == len(w.values) {
+		return 0.0
+	}
+	m := w.Mean()
+	var sum float64
+	for i, v := range w.values {
+		d := float64(v) - m
+		sum += w.weights[i] * d * d
+	}
+	return sum / w.total
+}
+
+// SlidingWindowHDRSample is a sample of the values recorded during the last
+// window backed by a ring of HDR histograms, one per bucket of the window.
+// Like HDRSample it forgets no value of the window, so its percentiles are
+// exact up to the bucket width and Min, Max, Sum and Mean are exact.  Memory
+// is bounded by the number of buckets times the size of an HDRSample.
+//
+// Every bucket is merged when reading percentiles, so reporters should read
+// them from a Snapshot.
+type SlidingWindowHDRSample struct {
+	mutex   sync.Mutex
+	ring    windowRing
+	buckets []*hdrHistogram
+}
+
+// NewSlidingWindowHistogram constructs a new StandardHistogram backed by a
+// SlidingWindowHDRSample.
+func NewSlidingWindowHistogram(window time.Duration, buckets int, lowest, highest int64, digits int) Histogram {
+	return NewHistogram(NewSlidingWindowHDRSample(window, buckets, lowest, highest, digits))
+}
+
+// NewSlidingWindowHDRSample constructs a new sliding window HDR sample
+// covering the given window divided into the given number of buckets, which
+// track values between lowest and highest with the given number of
+// significant decimal digits like NewHDRSample.
+func NewSlidingWindowHDRSample(window time.Duration, buckets int, lowest, highest int64, digits int) Sample {
+	return NewSlidingWindowHDRSampleWithClock(window, buckets, lowest, highest, digits, DefaultClock)
+}
+
+// NewSlidingWindowHDRSampleWithClock constructs a new sliding window HDR
+// sample which expires its buckets with the given clock.
+func NewSlidingWindowHDRSampleWithClock(window time.Duration, buckets int, lowest, highest int64, digits int, c Clock) Sample {
+	if UseNilMetrics {
+		return NilSample{}
+	}
+	if buckets < 1 {
+		buckets = 1
+	}
+	s := &SlidingWindowHDRSample{
+		ring:    newWindowRing(window, buckets, c),
+		buckets: make([]*hdrHistogram, buckets),
+	}
+	for i := range s.buckets {
+		s.buckets[i] = newHDRHistogram(lowest, highest, digits)
+	}
+	return s
+}
+
+// Clear clears all samples.
+func (s *SlidingWindowHDRSample) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, h := range s.buckets {
+		h.clear()
+	}
+	s.ring.reset()
+}
+
+func (s *SlidingWindowHDRSample) adoptClock(c Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m := s.moments(); 0 == m.count {
+		s.ring.adoptClock(c)
+	}
+}
+
+// Count returns the number of values recorded during the window.
+func (s *SlidingWindowHDRSample) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.count
+}
+
+// Max returns the maximum value recorded during the window.
+func (s *SlidingWindowHDRSample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.Max()
+}
+
+// Mean returns the mean of the values recorded during the window.
+func (s *SlidingWindowHDRSample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.Mean()
+}
+
+// Min returns the minimum value recorded during the window.
+func (s *SlidingWindowHDRSample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.Min()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded during
+// the window.
+func (s *SlidingWindowHDRSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded during the window.
+func (s *SlidingWindowHDRSample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.merged().Percentiles(ps)
+}
+
+// Size returns the number of values recorded during the window.
+func (s *SlidingWindowHDRSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.Size()
+}
+
+// Snapshot returns a read-only copy of the sample.
+func (s *SlidingWindowHDRSample) Snapshot() Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	h := s.merged()
+	return &SampleSnapshot{count: h.count, stats: h}
+}
+
+// StdDev returns the standard deviation of the values recorded during the
+// window.
+func (s *SlidingWindowHDRSample) StdDev() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.StdDev()
+}
+
+// Sum returns the sum of the values recorded during the window.
+func (s *SlidingWindowHDRSample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.Sum()
+}
+
+// Update records a new value.
+func (s *SlidingWindowHDRSample) Update(v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ring.advance(func(i int) { s.buckets[i].clear() })
+	s.buckets[s.ring.head].record(v)
+}
+
+// Values returns an empty slice since the sample keeps no values.
+func (s *SlidingWindowHDRSample) Values() []int64 {
+	return []int64{}
+}
+
+// Variance returns the variance of the values recorded during the window.
+func (s *SlidingWindowHDRSample) Variance() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.moments()
+	return m.Variance()
+}
+
+// moments expires old buckets and returns the moments of the others.
+func (s *SlidingWindowHDRSample) moments() sampleMoments {
+	s.ring.advance(func(i int) { s.buckets[i].clear() })
+	var m sampleMoments
+	for _, h := range s.buckets {
+		m.merge(h.sampleMoments)
+	}
+	return m
+}
+
+// merged expires old buckets and returns a histogram of the others.
+func (s *SlidingWindowHDRSample) merged() *hdrHistogram {
+	s.ring.advance(func(i int) { s.buckets[i].clear() })
+	merged := s.buckets[0].copy()
+	for _, h := range s.buckets[1:] {
+		merged.merge(h)
+	}
+	return merged
+}
+
+// windowRing tracks which of the buckets of a sliding time window is the
+// current one.
+type windowRing struct {
+	clock Clock
+	width time.Duration // of a bucket
+	n     int
+	head  int
+	start time.Time // of the head bucket
+}
+
+func newWindowRing(window time.Duration, n int, c Clock) windowRing {
+	width := window / time.Duration(n)
+	if width <= 0 {
+		width = 1
+	}
+	return windowRing{clock: c, width: width, n: n, start: c.Now()}
+}
+
+// advance moves the head to the bucket of the current time and calls clear
+// with every bucket it moves to, since their values fell out of the window.
+func (r *windowRing) advance(clear func(int)) {
+	elapsed := r.clock.Now().Sub(r.start) / r.width
+	if elapsed <= 0 {
+		return
+	}
+	r.start = r.start.Add(elapsed * r.width)
+	if elapsed > time.Duration(r.n) {
+		elapsed = time.Duration(r.n)
+	}
+	for ; elapsed > 0; elapsed-- {
+		r.head = (r.head + 1) % r.n
+		clear(r.head)
+	}
+}
+
+// adoptClock restarts the ring with c if it reads DefaultClock.
+func (r *windowRing) adoptClock(c Clock) {
+	if DefaultClock == r.clock {
+		r.clock = c
+		r.reset()
+	}
+}
+
+func (r *windowRing) reset() {
+	r.head = 0
+	r.start = r.clock.Now()
+}
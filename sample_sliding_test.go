@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func BenchmarkSlidingTimeWindowSample(b *testing.B) {
+	benchmarkSample(b, NewSlidingTimeWindowSample(time.Minute, 1028))
+}
+
+func BenchmarkSlidingWindowHDRSample(b *testing.B) {
+	benchmarkSample(b, NewSlidingWindowHDRSample(time.Minute, 6, 1, int64(time.Hour), 3))
+}
+
+func TestSlidingTimeWindowSample(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	s := NewSlidingTimeWindowSampleWithClock(time.Minute, 6000, clock)
+	for i := 1; i <= 60; i++ {
+		if i > 1 {
+			clock.Add(time.Second)
+		}
+		s.Update(int64(i))
+	}
+	if count := s.Count(); 60 != count {
+		t.Errorf("s.Count(): 60 != %v\n", count)
+	}
+	if min, max := s.Min(), s.Max(); 1 != min || 60 != max {
+		t.Errorf("s.Min(), s.Max(): 1, 60 != %v, %v\n", min, max)
+	}
+
+	// the first 30 seconds fall out of the window
+	clock.Add(30 * time.Second)
+	if count := s.Count(); 30 != count {
+		t.Errorf("s.Count(): 30 != %v\n", count)
+	}
+	snapshot := s.Snapshot()
+	if min, max := snapshot.Min(), snapshot.Max(); 31 != min || 60 != max {
+		t.Errorf("snapshot.Min(), snapshot.Max(): 31, 60 != %v, %v\n", min, max)
+	}
+	if mean := snapshot.Mean(); 45.5 != mean {
+		t.Errorf("snapshot.Mean(): 45.5 != %v\n", mean)
+	}
+
+	clock.Add(time.Hour)
+	if count, size := s.Count(), s.Size(); 0 != count || 0 != size {
+		t.Errorf("s.Count(), s.Size(): 0, 0 != %v, %v\n", count, size)
+	}
+}
+
+func TestSlidingTimeWindowSampleBounded(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	s := NewSlidingTimeWindowSampleWithClock(time.Minute, 600, clock)
+	for i := 0; i < 100000; i++ {
+		s.Update(int64(i % 1000))
+		if 0 == i%1000 {
+			clock.Add(time.Second / 2)
+		}
+	}
+	if count := s.Count(); 100000 != count {
+		t.Errorf("s.Count(): 100000 != %v\n", count)
+	}
+	if size := s.Size(); size > 600 {
+		t.Errorf("s.Size(): %v > 600\n", size)
+	}
+	if p := s.Percentile(0.5); math.Abs(p-500) > 100 {
+		t.Errorf("s.Percentile(0.5): 500 != %v\n", p)
+	}
+}
+
+func TestSlidingTimeWindowSampleWeighted(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	s := NewSlidingTimeWindowSampleWithClock(time.Minute, 600, clock)
+	// a quiet second of 10 values of 1 and a busy one of 990 values of 1000,
+	// of which each bucket keeps 10
+	for i := 0; i < 10; i++ {
+		s.Update(1)
+	}
+	clock.Add(time.Second)
+	for i := 0; i < 990; i++ {
+		s.Update(1000)
+	}
+	if count, size := s.Count(), s.Size(); 1000 != count || 20 != size {
+		t.Errorf("s.Count(), s.Size(): 1000, 20 != %v, %v\n", count, size)
+	}
+	snapshot := s.Snapshot()
+	if p := snapshot.Percentile(0.5); 1000 != p {
+		t.Errorf("snapshot.Percentile(0.5): 1000 != %v\n", p)
+	}
+	if p := snapshot.Percentile(0.005); 1 != p {
+		t.Errorf("snapshot.Percentile(0.005): 1 != %v\n", p)
+	}
+	if mean := snapshot.Mean(); math.Abs(mean-990.01) > 1e-9 {
+		t.Errorf("snapshot.Mean(): 990.01 != %v\n", mean)
+	}
+	if sum := snapshot.Sum(); 990010 != sum {
+		t.Errorf("snapshot.Sum(): 990010 != %v\n", sum)
+	}
+	if min, max := snapshot.Min(), snapshot.Max(); 1 != min || 1000 != max {
+		t.Errorf("snapshot.Min(), snapshot.Max(): 1, 1000 != %v, %v\n", min, max)
+	}
+}
+
+func TestSlidingWindowHDRSample(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	s := NewSlidingWindowHDRSampleWithClock(time.Minute, 6, 1, 1000000, 3, clock)
+	for i := 1; i <= 6000; i++ {
+		if i > 1 && 1 == i%100 {
+			clock.Add(time.Second)
+		}
+		s.Update(int64(i))
+	}
+	if count := s.Count(); 6000 != count {
+		t.Errorf("s.Count(): 6000 != %v\n", count)
+	}
+	if p := s.Percentile(0.99); math.Abs(p-5940) > 5.94 {
+		t.Errorf("s.Percentile(0.99): 5940 != %v\n", p)
+	}
+
+	// the first 30 seconds fall out of the window
+	clock.Add(30 * time.Second)
+	snapshot := s.Snapshot()
+	if count := snapshot.Count(); 3000 != count {
+		t.Errorf("snapshot.Count(): 3000 != %v\n", count)
+	}
+	if min, max := snapshot.Min(), snapshot.Max(); 3001 != min || 6000 != max {
+		t.Errorf("snapshot.Min(), snapshot.Max(): 3001, 6000 != %v, %v\n", min, max)
+	}
+	if p := snapshot.Percentile(0.5); math.Abs(p-4500) > 4.5 {
+		t.Errorf("snapshot.Percentile(0.5): 4500 != %v\n", p)
+	}
+	if mean := s.Mean(); 4500.5 != mean {
+		t.Errorf("s.Mean(): 4500.5 != %v\n", mean)
+	}
+
+	s.Clear()
+	if count := s.Count(); 0 != count {
+		t.Errorf("s.Count(): 0 != %v\n", count)
+	}
+}
+
+func TestSlidingWindowHistogramTimer(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	h := NewHistogram(NewSlidingWindowHDRSampleWithClock(time.Minute, 6, 1, int64(time.Minute), 3, clock))
+	tm := NewCustomTimer(h, NewMeter())
+	tm.Update(time.Second)
+	clock.Add(2 * time.Minute)
+	tm.Update(time.Millisecond)
+	ts := tm.Snapshot()
+	// the timer's histogram only covers the window
+	if count := ts.Count(); 1 != count {
+		t.Errorf("ts.Count(): 1 != %v\n", count)
+	}
+	if max := ts.Max(); int64(time.Millisecond) != max {
+		t.Errorf("ts.Max(): 1ms != %v\n", max)
+	}
+}
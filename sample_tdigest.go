@@ -0,0 +1,353 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// TDigestSample is a Sample backed by a merging t-digest, which summarizes
+// every value recorded in centroids that are smaller near the extremes, so
+// that high and low percentiles stay accurate in little memory.  Min, Max,
+// Sum and Mean are exact.
+//
+// Digests of many processes can be combined with Merge, for instance after
+// encoding them with MarshalBinary, to compute the percentiles over all
+// their values.  It keeps no individual values, so Values returns an empty
+// slice and Size returns the number of values recorded.
+//
+// <https://github.com/tdunning/t-digest>
+type TDigestSample struct {
+	mutex sync.Mutex
+	d     *tdigest
+}
+
+// NewTDigestSample constructs a new t-digest sample with the given
+// compression, which bounds the number of centroids to about twice its
+// value.  100 is a good default.
+//
+// The sample is a *TDigestSample, on which Merge and the binary encoding
+// are at hand, unless UseNilMetrics is set.
+func NewTDigestSample(compression float64) Sample {
+	if UseNilMetrics {
+		return NilSample{}
+	}
+	if compression < 1 {
+		compression = 1
+	}
+	return &TDigestSample{d: newTDigest(compression)}
+}
+
+// Clear clears all samples.
+func (s *TDigestSample) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.d = newTDigest(s.d.compression)
+}
+
+// Count returns the number of samples recorded.
+func (s *TDigestSample) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.count
+}
+
+// Max returns the maximum value recorded.
+func (s *TDigestSample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.Max()
+}
+
+// Mean returns the mean of the values recorded.
+func (s *TDigestSample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.Mean()
+}
+
+// Merge adds the values summarized by other, which must be a TDigestSample
+// or a snapshot of one, to the sample.
+func (s *TDigestSample) Merge(other Sample) error {
+	var o *tdigest
+	switch other := other.(type) {
+	case *TDigestSample:
+		if other == s {
+			return errors.New("metrics: t-digest merged with itself")
+		}
+		other.mutex.Lock()
+		o = other.d.copy()
+		other.mutex.Unlock()
+	case *SampleSnapshot:
+		o, _ = other.stats.(*tdigest)
+	}
+	if nil == o {
+		return fmt.Errorf("metrics: can not merge %T into a t-digest", other)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.d.merge(o)
+	return nil
+}
+
+// Min returns the minimum value recorded.
+func (s *TDigestSample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.Min()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded.
+func (s *TDigestSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded.
+func (s *TDigestSample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.Percentiles(ps)
+}
+
+// Size returns the number of values recorded.
+func (s *TDigestSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.Size()
+}
+
+// Snapshot returns a read-only copy of the sample, which can be merged into
+// another TDigestSample.
+func (s *TDigestSample) Snapshot() Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &SampleSnapshot{count: s.d.count, stats: s.d.copy()}
+}
+
+// StdDev returns the standard deviation of the values recorded.
+func (s *TDigestSample) StdDev() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.StdDev()
+}
+
+// Sum returns the sum of the values recorded.
+func (s *TDigestSample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.Sum()
+}
+
+// Update records a new value.
+func (s *TDigestSample) Update(v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.d.add(v)
+}
+
+// Values returns an empty slice since the sample keeps no values.
+func (s *TDigestSample) Values() []int64 {
+	return []int64{}
+}
+
+// Variance returns the variance of the values recorded.
+func (s *TDigestSample) Variance() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.d.Variance()
+}
+
+// MarshalBinary encodes the digest compactly.
+func (s *TDigestSample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.d.compress()
+	b := []byte{tdigestEncodingVersion}
+	b = appendFloat64(b, s.d.compression)
+	b = appendMoments(b, &s.d.sampleMoments)
+	b = appendUvarint(b, uint64(len(s.d.centroids)))
+	for _, c := range s.d.centroids {
+		b = appendFloat64(b, c.mean)
+		b = appendUvarint(b, uint64(c.count))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary replaces the sample with a digest encoded by
+// MarshalBinary.  It can be called on a zero TDigestSample.
+func (s *TDigestSample) UnmarshalBinary(b []byte) error {
+	r := &binaryReader{b: b}
+	if tdigestEncodingVersion != r.byte() {
+		return errors.New("metrics: unknown t-digest encoding")
+	}
+	compression := r.float64()
+	if !(compression >= 1 && compression <= tdigestMaxCompression) {
+		return errors.New("metrics: invalid t-digest compression")
+	}
+	d := newTDigest(compression)
+	r.moments(&d.sampleMoments)
+	n := r.uvarint()
+	if n > uint64(len(b)) {
+		return errors.New("metrics: invalid t-digest encoding")
+	}
+	d.centroids = make([]tdigestCentroid, n)
+	var total int64
+	for i := range d.centroids {
+		d.centroids[i].mean = r.float64()
+		d.centroids[i].count = r.count()
+		if total > math.MaxInt64-d.centroids[i].count {
+			return errors.New("metrics: invalid t-digest encoding: centroid counts out of range")
+		}
+		total += d.centroids[i].count
+	}
+	if nil != r.err {
+		return fmt.Errorf("metrics: invalid t-digest encoding: %v", r.err)
+	}
+	// the percentiles read the centroids of every value counted
+	if total != d.count {
+		return fmt.Errorf("metrics: invalid t-digest encoding: centroids count %d values, not %d", total, d.count)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.d = d
+	return nil
+}
+
+const (
+	tdigestEncodingVersion = 1
+	tdigestMaxCompression  = 10000 // bounds the buffer of decoded digests
+)
+
+type tdigestCentroid struct {
+	mean  float64
+	count int64
+}
+
+// tdigest is the unsynchronized digest of a TDigestSample.  New values are
+// buffered and merged into the centroids once the buffer is full or the
+// centroids are read.
+type tdigest struct {
+	compression float64
+	centroids   []tdigestCentroid
+	buffer      []tdigestCentroid
+	sampleMoments
+}
+
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{
+		compression: compression,
+		buffer:      make([]tdigestCentroid, 0, int(5*compression)),
+	}
+}
+
+func (d *tdigest) copy() *tdigest {
+	d.compress()
+	c := *d
+	c.centroids = make([]tdigestCentroid, len(d.centroids))
+	copy(c.centroids, d.centroids)
+	c.buffer = nil
+	return &c
+}
+
+func (d *tdigest) add(v int64) {
+	d.sampleMoments.add(v)
+	d.buffer = append(d.buffer, tdigestCentroid{float64(v), 1})
+	if len(d.buffer) == cap(d.buffer) {
+		d.compress()
+	}
+}
+
+func (d *tdigest) merge(o *tdigest) {
+	d.sampleMoments.merge(o.sampleMoments)
+	d.buffer = append(d.buffer, o.centroids...)
+	d.buffer = append(d.buffer, o.buffer...)
+	d.compress()
+}
+
+// compress merges the buffer into the centroids, merging neighbouring
+// centroids as long as the merged centroid stays within one unit of the
+// scale function k(q) = compression/2π·asin(2q-1).
+func (d *tdigest) compress() {
+	if 0 == len(d.buffer) {
+		return
+	}
+	all := append(d.buffer, d.centroids...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	var total int64
+	for _, c := range all {
+		total += c.count
+	}
+
+	centroids := make([]tdigestCentroid, 0, len(d.centroids)+1)
+	cur, soFar := all[0], int64(0)
+	limit := d.qLimit(0)
+	for _, c := range all[1:] {
+		if float64(soFar+cur.count+c.count)/float64(total) <= limit {
+			count := cur.count + c.count
+			cur.mean += (c.mean - cur.mean) * float64(c.count) / float64(count)
+			cur.count = count
+			continue
+		}
+		soFar += cur.count
+		centroids = append(centroids, cur)
+		limit = d.qLimit(float64(soFar) / float64(total))
+		cur = c
+	}
+	d.centroids = append(centroids, cur)
+	if size := int(5 * d.compression); cap(d.buffer) > size {
+		// merged digests grew the buffer
+		d.buffer = make([]tdigestCentroid, 0, size)
+	} else {
+		d.buffer = d.buffer[:0]
+	}
+}
+
+// qLimit returns the highest quantile a centroid starting at quantile q may
+// reach.
+func (d *tdigest) qLimit(q float64) float64 {
+	k := d.compression/(2*math.Pi)*math.Asin(2*q-1) + 1
+	if k >= d.compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/d.compression) + 1) / 2
+}
+
+// Percentiles interpolates between the means of the centroids, which stand
+// for the value in the middle of their counts, and between the extreme
+// centroids and the minimum and maximum.
+func (d *tdigest) Percentiles(ps []float64) []float64 {
+	scores := make([]float64, len(ps))
+	if 0 == d.count {
+		return scores
+	}
+	d.compress()
+	cs := d.centroids
+	min, max := float64(d.min), float64(d.max)
+	for j, p := range ps {
+		target := p * float64(d.count)
+		first, last := cs[0], cs[len(cs)-1]
+		var v float64
+		switch {
+		case target <= float64(first.count)/2:
+			v = min + (first.mean-min)*target/(float64(first.count)/2)
+		case target >= float64(d.count)-float64(last.count)/2:
+			v = last.mean + (max-last.mean)*(target-float64(d.count)+float64(last.count)/2)/(float64(last.count)/2)
+		default:
+			v = last.mean
+			cum := float64(first.count) / 2
+			for i := 0; i < len(cs)-1; i++ {
+				dw := float64(cs[i].count+cs[i+1].count) / 2
+				if cum+dw > target {
+					v = cs[i].mean + (cs[i+1].mean-cs[i].mean)*(target-cum)/dw
+					break
+				}
+				cum += dw
+			}
+		}
+		scores[j] = math.Max(min, math.Min(max, v))
+	}
+	return scores
+}
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func BenchmarkTDigestSample(b *testing.B) {
+	benchmarkSample(b, NewTDigestSample(100))
+}
+
+func TestTDigestSample(t *testing.T) {
+	s := NewTDigestSample(100)
+	for _, i := range rand.Perm(100000) {
+		s.Update(int64(i + 1))
+	}
+	if count := s.Count(); 100000 != count {
+		t.Errorf("s.Count(): 100000 != %v\n", count)
+	}
+	if min, max := s.Min(), s.Max(); 1 != min || 100000 != max {
+		t.Errorf("s.Min(), s.Max(): 1, 100000 != %v, %v\n", min, max)
+	}
+	// the running mean is exact up to floating-point rounding
+	if mean := s.Mean(); math.Abs(mean-50000.5) > 1e-6 {
+		t.Errorf("s.Mean(): 50000.5 != %v\n", mean)
+	}
+	testRankQuantiles(t, s, 100000, 0.001)
+	if 0 != len(s.Values()) {
+		t.Errorf("len(s.Values()): 0 != %v\n", len(s.Values()))
+	}
+	s.Clear()
+	if count, p := s.Count(), s.Percentile(0.5); 0 != count || 0 != p {
+		t.Errorf("s.Count(), s.Percentile(0.5): 0, 0 != %v, %v\n", count, p)
+	}
+}
+
+func TestTDigestSampleMerge(t *testing.T) {
+	a, b, c := NewTDigestSample(100).(*TDigestSample), NewTDigestSample(100).(*TDigestSample), NewTDigestSample(100).(*TDigestSample)
+	for i := 1; i <= 100000; i++ {
+		if i%2 == 0 {
+			a.Update(int64(i))
+		} else {
+			b.Update(int64(i))
+		}
+	}
+	// merge a live sample and the decoded encoding of another
+	if err := c.Merge(a); nil != err {
+		t.Fatal(err)
+	}
+	buf, err := b.MarshalBinary()
+	if nil != err {
+		t.Fatal(err)
+	}
+	var decoded TDigestSample
+	if err := decoded.UnmarshalBinary(buf); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Merge(decoded.Snapshot()); nil != err {
+		t.Fatal(err)
+	}
+	if count := c.Count(); 100000 != count {
+		t.Errorf("c.Count(): 100000 != %v\n", count)
+	}
+	if sum := c.Sum(); 5000050000 != sum {
+		t.Errorf("c.Sum(): 5000050000 != %v\n", sum)
+	}
+	if stdDev := c.StdDev(); math.Abs(stdDev-28867.513) > 0.001 {
+		t.Errorf("c.StdDev(): 28867.513 != %v\n", stdDev)
+	}
+	testRankQuantiles(t, c, 100000, 0.001)
+
+	if err := c.Merge(NewUniformSample(10)); nil == err {
+		t.Error("no error merging a uniform sample")
+	}
+	if err := c.Merge(NewDDSketchSample(0.01)); nil == err {
+		t.Error("no error merging a DDSketch")
+	}
+}
+
+func TestTDigestSampleUnmarshalBinaryInvalid(t *testing.T) {
+	buf, _ := NewTDigestSample(100).(*TDigestSample).MarshalBinary()
+	var s TDigestSample
+	if err := s.UnmarshalBinary(buf[:len(buf)-1]); nil == err {
+		t.Error("no error decoding a truncated digest")
+	}
+	if err := s.UnmarshalBinary([]byte{2}); nil == err {
+		t.Error("no error decoding an unknown version")
+	}
+}
+
+func TestTDigestSampleUnmarshalBinaryMalformed(t *testing.T) {
+	encode := func(count int64, centroids ...tdigestCentroid) []byte {
+		b := []byte{tdigestEncodingVersion}
+		b = appendFloat64(b, 100)
+		b = appendMoments(b, &sampleMoments{count: count, min: 1, max: 10, sum: 5 * count, mean: 5})
+		b = appendUvarint(b, uint64(len(centroids)))
+		for _, c := range centroids {
+			b = appendFloat64(b, c.mean)
+			b = appendUvarint(b, uint64(c.count))
+		}
+		return b
+	}
+	for name, buf := range map[string][]byte{
+		"no centroids":       encode(5),
+		"too few values":     encode(5, tdigestCentroid{mean: 5, count: 4}),
+		"too many values":    encode(5, tdigestCentroid{mean: 5, count: 3}, tdigestCentroid{mean: 6, count: 3}),
+		"count out of range": encode(5, tdigestCentroid{mean: 5, count: -1}),
+	} {
+		var s TDigestSample
+		if err := s.UnmarshalBinary(buf); nil == err {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	var s TDigestSample
+	if err := s.UnmarshalBinary(encode(5, tdigestCentroid{mean: 2, count: 2}, tdigestCentroid{mean: 8, count: 3})); nil != err {
+		t.Fatal(err)
+	}
+	if p := s.Percentile(0.5); p < 1 || p > 10 {
+		t.Errorf("s.Percentile(0.5): %v\n", p)
+	}
+}
+
+func TestTDigestSampleHistogram(t *testing.T) {
+	h := NewHistogram(NewTDigestSample(100))
+	for i := 1; i <= 1000; i++ {
+		h.Update(int64(i))
+	}
+	snapshot := h.Snapshot()
+	h.Update(100000)
+	if max := snapshot.Max(); 1000 != max {
+		t.Errorf("snapshot.Max(): 1000 != %v\n", max)
+	}
+	if p := snapshot.Percentile(0.99); math.Abs(p-990) > 2 {
+		t.Errorf("snapshot.Percentile(0.99): 990 != %v\n", p)
+	}
+}
+
+// testRankQuantiles checks the percentiles of a sample of the values 1 to n
+// against the given error in rank.
+func testRankQuantiles(t *testing.T, s Sample, n int, rankErr float64) {
+	ps := []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999}
+	for i, p := range s.Percentiles(ps) {
+		expected := ps[i] * float64(n)
+		if math.Abs(p-expected)/float64(n) > rankErr {
+			t.Errorf("s.Percentile(%v): %v != %v\n", ps[i], expected, p)
+		}
+	}
+}
+
+// testQuantiles checks the percentiles of a sample of the values 1 to n
+// against the given relative error.
+func testQuantiles(t *testing.T, s Sample, n int, relErr float64) {
+	ps := []float64{0.01, 0.1, 0.5, 0.9, 0.99, 0.999}
+	for i, p := range s.Percentiles(ps) {
+		expected := ps[i] * float64(n)
+		if math.Abs(p-expected)/expected > relErr {
+			t.Errorf("s.Percentile(%v): %v != %v\n", ps[i], expected, p)
+		}
+	}
+}
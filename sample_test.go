@@ -361,3 +361,19 @@ func TestUniformSampleConcurrentUpdateCount(t *testing.T) {
 	}
 	quit <- struct{}{}
 }
+
+func TestExpDecaySampleWithClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	s := NewExpDecaySampleWithClock(2, 0.001, clock).(*ExpDecaySample)
+	s.Update(1)
+	clock.Add(time.Hour + time.Microsecond)
+	s.Update(1)
+	if !s.t0.Equal(clock.Now()) {
+		t.Fatalf("s.t0: %v != %v\n", clock.Now(), s.t0)
+	}
+	for _, v := range s.values.Values() {
+		if v.k == 0.0 {
+			t.Fatal("v.k == 0.0")
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// RegistrySnapshot is a read-only view of every metric of a Registry taken
+// at a single point in time.  Every metric in it is a read-only copy such as
+// a CounterSnapshot or a TimerSnapshot, so later updates to the registry do
+// not change it.
+//
+// A snapshot can be encoded as JSON or gob, decoded again and restored into
+// a Registry, so that counters, gauges, the base counts of PeriodCounters and
+// the history of DataMaps survive a restart.  Histograms and timers keep
+// their sampled values, or the statistics and a fixed set of percentiles of
+// samples which keep no values such as an HDRSample, from which other
+// percentiles are interpolated once decoded.
+type RegistrySnapshot struct {
+	Time    time.Time
+	metrics map[string]snapshotEntry
+}
+
+type snapshotEntry struct {
+	name   string
+	labels Labels
+	metric interface{}
+}
+
+// snapshotRegistry takes a snapshot of every metric of r, expanding labeled
+// metric families into their children.  Healthchecks are left out.
+//
+// The registry lock is not held while copying the metrics, since DataMaps
+// take the registry lock while holding their own.
+func snapshotRegistry(r Registry) *RegistrySnapshot {
+	s := &RegistrySnapshot{
+		Time:    registryClock(r).Now(),
+		metrics: make(map[string]snapshotEntry),
+	}
+	EachLabeled(r, func(name string, labels Labels, i interface{}) {
+		var snapshot interface{}
+		switch metric := i.(type) {
+		case Counter:
+			snapshot = metric.Snapshot()
+		case Gauge:
+			snapshot = metric.Snapshot()
+		case GaugeFloat64:
+			snapshot = metric.Snapshot()
+		case Histogram:
+			snapshot = metric.Snapshot()
+		case BucketHistogram:
+			snapshot = metric.Snapshot()
+		case Meter:
+			snapshot = metric.Snapshot()
+		case Timer:
+			snapshot = metric.Snapshot()
+		// the Snapshot methods of the following types consume their write
+		// window, so they are copied without them
+		case PeriodCounter:
+			state := metric.State()
+			snapshot = &PeriodCounterSnapshot{count: state.Count, state: &state}
+		case CondInt:
+			snapshot = &CondIntSnapshot{metric.Value(), metric.Writable()}
+		case CondFloat:
+			snapshot = &CondFloatSnapshot{metric.Value(), metric.Writable()}
+		case dataMapState:
+			state := metric.State()
+			snapshot = &state
+		default:
+			custom := snapshotCustomMetric(i)
+			if nil == custom {
+				return
+			}
+			snapshot = custom
+		}
+		s.metrics[name+labels.String()] = snapshotEntry{name, labels, snapshot}
+	})
+	return s
+}
+
+// Each calls f for every metric of the snapshot, sorted by name and labels.
+// DataMaps are passed as a *DataMapState.
+func (s *RegistrySnapshot) Each(f func(string, Labels, interface{})) {
+	keys := make([]string, 0, len(s.metrics))
+	for key := range s.metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e := s.metrics[key]
+		f(e.name, e.labels, e.metric)
+	}
+}
+
+// Get returns the copy of the metric with the given name and labels or nil
+// if the snapshot has none.
+func (s *RegistrySnapshot) Get(name string, labels Labels) interface{} {
+	if e, ok := s.metrics[name+labels.String()]; ok {
+		return e.metric
+	}
+	return nil
+}
+
+// Len returns the number of metrics of the snapshot.
+func (s *RegistrySnapshot) Len() int {
+	return len(s.metrics)
+}
+
+// Restore writes the snapshot back into r.  Counters, gauges and
+// PeriodCounters are set to their values in the snapshot and registered if
+// r does not have them yet, children of labeled counters included.  CondInts,
+// CondFloats and DataMaps need options to be constructed, so only those
+// already registered are restored.  Histograms, bucket histograms, meters
+// and timers can not be set to their statistics and are skipped, as are
+// Metrics and metrics of the types registered with RegisterMetricType.
+//
+// A metric registered in r with another type than in the snapshot is left
+// alone; the first such mismatch is returned after restoring the rest.
+func (s *RegistrySnapshot) Restore(r Registry) error {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	var err error
+	s.Each(func(name string, labels Labels, i interface{}) {
+		if e := restoreMetric(r, name, labels, i); nil != e && nil == err {
+			err = e
+		}
+	})
+	return err
+}
+
+func restoreMetric(r Registry, name string, labels Labels, i interface{}) error {
+	if 0 != len(labels) {
+		c, ok := i.(Counter)
+		if !ok {
+			return nil
+		}
+		names := make([]string, len(labels))
+		values := make([]string, len(labels))
+		for j, l := range labels {
+			names[j], values[j] = l.Name, l.Value
+		}
+		vec, ok := r.GetOrRegister(name, func() CounterVec { return NewCounterVec(names...) }, nil).(CounterVec)
+		if !ok {
+			return fmt.Errorf("metrics: %s is not a counter vec", name)
+		}
+		child := vec.WithLabelValues(values...)
+		child.Clear()
+		child.Inc(c.Count())
+		return nil
+	}
+
+	switch metric := i.(type) {
+	case Counter:
+		c, ok := r.GetOrRegister(name, NewCounter, nil).(Counter)
+		if !ok {
+			return fmt.Errorf("metrics: %s is not a counter", name)
+		}
+		c.Clear()
+		c.Inc(metric.Count())
+	case Gauge:
+		g, ok := r.GetOrRegister(name, NewGauge, nil).(Gauge)
+		if !ok {
+			return fmt.Errorf("metrics: %s is not a gauge", name)
+		}
+		g.Update(metric.Value())
+	case GaugeFloat64:
+		g, ok := r.GetOrRegister(name, NewGaugeFloat64, nil).(GaugeFloat64)
+		if !ok {
+			return fmt.Errorf("metrics: %s is not a gauge", name)
+		}
+		g.Update(metric.Value())
+	case PeriodCounter:
+		state := metric.State()
+		clock := registryClock(r)
+		pc, ok := r.GetOrRegister(name, func(cb interface{}) PeriodCounter {
+			return NewPeriodCounterWithClock(cb, clock)
+		}, state.Periods).(PeriodCounter)
+		if !ok {
+			return fmt.Errorf("metrics: %s is not a period counter", name)
+		}
+		pc.Restore(state)
+	case CondInt:
+		if existing := r.Get(name); nil != existing {
+			c, ok := existing.(CondInt)
+			if !ok {
+				return fmt.Errorf("metrics: %s is not a cond int", name)
+			}
+			c.Update(metric.Value())
+		}
+	case CondFloat:
+		if existing := r.Get(name); nil != existing {
+			c, ok := existing.(CondFloat)
+			if !ok {
+				return fmt.Errorf("metrics: %s is not a cond float", name)
+			}
+			c.Update(metric.Value())
+		}
+	case *DataMapState:
+		if existing := r.Get(name); nil != existing {
+			dm, ok := existing.(dataMapState)
+			if !ok {
+				return fmt.Errorf("metrics: %s is not a datamap", name)
+			}
+			dm.Restore(*metric)
+		}
+	}
+	return nil
+}
+
+// snapshotMetric is the encoded form of a metric of a RegistrySnapshot.
+type snapshotMetric struct {
+	Name          string                        `json:"name"`
+	Labels        Labels                        `json:"labels,omitempty"`
+	Type          string                        `json:"type"`
+	Count         int64                         `json:"count,omitempty"`
+	Int           int64                         `json:"int,omitempty"`
+	Float         float64                       `json:"float,omitempty"`
+	Writable      bool                          `json:"writable,omitempty"`
+	Values        []int64                       `json:"values,omitempty"`  // sample values
+	Buckets       []float64                     `json:"buckets,omitempty"` // bucket histogram upper bounds
+	Counts        []int64                       `json:"counts,omitempty"`  // cumulative bucket counts
+	Rates         []float64                     `json:"rates,omitempty"`   // 1, 5, 15 minute and mean rates
+	Periods       map[string]time.Duration      `json:"periods,omitempty"`
+	LatestCounts  map[string]int64              `json:"latest_counts,omitempty"`
+	Ints          map[string]int64              `json:"ints,omitempty"` // int64 values of a datamap
+	Floats        map[string]float64            `json:"floats,omitempty"`
+	HistoryInts   map[string]map[string]int64   `json:"history_ints,omitempty"`
+	HistoryFloats map[string]map[string]float64 `json:"history_floats,omitempty"`
+
+	// history rings of a datamap, oldest first
+	RingInts   map[string][]map[string]int64   `json:"ring_ints,omitempty"`
+	RingFloats map[string][]map[string]float64 `json:"ring_floats,omitempty"`
+
+	// statistics of a histogram or timer whose sample keeps no values
+	Stats *snapshotStats `json:"stats,omitempty"`
+
+	// type and fields of a Metric or a metric of a registered type
+	MetricType string          `json:"metric_type,omitempty"`
+	Fields     []snapshotField `json:"fields,omitempty"`
+}
+
+// snapshotField is the encoded form of a Field, which keeps whether its
+// value is an int64 or a float64.
+type snapshotField struct {
+	Name     string  `json:"name"`
+	Int      int64   `json:"int,omitempty"`
+	Float    float64 `json:"float,omitempty"`
+	IsFloat  bool    `json:"is_float,omitempty"`
+	Duration bool    `json:"duration,omitempty"`
+}
+
+// snapshotQuantiles are the percentiles kept of the histograms and timers
+// whose sample keeps no values, such as an HDRSample.  Other percentiles
+// are interpolated between them and the minimum and maximum.
+var snapshotQuantiles = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 0.999, 0.9999}
+
+// snapshotStats are the statistics of a sample which keeps no values, which
+// a decoded SampleSnapshot answers from.
+type snapshotStats struct {
+	SampleSize int       `json:"size"`
+	Minimum    int64     `json:"min"`
+	Maximum    int64     `json:"max"`
+	Total      int64     `json:"sum"`
+	Average    float64   `json:"mean"`
+	Var        float64   `json:"variance"`
+	Quantiles  []float64 `json:"quantiles"` // percentiles of snapshotQuantiles
+}
+
+// sampleData returns the values of s, or its statistics if it keeps none.
+func sampleData(s Sample) ([]int64, *snapshotStats) {
+	ss, ok := s.(*SampleSnapshot)
+	if !ok || nil == ss.stats {
+		return s.Values(), nil
+	}
+	return nil, &snapshotStats{
+		SampleSize: ss.stats.Size(),
+		Minimum:    ss.stats.Min(),
+		Maximum:    ss.stats.Max(),
+		Total:      ss.stats.Sum(),
+		Average:    ss.stats.Mean(),
+		Var:        ss.stats.Variance(),
+		Quantiles:  ss.stats.Percentiles(snapshotQuantiles),
+	}
+}
+
+// sampleSnapshot returns the SampleSnapshot of decoded values or statistics.
+func sampleSnapshot(count int64, values []int64, stats *snapshotStats) *SampleSnapshot {
+	s := NewSampleSnapshot(count, values)
+	if nil != stats {
+		s.stats = stats
+	}
+	return s
+}
+
+func (s *snapshotStats) Max() int64        { return s.Maximum }
+func (s *snapshotStats) Mean() float64     { return s.Average }
+func (s *snapshotStats) Min() int64        { return s.Minimum }
+func (s *snapshotStats) Size() int         { return s.SampleSize }
+func (s *snapshotStats) StdDev() float64   { return math.Sqrt(s.Var) }
+func (s *snapshotStats) Sum() int64        { return s.Total }
+func (s *snapshotStats) Variance() float64 { return s.Var }
+
+// Percentiles interpolates linearly between the kept percentiles.
+func (s *snapshotStats) Percentiles(ps []float64) []float64 {
+	qs := append(append([]float64{0}, snapshotQuantiles...), 1)
+	vs := append(append([]float64{float64(s.Minimum)}, s.Quantiles...), float64(s.Maximum))
+	scores := make([]float64, len(ps))
+	if 0 == s.SampleSize || len(vs) != len(qs) {
+		return scores
+	}
+	for i, p := range ps {
+		j := sort.SearchFloat64s(qs, p)
+		switch {
+		case j == 0:
+			scores[i] = vs[0]
+		case j == len(qs):
+			scores[i] = vs[len(vs)-1]
+		default:
+			f := (p - qs[j-1]) / (qs[j] - qs[j-1])
+			scores[i] = vs[j-1] + f*(vs[j]-vs[j-1])
+		}
+	}
+	return scores
+}
+
+// snapshotData is the encoded form of a RegistrySnapshot.
+type snapshotData struct {
+	Time    time.Time        `json:"time"`
+	Metrics []snapshotMetric `json:"metrics"`
+}
+
+func (s *RegistrySnapshot) encode() snapshotData {
+	d := snapshotData{Time: s.Time, Metrics: make([]snapshotMetric, 0, len(s.metrics))}
+	s.Each(func(name string, labels Labels, i interface{}) {
+		m := snapshotMetric{Name: name, Labels: labels}
+		switch metric := i.(type) {
+		case Counter:
+			m.Type, m.Count = "counter", metric.Count()
+		case Gauge:
+			m.Type, m.Int = "gauge", metric.Value()
+		case GaugeFloat64:
+			m.Type, m.Float = "gauge_float64", metric.Value()
+		case Histogram:
+			m.Type, m.Count = "histogram", metric.Count()
+			m.Values, m.Stats = sampleData(metric.Sample())
+		case BucketHistogram:
+			m.Type, m.Count, m.Int = "bucket_histogram", metric.Count(), metric.Sum()
+			m.Buckets, m.Counts = metric.Buckets(), metric.Counts()
+		case Meter:
+			m.Type, m.Count = "meter", metric.Count()
+			m.Rates = []float64{metric.Rate1(), metric.Rate5(), metric.Rate15(), metric.RateMean()}
+		case Timer:
+			m.Type, m.Count = "timer", metric.Count()
+			m.Rates = []float64{metric.Rate1(), metric.Rate5(), metric.Rate15(), metric.RateMean()}
+			if t, ok := metric.(*TimerSnapshot); ok {
+				m.Values, m.Stats = sampleData(t.histogram.Sample())
+			}
+		case PeriodCounter:
+			state := metric.State()
+			m.Type, m.Count = "period_counter", state.Count
+			m.Periods, m.LatestCounts = state.Periods, state.LatestCounts
+		case CondInt:
+			m.Type, m.Int, m.Writable = "cond_int", metric.Value(), metric.Writable()
+		case CondFloat:
+			m.Type, m.Float, m.Writable = "cond_float", metric.Value(), metric.Writable()
+		case *DataMapState:
+			m.Type = "datamap"
+			m.Ints, m.Floats = splitDataMapValues(metric.Values)
+			for p, values := range metric.History {
+				ints, floats := splitDataMapValues(values)
+				if nil != ints {
+					if nil == m.HistoryInts {
+						m.HistoryInts = make(map[string]map[string]int64)
+					}
+					m.HistoryInts[p] = ints
+				}
+				if nil != floats {
+					if nil == m.HistoryFloats {
+						m.HistoryFloats = make(map[string]map[string]float64)
+					}
+					m.HistoryFloats[p] = floats
+				}
+			}
+			if 0 != len(metric.Rings) {
+				m.RingInts = make(map[string][]map[string]int64, len(metric.Rings))
+				m.RingFloats = make(map[string][]map[string]float64, len(metric.Rings))
+			}
+			for p, ring := range metric.Rings {
+				m.RingInts[p] = make([]map[string]int64, len(ring))
+				m.RingFloats[p] = make([]map[string]float64, len(ring))
+				for i, values := range ring {
+					m.RingInts[p][i], m.RingFloats[p][i] = splitDataMapValues(values)
+				}
+			}
+		case *MetricSnapshot:
+			m.Type, m.MetricType = "metric", metric.typ
+			m.Fields = make([]snapshotField, len(metric.fields))
+			for i, f := range metric.fields {
+				m.Fields[i] = snapshotField{Name: f.Name, Duration: f.Duration}
+				switch v := f.Value.(type) {
+				case int64:
+					m.Fields[i].Int = v
+				case float64:
+					m.Fields[i].Float, m.Fields[i].IsFloat = v, true
+				}
+			}
+		}
+		d.Metrics = append(d.Metrics, m)
+	})
+	return d
+}
+
+func (s *RegistrySnapshot) decode(d snapshotData) error {
+	s.Time = d.Time
+	s.metrics = make(map[string]snapshotEntry, len(d.Metrics))
+	for _, m := range d.Metrics {
+		var metric interface{}
+		switch m.Type {
+		case "counter":
+			metric = CounterSnapshot(m.Count)
+		case "gauge":
+			metric = GaugeSnapshot(m.Int)
+		case "gauge_float64":
+			metric = GaugeFloat64Snapshot(m.Float)
+		case "histogram":
+			metric = &HistogramSnapshot{sample: sampleSnapshot(m.Count, m.Values, m.Stats)}
+		case "bucket_histogram":
+			if len(m.Buckets) != len(m.Counts) {
+				return fmt.Errorf("metrics: %s has %d counts for %d buckets", m.Name, len(m.Counts), len(m.Buckets))
+			}
+			metric = &BucketHistogramSnapshot{buckets: m.Buckets, counts: m.Counts, count: m.Count, sum: m.Int}
+		case "meter", "timer":
+			if 4 != len(m.Rates) {
+				return fmt.Errorf("metrics: %s has %d rates instead of 4", m.Name, len(m.Rates))
+			}
+			meter := &MeterSnapshot{m.Count, m.Rates[0], m.Rates[1], m.Rates[2], m.Rates[3]}
+			metric = meter
+			if "timer" == m.Type {
+				metric = &TimerSnapshot{
+					histogram: &HistogramSnapshot{sample: sampleSnapshot(m.Count, m.Values, m.Stats)},
+					meter:     meter,
+				}
+			}
+		case "period_counter":
+			state := &PeriodCounterState{Count: m.Count, Periods: m.Periods, LatestCounts: m.LatestCounts}
+			metric = &PeriodCounterSnapshot{count: m.Count, state: state}
+		case "cond_int":
+			metric = &CondIntSnapshot{m.Int, m.Writable}
+		case "cond_float":
+			metric = &CondFloatSnapshot{m.Float, m.Writable}
+		case "datamap":
+			state := &DataMapState{
+				Values:  joinDataMapValues(m.Ints, m.Floats),
+				History: make(map[string]map[string]interface{}),
+			}
+			for p, ints := range m.HistoryInts {
+				state.History[p] = joinDataMapValues(ints, m.HistoryFloats[p])
+			}
+			for p, floats := range m.HistoryFloats {
+				if _, ok := state.History[p]; !ok {
+					state.History[p] = joinDataMapValues(nil, floats)
+				}
+			}
+			for p, ints := range m.RingInts {
+				floats := m.RingFloats[p]
+				if len(floats) != len(ints) {
+					return fmt.Errorf("metrics: %s has %d int and %d float history values of %s", m.Name, len(ints), len(floats), p)
+				}
+				if nil == state.Rings {
+					state.Rings = make(map[string][]map[string]interface{})
+				}
+				state.Rings[p] = make([]map[string]interface{}, len(ints))
+				for i := range ints {
+					state.Rings[p][i] = joinDataMapValues(ints[i], floats[i])
+				}
+			}
+			metric = state
+		case "metric":
+			custom := &MetricSnapshot{typ: m.MetricType, fields: make([]Field, len(m.Fields))}
+			for i, f := range m.Fields {
+				custom.fields[i] = Field{Name: f.Name, Value: f.Int, Duration: f.Duration}
+				if f.IsFloat {
+					custom.fields[i].Value = f.Float
+				}
+			}
+			metric = custom
+		default:
+			return fmt.Errorf("metrics: %s has unknown type %q", m.Name, m.Type)
+		}
+		s.metrics[m.Name+m.Labels.String()] = snapshotEntry{m.Name, m.Labels, metric}
+	}
+	return nil
+}
+
+// splitDataMapValues splits the values of a DataMap by type so that they
+// keep it when encoded as JSON.
+func splitDataMapValues(values map[string]interface{}) (ints map[string]int64, floats map[string]float64) {
+	for k, v := range values {
+		switch v := v.(type) {
+		case int64:
+			if nil == ints {
+				ints = make(map[string]int64)
+			}
+			ints[k] = v
+		case float64:
+			if nil == floats {
+				floats = make(map[string]float64)
+			}
+			floats[k] = v
+		}
+	}
+	return
+}
+
+func joinDataMapValues(ints map[string]int64, floats map[string]float64) map[string]interface{} {
+	values := make(map[string]interface{}, len(ints)+len(floats))
+	for k, v := range ints {
+		values[k] = v
+	}
+	for k, v := range floats {
+		values[k] = v
+	}
+	return values
+}
+
+// MarshalJSON returns the snapshot as a JSON object of its time and a list
+// of its metrics, which UnmarshalJSON reads back.
+func (s *RegistrySnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.encode())
+}
+
+// UnmarshalJSON replaces the snapshot with one encoded by MarshalJSON.
+func (s *RegistrySnapshot) UnmarshalJSON(b []byte) error {
+	var d snapshotData
+	if err := json.Unmarshal(b, &d); nil != err {
+		return err
+	}
+	return s.decode(d)
+}
+
+// GobEncode returns the snapshot encoded as gob.
+func (s *RegistrySnapshot) GobEncode() ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(s.encode()); nil != err {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// GobDecode replaces the snapshot with one encoded by GobEncode.
+func (s *RegistrySnapshot) GobDecode(b []byte) error {
+	var d snapshotData
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&d); nil != err {
+		return err
+	}
+	return s.decode(d)
+}
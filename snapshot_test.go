@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func snapshotTestRegistry(clock Clock) Registry {
+	r := NewRegistryWithClock(clock)
+	GetOrRegisterCounter("counter", r).Inc(47)
+	GetOrRegisterGauge("gauge", r).Update(-3)
+	GetOrRegisterGaugeFloat64("gauge_float64", r).Update(2.5)
+	GetOrRegisterHistogram("histogram", r, NewUniformSample(100)).Update(7)
+	GetOrRegisterCounterVec("requests", r, "code").WithLabelValues("200").Inc(5)
+	GetOrRegisterCondInt("cond", r, time.Minute).Update(9)
+
+	pc := GetOrRegisterPeriodCounter("period_counter", r, map[string]time.Duration{MS1: M1, MS5: M5})
+	pc.Inc(30)
+	clock.(*ManualClock).Add(time.Minute)
+	pc.LatestPeriodCountRate(MS1)
+	pc.Inc(12)
+
+	dm := GetOrRegisterDataMap("datamap", r, &DataMapOption{Interval: time.Minute})
+	dm.Restore(DataMapState{
+		Values: map[string]interface{}{"a": int64(3), "b": 1.5},
+		History: map[string]map[string]interface{}{
+			MS1: {"a": int64(2), "b": 0.5},
+		},
+	})
+	return r
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	clock := NewManualClock(time.Date(2016, 1, 1, 10, 0, 30, 0, time.Local))
+	r := snapshotTestRegistry(clock)
+	s := r.Snapshot()
+
+	// the snapshot does not change with the registry
+	GetOrRegisterCounter("counter", r).Inc(1)
+	if c, ok := s.Get("counter", nil).(Counter); !ok || 47 != c.Count() {
+		t.Errorf("counter: %v", s.Get("counter", nil))
+	}
+	if c, ok := s.Get("requests", Labels{{"code", "200"}}).(Counter); !ok || 5 != c.Count() {
+		t.Errorf("requests: %v", s.Get("requests", Labels{{"code", "200"}}))
+	}
+	if 8 != s.Len() {
+		t.Errorf("s.Len(): 8 != %v", s.Len())
+	}
+
+	// snapshots do not consume the write window of gated metrics
+	if !r.Get("period_counter").(PeriodCounter).Writable() {
+		t.Error("period counter not writable after snapshot")
+	}
+
+	var names []string
+	s.Each(func(name string, labels Labels, i interface{}) {
+		names = append(names, name+labels.String())
+	})
+	expected := []string{"cond", "counter", "datamap", "gauge", "gauge_float64", "histogram", "period_counter", `requests{code="200"}`}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("names: %v != %v", expected, names)
+	}
+}
+
+func testRestoredSnapshot(t *testing.T, s *RegistrySnapshot) {
+	clock := NewManualClock(time.Date(2016, 1, 1, 10, 3, 0, 0, time.Local))
+	r := NewRegistryWithClock(clock)
+	GetOrRegisterCounter("counter", r).Inc(1000)
+	GetOrRegisterCondInt("cond", r, time.Minute)
+	dm := GetOrRegisterDataMap("datamap", r, &DataMapOption{Interval: time.Minute})
+	if err := s.Restore(r); nil != err {
+		t.Fatal(err)
+	}
+
+	if c := GetOrRegisterCounter("counter", r).Count(); 47 != c {
+		t.Errorf("counter: 47 != %v", c)
+	}
+	if v := GetOrRegisterGauge("gauge", r).Value(); -3 != v {
+		t.Errorf("gauge: -3 != %v", v)
+	}
+	if v := GetOrRegisterGaugeFloat64("gauge_float64", r).Value(); 2.5 != v {
+		t.Errorf("gauge_float64: 2.5 != %v", v)
+	}
+	if c := GetOrRegisterCounterVec("requests", r, "code").WithLabelValues("200").Count(); 5 != c {
+		t.Errorf("requests: 5 != %v", c)
+	}
+	if v := GetOrRegisterCondInt("cond", r, time.Minute).Value(); 9 != v {
+		t.Errorf("cond: 9 != %v", v)
+	}
+	if nil != r.Get("histogram") {
+		t.Error("histogram restored")
+	}
+
+	pc := GetOrRegisterPeriodCounter("period_counter", r, nil)
+	if c := pc.Count(); 42 != c {
+		t.Errorf("period_counter: 42 != %v", c)
+	}
+	// the counts since the last boundary of every period survive
+	clock.Add(2 * time.Minute)
+	if count, _ := pc.LatestPeriodCountRate(MS1); 12 != count {
+		t.Errorf("period_counter %s: 12 != %v", MS1, count)
+	}
+	if count, _ := pc.LatestPeriodCountRate(MS5); 42 != count {
+		t.Errorf("period_counter %s: 42 != %v", MS5, count)
+	}
+
+	expected := DataMapState{
+		Values: map[string]interface{}{"a": int64(3), "b": 1.5},
+		History: map[string]map[string]interface{}{
+			MS1: {"a": int64(2), "b": 0.5},
+		},
+		Rings: map[string][]map[string]interface{}{
+			MS1: {{"a": int64(2), "b": 0.5}},
+		},
+	}
+	if state := dm.State(); !reflect.DeepEqual(expected, state) {
+		t.Errorf("datamap: %v != %v", expected, state)
+	}
+}
+
+func TestRegistrySnapshotJSON(t *testing.T) {
+	clock := NewManualClock(time.Date(2016, 1, 1, 10, 0, 30, 0, time.Local))
+	b, err := json.Marshal(snapshotTestRegistry(clock).Snapshot())
+	if nil != err {
+		t.Fatal(err)
+	}
+	var s RegistrySnapshot
+	if err := json.Unmarshal(b, &s); nil != err {
+		t.Fatal(err)
+	}
+	if !s.Time.Equal(clock.Now()) {
+		t.Errorf("s.Time: %v != %v", clock.Now(), s.Time)
+	}
+	if h, ok := s.Get("histogram", nil).(Histogram); !ok || 1 != h.Count() || 7 != h.Max() {
+		t.Errorf("histogram: %v", s.Get("histogram", nil))
+	}
+	testRestoredSnapshot(t, &s)
+}
+
+func TestRegistrySnapshotGob(t *testing.T) {
+	clock := NewManualClock(time.Date(2016, 1, 1, 10, 0, 30, 0, time.Local))
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(snapshotTestRegistry(clock).Snapshot()); nil != err {
+		t.Fatal(err)
+	}
+	var s RegistrySnapshot
+	if err := gob.NewDecoder(&b).Decode(&s); nil != err {
+		t.Fatal(err)
+	}
+	testRestoredSnapshot(t, &s)
+}
+
+func TestRegistrySnapshotRestoreMismatch(t *testing.T) {
+	clock := NewManualClock(time.Date(2016, 1, 1, 10, 0, 30, 0, time.Local))
+	s := snapshotTestRegistry(clock).Snapshot()
+
+	r := NewRegistry()
+	GetOrRegisterMeter("counter", r)
+	if err := s.Restore(r); nil == err {
+		t.Fatal("no error restoring a counter into a meter")
+	}
+	if v := GetOrRegisterGauge("gauge", r).Value(); -3 != v {
+		t.Errorf("gauge: -3 != %v", v)
+	}
+}
+
+func TestRegistrySnapshotUnknownType(t *testing.T) {
+	var s RegistrySnapshot
+	if err := json.Unmarshal([]byte(`{"metrics":[{"name":"foo","type":"bar"}]}`), &s); nil == err {
+		t.Fatal("no error decoding an unknown type")
+	}
+}
+
+func TestRegistrySnapshotHDRSample(t *testing.T) {
+	r := NewRegistry()
+	h := NewRegisteredHistogram("hdr", r, NewHDRSample(1, 1000000, 3))
+	tm := NewCustomTimer(NewHistogram(NewHDRSample(1, 1000000, 3)), NewMeter())
+	r.Register("timer", tm)
+	for i := int64(1); i <= 1000; i++ {
+		h.Update(i)
+		tm.Update(time.Duration(i))
+	}
+	s := r.Snapshot()
+
+	b, err := json.Marshal(s)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var fromJSON RegistrySnapshot
+	if err := json.Unmarshal(b, &fromJSON); nil != err {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); nil != err {
+		t.Fatal(err)
+	}
+	var fromGob RegistrySnapshot
+	if err := gob.NewDecoder(&buf).Decode(&fromGob); nil != err {
+		t.Fatal(err)
+	}
+
+	for name, d := range map[string]*RegistrySnapshot{"json": &fromJSON, "gob": &fromGob} {
+		for _, hs := range []interface {
+			Count() int64
+			Min() int64
+			Max() int64
+			Mean() float64
+			Percentile(float64) float64
+		}{d.Get("hdr", nil).(Histogram), d.Get("timer", nil).(Timer)} {
+			if 1000 != hs.Count() || 1 != hs.Min() || 1000 != hs.Max() {
+				t.Errorf("%s: count, min, max: %v, %v, %v", name, hs.Count(), hs.Min(), hs.Max())
+			}
+			if m := hs.Mean(); m < 500 || m > 501 {
+				t.Errorf("%s: mean: %v", name, m)
+			}
+			if p := hs.Percentile(0.5); p < 495 || p > 505 {
+				t.Errorf("%s: p50: %v", name, p)
+			}
+			if p := hs.Percentile(0.3); p < 290 || p > 310 {
+				t.Errorf("%s: p30: %v", name, p)
+			}
+		}
+	}
+}
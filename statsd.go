@@ -0,0 +1,280 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsDConfig provides a container with configuration parameters for
+// the StatsD exporter
+type StatsDConfig struct {
+	Addr          *net.UDPAddr  // Network address of the StatsD agent
+	Registry      Registry      // Registry to be exported
+	FlushInterval time.Duration // Flush interval
+	DurationUnit  time.Duration // Unit of timer values, milliseconds if zero
+	Prefix        string        // Prefix to be prepended to metric names
+	Percentiles   []float64     // Percentiles of aggregated timers and histograms
+	Aggregate     bool          // Send every timer and histogram as gauges of their statistics
+	DogStatsD     bool          // Send labels as DogStatsD tags instead of name segments
+	Tags          Labels        // DogStatsD tags added to every line
+	SampleRate    float64       // Fraction of counter, timer and histogram lines sent, 1 if zero
+	MaxPacketSize int           // Maximum UDP payload in bytes, 1432 if zero
+}
+
+// StatsDMaxPacketSize is the default maximum payload of a StatsD packet,
+// which fits an Ethernet MTU.
+const StatsDMaxPacketSize = maxUDPPayload
+
+// maxUDPPayload is the largest UDP payload which fits an Ethernet MTU.
+const maxUDPPayload = 1432
+
+// StatsD is a blocking exporter function which reports metrics in r to a
+// StatsD agent located at addr, flushing them every d duration and
+// prepending metric names with prefix.
+func StatsD(r Registry, d time.Duration, prefix string, addr *net.UDPAddr) {
+	StatsDWithConfig(StatsDConfig{
+		Addr:          addr,
+		Registry:      r,
+		FlushInterval: d,
+		Prefix:        prefix,
+	})
+}
+
+// StatsDWithConfig is a blocking exporter function just like StatsD, but it
+// takes a StatsDConfig instead.
+func StatsDWithConfig(c StatsDConfig) {
+	StatsDWithContext(context.Background(), c, func(err error) { log.Println(err) })
+}
+
+// StatsDWithContext is an exporter function just like StatsDWithConfig, but
+// it returns after a final flush once ctx is done and passes errors to
+// onError instead of logging them.
+//
+// Counters, meters and the count of a PeriodCounter are sent as |c deltas
+// since the previous flush and every other single value as a |g gauge, a
+// negative one after a reset to zero since StatsD reads a sign as a change.
+// Timers and histograms whose sample is a BufferedSample are sent as |ms and
+// |h values of the updates made since the previous flush, with a sample rate
+// when the buffer kept only some of them so that StatsD scales their count
+// back up.  Other timers and histograms, whose reservoir does not tell which
+// values are recent, and every one with Aggregate set, are sent as gauges of
+// their count, min, max, mean, standard deviation and percentiles.
+func StatsDWithContext(ctx context.Context, c StatsDConfig, onError func(error)) {
+	s := newStatsD(c)
+	ReportLoop(ctx, c.FlushInterval, s.report, onError)
+}
+
+type statsd struct {
+	c      StatsDConfig
+	counts map[string]int64 // counts sent by the previous flush
+}
+
+func newStatsD(c StatsDConfig) *statsd {
+	if c.DurationUnit <= 0 {
+		c.DurationUnit = time.Millisecond
+	}
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		c.SampleRate = 1
+	}
+	if c.MaxPacketSize <= 0 {
+		c.MaxPacketSize = StatsDMaxPacketSize
+	}
+	return &statsd{c: c, counts: make(map[string]int64)}
+}
+
+func (s *statsd) report() error {
+	conn, err := net.DialUDP("udp", nil, s.c.Addr)
+	if nil != err {
+		return err
+	}
+	defer conn.Close()
+	p := &linePacket{w: conn, max: s.c.MaxPacketSize}
+	EachLabeled(s.c.Registry, func(name string, labels Labels, i interface{}) {
+		switch metric := i.(type) {
+		case Counter:
+			s.count(p, name, labels, metric.Count())
+		case Meter:
+			s.count(p, name, labels, metric.Count())
+		case Histogram:
+			if d, ok := metric.Sample().(sampleDrainer); ok && !s.c.Aggregate {
+				s.values(p, name, labels, "h", d, 1)
+				return
+			}
+			s.gauges(p, name, labels, i)
+		case Timer:
+			if t, ok := metric.(*StandardTimer); ok && !s.c.Aggregate {
+				if d, ok := t.histogram.Sample().(sampleDrainer); ok {
+					s.values(p, name, labels, "ms", d, float64(s.c.DurationUnit))
+					return
+				}
+			}
+			s.gauges(p, name, labels, i)
+		default:
+			s.gauges(p, name, labels, i)
+		}
+	})
+	p.flush()
+	return p.err
+}
+
+// name returns the StatsD name of a metric and its DogStatsD tags.  Without
+// DogStatsD labels are appended to the name as .name.value segments.
+func (s *statsd) name(name string, labels Labels) (string, string) {
+	if "" != s.c.Prefix {
+		name = s.c.Prefix + "." + name
+	}
+	if !s.c.DogStatsD {
+		for _, l := range labels {
+			name += "." + l.Name + "." + l.Value
+		}
+		return statsdName(name), ""
+	}
+	return statsdName(name), statsdTags(append(append(Labels(nil), s.c.Tags...), labels...))
+}
+
+// count sends the change of a monotonic count since the previous flush.
+func (s *statsd) count(p *linePacket, name string, labels Labels, count int64) {
+	name, tags := s.name(name, labels)
+	key := name + tags
+	delta := count - s.counts[key]
+	s.counts[key] = count
+	if 0 == delta {
+		return
+	}
+	s.sampled(p, name, strconv.FormatInt(delta, 10), "c", 1, tags)
+}
+
+// values sends the updates made to a sample since the previous flush.
+func (s *statsd) values(p *linePacket, name string, labels Labels, typ string, d sampleDrainer, unit float64) {
+	name, tags := s.name(name, labels)
+	values, count := d.Drain()
+	if 0 == len(values) {
+		return
+	}
+	rate := float64(len(values)) / float64(count)
+	for _, v := range values {
+		value := strconv.FormatInt(v, 10)
+		if 1 != unit {
+			value = strconv.FormatFloat(float64(v)/unit, 'f', -1, 64)
+		}
+		s.sampled(p, name, value, typ, rate, tags)
+	}
+}
+
+// gauges sends every field of a flattened metric as a gauge, except the
+// count of a PeriodCounter which is sent as a delta.
+func (s *statsd) gauges(p *linePacket, name string, labels Labels, i interface{}) {
+	opts := FlattenOptions{
+		Percentiles:  s.c.Percentiles,
+		DurationUnit: s.c.DurationUnit,
+		Gated:        true,
+	}
+	for _, m := range FlattenMetric(name, labels, i, opts) {
+		if "periodcounter" == m.Type {
+			s.count(p, m.Name+".count", m.Labels, m.Fields[0].Value.(int64))
+			m.Fields = m.Fields[1:]
+		}
+		mname, tags := s.name(m.Name, m.Labels)
+		for _, f := range m.Fields {
+			fname := mname
+			if len(m.Fields) > 1 || "value" != f.Name {
+				fname += "." + statsdName(f.Name)
+			}
+			s.gauge(p, fname, statsdValue(f.Value), tags)
+		}
+	}
+}
+
+// gauge sends a gauge line.  StatsD reads a signed gauge as an adjustment,
+// so a negative value is sent after resetting the gauge to zero, in the same
+// packet.
+func (s *statsd) gauge(p *linePacket, name, value, tags string) {
+	line := fmt.Sprintf("%s:%s|g%s", name, value, tags)
+	if strings.HasPrefix(value, "-") {
+		line = fmt.Sprintf("%s:0|g%s\n%s", name, tags, line)
+	}
+	p.write(line)
+}
+
+// sampled sends a line subject to the configured sample rate.  rate is the
+// fraction of the updates the line already stands for.
+func (s *statsd) sampled(p *linePacket, name, value, typ string, rate float64, tags string) {
+	if s.c.SampleRate < 1 {
+		if rand.Float64() >= s.c.SampleRate {
+			return
+		}
+		rate *= s.c.SampleRate
+	}
+	if rate < 1 {
+		p.write(fmt.Sprintf("%s:%s|%s|@%s%s", name, value, typ, strconv.FormatFloat(rate, 'f', -1, 64), tags))
+		return
+	}
+	p.write(fmt.Sprintf("%s:%s|%s%s", name, value, typ, tags))
+}
+
+// linePacket batches newline separated lines into packets of at most max
+// bytes.  A single line longer than max is sent on its own.
+type linePacket struct {
+	w   io.Writer
+	max int
+	buf []byte
+	err error
+}
+
+func (p *linePacket) write(line string) {
+	if 0 != len(p.buf) && len(p.buf)+1+len(line) > p.max {
+		p.flush()
+	}
+	if 0 != len(p.buf) {
+		p.buf = append(p.buf, '\n')
+	}
+	p.buf = append(p.buf, line...)
+}
+
+func (p *linePacket) flush() {
+	if 0 == len(p.buf) {
+		return
+	}
+	if _, err := p.w.Write(p.buf); nil != err && nil == p.err {
+		p.err = err
+	}
+	p.buf = p.buf[:0]
+}
+
+// statsdName replaces the characters which delimit a StatsD line.
+func statsdName(name string) string {
+	return strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_").Replace(name)
+}
+
+// statsdTags formats labels as the |#name:value,... DogStatsD tag extension.
+func statsdTags(labels Labels) string {
+	if 0 == len(labels) {
+		return ""
+	}
+	tags := make([]string, len(labels))
+	for i, l := range labels {
+		tags[i] = statsdTag(l.Name) + ":" + statsdTag(l.Value)
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+func statsdTag(s string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "\n", "_").Replace(s)
+}
+
+func statsdValue(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsDServer receives StatsD lines over UDP and TCP and records them in a
+// Registry, so that other processes can push metrics through the reporters
+// of this package.
+//
+// Counters (|c) increment a Counter, gauges (|g) update a Gauge, or a
+// GaugeFloat64 when the first value has a fraction, or adjust it when the
+// value is signed, timers (|ms) update a Timer and histograms (|h) update a
+// Histogram, both with a sample from NewSample and the clock of the
+// Registry.  Sample rates (|@0.1) scale counters up and repeat timer and
+// histogram values accordingly.  Sets (|s) update a Gauge with the number of
+// distinct values received during the current SetInterval.
+// DogStatsD tags are accepted and ignored.  Lines which can not be parsed or
+// which name a metric of another type increment the Malformed counter.
+type StatsDServer struct {
+	Registry    Registry
+	NewSample   func() Sample // Sample of new histograms and timers
+	SetInterval time.Duration // Interval after which set members are forgotten
+	Malformed   Counter       // Number of malformed lines
+
+	mutex sync.Mutex // serializes gauge adjustments and sets
+	sets  map[string]*statsdSet
+}
+
+type statsdSet struct {
+	start   time.Time
+	members map[string]struct{}
+}
+
+// StatsDMalformedName is the name under which NewStatsDServer registers the
+// counter of malformed lines.
+const StatsDMalformedName = "statsd.malformed"
+
+// NewStatsDServer constructs a new StatsDServer which records into r and
+// registers its counter of malformed lines in r.
+func NewStatsDServer(r Registry) *StatsDServer {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	return &StatsDServer{
+		Registry:    r,
+		NewSample:   func() Sample { return NewExpDecaySample(1028, 0.015) },
+		SetInterval: time.Minute,
+		Malformed:   GetOrRegisterCounter(StatsDMalformedName, r),
+		sets:        make(map[string]*statsdSet),
+	}
+}
+
+// ListenAndServe receives StatsD lines over both UDP and TCP on addr until
+// ctx is done.  It returns the first error of either listener, or nil once
+// ctx is done.
+func (s *StatsDServer) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if nil != err {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		conn.Close()
+		return err
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServeUDP(conn) }()
+	go func() { errs <- s.ServeTCP(l) }()
+	select {
+	case <-ctx.Done():
+		err = nil
+	case err = <-errs:
+	}
+	conn.Close()
+	l.Close()
+	return err
+}
+
+// ServeUDP receives StatsD packets of newline separated lines on conn until
+// it is closed.  Closing conn makes ServeUDP return nil.
+func (s *StatsDServer) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if nil != err {
+			if isClosedConn(err) {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.ProcessLine(line)
+		}
+	}
+}
+
+// ServeTCP accepts connections on l until it is closed and receives StatsD
+// lines on each of them.  Closing l makes ServeTCP return nil.
+func (s *StatsDServer) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if nil != err {
+			if isClosedConn(err) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				s.ProcessLine(scanner.Text())
+			}
+		}()
+	}
+}
+
+func isClosedConn(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// ProcessLine records a single StatsD line.  Empty lines are ignored.  It
+// returns an error and increments Malformed if the line can not be parsed.
+func (s *StatsDServer) ProcessLine(line string) error {
+	line = strings.TrimSpace(line)
+	if "" == line {
+		return nil
+	}
+	if err := s.processLine(line); nil != err {
+		s.Malformed.Inc(1)
+		return err
+	}
+	return nil
+}
+
+func (s *StatsDServer) processLine(line string) error {
+	colon := strings.LastIndex(line, ":")
+	if colon <= 0 {
+		return fmt.Errorf("statsd: missing value in %q", line)
+	}
+	// DogStatsD tags may contain colons of their own
+	if tags := strings.Index(line, "|#"); tags >= 0 {
+		colon = strings.LastIndex(line[:tags], ":")
+		if colon <= 0 {
+			return fmt.Errorf("statsd: missing value in %q", line)
+		}
+	}
+	name := line[:colon]
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return fmt.Errorf("statsd: missing type in %q", line)
+	}
+	value, typ := parts[0], parts[1]
+
+	rate := 1.0
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			r, err := strconv.ParseFloat(part[1:], 64)
+			if nil != err || r <= 0 || r > 1 {
+				return fmt.Errorf("statsd: invalid sample rate in %q", line)
+			}
+			rate = r
+		case strings.HasPrefix(part, "#"):
+		default:
+			return fmt.Errorf("statsd: unknown field %q in %q", part, line)
+		}
+	}
+
+	if "s" == typ {
+		return s.set(name, value)
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if nil != err || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("statsd: invalid value in %q", line)
+	}
+
+	switch typ {
+	case "c":
+		c, ok := s.Registry.GetOrRegister(name, NewCounter, nil).(Counter)
+		if !ok {
+			return fmt.Errorf("statsd: %s is not a counter", name)
+		}
+		n, ok := statsdInt64(math.Floor(v/rate + 0.5))
+		if !ok {
+			return fmt.Errorf("statsd: counter value out of range in %q", line)
+		}
+		c.Inc(n)
+	case "g":
+		// fractional gauges are kept by a GaugeFloat64, and so are the
+		// integer values of a gauge which is already one
+		existing := s.Registry.Get(name)
+		if _, ok := existing.(GaugeFloat64); ok || (nil == existing && v != math.Trunc(v)) {
+			g, ok := s.Registry.GetOrRegister(name, NewGaugeFloat64, nil).(GaugeFloat64)
+			if !ok {
+				return fmt.Errorf("statsd: %s is not a float gauge", name)
+			}
+			if '+' == value[0] || '-' == value[0] {
+				s.mutex.Lock()
+				g.Update(g.Value() + v)
+				s.mutex.Unlock()
+			} else {
+				g.Update(v)
+			}
+			break
+		}
+		g, ok := s.Registry.GetOrRegister(name, NewGauge, nil).(Gauge)
+		if !ok {
+			return fmt.Errorf("statsd: %s is not a gauge", name)
+		}
+		if v != math.Trunc(v) {
+			return fmt.Errorf("statsd: fractional value for the integer gauge %s in %q", name, line)
+		}
+		n, ok := statsdInt64(v)
+		if !ok {
+			return fmt.Errorf("statsd: gauge value out of range in %q", line)
+		}
+		if '+' == value[0] || '-' == value[0] {
+			s.mutex.Lock()
+			g.Update(g.Value() + n)
+			s.mutex.Unlock()
+		} else {
+			g.Update(n)
+		}
+	case "ms":
+		t, ok := s.Registry.GetOrRegister(name, func() Timer {
+			c := registryClock(s.Registry)
+			return NewCustomTimer(NewHistogram(sampleWithClock(s.NewSample(), c)), NewMeterWithClock(c))
+		}, nil).(Timer)
+		if !ok {
+			return fmt.Errorf("statsd: %s is not a timer", name)
+		}
+		n, ok := statsdInt64(v * float64(time.Millisecond))
+		if !ok {
+			return fmt.Errorf("statsd: timer value out of range in %q", line)
+		}
+		d := time.Duration(n)
+		for i := statsdRepeat(rate); i > 0; i-- {
+			t.Update(d)
+		}
+	case "h":
+		h, ok := s.Registry.GetOrRegister(name, func() Histogram {
+			return NewHistogram(sampleWithClock(s.NewSample(), registryClock(s.Registry)))
+		}, nil).(Histogram)
+		if !ok {
+			return fmt.Errorf("statsd: %s is not a histogram", name)
+		}
+		n, ok := statsdInt64(v)
+		if !ok {
+			return fmt.Errorf("statsd: histogram value out of range in %q", line)
+		}
+		for i := statsdRepeat(rate); i > 0; i-- {
+			h.Update(n)
+		}
+	default:
+		return fmt.Errorf("statsd: unknown type %q in %q", typ, line)
+	}
+	return nil
+}
+
+// StatsDMaxRepeat is the largest number of updates the StatsD server records
+// for one timer or histogram value with a sample rate, so that a tiny rate
+// does not make a single line cost millions of updates.  Counters are scaled
+// exactly.
+const StatsDMaxRepeat = 100
+
+// statsdRepeat returns how many updates a value sampled at rate stands for,
+// at most StatsDMaxRepeat.
+func statsdRepeat(rate float64) int {
+	if n := math.Floor(1/rate + 0.5); n < StatsDMaxRepeat {
+		return int(n)
+	}
+	return StatsDMaxRepeat
+}
+
+// statsdInt64 converts f to int64 if it is in range.
+func statsdInt64(f float64) (int64, bool) {
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// set adds member to the set name and updates its gauge with the number of
+// distinct members received during the current SetInterval.
+func (s *StatsDServer) set(name, member string) error {
+	g, ok := s.Registry.GetOrRegister(name, NewGauge, nil).(Gauge)
+	if !ok {
+		return fmt.Errorf("statsd: %s is not a gauge", name)
+	}
+	now := registryClock(s.Registry).Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set, ok := s.sets[name]
+	if !ok || now.Sub(set.start) >= s.SetInterval {
+		set = &statsdSet{start: now, members: make(map[string]struct{})}
+		s.sets[name] = set
+	}
+	set.members[member] = struct{}{}
+	g.Update(int64(len(set.members)))
+	return nil
+}
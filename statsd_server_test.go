@@ -0,0 +1,210 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsDServerProcessLine(t *testing.T) {
+	r := NewRegistry()
+	s := NewStatsDServer(r)
+	for _, line := range []string{
+		"requests:1|c",
+		"requests:2|c|@0.5",
+		"queue:10|g",
+		"queue:-3|g",
+		"latency:1.5|ms",
+		"size:7|h|@0.25",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+		"tagged:1|c|#env:test,role:web",
+		"",
+	} {
+		if err := s.ProcessLine(line); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if c := r.Get("requests").(Counter).Count(); 5 != c {
+		t.Errorf("requests: 5 != %v\n", c)
+	}
+	if v := r.Get("queue").(Gauge).Value(); 7 != v {
+		t.Errorf("queue: 7 != %v\n", v)
+	}
+	if tm := r.Get("latency").(Timer); 1 != tm.Count() || int64(1500*time.Microsecond) != tm.Max() {
+		t.Errorf("latency: %v %v\n", tm.Count(), tm.Max())
+	}
+	if h := r.Get("size").(Histogram); 4 != h.Count() || 7 != h.Max() {
+		t.Errorf("size: %v %v\n", h.Count(), h.Max())
+	}
+	if v := r.Get("users").(Gauge).Value(); 2 != v {
+		t.Errorf("users: 2 != %v\n", v)
+	}
+	if c := r.Get("tagged").(Counter).Count(); 1 != c {
+		t.Errorf("tagged: 1 != %v\n", c)
+	}
+	if c := s.Malformed.Count(); 0 != c {
+		t.Errorf("malformed: 0 != %v\n", c)
+	}
+}
+
+func TestStatsDServerMalformed(t *testing.T) {
+	r := NewRegistry()
+	s := NewStatsDServer(r)
+	for _, line := range []string{
+		"novalue",
+		"notype:1",
+		"nan:x|c",
+		"unknown:1|z",
+		"rate:1|c|@2",
+		"requests:1|c",
+		"requests:1|g",
+	} {
+		s.ProcessLine(line)
+	}
+	if c := r.Get(StatsDMalformedName).(Counter).Count(); 6 != c {
+		t.Fatalf("malformed: 6 != %v\n", c)
+	}
+}
+
+func TestStatsDServerSetInterval(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	s := NewStatsDServer(r)
+	s.ProcessLine("users:alice|s")
+	s.ProcessLine("users:bob|s")
+	clock.Add(s.SetInterval)
+	s.ProcessLine("users:bob|s")
+	if v := r.Get("users").(Gauge).Value(); 1 != v {
+		t.Fatalf("users: 1 != %v\n", v)
+	}
+}
+
+func TestStatsDServerListenAndServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	r := NewRegistry()
+	s := NewStatsDServer(r)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.ListenAndServe(ctx, addr) }()
+
+	var udp, tcp net.Conn
+	for i := 0; i < 100; i++ {
+		if tcp, err = net.Dial("tcp", addr); nil == err {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	if udp, err = net.Dial("udp", addr); nil != err {
+		t.Fatal(err)
+	}
+	udp.Write([]byte("udp:1|c\nudp:2|c"))
+	tcp.Write([]byte("tcp:3|c\n"))
+	udp.Close()
+	tcp.Close()
+
+	for i := 0; i < 100; i++ {
+		if nil != r.Get("udp") && nil != r.Get("tcp") &&
+			3 == r.Get("udp").(Counter).Count() && 3 == r.Get("tcp").(Counter).Count() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nil == r.Get("udp") || 3 != r.Get("udp").(Counter).Count() {
+		t.Error("udp lines not received")
+	}
+	if nil == r.Get("tcp") || 3 != r.Get("tcp").(Counter).Count() {
+		t.Error("tcp lines not received")
+	}
+
+	cancel()
+	if err := <-done; nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsDServerSampleRate(t *testing.T) {
+	r := NewRegistry()
+	s := NewStatsDServer(r)
+	for _, line := range []string{
+		"zero:1|ms|@0",
+		"above:1|ms|@2",
+		"negative:1|c|@-0.5",
+		"huge:1|c|@1e-300",
+		"inf:Inf|g",
+		"big:1e300|h",
+	} {
+		if err := s.ProcessLine(line); nil == err {
+			t.Errorf("%q accepted", line)
+		}
+	}
+
+	// a tiny rate is capped rather than recorded a billion times
+	if err := s.ProcessLine("tiny:1|ms|@1e-9"); nil != err {
+		t.Fatal(err)
+	}
+	if n := r.Get("tiny").(Timer).Count(); StatsDMaxRepeat != n {
+		t.Fatal(n)
+	}
+	if err := s.ProcessLine("tiny.count:1|c|@1e-9"); nil != err {
+		t.Fatal(err)
+	}
+	if n := r.Get("tiny.count").(Counter).Count(); 1e9 != n {
+		t.Fatal(n)
+	}
+}
+
+func TestStatsDServerFloatGauge(t *testing.T) {
+	r := NewRegistry()
+	s := NewStatsDServer(r)
+	for _, line := range []string{"load:0.5|g", "load:+0.25|g", "load:2|g", "load:-1|g"} {
+		if err := s.ProcessLine(line); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if v := r.Get("load").(GaugeFloat64).Value(); 1 != v {
+		t.Errorf("load: 1 != %v\n", v)
+	}
+	if err := s.ProcessLine("queue:3|g"); nil != err {
+		t.Fatal(err)
+	}
+	if err := s.ProcessLine("queue:3.5|g"); nil == err {
+		t.Error("fractional value of an integer gauge accepted")
+	}
+	if v := r.Get("queue").(Gauge).Value(); 3 != v {
+		t.Errorf("queue: 3 != %v\n", v)
+	}
+}
+
+func TestStatsDServerTimerSample(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	r := NewRegistryWithClock(clock)
+	s := NewStatsDServer(r)
+	s.NewSample = func() Sample { return NewHDRSample(1, int64(time.Hour), 3) }
+	for _, line := range []string{"latency:1|ms", "latency:3|ms"} {
+		if err := s.ProcessLine(line); nil != err {
+			t.Fatal(err)
+		}
+	}
+	tm := r.Get("latency").(*StandardTimer)
+	if _, ok := tm.histogram.Sample().(*HDRSample); !ok {
+		t.Fatalf("%T", tm.histogram.Sample())
+	}
+	if m := tm.Mean(); float64(2*time.Millisecond) != m {
+		t.Errorf("latency: %v != %v\n", float64(2*time.Millisecond), m)
+	}
+	if m := tm.meter.(*StandardMeter); clock != m.clock {
+		t.Errorf("latency meter clock: %v", m.clock)
+	}
+}
@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenStatsD(t *testing.T) (*net.UDPConn, *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	return conn, conn.LocalAddr().(*net.UDPAddr)
+}
+
+// readStatsD returns the packets received by conn until it stays quiet.
+func readStatsD(t *testing.T, conn *net.UDPConn) []string {
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if nil != err {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func ExampleStatsD() {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:8125")
+	go StatsD(DefaultRegistry, 10*time.Second, "some.prefix", addr)
+}
+
+func TestStatsD(t *testing.T) {
+	conn, addr := listenStatsD(t)
+	defer conn.Close()
+
+	r := NewRegistry()
+	c := NewRegisteredCounter("requests", r)
+	c.Inc(3)
+	NewRegisteredGauge("queue", r).Update(47)
+	NewRegisteredHistogram("sizes", r, NewBufferedSample(NewUniformSample(100), 100)).Update(5)
+	tm := NewCustomTimer(NewHistogram(NewBufferedSample(NewExpDecaySample(1028, 0.015), 100)), NewMeter())
+	r.Register("latency", tm)
+	tm.Update(1500 * time.Microsecond)
+	NewRegisteredCounterVec("hits", r, "code").WithLabelValues("200").Inc(1)
+
+	s := newStatsD(StatsDConfig{Addr: addr, Registry: r, Prefix: "app"})
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	packets := readStatsD(t, conn)
+	if 1 != len(packets) {
+		t.Fatal(packets)
+	}
+	for _, line := range []string{
+		"app.requests:3|c",
+		"app.queue:47|g",
+		"app.sizes:5|h",
+		"app.latency:1.5|ms",
+		"app.hits.code.200:1|c",
+	} {
+		if !strings.Contains(packets[0]+"\n", line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, packets[0])
+		}
+	}
+
+	// only the change since the previous flush is sent
+	c.Inc(2)
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	packets = readStatsD(t, conn)
+	if 1 != len(packets) || "app.queue:47|g\napp.requests:2|c" != sortedLines(packets[0]) {
+		t.Fatal(packets)
+	}
+}
+
+func sortedLines(s string) string {
+	lines := strings.Split(s, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestStatsDDogStatsD(t *testing.T) {
+	conn, addr := listenStatsD(t)
+	defer conn.Close()
+
+	r := NewRegistry()
+	NewRegisteredCounterVec("hits", r, "code").WithLabelValues("200").Inc(1)
+	tm := NewRegisteredTimer("latency", r)
+	tm.Update(time.Millisecond)
+	tm.Update(3 * time.Millisecond)
+
+	s := newStatsD(StatsDConfig{
+		Addr:        addr,
+		Registry:    r,
+		DogStatsD:   true,
+		Tags:        Labels{{"env", "test"}},
+		Aggregate:   true,
+		Percentiles: []float64{0.5},
+	})
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	packets := readStatsD(t, conn)
+	if 1 != len(packets) {
+		t.Fatal(packets)
+	}
+	for _, line := range []string{
+		"hits:1|c|#env:test,code:200",
+		"latency.count:2|g|#env:test",
+		"latency.max:3|g|#env:test",
+		"latency.50-percentile:2|g|#env:test",
+	} {
+		if !strings.Contains(packets[0]+"\n", line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, packets[0])
+		}
+	}
+}
+
+func TestStatsDMaxPacketSize(t *testing.T) {
+	conn, addr := listenStatsD(t)
+	defer conn.Close()
+
+	r := NewRegistry()
+	h := NewRegisteredHistogram("h", r, NewBufferedSample(NewUniformSample(100), 100))
+	for i := 0; i < 100; i++ {
+		h.Update(int64(i))
+	}
+	s := newStatsD(StatsDConfig{Addr: addr, Registry: r, MaxPacketSize: 64})
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, packet := range readStatsD(t, conn) {
+		if len(packet) > 64 {
+			t.Fatalf("%d byte packet: %q", len(packet), packet)
+		}
+		n += len(strings.Split(packet, "\n"))
+	}
+	if 100 != n {
+		t.Fatal(n)
+	}
+}
+
+func TestStatsDSampleRate(t *testing.T) {
+	conn, addr := listenStatsD(t)
+	defer conn.Close()
+
+	r := NewRegistry()
+	NewRegisteredCounter("c", r).Inc(1)
+	h := NewRegisteredHistogram("h", r, NewBufferedSample(NewUniformSample(100), 2))
+	for i := 0; i < 4; i++ {
+		h.Update(1)
+	}
+	s := newStatsD(StatsDConfig{Addr: addr, Registry: r, SampleRate: 0.99999999})
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	packets := readStatsD(t, conn)
+	if 1 != len(packets) || "c:1|c|@0.99999999\nh:1|h|@0.499999995\nh:1|h|@0.499999995" != sortedLines(packets[0]) {
+		t.Fatal(packets)
+	}
+}
+
+func TestStatsDReservoir(t *testing.T) {
+	conn, addr := listenStatsD(t)
+	defer conn.Close()
+
+	// a reservoir does not tell which values are recent, so it is aggregated
+	r := NewRegistry()
+	h := NewRegisteredHistogram("h", r, NewExpDecaySample(1028, 0.015))
+	h.Update(1)
+	h.Update(3)
+	s := newStatsD(StatsDConfig{Addr: addr, Registry: r, Percentiles: []float64{0.5}})
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	packets := readStatsD(t, conn)
+	if 1 != len(packets) || strings.Contains(packets[0], "|h") || !strings.Contains(packets[0]+"\n", "h.max:3|g\n") {
+		t.Fatal(packets)
+	}
+}
+
+func TestStatsDBufferedSample(t *testing.T) {
+	conn, addr := listenStatsD(t)
+	defer conn.Close()
+
+	r := NewRegistry()
+	h := NewRegisteredHistogram("h", r, NewBufferedSample(NewUniformSample(2), 100))
+	for i := 1; i <= 3; i++ {
+		h.Update(int64(i))
+	}
+	s := newStatsD(StatsDConfig{Addr: addr, Registry: r})
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := readStatsD(t, conn); 1 != len(packets) || "h:1|h\nh:2|h\nh:3|h" != sortedLines(packets[0]) {
+		t.Fatal(packets)
+	}
+
+	// only the updates since the previous flush are sent
+	h.Update(4)
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := readStatsD(t, conn); 1 != len(packets) || "h:4|h" != packets[0] {
+		t.Fatal(packets)
+	}
+	if err := s.report(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := readStatsD(t, conn); 0 != len(packets) {
+		t.Fatal(packets)
+	}
+}
+
+func TestStatsDNegativeGauge(t *testing.T) {
+	conn, addr := listenStatsD(t)
+	defer conn.Close()
+
+	r := NewRegistry()
+	g := NewRegisteredGauge("queue", r)
+	s := newStatsD(StatsDConfig{Addr: addr, Registry: r, Prefix: "app"})
+	server := NewStatsDServer(NewRegistry())
+	for _, v := range []int64{10, -5, -7, 3} {
+		g.Update(v)
+		if err := s.report(); nil != err {
+			t.Fatal(err)
+		}
+		packets := readStatsD(t, conn)
+		if 1 != len(packets) {
+			t.Fatal(packets)
+		}
+		for _, line := range strings.Split(packets[0], "\n") {
+			if err := server.ProcessLine(line); nil != err {
+				t.Fatal(err)
+			}
+		}
+		if received := server.Registry.Get("app.queue").(Gauge).Value(); v != received {
+			t.Errorf("received %v instead of %v from %q", received, v, packets[0])
+		}
+	}
+}
@@ -3,8 +3,10 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"log/syslog"
+	"strings"
 	"time"
 )
 
@@ -12,67 +14,34 @@ import (
 // the given syslogger.
 func Syslog(r Registry, d time.Duration, w *syslog.Writer) {
 	for _ = range time.Tick(d) {
-		r.Each(func(name string, i interface{}) {
-			switch metric := i.(type) {
-			case Counter:
-				w.Info(fmt.Sprintf("counter %s: count: %d", name, metric.Count()))
-			case Gauge:
-				w.Info(fmt.Sprintf("gauge %s: value: %d", name, metric.Value()))
-			case GaugeFloat64:
-				w.Info(fmt.Sprintf("gauge %s: value: %f", name, metric.Value()))
-			case Healthcheck:
-				metric.Check()
-				w.Info(fmt.Sprintf("healthcheck %s: error: %v", name, metric.Error()))
-			case Histogram:
-				h := metric.Snapshot()
-				ps := h.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-				w.Info(fmt.Sprintf(
-					"histogram %s: count: %d min: %d max: %d mean: %.2f stddev: %.2f median: %.2f 75%%: %.2f 95%%: %.2f 99%%: %.2f 99.9%%: %.2f",
-					name,
-					h.Count(),
-					h.Min(),
-					h.Max(),
-					h.Mean(),
-					h.StdDev(),
-					ps[0],
-					ps[1],
-					ps[2],
-					ps[3],
-					ps[4],
-				))
-			case Meter:
-				m := metric.Snapshot()
-				w.Info(fmt.Sprintf(
-					"meter %s: count: %d 1-min: %.2f 5-min: %.2f 15-min: %.2f mean: %.2f",
-					name,
-					m.Count(),
-					m.Rate1(),
-					m.Rate5(),
-					m.Rate15(),
-					m.RateMean(),
-				))
-			case Timer:
-				t := metric.Snapshot()
-				ps := t.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-				w.Info(fmt.Sprintf(
-					"timer %s: count: %d min: %d max: %d mean: %.2f stddev: %.2f median: %.2f 75%%: %.2f 95%%: %.2f 99%%: %.2f 99.9%%: %.2f 1-min: %.2f 5-min: %.2f 15-min: %.2f mean-rate: %.2f",
-					name,
-					t.Count(),
-					t.Min(),
-					t.Max(),
-					t.Mean(),
-					t.StdDev(),
-					ps[0],
-					ps[1],
-					ps[2],
-					ps[3],
-					ps[4],
-					t.Rate1(),
-					t.Rate5(),
-					t.Rate15(),
-					t.RateMean(),
-				))
-			}
-		})
+		syslogOnce(r, w)
 	}
 }
+
+// SyslogWithContext outputs each metric in the given registry to syslog
+// periodically until ctx is done, then outputs them one last time.  The first
+// write error of each flush is passed to onError.
+func SyslogWithContext(ctx context.Context, r Registry, d time.Duration, w *syslog.Writer, onError func(error)) {
+	ReportLoop(ctx, d, func() error { return syslogOnce(r, w) }, onError)
+}
+
+func syslogOnce(r Registry, w *syslog.Writer) error {
+	var err error
+	info := func(m string) {
+		if e := w.Info(m); nil != e && nil == err {
+			err = e
+		}
+	}
+
+	Flatten(r, FlattenOptions{Gated: true}, func(m FlatMetric) {
+		var fields []string
+		if "healthcheck" == m.Type {
+			fields = append(fields, fmt.Sprintf("error: %v", m.Error))
+		}
+		for _, f := range m.Fields {
+			fields = append(fields, fmt.Sprintf("%s: %s", textFieldName(m, f), formatField(f)))
+		}
+		info(fmt.Sprintf("%s %s: %s", m.Type, m.Name+m.Labels.String(), strings.Join(fields, " ")))
+	})
+	return err
+}
@@ -32,7 +32,8 @@ func GetOrRegisterTimer(name string, r Registry) Timer {
 	if nil == r {
 		r = DefaultRegistry
 	}
-	return r.GetOrRegister(name, NewTimer, nil).(Timer)
+	c := registryClock(r)
+	return r.GetOrRegister(name, func() Timer { return NewTimerWithClock(c) }, nil).(Timer)
 }
 
 // NewCustomTimer constructs a new StandardTimer from a Histogram and a Meter.
@@ -43,15 +44,16 @@ func NewCustomTimer(h Histogram, m Meter) Timer {
 	return &StandardTimer{
 		histogram: h,
 		meter:     m,
+		clock:     DefaultClock,
 	}
 }
 
 // NewRegisteredTimer constructs and registers a new StandardTimer.
 func NewRegisteredTimer(name string, r Registry) Timer {
-	c := NewTimer()
 	if nil == r {
 		r = DefaultRegistry
 	}
+	c := NewTimerWithClock(registryClock(r))
 	r.Register(name, c)
 	return c
 }
@@ -59,12 +61,19 @@ func NewRegisteredTimer(name string, r Registry) Timer {
 // NewTimer constructs a new StandardTimer using an exponentially-decaying
 // sample with the same reservoir size and alpha as UNIX load averages.
 func NewTimer() Timer {
+	return NewTimerWithClock(DefaultClock)
+}
+
+// NewTimerWithClock constructs a new StandardTimer whose sample, meter and
+// Time and UpdateSince read the given clock.
+func NewTimerWithClock(c Clock) Timer {
 	if UseNilMetrics {
 		return NilTimer{}
 	}
 	return &StandardTimer{
-		histogram: NewHistogram(NewExpDecaySample(1028, 0.015)),
-		meter:     NewMeter(),
+		histogram: NewHistogram(NewExpDecaySampleWithClock(1028, 0.015, c)),
+		meter:     NewMeterWithClock(c),
+		clock:     c,
 	}
 }
 
@@ -133,6 +142,8 @@ type StandardTimer struct {
 	histogram Histogram
 	meter     Meter
 	mutex     sync.Mutex
+
+	clock Clock
 }
 
 // Count returns the number of events recorded.
@@ -201,6 +212,13 @@ func (t *StandardTimer) StdDev() float64 {
 	return t.histogram.StdDev()
 }
 
+// Stop stops the meter of the timer if it is Stoppable.
+func (t *StandardTimer) Stop() {
+	if m, ok := t.meter.(Stoppable); ok {
+		m.Stop()
+	}
+}
+
 // Sum returns the sum in the sample.
 func (t *StandardTimer) Sum() int64 {
 	return t.histogram.Sum()
@@ -208,9 +226,9 @@ func (t *StandardTimer) Sum() int64 {
 
 // Record the duration of the execution of the given function.
 func (t *StandardTimer) Time(f func()) {
-	ts := time.Now()
+	ts := t.clock.Now()
 	f()
-	t.Update(time.Since(ts))
+	t.Update(t.clock.Now().Sub(ts))
 }
 
 // Record the duration of an event.
@@ -225,7 +243,7 @@ func (t *StandardTimer) Update(d time.Duration) {
 func (t *StandardTimer) UpdateSince(ts time.Time) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
-	t.histogram.Update(int64(time.Since(ts)))
+	t.histogram.Update(int64(t.clock.Now().Sub(ts)))
 	t.meter.Mark(1)
 }
 
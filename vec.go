@@ -0,0 +1,293 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Label is a single name/value pair identifying a child of a labeled metric
+// family.
+type Label struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Labels is the ordered list of label pairs of a child of a labeled metric
+// family, in the order of the family's label names.
+type Labels []Label
+
+// String returns the labels as {name="value",...} or "" when there are none.
+func (ls Labels) String() string {
+	if len(ls) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(ls))
+	for i, l := range ls {
+		pairs[i] = fmt.Sprintf("%s=%q", l.Name, l.Value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// MetricVec is a family of metrics of the same type partitioned by a fixed
+// set of label names.  The family is registered once under its name and every
+// distinct combination of label values is a child metric.
+type MetricVec interface {
+	DeleteLabelValues(...string) bool
+	Each(func(Labels, interface{}))
+	LabelNames() []string
+	Reset()
+}
+
+// EachLabeled calls f for every metric registered in r, expanding labeled
+// metric families into one call per child.  Unlabeled metrics are passed
+// with nil labels.
+func EachLabeled(r Registry, f func(string, Labels, interface{})) {
+	r.Each(func(name string, i interface{}) {
+		if vec, ok := i.(MetricVec); ok {
+			vec.Each(func(labels Labels, child interface{}) {
+				f(name, labels, child)
+			})
+			return
+		}
+		f(name, nil, i)
+	})
+}
+
+// CounterVec is a family of Counters partitioned by label values.
+type CounterVec interface {
+	MetricVec
+	WithLabelValues(...string) Counter
+}
+
+// GetOrRegisterCounterVec returns an existing CounterVec or constructs and
+// registers a new one with the given label names.
+func GetOrRegisterCounterVec(name string, r Registry, labelNames ...string) CounterVec {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, func() CounterVec { return NewCounterVec(labelNames...) }, nil).(CounterVec)
+}
+
+// NewCounterVec constructs a new CounterVec with the given label names.
+func NewCounterVec(labelNames ...string) CounterVec {
+	return &StandardCounterVec{newMetricVec(labelNames, func() interface{} { return NewCounter() })}
+}
+
+// NewRegisteredCounterVec constructs and registers a new CounterVec.
+func NewRegisteredCounterVec(name string, r Registry, labelNames ...string) CounterVec {
+	c := NewCounterVec(labelNames...)
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, c)
+	return c
+}
+
+// StandardCounterVec is the standard implementation of a CounterVec.
+type StandardCounterVec struct {
+	*metricVec
+}
+
+// WithLabelValues returns the Counter for the given label values, creating it
+// on first use.  It panics if the number of values does not match the number
+// of label names.
+func (v *StandardCounterVec) WithLabelValues(values ...string) Counter {
+	return v.withLabelValues(values).(Counter)
+}
+
+// HistogramVec is a family of Histograms partitioned by label values.
+type HistogramVec interface {
+	MetricVec
+	WithLabelValues(...string) Histogram
+}
+
+// GetOrRegisterHistogramVec returns an existing HistogramVec or constructs and
+// registers a new one.  newSample is called once per child to construct the
+// Sample backing its Histogram.
+func GetOrRegisterHistogramVec(name string, r Registry, newSample func() Sample, labelNames ...string) HistogramVec {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, func() HistogramVec {
+		return NewHistogramVec(newSampleWithClock(newSample, registryClock(r)), labelNames...)
+	}, nil).(HistogramVec)
+}
+
+// NewHistogramVec constructs a new HistogramVec whose children use samples
+// constructed by newSample.
+func NewHistogramVec(newSample func() Sample, labelNames ...string) HistogramVec {
+	return &StandardHistogramVec{newMetricVec(labelNames, func() interface{} { return NewHistogram(newSample()) })}
+}
+
+// NewRegisteredHistogramVec constructs and registers a new HistogramVec.
+func NewRegisteredHistogramVec(name string, r Registry, newSample func() Sample, labelNames ...string) HistogramVec {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	c := NewHistogramVec(newSampleWithClock(newSample, registryClock(r)), labelNames...)
+	r.Register(name, c)
+	return c
+}
+
+// StandardHistogramVec is the standard implementation of a HistogramVec.
+type StandardHistogramVec struct {
+	*metricVec
+}
+
+// WithLabelValues returns the Histogram for the given label values, creating
+// it on first use.  It panics if the number of values does not match the
+// number of label names.
+func (v *StandardHistogramVec) WithLabelValues(values ...string) Histogram {
+	return v.withLabelValues(values).(Histogram)
+}
+
+// TimerVec is a family of Timers partitioned by label values.
+type TimerVec interface {
+	MetricVec
+	WithLabelValues(...string) Timer
+}
+
+// GetOrRegisterTimerVec returns an existing TimerVec or constructs and
+// registers a new one with the given label names.
+func GetOrRegisterTimerVec(name string, r Registry, labelNames ...string) TimerVec {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	c := registryClock(r)
+	return r.GetOrRegister(name, func() TimerVec { return newTimerVec(c, labelNames...) }, nil).(TimerVec)
+}
+
+// NewTimerVec constructs a new TimerVec with the given label names.
+func NewTimerVec(labelNames ...string) TimerVec {
+	return newTimerVec(DefaultClock, labelNames...)
+}
+
+func newTimerVec(c Clock, labelNames ...string) TimerVec {
+	return &StandardTimerVec{newMetricVec(labelNames, func() interface{} { return NewTimerWithClock(c) })}
+}
+
+// NewRegisteredTimerVec constructs and registers a new TimerVec.
+func NewRegisteredTimerVec(name string, r Registry, labelNames ...string) TimerVec {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	c := newTimerVec(registryClock(r), labelNames...)
+	r.Register(name, c)
+	return c
+}
+
+// StandardTimerVec is the standard implementation of a TimerVec.
+type StandardTimerVec struct {
+	*metricVec
+}
+
+// WithLabelValues returns the Timer for the given label values, creating it
+// on first use.  It panics if the number of values does not match the number
+// of label names.
+func (v *StandardTimerVec) WithLabelValues(values ...string) Timer {
+	return v.withLabelValues(values).(Timer)
+}
+
+// metricVec holds the children of a labeled family keyed by their joined
+// label values.
+type metricVec struct {
+	mutex      sync.RWMutex
+	labelNames []string
+	children   map[string]*vecChild
+	newMetric  func() interface{}
+}
+
+type vecChild struct {
+	labels Labels
+	metric interface{}
+}
+
+func newMetricVec(labelNames []string, newMetric func() interface{}) *metricVec {
+	return &metricVec{
+		labelNames: labelNames,
+		children:   make(map[string]*vecChild),
+		newMetric:  newMetric,
+	}
+}
+
+// DeleteLabelValues removes the child with the given label values, stopping
+// it if it is Stoppable, and reports whether it existed.
+func (v *metricVec) DeleteLabelValues(values ...string) bool {
+	key := v.key(values)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	child, ok := v.children[key]
+	if !ok {
+		return false
+	}
+	stopMetric(child.metric)
+	delete(v.children, key)
+	return true
+}
+
+// Each calls f for every child, ordered by label values.
+func (v *metricVec) Each(f func(Labels, interface{})) {
+	v.mutex.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	children := make([]*vecChild, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		children[i] = v.children[key]
+	}
+	v.mutex.RUnlock()
+
+	for _, child := range children {
+		f(child.labels, child.metric)
+	}
+}
+
+// LabelNames returns the label names of the family.
+func (v *metricVec) LabelNames() []string {
+	return append([]string(nil), v.labelNames...)
+}
+
+// Reset removes and stops all children.
+func (v *metricVec) Reset() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, child := range v.children {
+		stopMetric(child.metric)
+	}
+	v.children = make(map[string]*vecChild)
+}
+
+func (v *metricVec) key(values []string) string {
+	if len(values) != len(v.labelNames) {
+		panic(fmt.Sprintf("expected %d label values %v, got %d: %v",
+			len(v.labelNames), v.labelNames, len(values), values))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (v *metricVec) withLabelValues(values []string) interface{} {
+	key := v.key(values)
+	v.mutex.RLock()
+	child, ok := v.children[key]
+	v.mutex.RUnlock()
+	if ok {
+		return child.metric
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if child, ok := v.children[key]; ok {
+		return child.metric
+	}
+	labels := make(Labels, len(values))
+	for i, value := range values {
+		labels[i] = Label{v.labelNames[i], value}
+	}
+	child = &vecChild{labels, v.newMetric()}
+	v.children[key] = child
+	return child.metric
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func BenchmarkCounterVec(b *testing.B) {
+	c := NewCounterVec("method", "code")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.WithLabelValues("GET", "200").Inc(1)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("method", "code")
+	c.WithLabelValues("GET", "200").Inc(1)
+	c.WithLabelValues("GET", "200").Inc(2)
+	c.WithLabelValues("POST", "500").Inc(1)
+	if count := c.WithLabelValues("GET", "200").Count(); 3 != count {
+		t.Errorf("c.WithLabelValues(\"GET\", \"200\").Count(): 3 != %v\n", count)
+	}
+
+	var seen []string
+	c.Each(func(labels Labels, i interface{}) {
+		seen = append(seen, labels.String())
+		if _, ok := i.(Counter); !ok {
+			t.Fatal(i)
+		}
+	})
+	if 2 != len(seen) || `{method="GET",code="200"}` != seen[0] || `{method="POST",code="500"}` != seen[1] {
+		t.Fatal(seen)
+	}
+
+	if !c.DeleteLabelValues("POST", "500") {
+		t.Fatal("DeleteLabelValues returned false for an existing child")
+	}
+	if c.DeleteLabelValues("POST", "500") {
+		t.Fatal("DeleteLabelValues returned true for a missing child")
+	}
+	c.Reset()
+	c.Each(func(Labels, interface{}) { t.Fatal("child left after Reset") })
+}
+
+func TestCounterVecLabelMismatch(t *testing.T) {
+	defer func() {
+		if nil == recover() {
+			t.Fatal("WithLabelValues did not panic")
+		}
+	}()
+	NewCounterVec("method", "code").WithLabelValues("GET")
+}
+
+func TestGetOrRegisterTimerVec(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredTimerVec("latency", r, "route").WithLabelValues("/").Update(47)
+	if c := GetOrRegisterTimerVec("latency", r, "route").WithLabelValues("/").Count(); 1 != c {
+		t.Fatal(c)
+	}
+}
+
+func TestEachLabeled(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter("plain", r)
+	h := NewRegisteredHistogramVec("sizes", r, func() Sample { return NewUniformSample(10) }, "kind")
+	h.WithLabelValues("a").Update(1)
+	h.WithLabelValues("b").Update(2)
+
+	i := 0
+	EachLabeled(r, func(name string, labels Labels, m interface{}) {
+		i++
+		switch name {
+		case "plain":
+			if nil != labels {
+				t.Fatal(labels)
+			}
+		case "sizes":
+			if 1 != len(labels) || "kind" != labels[0].Name {
+				t.Fatal(labels)
+			}
+			if _, ok := m.(Histogram); !ok {
+				t.Fatal(m)
+			}
+		default:
+			t.Fatal(name)
+		}
+	})
+	if 3 != i {
+		t.Fatal(i)
+	}
+}
+
+func TestCounterVecMarshalJSON(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounterVec("requests", r, "method", "code").WithLabelValues("GET", "200").Inc(1)
+	b := &bytes.Buffer{}
+	WriteJSONOnce(r, b)
+	if s := b.String(); "{\"requests\":{\"GET\":{\"200\":{\"count\":1}}}}\n" != s {
+		t.Fatal(s)
+	}
+}
+
+func TestLabelsTags(t *testing.T) {
+	labels := Labels{{"method", "GET"}, {"code", "200"}}
+	if s := graphiteTags(labels); ";method=GET;code=200" != s {
+		t.Fatal(s)
+	}
+	if s := openTSDBTags(openTSDBTagMap(map[string]string{"host": "h"}, labels)); " code=200 host=h method=GET" != s {
+		t.Fatal(s)
+	}
+	if s := Labels(nil).String(); "" != s {
+		t.Fatal(s)
+	}
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sort"
@@ -11,74 +12,92 @@ import (
 // given io.Writer.
 func Write(r Registry, d time.Duration, w io.Writer) {
 	for _ = range time.Tick(d) {
-		WriteOnce(r, w)
+		writeOnce(r, w, FlattenOptions{Gated: true})
 	}
 }
 
+// WriteWithContext sorts and writes each metric in the given registry
+// periodically to the given io.Writer until ctx is done, then writes them
+// one last time.  The first write error of each flush is passed to onError.
+func WriteWithContext(ctx context.Context, r Registry, d time.Duration, w io.Writer, onError func(error)) {
+	ReportLoop(ctx, d, func() error {
+		return writeOnce(r, w, FlattenOptions{Gated: true})
+	}, onError)
+}
+
 // WriteOnce sorts and writes metrics in the given registry to the given
-// io.Writer.
+// io.Writer.  It writes the conditional metrics whether or not their window
+// is writable and does not consume it, unlike Write and WriteWithContext.
 func WriteOnce(r Registry, w io.Writer) {
+	writeOnce(r, w, FlattenOptions{})
+}
+
+func writeOnce(r Registry, w io.Writer, opts FlattenOptions) error {
 	var namedMetrics namedMetricSlice
-	r.Each(func(name string, i interface{}) {
-		namedMetrics = append(namedMetrics, namedMetric{name, i})
+	Flatten(r, opts, func(m FlatMetric) {
+		namedMetrics = append(namedMetrics, namedMetric{m.Name + m.Labels.String(), m})
 	})
 
+	var err error
 	sort.Sort(namedMetrics)
 	for _, namedMetric := range namedMetrics {
-		switch metric := namedMetric.m.(type) {
-		case Counter:
-			fmt.Fprintf(w, "counter %s\n", namedMetric.name)
-			fmt.Fprintf(w, "  count:       %9d\n", metric.Count())
-		case Gauge:
-			fmt.Fprintf(w, "gauge %s\n", namedMetric.name)
-			fmt.Fprintf(w, "  value:       %9d\n", metric.Value())
-		case GaugeFloat64:
-			fmt.Fprintf(w, "gauge %s\n", namedMetric.name)
-			fmt.Fprintf(w, "  value:       %f\n", metric.Value())
-		case Healthcheck:
-			metric.Check()
-			fmt.Fprintf(w, "healthcheck %s\n", namedMetric.name)
-			fmt.Fprintf(w, "  error:       %v\n", metric.Error())
-		case Histogram:
-			h := metric.Snapshot()
-			ps := h.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-			fmt.Fprintf(w, "histogram %s\n", namedMetric.name)
-			fmt.Fprintf(w, "  count:       %9d\n", h.Count())
-			fmt.Fprintf(w, "  min:         %9d\n", h.Min())
-			fmt.Fprintf(w, "  max:         %9d\n", h.Max())
-			fmt.Fprintf(w, "  mean:        %12.2f\n", h.Mean())
-			fmt.Fprintf(w, "  stddev:      %12.2f\n", h.StdDev())
-			fmt.Fprintf(w, "  median:      %12.2f\n", ps[0])
-			fmt.Fprintf(w, "  75%%:         %12.2f\n", ps[1])
-			fmt.Fprintf(w, "  95%%:         %12.2f\n", ps[2])
-			fmt.Fprintf(w, "  99%%:         %12.2f\n", ps[3])
-			fmt.Fprintf(w, "  99.9%%:       %12.2f\n", ps[4])
-		case Meter:
-			m := metric.Snapshot()
-			fmt.Fprintf(w, "meter %s\n", namedMetric.name)
-			fmt.Fprintf(w, "  count:       %9d\n", m.Count())
-			fmt.Fprintf(w, "  1-min rate:  %12.2f\n", m.Rate1())
-			fmt.Fprintf(w, "  5-min rate:  %12.2f\n", m.Rate5())
-			fmt.Fprintf(w, "  15-min rate: %12.2f\n", m.Rate15())
-			fmt.Fprintf(w, "  mean rate:   %12.2f\n", m.RateMean())
-		case Timer:
-			t := metric.Snapshot()
-			ps := t.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-			fmt.Fprintf(w, "timer %s\n", namedMetric.name)
-			fmt.Fprintf(w, "  count:       %9d\n", t.Count())
-			fmt.Fprintf(w, "  min:         %9d\n", t.Min())
-			fmt.Fprintf(w, "  max:         %9d\n", t.Max())
-			fmt.Fprintf(w, "  mean:        %12.2f\n", t.Mean())
-			fmt.Fprintf(w, "  stddev:      %12.2f\n", t.StdDev())
-			fmt.Fprintf(w, "  median:      %12.2f\n", ps[0])
-			fmt.Fprintf(w, "  75%%:         %12.2f\n", ps[1])
-			fmt.Fprintf(w, "  95%%:         %12.2f\n", ps[2])
-			fmt.Fprintf(w, "  99%%:         %12.2f\n", ps[3])
-			fmt.Fprintf(w, "  99.9%%:       %12.2f\n", ps[4])
-			fmt.Fprintf(w, "  1-min rate:  %12.2f\n", t.Rate1())
-			fmt.Fprintf(w, "  5-min rate:  %12.2f\n", t.Rate5())
-			fmt.Fprintf(w, "  15-min rate: %12.2f\n", t.Rate15())
-			fmt.Fprintf(w, "  mean rate:   %12.2f\n", t.RateMean())
+		printText(func(format string, v ...interface{}) {
+			if _, e := fmt.Fprintf(w, format, v...); nil != e && nil == err {
+				err = e
+			}
+		}, namedMetric.name, namedMetric.m.(FlatMetric), "")
+	}
+	return err
+}
+
+// textFieldNames maps field names to the names used by the text reporters.
+var textFieldNames = map[string]string{
+	"std-dev":        "stddev",
+	"50-percentile":  "median",
+	"75-percentile":  "75%",
+	"95-percentile":  "95%",
+	"99-percentile":  "99%",
+	"999-percentile": "99.9%",
+	"one-minute":     "1-min rate",
+	"five-minute":    "5-min rate",
+	"fifteen-minute": "15-min rate",
+	"mean-rate":      "mean rate",
+}
+
+// textFieldName returns the name of field f of m used by the text reporters.
+func textFieldName(m FlatMetric, f Field) string {
+	// the mean of a meter is its mean rate
+	if "meter" == m.Type && "mean" == f.Name {
+		return "mean rate"
+	}
+	if name, ok := textFieldNames[f.Name]; ok {
+		return name
+	}
+	return f.Name
+}
+
+// printText prints m under name in the multi-line text format shared by
+// Write and Log.  Duration fields are followed by durationSuffix.
+func printText(printf func(format string, v ...interface{}), name string, m FlatMetric, durationSuffix string) {
+	printf("%s %s\n", m.Type, name)
+	if "healthcheck" == m.Type {
+		printf("  error:       %v\n", m.Error)
+	}
+	for _, f := range m.Fields {
+		label := textFieldName(m, f) + ":"
+		suffix := ""
+		if f.Duration {
+			suffix = durationSuffix
+		}
+		switch v := f.Value.(type) {
+		case int64:
+			printf("  %-13s%9d%s\n", label, v, suffix)
+		case float64:
+			if "value" == f.Name {
+				printf("  %-13s%f\n", label, v)
+			} else {
+				printf("  %-13s%12.2f%s\n", label, v, suffix)
+			}
 		}
 	}
 }